@@ -1,25 +1,120 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
 	"github.com/bmcdonald3/openchami-inventory-service/internal/service"
 )
 
 func main() {
-	// Create the in-memory datastore.
-	db := datastore.NewMemoryStore()
+	storeType := flag.String("datastore", envOrDefault("INVENTORY_DATASTORE", "memory"), "datastore backend to use: memory, sqlite or postgres")
+	memoryDir := flag.String("memory-dir", os.Getenv("INVENTORY_MEMORY_DIR"), "directory for the memory datastore's write-ahead log and snapshots; empty keeps data in memory only")
+	sqlitePath := flag.String("sqlite-path", envOrDefault("INVENTORY_SQLITE_PATH", "inventory.db"), "SQLite database file, used when -datastore=sqlite")
+	postgresDSN := flag.String("postgres-dsn", os.Getenv("INVENTORY_POSTGRES_DSN"), "PostgreSQL connection string, used when -datastore=postgres")
+	idempotencyTTL := flag.Duration("idempotency-ttl", durationEnvOrDefault("INVENTORY_IDEMPOTENCY_TTL", service.DefaultIdempotencyTTL), "how long responses to requests with an Idempotency-Key are kept for replay")
+	idempotencyLease := flag.Duration("idempotency-lease", durationEnvOrDefault("INVENTORY_IDEMPOTENCY_LEASE", service.DefaultIdempotencyLease), "how long a request with an Idempotency-Key holds the key before a retry may take it over")
+	namesPerParent := flag.Bool("location-names-per-parent", os.Getenv("INVENTORY_LOCATION_NAMES_PER_PARENT") == "true", "only require location names to be unique among locations with the same parent")
+	flag.Parse()
+
+	scope := datastore.LocationNamesGlobal
+	if *namesPerParent {
+		scope = datastore.LocationNamesPerParent
+	}
+
+	// Create the configured datastore.
+	db, err := newDatastore(*storeType, *memoryDir, *sqlitePath, *postgresDSN, scope)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Create the server, injecting the datastore.
 	server := service.NewServer(db)
+	server.IdempotencyTTL = *idempotencyTTL
+	server.IdempotencyLease = *idempotencyLease
 
 	// Create the router, passing the server to it.
 	router := service.NewRouter(server)
 
-	// Start the server.
-	log.Println("Starting server on :8080")
-	err := http.ListenAndServe(":8080", router)
-	log.Fatal(err)
+	// Start the server, and stop it on SIGINT or SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	httpServer := &http.Server{Addr: ":8080", Handler: router}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("Starting server on :8080 using the %s datastore", *storeType)
+		serveErr <- httpServer.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Let requests in flight finish before the datastore goes away, so that
+	// the memory datastore's final snapshot holds their writes.
+	log.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutting down the server: %v", err)
+	}
+	if closer, ok := db.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Fatalf("closing the datastore: %v", err)
+		}
+	}
+}
+
+// shutdownTimeout is how long requests in flight get to finish on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// newDatastore creates the datastore backend selected by storeType.
+func newDatastore(storeType, memoryDir, sqlitePath, postgresDSN string, scope datastore.LocationNameScope) (datastore.Datastore, error) {
+	switch storeType {
+	case "memory":
+		opts := []datastore.MemoryStoreOption{datastore.WithLocationNameScope(scope)}
+		if memoryDir != "" {
+			opts = append(opts, datastore.WithPersistence(memoryDir))
+		}
+		return datastore.NewMemoryStore(opts...)
+	case "sqlite":
+		return datastore.NewSQLiteStore(sqlitePath, datastore.WithSQLLocationNameScope(scope))
+	case "postgres":
+		if postgresDSN == "" {
+			return nil, fmt.Errorf("the postgres datastore requires -postgres-dsn or INVENTORY_POSTGRES_DSN")
+		}
+		return datastore.NewPostgresStore(postgresDSN, datastore.WithSQLLocationNameScope(scope))
+	default:
+		return nil, fmt.Errorf("unknown datastore %q", storeType)
+	}
+}
+
+func envOrDefault(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func durationEnvOrDefault(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	return d
 }
@@ -0,0 +1,89 @@
+package datastore
+
+import "github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+
+// BatchOp is what one operation of a batch does to its record.
+type BatchOp string
+
+const (
+	BatchCreate BatchOp = "create"
+	BatchUpdate BatchOp = "update"
+	BatchDelete BatchOp = "delete"
+)
+
+// DeviceOperation is one operation of a device batch.
+type DeviceOperation struct {
+	Op BatchOp
+	// ID names the device to update or delete.
+	ID string
+	// Device is the device to create, or the new state of the device to
+	// update. An update is conditional on its ResourceVersion, as in
+	// UpdateDevice.
+	Device *models.Device
+	// Delete controls a delete.
+	Delete DeleteOptions
+	// Actor is recorded on the events an update records.
+	Actor string
+}
+
+// LocationOperation is one operation of a location batch.
+type LocationOperation struct {
+	Op BatchOp
+	// ID names the location to update or delete.
+	ID string
+	// Location is the location to create, or the new state of the location
+	// to update.
+	Location *models.Location
+	// Delete controls a delete.
+	Delete DeleteOptions
+	// Actor is recorded on the events an update records.
+	Actor string
+}
+
+// checkBatchOp rejects an operation that lacks what op needs.
+func checkBatchOp(op BatchOp, id string, hasRecord bool) error {
+	switch op {
+	case BatchCreate:
+		if !hasRecord {
+			return errorf(ErrInvalid, "create needs a record")
+		}
+	case BatchUpdate:
+		if id == "" || !hasRecord {
+			return errorf(ErrInvalid, "update needs an ID and a record")
+		}
+	case BatchDelete:
+		if id == "" {
+			return errorf(ErrInvalid, "delete needs an ID")
+		}
+	default:
+		return errorf(ErrInvalid, "unknown operation %q", op)
+	}
+	return nil
+}
+
+// validate checks op before any of its batch is applied.
+func (op DeviceOperation) validate() error {
+	if err := checkBatchOp(op.Op, op.ID, op.Device != nil); err != nil {
+		return err
+	}
+	if op.Op == BatchDelete {
+		return nil
+	}
+	return validateDevice(op.Device)
+}
+
+// validate checks op before any of its batch is applied. An update writes
+// the location op names, whatever ID its record holds, as UpdateLocation
+// does.
+func (op LocationOperation) validate() error {
+	if err := checkBatchOp(op.Op, op.ID, op.Location != nil); err != nil {
+		return err
+	}
+	switch op.Op {
+	case BatchDelete:
+		return nil
+	case BatchUpdate:
+		op.Location.ID = op.ID
+	}
+	return validateLocation(op.Location)
+}
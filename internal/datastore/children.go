@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// The children lists of devices and locations are derived from the parent
+// pointers of their children: the datastore rewrites a parent's list
+// whenever one of its children is created, moved, deleted or restored.
+
+// checkChildren rejects a write that sets the children list in field to
+// anything but the stored list. Leaving the list out keeps it.
+func checkChildren(field string, supplied, stored []string) error {
+	if supplied == nil {
+		return nil
+	}
+	sorted := slices.Clone(supplied)
+	slices.Sort(sorted)
+	if slices.Equal(sorted, stored) {
+		return nil
+	}
+	return &ValidationError{Fields: []FieldError{{Field: field, Message: field + " follows the parent of each child and cannot be written"}}}
+}
+
+// sameParent reports whether two parent pointers name the same parent.
+func sameParent(a, b *string) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+// reparentEvents returns the events recorded when a child moves from
+// oldParent to newParent: detached from the one, attached to the other.
+func reparentEvents(detached, attached, parentField, actor string, deviceID, locationID *string, oldParent, newParent *string) []*models.Event {
+	if sameParent(oldParent, newParent) {
+		return nil
+	}
+	var events []*models.Event
+	if oldParent != nil {
+		events = append(events, newDetachedEvent(detached, actor, deviceID, locationID, parentField, *oldParent))
+	}
+	if newParent != nil {
+		events = append(events, newAttachedEvent(attached, actor, deviceID, locationID, parentField, *newParent))
+	}
+	return events
+}
+
+// checkParent rejects setting the parent of record id to parent when the
+// parent does not exist, is the record itself, or is one of its descendants.
+// kind names the record type in messages and field is its parent field;
+// parentOf looks up the parent of a live record, reporting false for records
+// that do not exist.
+func checkParent(kind, field, id string, parent *string, parentOf func(id string) (*string, bool, error)) error {
+	if parent == nil {
+		return nil
+	}
+	invalid := func(format string, args ...interface{}) error {
+		return &ValidationError{Fields: []FieldError{{Field: field, Message: fmt.Sprintf(format, args...)}}}
+	}
+	if *parent == id {
+		return invalid("%s %s cannot be its own parent", kind, id)
+	}
+	// seen stops the walk at cycles that are already stored.
+	seen := map[string]bool{}
+	for ancestor := parent; ancestor != nil && !seen[*ancestor]; {
+		seen[*ancestor] = true
+		next, exists, err := parentOf(*ancestor)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if ancestor == parent {
+				return invalid("parent %s %s does not exist", kind, *parent)
+			}
+			break
+		}
+		if next != nil && *next == id {
+			return invalid("%s %s cannot be the parent of %s, which is one of its ancestors", kind, *parent, id)
+		}
+		ancestor = next
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package datastore_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore/datastoretest"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	datastoretest.RunConformance(t, func(t *testing.T) datastore.Datastore {
+		store, err := datastore.NewMemoryStore()
+		if err != nil {
+			t.Fatalf("NewMemoryStore: %v", err)
+		}
+		return store
+	})
+}
+
+func TestPersistentMemoryStoreConformance(t *testing.T) {
+	datastoretest.RunConformance(t, func(t *testing.T) datastore.Datastore {
+		store, err := datastore.NewMemoryStore(datastore.WithPersistence(t.TempDir()))
+		if err != nil {
+			t.Fatalf("NewMemoryStore: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	datastoretest.RunConformance(t, func(t *testing.T) datastore.Datastore {
+		store, err := datastore.NewSQLiteStore(filepath.Join(t.TempDir(), "inventory.db"))
+		if err != nil {
+			t.Fatalf("NewSQLiteStore: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
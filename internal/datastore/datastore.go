@@ -1,29 +1,197 @@
 package datastore
 
-import "github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+import (
+	"time"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
 
 // Datastore defines the interface for all database operations for the inventory service.
+//
+// Updates are conditional when the record passed in carries a non-zero
+// ResourceVersion: they fail with ErrPreconditionFailed unless it matches
+// the stored version. Deletes take the same precondition in DeleteOptions.
+//
+// Deleting a device or location only marks it with DeletedAt and records an
+// event. Soft-deleted records are invisible to gets, updates and installs,
+// are left out of lists unless asked for, and stay restorable until purged.
+// A delete is refused with ErrStillReferenced while an installation or child
+// records refer to the target, unless DeleteOptions.Cascade says how to deal
+// with them; the cascade and the delete are applied as one transaction.
+//
+// The children lists of devices and locations follow the parent pointers of
+// their children and are kept up to date by the datastore. Writes that set
+// a children list to anything but its stored value fail with ErrInvalid,
+// and moving an existing record from one parent to another records detached
+// and attached events for it. Setting a parent that does not exist, or that
+// would make a record its own ancestor, fails with ErrInvalid, and so does
+// restoring a record whose parent is deleted.
+//
+// List methods return devices and locations in creation order and events in
+// time order, ties broken by sequence number, unless ListOptions asks for
+// another order. They return one page at a time, together with a Page
+// describing the rest of the list.
 type Datastore interface {
 	// --- Device Methods ---
 	CreateDevice(device *models.Device) (*models.Device, error)
 	GetDeviceByID(id string) (*models.Device, error)
 	GetDeviceByName(name string) (*models.Device, error)
-	ListDevices() ([]models.Device, error)
-	UpdateDevice(id string, device *models.Device) (*models.Device, error)
-	DeleteDevice(id string) error
+	ListDevices(filter DeviceFilter, opts ListOptions) ([]models.Device, Page, error)
+	// ListLocationDevices lists the live devices installed in a live
+	// location, and in every location below it if recursive, along with
+	// their child devices at any depth, as ListDevices lists them.
+	ListLocationDevices(id string, recursive bool, filter DeviceFilter, opts ListOptions) ([]models.Device, Page, error)
+	// UpdateDevice replaces a live device. Moving it to another parent
+	// records detached and attached events with actor.
+	UpdateDevice(id string, device *models.Device, actor string) (*models.Device, error)
+	// PatchDevice applies patch to a live device and records an updated
+	// event holding the changed fields, as a single transaction. A patch
+	// that changes nothing records nothing.
+	PatchDevice(id string, patch Patch, opts PatchOptions) (*models.Device, error)
+	DeleteDevice(id string, opts DeleteOptions) error
+	RestoreDevice(id, actor string) (*models.Device, error)
+	// RelabelDevices applies change to every live device filter selects, as
+	// a single transaction, and returns the devices whose labels changed.
+	RelabelDevices(filter DeviceFilter, change LabelChange) ([]models.Device, error)
+	// ApplyDeviceBatch applies ops in order as a single transaction and
+	// returns the device each left, nil for deletes. If an operation fails,
+	// none are applied and the error is a *BatchError naming it.
+	ApplyDeviceBatch(ops []DeviceOperation) ([]*models.Device, error)
 
 	// --- Location Methods ---
 	CreateLocation(location *models.Location) (*models.Location, error)
 	GetLocationByID(id string) (*models.Location, error)
 	GetLocationByName(name string) (*models.Location, error)
-	ListLocations() ([]models.Location, error)
-	UpdateLocation(id string, location *models.Location) (*models.Location, error)
-	DeleteLocation(id string) error
+	// GetLocationTree returns a live location with the live locations below
+	// it, to the depth opts allows, and the device installed in each.
+	GetLocationTree(id string, opts TreeOptions) (*models.LocationTree, error)
+	// GetLocationAncestors returns the live ancestors of a live location,
+	// from the root down to its parent.
+	GetLocationAncestors(id string) ([]models.Location, error)
+	// GetLocationByPath finds the live location reached by starting at the
+	// root location named names[0] and following the children with each
+	// following name.
+	GetLocationByPath(names []string) (*models.Location, error)
+	// LocationPaths returns the path of each stored location in ids, deleted
+	// or not, by ID. Unknown IDs are left out.
+	LocationPaths(ids []string) (map[string]string, error)
+	ListLocations(filter LocationFilter, opts ListOptions) ([]models.Location, Page, error)
+	// UpdateLocation is UpdateDevice for locations.
+	UpdateLocation(id string, location *models.Location, actor string) (*models.Location, error)
+	// PatchLocation is PatchDevice for locations.
+	PatchLocation(id string, patch Patch, opts PatchOptions) (*models.Location, error)
+	DeleteLocation(id string, opts DeleteOptions) error
+	RestoreLocation(id, actor string) (*models.Location, error)
+	// RelabelLocations is RelabelDevices for locations.
+	RelabelLocations(filter LocationFilter, change LabelChange) ([]models.Location, error)
+	// ApplyLocationBatch is ApplyDeviceBatch for locations.
+	ApplyLocationBatch(ops []LocationOperation) ([]*models.Location, error)
 
 	// --- Event Methods ---
 	CreateEvent(event *models.Event) (*models.Event, error)
 	GetEventByID(id string) (*models.Event, error)
-	ListEvents() ([]models.Event, error)
-	ListEventsByDeviceID(deviceID string) ([]models.Event, error)
-	ListEventsByLocationID(locationID string) ([]models.Event, error)
+	ListEvents(filter EventFilter, opts ListOptions) ([]models.Event, Page, error)
+	ListEventsByDeviceID(deviceID string, opts ListOptions) ([]models.Event, Page, error)
+	ListEventsByLocationID(locationID string, opts ListOptions) ([]models.Event, Page, error)
+
+	// --- Composite Methods ---
+
+	// InstallDevice places a device into an empty location. The occupancy
+	// check, both pointer updates and the installed event are applied as a
+	// single transaction. The pointers, a device's CurrentLocationID and a
+	// location's CurrentDeviceID, change only here and in RemoveDevice;
+	// creates leave them unset and updates and patches keep them.
+	InstallDevice(locationID, deviceID, actor string) (*models.Location, *models.Event, error)
+	// RemoveDevice takes the installed device out of a location, clearing
+	// both pointers and recording the removed event in a single transaction.
+	RemoveDevice(locationID, actor string) (*models.Location, *models.Event, error)
+	// ApplyTransaction applies ops, which may mix device and location
+	// writes with installs and removes, in order as a single transaction,
+	// recording the events of all of them or none. If an operation fails,
+	// the error is a *BatchError naming it.
+	ApplyTransaction(ops []TxOperation, actor string) ([]TxResult, error)
+
+	// --- Idempotency Methods ---
+
+	// ReserveIdempotencyKey stores record, without a response, unless an
+	// unexpired record already holds its key; then it stores nothing and
+	// returns that record instead. Expired records are dropped, so a
+	// reservation whose lease has run out is taken over.
+	ReserveIdempotencyKey(record IdempotencyRecord) (*IdempotencyRecord, error)
+	// CompleteIdempotencyKey stores the response of a reserved key.
+	CompleteIdempotencyKey(record IdempotencyRecord) error
+	// ReleaseIdempotencyKey drops the record of key, so that the request
+	// can be tried again.
+	ReleaseIdempotencyKey(key string) error
+
+	// --- Maintenance Methods ---
+
+	// PurgeDeleted permanently removes devices and locations that were
+	// soft-deleted before deletedBefore. Their events are kept.
+	PurgeDeleted(deletedBefore time.Time) (PurgeResult, error)
+}
+
+// ListOptions controls which records the list methods return.
+type ListOptions struct {
+	// IncludeDeleted also returns soft-deleted records. Events ignore it.
+	IncludeDeleted bool
+	// After is the Next cursor of a previous page; the list continues with
+	// the records that follow it. A malformed cursor fails with ErrInvalid.
+	After string
+	// Offset skips this many records, counted after the cursor if any.
+	Offset int
+	// Limit caps the number of records returned; zero means no limit.
+	Limit int
+	// Sort orders the list by these fields, by their JSON names, before the
+	// default order. An unknown field fails with ErrInvalidSort.
+	Sort []SortField
+}
+
+// SortField orders a list by one field.
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// Page describes the list a page of records was taken from.
+type Page struct {
+	// Total is the number of records in the whole list, on every page.
+	Total int
+	// Next is the cursor to pass as ListOptions.After for the following
+	// page. It is empty on the last page.
+	Next string
+}
+
+// DeleteOptions controls how a device or location is deleted.
+type DeleteOptions struct {
+	// ResourceVersion, when non-zero, only deletes the record if it is still
+	// at this version.
+	ResourceVersion int64
+	// Actor is recorded on the deleted event and on the events of any
+	// cascaded changes.
+	Actor string
+	// Cascade says what happens to the records that refer to the deleted one.
+	Cascade CascadePolicy
+}
+
+// CascadePolicy selects how a delete treats the records that refer to the
+// deleted device or location: its installation and its child devices or
+// child locations.
+type CascadePolicy string
+
+const (
+	// CascadeNone refuses the delete while such references exist.
+	CascadeNone CascadePolicy = ""
+	// CascadeDetach removes an installed device from its location and clears
+	// the parent of every child.
+	CascadeDetach CascadePolicy = "detach"
+	// CascadeDelete also deletes every child, recursively, detaching their
+	// installations.
+	CascadeDelete CascadePolicy = "delete"
+)
+
+// PurgeResult reports how many records PurgeDeleted removed.
+type PurgeResult struct {
+	Devices   int
+	Locations int
 }
@@ -0,0 +1,2091 @@
+// Package datastoretest provides a conformance suite for implementations of
+// datastore.Datastore, so that every backend behaves like MemoryStore.
+package datastoretest
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// Factory returns a new, empty Datastore for a single test. It may register
+// cleanup functions with t.
+type Factory func(t *testing.T) datastore.Datastore
+
+// DamagedStore is implemented by stores under test that can write data the
+// Datastore methods never leave behind, for the cases that check how a store
+// copes with it. Cases that need it are skipped for other stores.
+type DamagedStore interface {
+	// SetDeviceLocation sets the current location of a device without
+	// changing any location.
+	SetDeviceLocation(deviceID string, locationID *string) error
+}
+
+// RunConformance runs the conformance suite against the stores returned by
+// newStore. Every subtest gets a fresh store.
+func RunConformance(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store datastore.Datastore)
+	}{
+		{"DeviceCRUD", testDeviceCRUD},
+		{"LocationCRUD", testLocationCRUD},
+		{"Validation", testValidation},
+		{"ConditionalWrites", testConditionalWrites},
+		{"SoftDelete", testSoftDelete},
+		{"Purge", testPurge},
+		{"Uniqueness", testUniqueness},
+		{"Events", testEvents},
+		{"InstallAndRemove", testInstallAndRemove},
+		{"RemoveWithStalePointer", testRemoveWithStalePointer},
+		{"Paging", testPaging},
+		{"Filters", testFilters},
+		{"Sorting", testSorting},
+		{"Expressions", testExpressions},
+		{"Labels", testLabels},
+		{"Patch", testPatch},
+		{"Batch", testBatch},
+		{"Transaction", testTransaction},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"DeleteDeviceReferences", testDeleteDeviceReferences},
+		{"DeleteLocationReferences", testDeleteLocationReferences},
+		{"LocationTree", testLocationTree},
+		{"ChildrenLists", testChildrenLists},
+		{"ParentValidation", testParentValidation},
+		{"LocationPaths", testLocationPaths},
+		{"LocationDevices", testLocationDevices},
+		{"ConcurrentInstalls", testConcurrentInstalls},
+		{"ConcurrentReparents", testConcurrentReparents},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+		{"ConcurrentCreates", testConcurrentCreates},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newStore(t))
+		})
+	}
+}
+
+// --- Helpers ---
+
+func createDevice(t *testing.T, store datastore.Datastore, name string) *models.Device {
+	t.Helper()
+	device, err := store.CreateDevice(&models.Device{Name: name, ComponentType: "Node", Manufacturer: "HPE", SerialNumber: "SN-" + name, Status: "active"})
+	if err != nil {
+		t.Fatalf("CreateDevice(%s): %v", name, err)
+	}
+	return device
+}
+
+func createLocation(t *testing.T, store datastore.Datastore, id string) *models.Location {
+	t.Helper()
+	location, err := store.CreateLocation(&models.Location{ID: id, Name: id, LocationType: "node_slot", Status: "empty"})
+	if err != nil {
+		t.Fatalf("CreateLocation(%s): %v", id, err)
+	}
+	return location
+}
+
+func expectError(t *testing.T, op string, err, kind error) {
+	t.Helper()
+	if !errors.Is(err, kind) {
+		t.Errorf("%s: got error %v, want %v", op, err, kind)
+	}
+}
+
+func deviceIDs(devices []models.Device) map[string]bool {
+	ids := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		ids[device.ID] = true
+	}
+	return ids
+}
+
+func locationIDs(locations []models.Location) map[string]bool {
+	ids := make(map[string]bool, len(locations))
+	for _, location := range locations {
+		ids[location.ID] = true
+	}
+	return ids
+}
+
+func eventTypes(events []models.Event) []string {
+	types := make([]string, len(events))
+	for i, event := range events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+// --- Tests ---
+
+func testDeviceCRUD(t *testing.T, store datastore.Datastore) {
+	created := createDevice(t, store, "node-1")
+	if created.ID == "" || created.ResourceVersion != 1 || created.CreatedAt.IsZero() {
+		t.Fatalf("CreateDevice returned %+v, want an ID, resource version 1 and a creation time", created)
+	}
+	if _, err := store.CreateDevice(&models.Device{ComponentType: "Node"}); !errors.Is(err, datastore.ErrInvalid) {
+		t.Errorf("CreateDevice without a name: got error %v, want %v", err, datastore.ErrInvalid)
+	}
+
+	got, err := store.GetDeviceByID(created.ID)
+	if err != nil || got.Name != "node-1" || got.SerialNumber != "SN-node-1" {
+		t.Fatalf("GetDeviceByID = %+v, %v; want node-1", got, err)
+	}
+	got.Name = "mutated"
+	if again, _ := store.GetDeviceByID(created.ID); again.Name != "node-1" {
+		t.Errorf("changing a returned device changed the stored one")
+	}
+	if got, err := store.GetDeviceByName("node-1"); err != nil || got.ID != created.ID {
+		t.Errorf("GetDeviceByName = %+v, %v; want %s", got, err, created.ID)
+	}
+	_, err = store.GetDeviceByID("missing")
+	expectError(t, "GetDeviceByID(missing)", err, datastore.ErrNotFound)
+	_, err = store.GetDeviceByName("missing")
+	expectError(t, "GetDeviceByName(missing)", err, datastore.ErrNotFound)
+
+	update := *created
+	update.Status = "failed"
+	update.Properties = map[string]interface{}{"rack": "x1000", "slots": float64(4)}
+	update.ResourceVersion = 0
+	updated, err := store.UpdateDevice(created.ID, &update, "tester")
+	if err != nil {
+		t.Fatalf("UpdateDevice: %v", err)
+	}
+	if updated.ResourceVersion != 2 || updated.UpdatedAt == nil || !updated.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("UpdateDevice returned %+v, want version 2, an update time and the original creation time", updated)
+	}
+	got, _ = store.GetDeviceByID(created.ID)
+	if got.Status != "failed" || got.Properties["rack"] != "x1000" || got.Properties["slots"] != float64(4) {
+		t.Errorf("stored device after update = %+v", got)
+	}
+	_, err = store.UpdateDevice("missing", &models.Device{Name: "ghost"}, "tester")
+	expectError(t, "UpdateDevice(missing)", err, datastore.ErrNotFound)
+	_, err = store.UpdateDevice(created.ID, &models.Device{}, "tester")
+	expectError(t, "UpdateDevice without a name", err, datastore.ErrInvalid)
+
+	other := createDevice(t, store, "node-2")
+	devices, _, err := store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{})
+	if ids := deviceIDs(devices); err != nil || len(devices) != 2 || !ids[created.ID] || !ids[other.ID] {
+		t.Errorf("ListDevices = %d devices, %v; want both devices", len(devices), err)
+	}
+
+	if err := store.DeleteDevice(created.ID, datastore.DeleteOptions{}); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	_, err = store.GetDeviceByID(created.ID)
+	expectError(t, "GetDeviceByID after delete", err, datastore.ErrNotFound)
+	expectError(t, "DeleteDevice twice", store.DeleteDevice(created.ID, datastore.DeleteOptions{}), datastore.ErrNotFound)
+	expectError(t, "DeleteDevice(missing)", store.DeleteDevice("missing", datastore.DeleteOptions{}), datastore.ErrNotFound)
+}
+
+func testLocationCRUD(t *testing.T, store datastore.Datastore) {
+	created := createLocation(t, store, "slot-1")
+	if created.ResourceVersion != 1 || created.CreatedAt.IsZero() {
+		t.Fatalf("CreateLocation returned %+v, want resource version 1 and a creation time", created)
+	}
+	_, err := store.CreateLocation(&models.Location{ID: "slot-1", Name: "Another"})
+	expectError(t, "CreateLocation with a duplicate ID", err, datastore.ErrAlreadyExists)
+	_, err = store.CreateLocation(&models.Location{Name: "No ID"})
+	expectError(t, "CreateLocation without an ID", err, datastore.ErrInvalid)
+	_, err = store.CreateLocation(&models.Location{ID: "no-name"})
+	expectError(t, "CreateLocation without a name", err, datastore.ErrInvalid)
+
+	if got, err := store.GetLocationByID("slot-1"); err != nil || got.Name != "slot-1" {
+		t.Errorf("GetLocationByID = %+v, %v", got, err)
+	}
+	if got, err := store.GetLocationByName("slot-1"); err != nil || got.ID != "slot-1" {
+		t.Errorf("GetLocationByName = %+v, %v", got, err)
+	}
+	_, err = store.GetLocationByID("missing")
+	expectError(t, "GetLocationByID(missing)", err, datastore.ErrNotFound)
+	_, err = store.GetLocationByName("missing")
+	expectError(t, "GetLocationByName(missing)", err, datastore.ErrNotFound)
+
+	update := *created
+	update.ResourceVersion = 0
+	update.Status = "reserved"
+	updated, err := store.UpdateLocation("slot-1", &update, "tester")
+	if err != nil {
+		t.Fatalf("UpdateLocation: %v", err)
+	}
+	if updated.ResourceVersion != 2 || updated.Status != "reserved" || !updated.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("UpdateLocation returned %+v, want version 2 and the original creation time", updated)
+	}
+	_, err = store.UpdateLocation("missing", &models.Location{Name: "ghost"}, "tester")
+	expectError(t, "UpdateLocation(missing)", err, datastore.ErrNotFound)
+
+	createLocation(t, store, "slot-2")
+	locations, _, err := store.ListLocations(datastore.LocationFilter{}, datastore.ListOptions{})
+	if ids := locationIDs(locations); err != nil || len(locations) != 2 || !ids["slot-1"] || !ids["slot-2"] {
+		t.Errorf("ListLocations = %d locations, %v; want both locations", len(locations), err)
+	}
+
+	if err := store.DeleteLocation("slot-1", datastore.DeleteOptions{}); err != nil {
+		t.Fatalf("DeleteLocation: %v", err)
+	}
+	_, err = store.GetLocationByID("slot-1")
+	expectError(t, "GetLocationByID after delete", err, datastore.ErrNotFound)
+	expectError(t, "DeleteLocation(missing)", store.DeleteLocation("missing", datastore.DeleteOptions{}), datastore.ErrNotFound)
+	// The ID of a soft-deleted location stays taken until it is purged.
+	_, err = store.CreateLocation(&models.Location{ID: "slot-1", Name: "Reused"})
+	expectError(t, "CreateLocation reusing a deleted ID", err, datastore.ErrAlreadyExists)
+}
+
+func testValidation(t *testing.T, store datastore.Datastore) {
+	_, err := store.CreateLocation(&models.Location{Labels: map[string]string{"bad key": "", "rack": "-x"}})
+	var validation *datastore.ValidationError
+	if !errors.As(err, &validation) || !errors.Is(err, datastore.ErrInvalid) {
+		t.Fatalf("CreateLocation of an invalid location: got error %v, want a ValidationError", err)
+	}
+	var fields []string
+	for _, field := range validation.Fields {
+		fields = append(fields, field.Field)
+	}
+	if got, want := strings.Join(fields, ","), "id,name,labels.bad key,labels.rack"; got != want {
+		t.Errorf("failed fields = %s, want %s", got, want)
+	}
+
+	device := createDevice(t, store, "node-1")
+	_, err = store.UpdateDevice(device.ID, &models.Device{}, "tester")
+	if !errors.As(err, &validation) || len(validation.Fields) != 1 || validation.Fields[0].Field != "name" {
+		t.Errorf("UpdateDevice without a name: got error %v, want name to fail", err)
+	}
+}
+
+func testConditionalWrites(t *testing.T, store datastore.Datastore) {
+	device := createDevice(t, store, "node-1")
+	update := *device
+	update.ResourceVersion = 1
+	updated, err := store.UpdateDevice(device.ID, &update, "tester")
+	if err != nil || updated.ResourceVersion != 2 {
+		t.Fatalf("UpdateDevice at the current version = %+v, %v", updated, err)
+	}
+	update.ResourceVersion = 1
+	_, err = store.UpdateDevice(device.ID, &update, "tester")
+	expectError(t, "UpdateDevice at a stale version", err, datastore.ErrPreconditionFailed)
+	expectError(t, "DeleteDevice at a stale version",
+		store.DeleteDevice(device.ID, datastore.DeleteOptions{ResourceVersion: 1}), datastore.ErrPreconditionFailed)
+	if err := store.DeleteDevice(device.ID, datastore.DeleteOptions{ResourceVersion: 2}); err != nil {
+		t.Errorf("DeleteDevice at the current version: %v", err)
+	}
+
+	location := createLocation(t, store, "slot-1")
+	locationUpdate := *location
+	locationUpdate.ResourceVersion = 5
+	_, err = store.UpdateLocation("slot-1", &locationUpdate, "tester")
+	expectError(t, "UpdateLocation at a stale version", err, datastore.ErrPreconditionFailed)
+	expectError(t, "DeleteLocation at a stale version",
+		store.DeleteLocation("slot-1", datastore.DeleteOptions{ResourceVersion: 5}), datastore.ErrPreconditionFailed)
+	if err := store.DeleteLocation("slot-1", datastore.DeleteOptions{ResourceVersion: 1}); err != nil {
+		t.Errorf("DeleteLocation at the current version: %v", err)
+	}
+}
+
+func testSoftDelete(t *testing.T, store datastore.Datastore) {
+	device := createDevice(t, store, "node-1")
+	createLocation(t, store, "slot-1")
+	if err := store.DeleteDevice(device.ID, datastore.DeleteOptions{Actor: "tester"}); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+
+	if devices, _, _ := store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{}); len(devices) != 0 {
+		t.Errorf("ListDevices returned %d devices, want the deleted one left out", len(devices))
+	}
+	devices, _, _ := store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{IncludeDeleted: true})
+	if len(devices) != 1 || devices[0].DeletedAt == nil || devices[0].ResourceVersion != 2 {
+		t.Errorf("ListDevices with deleted = %+v, want the device marked deleted at version 2", devices)
+	}
+	_, err := store.GetDeviceByName("node-1")
+	expectError(t, "GetDeviceByName after delete", err, datastore.ErrNotFound)
+	_, err = store.UpdateDevice(device.ID, &models.Device{Name: "node-1"}, "tester")
+	expectError(t, "UpdateDevice after delete", err, datastore.ErrNotFound)
+	_, _, err = store.InstallDevice("slot-1", device.ID, "tester")
+	expectError(t, "InstallDevice of a deleted device", err, datastore.ErrNotFound)
+
+	restored, err := store.RestoreDevice(device.ID, "tester")
+	if err != nil {
+		t.Fatalf("RestoreDevice: %v", err)
+	}
+	if restored.DeletedAt != nil || restored.ResourceVersion != 3 {
+		t.Errorf("RestoreDevice returned %+v, want it live at version 3", restored)
+	}
+	if _, err := store.GetDeviceByID(device.ID); err != nil {
+		t.Errorf("GetDeviceByID after restore: %v", err)
+	}
+	_, err = store.RestoreDevice(device.ID, "tester")
+	expectError(t, "RestoreDevice of a live device", err, datastore.ErrConflict)
+	_, err = store.RestoreDevice("missing", "tester")
+	expectError(t, "RestoreDevice(missing)", err, datastore.ErrNotFound)
+
+	events, _, _ := store.ListEventsByDeviceID(device.ID, datastore.ListOptions{})
+	types := map[string]bool{}
+	for _, event := range events {
+		types[event.Type] = true
+		if event.Data.Actor == nil || *event.Data.Actor != "tester" {
+			t.Errorf("event %s has actor %v, want tester", event.Type, event.Data.Actor)
+		}
+	}
+	if len(events) != 2 || !types[datastore.EventTypeDeviceDeleted] || !types[datastore.EventTypeDeviceRestored] {
+		t.Errorf("device events = %v, want deleted and restored", eventTypes(events))
+	}
+
+	if err := store.DeleteLocation("slot-1", datastore.DeleteOptions{Actor: "tester"}); err != nil {
+		t.Fatalf("DeleteLocation: %v", err)
+	}
+	if locations, _, _ := store.ListLocations(datastore.LocationFilter{}, datastore.ListOptions{}); len(locations) != 0 {
+		t.Errorf("ListLocations returned %d locations, want the deleted one left out", len(locations))
+	}
+	if locations, _, _ := store.ListLocations(datastore.LocationFilter{}, datastore.ListOptions{IncludeDeleted: true}); len(locations) != 1 {
+		t.Errorf("ListLocations with deleted returned %d locations, want 1", len(locations))
+	}
+	if _, err := store.RestoreLocation("slot-1", "tester"); err != nil {
+		t.Fatalf("RestoreLocation: %v", err)
+	}
+	_, err = store.RestoreLocation("slot-1", "tester")
+	expectError(t, "RestoreLocation of a live location", err, datastore.ErrConflict)
+	events, _, _ = store.ListEventsByLocationID("slot-1", datastore.ListOptions{})
+	if len(events) != 2 {
+		t.Errorf("location events = %v, want deleted and restored", eventTypes(events))
+	}
+}
+
+func testPurge(t *testing.T, store datastore.Datastore) {
+	kept := createDevice(t, store, "kept")
+	purged := createDevice(t, store, "purged")
+	createLocation(t, store, "slot-1")
+	store.DeleteDevice(purged.ID, datastore.DeleteOptions{})
+	store.DeleteLocation("slot-1", datastore.DeleteOptions{})
+
+	result, err := store.PurgeDeleted(time.Now().Add(-time.Hour))
+	if err != nil || result != (datastore.PurgeResult{}) {
+		t.Fatalf("PurgeDeleted before the deletes = %+v, %v; want nothing purged", result, err)
+	}
+	result, err = store.PurgeDeleted(time.Now().Add(time.Second))
+	if err != nil || result != (datastore.PurgeResult{Devices: 1, Locations: 1}) {
+		t.Fatalf("PurgeDeleted = %+v, %v; want one device and one location", result, err)
+	}
+	if devices, _, _ := store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{IncludeDeleted: true}); len(devices) != 1 || devices[0].ID != kept.ID {
+		t.Errorf("devices after purge = %+v, want only %s", devices, kept.ID)
+	}
+	_, err = store.RestoreDevice(purged.ID, "tester")
+	expectError(t, "RestoreDevice after purge", err, datastore.ErrNotFound)
+	if events, _, _ := store.ListEventsByDeviceID(purged.ID, datastore.ListOptions{}); len(events) != 1 {
+		t.Errorf("got %d events for the purged device, want its deleted event kept", len(events))
+	}
+	// A purged location's ID can be used again.
+	createLocation(t, store, "slot-1")
+}
+
+func testUniqueness(t *testing.T, store datastore.Datastore) {
+	first := createDevice(t, store, "node-1")
+	tests := []struct {
+		name   string
+		device models.Device
+	}{
+		{"Name", models.Device{Name: "node-1"}},
+		{"SerialNumber", models.Device{Name: "node-2", Manufacturer: "HPE", SerialNumber: "SN-node-1"}},
+	}
+	for _, tt := range tests {
+		_, err := store.CreateDevice(&tt.device)
+		var duplicate *datastore.DuplicateError
+		if !errors.As(err, &duplicate) || !errors.Is(err, datastore.ErrAlreadyExists) || duplicate.ConflictingID != first.ID {
+			t.Errorf("duplicate %s: got error %v, want a DuplicateError naming %s", tt.name, err, first.ID)
+		}
+	}
+	if _, err := store.CreateDevice(&models.Device{Name: "node-3", Manufacturer: "Dell", SerialNumber: "SN-node-1"}); err != nil {
+		t.Errorf("same serial number from another manufacturer: %v", err)
+	}
+	if _, err := store.CreateDevice(&models.Device{Name: "node-4", Manufacturer: "HPE"}); err != nil {
+		t.Errorf("first device without a serial number: %v", err)
+	}
+	if _, err := store.CreateDevice(&models.Device{Name: "node-5", Manufacturer: "HPE"}); err != nil {
+		t.Errorf("second device without a serial number: %v", err)
+	}
+
+	second := createDevice(t, store, "node-6")
+	rename := *second
+	rename.Name = "node-1"
+	rename.ResourceVersion = 0
+	_, err := store.UpdateDevice(second.ID, &rename, "tester")
+	expectError(t, "renaming onto an existing name", err, datastore.ErrAlreadyExists)
+
+	createLocation(t, store, "rack-1")
+	_, err = store.CreateLocation(&models.Location{ID: "rack-2", Name: "rack-1"})
+	expectError(t, "duplicate location name", err, datastore.ErrAlreadyExists)
+
+	store.DeleteDevice(first.ID, datastore.DeleteOptions{})
+	replacement := createDevice(t, store, "node-1")
+	_, err = store.RestoreDevice(first.ID, "tester")
+	var duplicate *datastore.DuplicateError
+	if !errors.As(err, &duplicate) || duplicate.ConflictingID != replacement.ID {
+		t.Errorf("restoring over a reused name: got error %v, want a DuplicateError naming %s", err, replacement.ID)
+	}
+}
+
+func testEvents(t *testing.T, store datastore.Datastore) {
+	deviceID, locationID := "device-1", "slot-1"
+	comment := "annual audit"
+	created, err := store.CreateEvent(&models.Event{
+		Source:      "tester",
+		SpecVersion: "1.0",
+		Type:        "com.example.audited",
+		Data:        models.EventData{DeviceID: &deviceID, Comment: &comment, StateAfter: map[string]interface{}{"status": "ok"}},
+	})
+	if err != nil {
+		t.Fatalf("CreateEvent: %v", err)
+	}
+	if created.ID == "" || created.Time.IsZero() {
+		t.Fatalf("CreateEvent returned %+v, want an ID and a time", created)
+	}
+	store.CreateEvent(&models.Event{Source: "tester", SpecVersion: "1.0", Type: "com.example.moved", Data: models.EventData{LocationID: &locationID}})
+
+	got, err := store.GetEventByID(created.ID)
+	if err != nil || got.Type != "com.example.audited" || got.Data.Comment == nil || *got.Data.Comment != comment || got.Data.StateAfter["status"] != "ok" {
+		t.Errorf("GetEventByID = %+v, %v", got, err)
+	}
+	_, err = store.GetEventByID("missing")
+	expectError(t, "GetEventByID(missing)", err, datastore.ErrNotFound)
+
+	if events, _, err := store.ListEvents(datastore.EventFilter{}, datastore.ListOptions{}); err != nil || len(events) != 2 {
+		t.Errorf("ListEvents = %d events, %v; want 2", len(events), err)
+	}
+	if events, _, _ := store.ListEventsByDeviceID(deviceID, datastore.ListOptions{}); len(events) != 1 || events[0].ID != created.ID {
+		t.Errorf("ListEventsByDeviceID = %v, want the audited event", eventTypes(events))
+	}
+	if events, _, _ := store.ListEventsByLocationID(locationID, datastore.ListOptions{}); len(events) != 1 || events[0].Type != "com.example.moved" {
+		t.Errorf("ListEventsByLocationID = %v, want the moved event", eventTypes(events))
+	}
+	if events, _, err := store.ListEventsByDeviceID("missing", datastore.ListOptions{}); err != nil || len(events) != 0 {
+		t.Errorf("ListEventsByDeviceID(missing) = %d events, %v; want none", len(events), err)
+	}
+}
+
+func testInstallAndRemove(t *testing.T, store datastore.Datastore) {
+	device := createDevice(t, store, "node-1")
+	other := createDevice(t, store, "node-2")
+	createLocation(t, store, "slot-1")
+	createLocation(t, store, "slot-2")
+
+	location, event, err := store.InstallDevice("slot-1", device.ID, "tester")
+	if err != nil {
+		t.Fatalf("InstallDevice: %v", err)
+	}
+	if location.CurrentDeviceID == nil || *location.CurrentDeviceID != device.ID || location.Status != "occupied" || location.ResourceVersion != 2 {
+		t.Errorf("InstallDevice returned location %+v", location)
+	}
+	if event.Type != datastore.EventTypeDeviceInstalled || event.Data.Actor == nil || *event.Data.Actor != "tester" {
+		t.Errorf("InstallDevice returned event %+v", event)
+	}
+	installed, _ := store.GetDeviceByID(device.ID)
+	if installed.CurrentLocationID == nil || *installed.CurrentLocationID != "slot-1" || installed.ResourceVersion != 2 {
+		t.Errorf("installed device = %+v", installed)
+	}
+
+	_, _, err = store.InstallDevice("slot-1", other.ID, "tester")
+	expectError(t, "InstallDevice into an occupied location", err, datastore.ErrLocationOccupied)
+	_, _, err = store.InstallDevice("slot-2", device.ID, "tester")
+	expectError(t, "InstallDevice of an installed device", err, datastore.ErrDeviceInstalled)
+	_, _, err = store.InstallDevice("missing", other.ID, "tester")
+	expectError(t, "InstallDevice into a missing location", err, datastore.ErrNotFound)
+	_, _, err = store.InstallDevice("slot-2", "missing", "tester")
+	expectError(t, "InstallDevice of a missing device", err, datastore.ErrNotFound)
+	if slot, _ := store.GetLocationByID("slot-2"); slot.CurrentDeviceID != nil {
+		t.Errorf("a failed install left slot-2 holding %s", *slot.CurrentDeviceID)
+	}
+
+	// Only installs and removals move a device; other writes keep both
+	// pointers as they are.
+	if _, err := store.UpdateLocation("slot-1", &models.Location{Name: "slot-1", LocationType: "node_slot"}, "tester"); err != nil {
+		t.Fatalf("UpdateLocation: %v", err)
+	}
+	if slot, _ := store.GetLocationByID("slot-1"); slot.CurrentDeviceID == nil || *slot.CurrentDeviceID != device.ID {
+		t.Errorf("an update cleared the device of slot-1: %+v", slot)
+	}
+	slot2 := "slot-2"
+	installed.CurrentLocationID = &slot2
+	if _, err := store.UpdateDevice(device.ID, installed, "tester"); err != nil {
+		t.Fatalf("UpdateDevice: %v", err)
+	}
+	_, err = store.PatchDevice(device.ID, datastore.Patch{Type: datastore.MergePatch, Document: []byte(`{"currentLocationId":null}`)}, datastore.PatchOptions{})
+	if err != nil {
+		t.Fatalf("PatchDevice: %v", err)
+	}
+	if got, _ := store.GetDeviceByID(device.ID); got.CurrentLocationID == nil || *got.CurrentLocationID != "slot-1" {
+		t.Errorf("writes moved the installed device: %+v", got)
+	}
+	stray, err := store.CreateDevice(&models.Device{Name: "node-3", CurrentLocationID: &slot2})
+	if err != nil || stray.CurrentLocationID != nil {
+		t.Errorf("CreateDevice with a location = %+v, %v, want it not installed", stray, err)
+	}
+
+	location, event, err = store.RemoveDevice("slot-1", "tester")
+	if err != nil {
+		t.Fatalf("RemoveDevice: %v", err)
+	}
+	if location.CurrentDeviceID != nil || location.Status != "empty" {
+		t.Errorf("RemoveDevice returned location %+v", location)
+	}
+	if event.Type != datastore.EventTypeDeviceRemoved || event.Data.DeviceID == nil || *event.Data.DeviceID != device.ID {
+		t.Errorf("RemoveDevice returned event %+v", event)
+	}
+	if removed, _ := store.GetDeviceByID(device.ID); removed.CurrentLocationID != nil {
+		t.Errorf("removed device still points at %s", *removed.CurrentLocationID)
+	}
+	_, _, err = store.RemoveDevice("slot-1", "tester")
+	expectError(t, "RemoveDevice from an empty location", err, datastore.ErrLocationEmpty)
+	_, _, err = store.RemoveDevice("missing", "tester")
+	expectError(t, "RemoveDevice from a missing location", err, datastore.ErrNotFound)
+
+	if events, _, _ := store.ListEventsByLocationID("slot-1", datastore.ListOptions{}); len(events) != 2 {
+		t.Errorf("slot-1 events = %v, want installed and removed", eventTypes(events))
+	}
+}
+
+func testRemoveWithStalePointer(t *testing.T, store datastore.Datastore) {
+	damaged, ok := store.(DamagedStore)
+	if !ok {
+		t.Skip("the store cannot set up damaged data")
+	}
+	createLocation(t, store, "slot-1")
+	createLocation(t, store, "slot-2")
+	device := createDevice(t, store, "node-1")
+	if _, _, err := store.InstallDevice("slot-1", device.ID, "tester"); err != nil {
+		t.Fatalf("InstallDevice: %v", err)
+	}
+	// The device no longer agrees that it is in slot-1; removing it from
+	// there must not take it out of slot-2 as well.
+	elsewhere := "slot-2"
+	if err := damaged.SetDeviceLocation(device.ID, &elsewhere); err != nil {
+		t.Fatalf("SetDeviceLocation: %v", err)
+	}
+	if _, _, err := store.RemoveDevice("slot-1", "tester"); err != nil {
+		t.Fatalf("RemoveDevice: %v", err)
+	}
+	if slot, _ := store.GetLocationByID("slot-1"); slot.CurrentDeviceID != nil {
+		t.Errorf("slot-1 still holds %s", *slot.CurrentDeviceID)
+	}
+	if got, _ := store.GetDeviceByID(device.ID); got.CurrentLocationID == nil || *got.CurrentLocationID != elsewhere {
+		t.Errorf("device location = %v, want it left at %s", got.CurrentLocationID, elsewhere)
+	}
+}
+
+func testPaging(t *testing.T, store datastore.Datastore) {
+	for _, name := range []string{"node-1", "node-2", "node-3", "node-4", "node-5"} {
+		createDevice(t, store, name)
+	}
+	all, page, err := store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{})
+	if err != nil || len(all) != 5 || page.Total != 5 || page.Next != "" {
+		t.Fatalf("ListDevices = %d devices, %+v, %v; want all 5 on one page", len(all), page, err)
+	}
+
+	var walked []string
+	opts := datastore.ListOptions{Limit: 2}
+	for pages := 1; ; pages++ {
+		devices, page, err := store.ListDevices(datastore.DeviceFilter{}, opts)
+		if err != nil {
+			t.Fatalf("ListDevices page %d: %v", pages, err)
+		}
+		if want := 5 - min(pages-1, 1); page.Total != want || len(devices) > 2 {
+			t.Fatalf("page %d = %d devices, %+v; want at most 2 of %d", pages, len(devices), page, want)
+		}
+		for _, device := range devices {
+			walked = append(walked, device.ID)
+		}
+		if page.Next == "" {
+			break
+		}
+		if pages == 3 {
+			t.Fatalf("the third page has a next cursor")
+		}
+		opts.After = page.Next
+		if pages == 1 {
+			// Deleting a record a cursor already passed does not move the cursor.
+			store.DeleteDevice(devices[0].ID, datastore.DeleteOptions{})
+		}
+	}
+	if len(walked) != 5 {
+		t.Fatalf("walked %d devices, want 5", len(walked))
+	}
+	for i, device := range all {
+		if walked[i] != device.ID {
+			t.Errorf("device %d of the walk is %s, want %s", i, walked[i], device.ID)
+		}
+	}
+
+	if devices, page, _ := store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{Offset: 2, Limit: 10}); len(devices) != 2 || page.Total != 4 || page.Next != "" {
+		t.Errorf("offset 2 of 4 devices = %d devices, %+v; want the last 2", len(devices), page)
+	}
+	if devices, _, _ := store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{Offset: 10}); len(devices) != 0 {
+		t.Errorf("offset past the end = %d devices, want none", len(devices))
+	}
+	_, _, err = store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{After: "not-a-cursor"})
+	expectError(t, "ListDevices with a malformed cursor", err, datastore.ErrInvalidCursor)
+
+	createLocation(t, store, "slot-1")
+	createLocation(t, store, "slot-2")
+	locations, page, err := store.ListLocations(datastore.LocationFilter{}, datastore.ListOptions{Limit: 1})
+	if err != nil || len(locations) != 1 || locations[0].ID != "slot-1" || page.Total != 2 {
+		t.Fatalf("first page of locations = %v, %+v, %v", locationIDs(locations), page, err)
+	}
+	if locations, page, _ = store.ListLocations(datastore.LocationFilter{}, datastore.ListOptions{Limit: 1, After: page.Next}); len(locations) != 1 || locations[0].ID != "slot-2" || page.Next != "" {
+		t.Errorf("second page of locations = %v, %+v", locationIDs(locations), page)
+	}
+
+	node := all[1]
+	store.InstallDevice("slot-1", node.ID, "tester")
+	store.RemoveDevice("slot-1", "tester")
+	events, page, err := store.ListEventsByDeviceID(node.ID, datastore.ListOptions{Limit: 1})
+	if err != nil || len(events) != 1 || events[0].Type != datastore.EventTypeDeviceInstalled || page.Total != 2 {
+		t.Fatalf("first page of events = %v, %+v, %v", eventTypes(events), page, err)
+	}
+	events, page, _ = store.ListEventsByDeviceID(node.ID, datastore.ListOptions{Limit: 1, After: page.Next})
+	if len(events) != 1 || events[0].Type != datastore.EventTypeDeviceRemoved || page.Next != "" {
+		t.Errorf("second page of events = %v, %+v", eventTypes(events), page)
+	}
+	if events, page, _ := store.ListEvents(datastore.EventFilter{}, datastore.ListOptions{Limit: 2}); len(events) != 2 || page.Total != 3 || page.Next == "" {
+		t.Errorf("first page of all events = %v, %+v; want 2 of 3", eventTypes(events), page)
+	}
+}
+
+func testFilters(t *testing.T, store datastore.Datastore) {
+	node1 := createDevice(t, store, "node-1")
+	node1.Status = "failed"
+	node1.ResourceVersion = 0
+	store.UpdateDevice(node1.ID, node1, "tester")
+	node2 := createDevice(t, store, "node-2")
+	dimm, err := store.CreateDevice(&models.Device{Name: "dimm-1", ComponentType: "DIMM", Manufacturer: "Micron", PartNumber: "MTA18", Status: "active", ParentDeviceID: &node1.ID})
+	if err != nil {
+		t.Fatalf("CreateDevice: %v", err)
+	}
+	createLocation(t, store, "rack")
+	createChildLocation(t, store, "slot-1", "rack")
+	createLocation(t, store, "slot-2")
+	if _, _, err := store.InstallDevice("slot-1", node2.ID, "alice"); err != nil {
+		t.Fatalf("InstallDevice: %v", err)
+	}
+	if _, _, err := store.InstallDevice("slot-2", dimm.ID, "bob"); err != nil {
+		t.Fatalf("InstallDevice: %v", err)
+	}
+
+	deviceTests := []struct {
+		name   string
+		filter datastore.DeviceFilter
+		want   []string
+	}{
+		{"None", datastore.DeviceFilter{}, []string{node1.ID, node2.ID, dimm.ID}},
+		{"ManufacturerAndStatus", datastore.DeviceFilter{Manufacturer: "HPE", Status: "failed"}, []string{node1.ID}},
+		{"ComponentType", datastore.DeviceFilter{ComponentType: "DIMM"}, []string{dimm.ID}},
+		{"PartNumber", datastore.DeviceFilter{PartNumber: "MTA18"}, []string{dimm.ID}},
+		{"CurrentLocation", datastore.DeviceFilter{CurrentLocationID: "slot-1"}, []string{node2.ID}},
+		{"ParentDevice", datastore.DeviceFilter{ParentDeviceID: node1.ID}, []string{dimm.ID}},
+		{"NoMatch", datastore.DeviceFilter{Manufacturer: "HPE", ComponentType: "DIMM"}, nil},
+	}
+	for _, tt := range deviceTests {
+		t.Run("Devices"+tt.name, func(t *testing.T) {
+			devices, page, err := store.ListDevices(tt.filter, datastore.ListOptions{})
+			if err != nil || page.Total != len(tt.want) || len(devices) != len(tt.want) {
+				t.Fatalf("ListDevices = %d devices of %d, %v; want %d", len(devices), page.Total, err, len(tt.want))
+			}
+			for i, device := range devices {
+				if device.ID != tt.want[i] {
+					t.Errorf("device %d = %s, want %s", i, device.Name, tt.want[i])
+				}
+			}
+		})
+	}
+
+	locationTests := []struct {
+		name   string
+		filter datastore.LocationFilter
+		want   []string
+	}{
+		{"Type", datastore.LocationFilter{LocationType: "node_slot"}, []string{"rack", "slot-2"}},
+		{"Status", datastore.LocationFilter{Status: "occupied"}, []string{"slot-1", "slot-2"}},
+		{"Parent", datastore.LocationFilter{ParentLocationID: "rack"}, []string{"slot-1"}},
+	}
+	for _, tt := range locationTests {
+		t.Run("Locations"+tt.name, func(t *testing.T) {
+			locations, page, err := store.ListLocations(tt.filter, datastore.ListOptions{})
+			ids := locationIDs(locations)
+			if err != nil || page.Total != len(tt.want) || len(locations) != len(tt.want) {
+				t.Fatalf("ListLocations = %v, %v; want %v", ids, err, tt.want)
+			}
+			for _, id := range tt.want {
+				if !ids[id] {
+					t.Errorf("ListLocations is missing %s", id)
+				}
+			}
+		})
+	}
+
+	all, _, _ := store.ListEvents(datastore.EventFilter{}, datastore.ListOptions{})
+	if len(all) != 2 {
+		t.Fatalf("ListEvents = %v, want the two installs", eventTypes(all))
+	}
+	eventTests := []struct {
+		name   string
+		filter datastore.EventFilter
+		want   int
+	}{
+		{"Type", datastore.EventFilter{Type: datastore.EventTypeDeviceInstalled}, 2},
+		{"OtherType", datastore.EventFilter{Type: datastore.EventTypeDeviceRemoved}, 0},
+		{"Actor", datastore.EventFilter{Actor: "alice"}, 1},
+		{"Device", datastore.EventFilter{DeviceID: dimm.ID}, 1},
+		{"Location", datastore.EventFilter{LocationID: "slot-1", Actor: "alice"}, 1},
+		{"Since", datastore.EventFilter{Since: all[1].Time}, 1 + btoi(all[0].Time.Equal(all[1].Time))},
+		{"Until", datastore.EventFilter{Until: all[1].Time}, btoi(all[0].Time.Before(all[1].Time))},
+		{"Range", datastore.EventFilter{Since: all[0].Time, Until: all[1].Time.Add(time.Second)}, 2},
+		{"Future", datastore.EventFilter{Since: time.Now().Add(time.Hour)}, 0},
+	}
+	for _, tt := range eventTests {
+		t.Run("Events"+tt.name, func(t *testing.T) {
+			events, page, err := store.ListEvents(tt.filter, datastore.ListOptions{})
+			if err != nil || len(events) != tt.want || page.Total != tt.want {
+				t.Errorf("ListEvents = %v, %v; want %d events", eventTypes(events), err, tt.want)
+			}
+		})
+	}
+
+	// Filters apply before paging.
+	devices, page, _ := store.ListDevices(datastore.DeviceFilter{Manufacturer: "HPE"}, datastore.ListOptions{Limit: 1})
+	if len(devices) != 1 || page.Total != 2 || page.Next == "" {
+		t.Fatalf("first page of HPE devices = %d devices, %+v", len(devices), page)
+	}
+	devices, page, _ = store.ListDevices(datastore.DeviceFilter{Manufacturer: "HPE"}, datastore.ListOptions{Limit: 1, After: page.Next})
+	if len(devices) != 1 || devices[0].ID != node2.ID || page.Next != "" {
+		t.Errorf("second page of HPE devices = %d devices, %+v", len(devices), page)
+	}
+}
+
+func testSorting(t *testing.T, store datastore.Datastore) {
+	// Events recorded in quick succession often share a timestamp; their
+	// sequence numbers keep them in order.
+	device := createDevice(t, store, "node-1")
+	createLocation(t, store, "slot-1")
+	for i := 0; i < 10; i++ {
+		store.InstallDevice("slot-1", device.ID, "tester")
+		store.RemoveDevice("slot-1", "tester")
+	}
+	events, _, err := store.ListEventsByDeviceID(device.ID, datastore.ListOptions{})
+	if err != nil || len(events) != 20 {
+		t.Fatalf("ListEventsByDeviceID = %d events, %v; want 20", len(events), err)
+	}
+	for i, event := range events {
+		want := datastore.EventTypeDeviceInstalled
+		if i%2 == 1 {
+			want = datastore.EventTypeDeviceRemoved
+		}
+		if event.Type != want || (i > 0 && event.Sequence <= events[i-1].Sequence) {
+			t.Fatalf("event %d is %s with sequence %d, want %s after sequence %d", i, event.Type, event.Sequence, want, events[max(i-1, 0)].Sequence)
+		}
+	}
+	if all, _, _ := store.ListEvents(datastore.EventFilter{}, datastore.ListOptions{Sort: []datastore.SortField{{Field: "time", Descending: true}}}); all[0].ID != events[19].ID {
+		t.Errorf("newest event = %s, want %s", all[0].Type, events[19].Type)
+	}
+
+	for _, name := range []string{"b", "B", "a"} {
+		status := "active"
+		if name == "b" {
+			status = "failed"
+		}
+		if _, err := store.CreateDevice(&models.Device{Name: name, Manufacturer: "HPE", Status: status}); err != nil {
+			t.Fatalf("CreateDevice(%s): %v", name, err)
+		}
+	}
+	tests := []struct {
+		name string
+		sort []datastore.SortField
+		want []string
+	}{
+		{"Default", nil, []string{"node-1", "b", "B", "a"}},
+		{"Name", []datastore.SortField{{Field: "name"}}, []string{"B", "a", "b", "node-1"}},
+		{"NameDescending", []datastore.SortField{{Field: "name", Descending: true}}, []string{"node-1", "b", "a", "B"}},
+		{"StatusThenName", []datastore.SortField{{Field: "status"}, {Field: "name", Descending: true}}, []string{"node-1", "a", "B", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices, _, err := store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{Sort: tt.sort})
+			if err != nil {
+				t.Fatalf("ListDevices: %v", err)
+			}
+			if got := deviceNames(devices); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("ListDevices = %v, want %v", got, tt.want)
+			}
+			// Paging through the same order yields the same devices.
+			var walked []string
+			opts := datastore.ListOptions{Sort: tt.sort, Limit: 1}
+			for {
+				devices, page, err := store.ListDevices(datastore.DeviceFilter{}, opts)
+				if err != nil {
+					t.Fatalf("ListDevices page: %v", err)
+				}
+				walked = append(walked, deviceNames(devices)...)
+				if page.Next == "" || len(walked) > len(tt.want) {
+					break
+				}
+				opts.After = page.Next
+			}
+			if strings.Join(walked, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("paged ListDevices = %v, want %v", walked, tt.want)
+			}
+		})
+	}
+
+	_, page, _ := store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{Sort: []datastore.SortField{{Field: "name"}}, Limit: 1})
+	_, _, err = store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{After: page.Next})
+	expectError(t, "ListDevices with a cursor of another order", err, datastore.ErrInvalidCursor)
+	_, _, err = store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{Sort: []datastore.SortField{{Field: "properties"}}})
+	expectError(t, "ListDevices sorted by an unsupported field", err, datastore.ErrInvalidSort)
+	_, _, err = store.ListLocations(datastore.LocationFilter{}, datastore.ListOptions{Sort: []datastore.SortField{{Field: "manufacturer"}}})
+	expectError(t, "ListLocations sorted by a device field", err, datastore.ErrInvalidSort)
+}
+
+func deviceNames(devices []models.Device) []string {
+	names := make([]string, len(devices))
+	for i, device := range devices {
+		names[i] = device.Name
+	}
+	return names
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func testExpressions(t *testing.T, store datastore.Datastore) {
+	create := func(name string, properties map[string]interface{}) {
+		t.Helper()
+		device := &models.Device{Name: name, Manufacturer: "HPE", Status: "active", Properties: properties}
+		if _, err := store.CreateDevice(device); err != nil {
+			t.Fatalf("CreateDevice(%s): %v", name, err)
+		}
+	}
+	create("big", map[string]interface{}{"memoryGiB": 1024, "cpu": "x86", "bmc": map[string]interface{}{"firmware": "2.1", "secure": true}})
+	create("small", map[string]interface{}{"memoryGiB": 256.5, "cpu": "arm", "bmc": map[string]interface{}{"firmware": "1.9", "secure": false}})
+	create("odd", map[string]interface{}{"memoryGiB": "lots", "bmc": nil})
+	create("bare", nil)
+
+	eq := func(field string, value any) datastore.Expr {
+		return datastore.Comparison{Field: field, Op: datastore.OpEqual, Value: value}
+	}
+	cmp := func(field string, op datastore.CompareOp, value any) datastore.Expr {
+		return datastore.Comparison{Field: field, Op: op, Value: value}
+	}
+	tests := []struct {
+		name string
+		expr datastore.Expr
+		want []string
+	}{
+		{"NumberGreater", cmp("properties.memoryGiB", datastore.OpGreater, 512.0), []string{"big"}},
+		{"NumberLessOrEqual", cmp("properties.memoryGiB", datastore.OpLessOrEqual, 256.5), []string{"small"}},
+		{"NumberEqualsString", eq("properties.memoryGiB", "lots"), []string{"odd"}},
+		{"String", eq("properties.cpu", "arm"), []string{"small"}},
+		{"StringNotEqual", cmp("properties.cpu", datastore.OpNotEqual, "arm"), []string{"big"}},
+		{"StringOrdered", cmp("properties.bmc.firmware", datastore.OpGreaterOrEqual, "2"), []string{"big"}},
+		{"Bool", eq("properties.bmc.secure", true), []string{"big"}},
+		{"BoolFalse", eq("properties.bmc.secure", false), []string{"small"}},
+		{"Null", eq("properties.cpu", nil), []string{"odd", "bare"}},
+		{"NestedNull", eq("properties.bmc.secure", nil), []string{"odd", "bare"}},
+		{"NotNull", cmp("properties.bmc", datastore.OpNotEqual, nil), []string{"big", "small"}},
+		{"Not", datastore.NotExpr{Expr: cmp("properties.memoryGiB", datastore.OpGreater, 512.0)}, []string{"small", "odd", "bare"}},
+		{"Or", datastore.OrExpr{Left: eq("properties.cpu", "x86"), Right: eq("name", "bare")}, []string{"big", "bare"}},
+		{"And", datastore.AndExpr{Left: eq("manufacturer", "HPE"), Right: cmp("name", datastore.OpLess, "c")}, []string{"big", "bare"}},
+		{"FieldNull", eq("hostname", nil), []string{"big", "small", "odd", "bare"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices, page, err := store.ListDevices(datastore.DeviceFilter{Expr: tt.expr}, datastore.ListOptions{})
+			if err != nil {
+				t.Fatalf("ListDevices: %v", err)
+			}
+			if got := deviceNames(devices); strings.Join(got, " ") != strings.Join(tt.want, " ") || page.Total != len(tt.want) {
+				t.Errorf("ListDevices = %v of %d, want %v", got, page.Total, tt.want)
+			}
+		})
+	}
+
+	createLocation(t, store, "rack")
+	locations, _, err := store.ListLocations(datastore.LocationFilter{Expr: eq("locationType", "node_slot")}, datastore.ListOptions{})
+	if err != nil || len(locations) != 1 {
+		t.Errorf("ListLocations = %v, %v; want rack", locationIDs(locations), err)
+	}
+
+	for _, expr := range []datastore.Expr{
+		eq("properties", "x"),
+		eq("properties..cpu", "x"),
+		eq("memoryGiB", 1.0),
+		eq("name", 1.0),
+		cmp("properties.bmc.secure", datastore.OpLess, true),
+	} {
+		_, _, err := store.ListDevices(datastore.DeviceFilter{Expr: expr}, datastore.ListOptions{})
+		expectError(t, fmt.Sprintf("ListDevices filtered by %v", expr), err, datastore.ErrInvalidFilter)
+	}
+	_, _, err = store.ListLocations(datastore.LocationFilter{Expr: eq("manufacturer", "HPE")}, datastore.ListOptions{})
+	expectError(t, "ListLocations filtered by a device field", err, datastore.ErrInvalidFilter)
+}
+
+func testLabels(t *testing.T, store datastore.Datastore) {
+	create := func(name string, labels map[string]string) *models.Device {
+		t.Helper()
+		device, err := store.CreateDevice(&models.Device{Name: name, Status: "active", Labels: labels})
+		if err != nil {
+			t.Fatalf("CreateDevice(%s): %v", name, err)
+		}
+		return device
+	}
+	create("compute-1", map[string]string{"partition": "compute", "env": "prod", "gpu": ""})
+	compute2 := create("compute-2", map[string]string{"partition": "compute", "env": "test"})
+	create("storage-1", map[string]string{"partition": "storage", "example.com/batch": "b7"})
+	create("spare", nil)
+
+	req := func(key string, op datastore.LabelOp, values ...string) datastore.LabelRequirement {
+		return datastore.LabelRequirement{Key: key, Op: op, Values: values}
+	}
+	tests := []struct {
+		name     string
+		selector datastore.LabelSelector
+		want     []string
+	}{
+		{"Equal", datastore.LabelSelector{req("partition", datastore.LabelIn, "compute")}, []string{"compute-1", "compute-2"}},
+		{"NotEqual", datastore.LabelSelector{req("env", datastore.LabelNotIn, "test")}, []string{"compute-1", "storage-1", "spare"}},
+		{"In", datastore.LabelSelector{req("partition", datastore.LabelIn, "storage", "login")}, []string{"storage-1"}},
+		{"Exists", datastore.LabelSelector{req("gpu", datastore.LabelExists)}, []string{"compute-1"}},
+		{"DoesNotExist", datastore.LabelSelector{req("partition", datastore.LabelDoesNotExist)}, []string{"spare"}},
+		{"Prefixed", datastore.LabelSelector{req("example.com/batch", datastore.LabelIn, "b7")}, []string{"storage-1"}},
+		{"All", datastore.LabelSelector{
+			req("partition", datastore.LabelIn, "compute"),
+			req("env", datastore.LabelNotIn, "test"),
+			req("gpu", datastore.LabelExists),
+		}, []string{"compute-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices, page, err := store.ListDevices(datastore.DeviceFilter{Labels: tt.selector}, datastore.ListOptions{})
+			if err != nil {
+				t.Fatalf("ListDevices: %v", err)
+			}
+			if got := deviceNames(devices); strings.Join(got, " ") != strings.Join(tt.want, " ") || page.Total != len(tt.want) {
+				t.Errorf("ListDevices = %v of %d, want %v", got, page.Total, tt.want)
+			}
+		})
+	}
+
+	t.Run("Update", func(t *testing.T) {
+		compute2.Labels = map[string]string{"partition": "login"}
+		compute2.ResourceVersion = 0
+		if _, err := store.UpdateDevice(compute2.ID, compute2, "tester"); err != nil {
+			t.Fatalf("UpdateDevice: %v", err)
+		}
+		devices, _, _ := store.ListDevices(datastore.DeviceFilter{Labels: datastore.LabelSelector{req("partition", datastore.LabelIn, "login")}}, datastore.ListOptions{})
+		if got := deviceNames(devices); len(got) != 1 || got[0] != "compute-2" {
+			t.Errorf("ListDevices after update = %v, want [compute-2]", got)
+		}
+		if got, _ := store.GetDeviceByID(compute2.ID); len(got.Labels) != 1 || got.Labels["partition"] != "login" {
+			t.Errorf("GetDeviceByID labels = %v, want partition=login", got.Labels)
+		}
+	})
+
+	t.Run("Relabel", func(t *testing.T) {
+		filter := datastore.DeviceFilter{Labels: datastore.LabelSelector{req("partition", datastore.LabelExists)}}
+		change := datastore.LabelChange{Set: map[string]string{"env": "prod"}, Remove: []string{"gpu"}}
+		relabeled, err := store.RelabelDevices(filter, change)
+		if err != nil {
+			t.Fatalf("RelabelDevices: %v", err)
+		}
+		// compute-1 loses gpu, compute-2 and storage-1 gain env; spare is not
+		// selected.
+		if got := deviceNames(relabeled); strings.Join(got, " ") != "compute-1 compute-2 storage-1" {
+			t.Fatalf("RelabelDevices changed %v, want compute-1 compute-2 storage-1", got)
+		}
+		for _, device := range relabeled {
+			stored, _ := store.GetDeviceByID(device.ID)
+			if stored.Labels["env"] != "prod" || stored.Labels["gpu"] != "" || stored.ResourceVersion != device.ResourceVersion {
+				t.Errorf("%s after relabel = %v at version %d, want env=prod without gpu at version %d",
+					device.Name, stored.Labels, stored.ResourceVersion, device.ResourceVersion)
+			}
+		}
+		if _, ok := relabeled[0].Labels["gpu"]; ok {
+			t.Errorf("compute-1 still has gpu: %v", relabeled[0].Labels)
+		}
+		devices, _, _ := store.ListDevices(datastore.DeviceFilter{Labels: datastore.LabelSelector{req("gpu", datastore.LabelExists)}}, datastore.ListOptions{})
+		if len(devices) != 0 {
+			t.Errorf("ListDevices by removed label = %v, want none", deviceNames(devices))
+		}
+		// Relabeling again changes nothing.
+		if relabeled, err := store.RelabelDevices(filter, change); err != nil || len(relabeled) != 0 {
+			t.Errorf("repeated RelabelDevices = %v, %v; want no changes", deviceNames(relabeled), err)
+		}
+	})
+
+	t.Run("Locations", func(t *testing.T) {
+		if _, err := store.CreateLocation(&models.Location{ID: "rack-1", Name: "rack-1", Labels: map[string]string{"row": "a"}}); err != nil {
+			t.Fatalf("CreateLocation: %v", err)
+		}
+		createLocation(t, store, "rack-2")
+		selector := datastore.LabelSelector{req("row", datastore.LabelIn, "a")}
+		locations, _, err := store.ListLocations(datastore.LocationFilter{Labels: selector}, datastore.ListOptions{})
+		if err != nil || len(locations) != 1 || locations[0].ID != "rack-1" {
+			t.Fatalf("ListLocations = %v, %v; want rack-1", locationIDs(locations), err)
+		}
+		relabeled, err := store.RelabelLocations(datastore.LocationFilter{Labels: selector}, datastore.LabelChange{Set: map[string]string{"row": "b"}})
+		if err != nil || len(relabeled) != 1 || relabeled[0].Labels["row"] != "b" {
+			t.Fatalf("RelabelLocations = %v, %v; want rack-1 in row b", relabeled, err)
+		}
+		if locations, _, _ := store.ListLocations(datastore.LocationFilter{Labels: selector}, datastore.ListOptions{}); len(locations) != 0 {
+			t.Errorf("ListLocations after relabel = %v, want none", locationIDs(locations))
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		device := create("labeled", map[string]string{"batch": "old"})
+		store.DeleteDevice(device.ID, datastore.DeleteOptions{})
+		if _, err := store.PurgeDeleted(time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("PurgeDeleted: %v", err)
+		}
+		devices, _, err := store.ListDevices(datastore.DeviceFilter{Labels: datastore.LabelSelector{req("batch", datastore.LabelExists)}}, datastore.ListOptions{IncludeDeleted: true})
+		if err != nil || len(devices) != 0 {
+			t.Errorf("ListDevices after purge = %v, %v; want none", deviceNames(devices), err)
+		}
+	})
+
+	_, err := store.CreateDevice(&models.Device{Name: "bad", Labels: map[string]string{"-bad": "x"}})
+	expectError(t, "CreateDevice with a malformed label key", err, datastore.ErrInvalid)
+	_, err = store.CreateDevice(&models.Device{Name: "bad", Labels: map[string]string{"ok": "not ok"}})
+	expectError(t, "CreateDevice with a malformed label value", err, datastore.ErrInvalid)
+	_, err = store.RelabelDevices(datastore.DeviceFilter{}, datastore.LabelChange{Set: map[string]string{"Example.com/x": "y"}})
+	expectError(t, "RelabelDevices with a malformed label key", err, datastore.ErrInvalid)
+	for _, selector := range []datastore.LabelSelector{
+		{req("bad key", datastore.LabelExists)},
+		{req("env", datastore.LabelIn)},
+		{req("env", datastore.LabelNotIn, "a b")},
+		{req("env", "~")},
+	} {
+		_, _, err := store.ListDevices(datastore.DeviceFilter{Labels: selector}, datastore.ListOptions{})
+		expectError(t, fmt.Sprintf("ListDevices selected by %v", selector), err, datastore.ErrInvalidLabelSelector)
+	}
+}
+
+func testPatch(t *testing.T, store datastore.Datastore) {
+	device, err := store.CreateDevice(&models.Device{Name: "node-1", Status: "active",
+		Properties: map[string]interface{}{"memoryGiB": 512.0, "bmc": map[string]interface{}{"firmware": "1.0"}}})
+	if err != nil {
+		t.Fatalf("CreateDevice: %v", err)
+	}
+	merge := func(doc string) datastore.Patch {
+		return datastore.Patch{Type: datastore.MergePatch, Document: []byte(doc)}
+	}
+	jsonPatch := func(doc string) datastore.Patch {
+		return datastore.Patch{Type: datastore.JSONPatch, Document: []byte(doc)}
+	}
+	opts := datastore.PatchOptions{Actor: "tester"}
+
+	patched, err := store.PatchDevice(device.ID, merge(`{"status":"failed","properties":{"bmc":{"firmware":"2.0"}}}`), opts)
+	if err != nil {
+		t.Fatalf("PatchDevice with a merge patch: %v", err)
+	}
+	if patched.Status != "failed" || patched.Properties["memoryGiB"] != 512.0 ||
+		patched.Properties["bmc"].(map[string]interface{})["firmware"] != "2.0" || patched.ResourceVersion != 2 {
+		t.Errorf("merge-patched device = %+v, want status failed and firmware 2.0 at version 2, memory kept", patched)
+	}
+	events, _, _ := store.ListEventsByDeviceID(device.ID, datastore.ListOptions{})
+	if len(events) != 1 || events[0].Type != datastore.EventTypeDeviceUpdated || *events[0].Data.Actor != "tester" {
+		t.Fatalf("events after patch = %v, want one updated event by tester", eventTypes(events))
+	}
+	if before, after := events[0].Data.StateBefore, events[0].Data.StateAfter; len(before) != 2 || len(after) != 2 ||
+		before["status"] != "active" || after["status"] != "failed" || after["properties"] == nil {
+		t.Errorf("updated event states = %v -> %v, want status and properties only", before, after)
+	}
+
+	patched, err = store.PatchDevice(device.ID, jsonPatch(`[
+		{"op":"test","path":"/status","value":"failed"},
+		{"op":"replace","path":"/status","value":"active"},
+		{"op":"add","path":"/labels","value":{"rack":"r1"}},
+		{"op":"remove","path":"/properties/bmc"}
+	]`), datastore.PatchOptions{ResourceVersion: 2, Actor: "tester"})
+	if err != nil {
+		t.Fatalf("PatchDevice with a JSON patch: %v", err)
+	}
+	if patched.Status != "active" || patched.Labels["rack"] != "r1" || patched.Properties["bmc"] != nil || patched.Properties["memoryGiB"] != 512.0 {
+		t.Errorf("JSON-patched device = %+v", patched)
+	}
+	if stored, _ := store.GetDeviceByID(device.ID); stored.ResourceVersion != 3 || stored.Labels["rack"] != "r1" {
+		t.Errorf("stored device = %+v, want the patch at version 3", stored)
+	}
+
+	// A patch that changes nothing keeps the version and records nothing.
+	if patched, err := store.PatchDevice(device.ID, merge(`{"status":"active","resourceVersion":99}`), opts); err != nil || patched.ResourceVersion != 3 {
+		t.Errorf("no-op PatchDevice = version %v, %v; want version 3", patched, err)
+	}
+	if events, _, _ := store.ListEventsByDeviceID(device.ID, datastore.ListOptions{}); len(events) != 2 {
+		t.Errorf("events after no-op patch = %v, want two updates", eventTypes(events))
+	}
+
+	_, err = store.PatchDevice(device.ID, merge(`{"status":"failed"}`), datastore.PatchOptions{ResourceVersion: 1})
+	expectError(t, "PatchDevice at a stale version", err, datastore.ErrPreconditionFailed)
+	_, err = store.PatchDevice(device.ID, jsonPatch(`[{"op":"test","path":"/status","value":"failed"}]`), opts)
+	expectError(t, "PatchDevice with a failing test", err, datastore.ErrPatchConflict)
+	_, err = store.PatchDevice(device.ID, jsonPatch(`[{"op":"remove","path":"/hostname"}]`), opts)
+	expectError(t, "PatchDevice removing a missing member", err, datastore.ErrPatchConflict)
+	_, err = store.PatchDevice(device.ID, jsonPatch(`[{"op":"frobnicate","path":"/status"}]`), opts)
+	expectError(t, "PatchDevice with an unknown op", err, datastore.ErrInvalidPatch)
+	_, err = store.PatchDevice(device.ID, merge(`["status"]`), opts)
+	expectError(t, "PatchDevice with a non-object merge patch", err, datastore.ErrInvalidPatch)
+	for _, doc := range []string{`{"id":"other"}`, `{"createdAt":"2020-01-01T00:00:00Z"}`, `{"name":null}`, `{"name":7}`, `{"colour":"red"}`} {
+		_, err = store.PatchDevice(device.ID, merge(doc), opts)
+		expectError(t, "PatchDevice with "+doc, err, datastore.ErrInvalid)
+	}
+	createDevice(t, store, "node-2")
+	_, err = store.PatchDevice(device.ID, merge(`{"name":"node-2"}`), opts)
+	expectError(t, "PatchDevice to a duplicate name", err, datastore.ErrAlreadyExists)
+	_, err = store.PatchDevice("missing", merge(`{}`), opts)
+	expectError(t, "PatchDevice of a missing device", err, datastore.ErrNotFound)
+	if stored, _ := store.GetDeviceByID(device.ID); stored.ResourceVersion != 3 || stored.Name != "node-1" {
+		t.Errorf("device after rejected patches = %+v, want it unchanged at version 3", stored)
+	}
+
+	createLocation(t, store, "slot-1")
+	location, err := store.PatchLocation("slot-1", merge(`{"name":"Slot 1","properties":{"row":3}}`), opts)
+	if err != nil || location.Name != "Slot 1" || location.Properties["row"] != 3.0 || location.LocationType != "node_slot" {
+		t.Fatalf("PatchLocation = %+v, %v", location, err)
+	}
+	events, _, _ = store.ListEventsByLocationID("slot-1", datastore.ListOptions{})
+	if len(events) != 1 || events[0].Type != datastore.EventTypeLocationUpdated || events[0].Data.StateAfter["name"] != "Slot 1" {
+		t.Errorf("location events = %v, want one updated event", eventTypes(events))
+	}
+	_, err = store.PatchLocation("slot-1", jsonPatch(`[{"op":"replace","path":"/id","value":"slot-2"}]`), opts)
+	expectError(t, "PatchLocation changing the ID", err, datastore.ErrInvalid)
+}
+
+func testBatch(t *testing.T, store datastore.Datastore) {
+	existing := createDevice(t, store, "node-1")
+	doomed := createDevice(t, store, "node-2")
+	update := *existing
+	update.Status = "failed"
+	devices, err := store.ApplyDeviceBatch([]datastore.DeviceOperation{
+		{Op: datastore.BatchCreate, Device: &models.Device{Name: "node-3"}},
+		{Op: datastore.BatchUpdate, ID: existing.ID, Device: &update},
+		{Op: datastore.BatchDelete, ID: doomed.ID},
+	})
+	if err != nil {
+		t.Fatalf("ApplyDeviceBatch: %v", err)
+	}
+	if len(devices) != 3 || devices[0].ID == "" || devices[0].ResourceVersion != 1 ||
+		devices[1].Status != "failed" || devices[1].ResourceVersion != 2 || devices[2] != nil {
+		t.Fatalf("ApplyDeviceBatch results = %+v", devices)
+	}
+	if _, err := store.GetDeviceByID(doomed.ID); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetDeviceByID of the deleted device: got error %v, want ErrNotFound", err)
+	}
+
+	// A failure anywhere leaves the store as it was.
+	tests := []struct {
+		name  string
+		ops   []datastore.DeviceOperation
+		index int
+		kind  error
+	}{
+		{"Missing", []datastore.DeviceOperation{
+			{Op: datastore.BatchCreate, Device: &models.Device{Name: "node-4"}},
+			{Op: datastore.BatchDelete, ID: "missing"},
+		}, 1, datastore.ErrNotFound},
+		{"DuplicateWithinBatch", []datastore.DeviceOperation{
+			{Op: datastore.BatchCreate, Device: &models.Device{Name: "node-4"}},
+			{Op: datastore.BatchCreate, Device: &models.Device{Name: "node-4"}},
+		}, 1, datastore.ErrAlreadyExists},
+		{"StaleVersion", []datastore.DeviceOperation{
+			{Op: datastore.BatchCreate, Device: &models.Device{Name: "node-4"}},
+			{Op: datastore.BatchUpdate, ID: existing.ID, Device: &models.Device{Name: "node-1", ResourceVersion: 1}},
+		}, 1, datastore.ErrPreconditionFailed},
+		{"Invalid", []datastore.DeviceOperation{
+			{Op: datastore.BatchCreate, Device: &models.Device{Name: "node-4"}},
+			{Op: datastore.BatchCreate, Device: &models.Device{}},
+		}, 1, datastore.ErrInvalid},
+		{"UnknownOp", []datastore.DeviceOperation{{Op: "upsert", ID: existing.ID}}, 0, datastore.ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := store.ApplyDeviceBatch(tt.ops)
+			var batchErr *datastore.BatchError
+			if !errors.As(err, &batchErr) || batchErr.Index != tt.index {
+				t.Fatalf("ApplyDeviceBatch: got error %v, want a failure of operation %d", err, tt.index)
+			}
+			expectError(t, "ApplyDeviceBatch", err, tt.kind)
+			if _, err := store.GetDeviceByName("node-4"); !errors.Is(err, datastore.ErrNotFound) {
+				t.Errorf("GetDeviceByName(node-4) after the failed batch: got error %v, want ErrNotFound", err)
+			}
+		})
+	}
+
+	// Later operations see the records earlier ones created.
+	parentID := "rack-1"
+	locations, err := store.ApplyLocationBatch([]datastore.LocationOperation{
+		{Op: datastore.BatchCreate, Location: &models.Location{ID: parentID, Name: "Rack 1"}},
+		{Op: datastore.BatchCreate, Location: &models.Location{ID: "slot-1", Name: "Slot 1", ParentLocationID: &parentID}},
+		{Op: datastore.BatchDelete, ID: "slot-1"},
+	})
+	if err != nil || len(locations) != 3 || locations[1].ID != "slot-1" || locations[2] != nil {
+		t.Fatalf("ApplyLocationBatch = %+v, %v", locations, err)
+	}
+	_, err = store.ApplyLocationBatch([]datastore.LocationOperation{
+		{Op: datastore.BatchUpdate, ID: parentID, Location: &models.Location{ID: parentID, Name: "Rack One"}},
+		{Op: datastore.BatchCreate, Location: &models.Location{ID: parentID, Name: "Rack 2"}},
+	})
+	expectError(t, "ApplyLocationBatch creating an existing location", err, datastore.ErrAlreadyExists)
+	if rack, _ := store.GetLocationByID(parentID); rack.Name != "Rack 1" {
+		t.Errorf("location after the failed batch = %+v, want it unchanged", rack)
+	}
+
+	// An update writes the location it names, whatever ID its record holds.
+	createLocation(t, store, "rack-2")
+	locations, err = store.ApplyLocationBatch([]datastore.LocationOperation{
+		{Op: datastore.BatchUpdate, ID: parentID, Location: &models.Location{Name: "Rack One"}},
+		{Op: datastore.BatchUpdate, ID: parentID, Location: &models.Location{ID: "rack-2", Name: "Rack Uno"}},
+	})
+	if err != nil || len(locations) != 2 || locations[0].ID != parentID || locations[1].ID != parentID {
+		t.Fatalf("ApplyLocationBatch updating by ID = %+v, %v", locations, err)
+	}
+	if rack, _ := store.GetLocationByID(parentID); rack.Name != "Rack Uno" {
+		t.Errorf("updated location = %+v, want it renamed", rack)
+	}
+	if other, _ := store.GetLocationByID("rack-2"); other.Name != "rack-2" {
+		t.Errorf("location named in the record = %+v, want it unchanged", other)
+	}
+}
+
+func testTransaction(t *testing.T, store datastore.Datastore) {
+	createLocation(t, store, "slot-1")
+	old := createDevice(t, store, "node-1")
+	if _, _, err := store.InstallDevice("slot-1", old.ID, "tester"); err != nil {
+		t.Fatalf("InstallDevice: %v", err)
+	}
+	failOld := datastore.Patch{Type: datastore.MergePatch, Document: []byte(`{"status":"failed"}`)}
+	replace := func(oldVersion int64) []datastore.TxOperation {
+		return []datastore.TxOperation{
+			{Op: datastore.TxCreateDevice, Ref: "new", Device: &models.Device{Name: "node-2"}},
+			{Op: datastore.TxRemoveDevice, LocationID: "slot-1"},
+			{Op: datastore.TxInstallDevice, DeviceID: "$new", LocationID: "slot-1"},
+			{Op: datastore.TxPatchDevice, ID: old.ID, Patch: failOld, ResourceVersion: oldVersion},
+		}
+	}
+
+	// The old device is at version 3 once it has been removed, not 2.
+	_, err := store.ApplyTransaction(replace(2), "tester")
+	var batchErr *datastore.BatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 3 || !errors.Is(err, datastore.ErrPreconditionFailed) {
+		t.Fatalf("ApplyTransaction with a stale version: got error %v, want a failed precondition of operation 3", err)
+	}
+	if slot, _ := store.GetLocationByID("slot-1"); slot.CurrentDeviceID == nil || *slot.CurrentDeviceID != old.ID {
+		t.Errorf("slot after the failed transaction = %+v, want it to still hold %s", slot, old.ID)
+	}
+	if _, err := store.GetDeviceByName("node-2"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetDeviceByName(node-2) after the failed transaction: got error %v, want ErrNotFound", err)
+	}
+	if events, _, _ := store.ListEventsByLocationID("slot-1", datastore.ListOptions{}); len(events) != 1 {
+		t.Errorf("slot events after the failed transaction = %v, want only the first install", eventTypes(events))
+	}
+
+	results, err := store.ApplyTransaction(replace(3), "tester")
+	if err != nil {
+		t.Fatalf("ApplyTransaction: %v", err)
+	}
+	newID := results[0].Device.ID
+	if len(results) != 4 || results[2].Event == nil || results[2].Event.Type != datastore.EventTypeDeviceInstalled ||
+		*results[2].Event.Data.DeviceID != newID || results[3].Device.Status != "failed" {
+		t.Fatalf("ApplyTransaction results = %+v", results)
+	}
+	if slot, _ := store.GetLocationByID("slot-1"); slot.CurrentDeviceID == nil || *slot.CurrentDeviceID != newID {
+		t.Errorf("slot after the transaction = %+v, want it to hold %s", slot, newID)
+	}
+	if device, _ := store.GetDeviceByID(old.ID); device.Status != "failed" || device.CurrentLocationID != nil {
+		t.Errorf("old device after the transaction = %+v, want it failed and uninstalled", device)
+	}
+	events, _, _ := store.ListEventsByLocationID("slot-1", datastore.ListOptions{})
+	want := strings.Join([]string{datastore.EventTypeDeviceInstalled, datastore.EventTypeDeviceRemoved, datastore.EventTypeDeviceInstalled}, ",")
+	if got := strings.Join(eventTypes(events), ","); got != want {
+		t.Errorf("slot events = %v, want %v", got, want)
+	}
+
+	parentID := "$rack"
+	results, err = store.ApplyTransaction([]datastore.TxOperation{
+		{Op: datastore.TxCreateLocation, Ref: "rack", Location: &models.Location{ID: "rack-1", Name: "Rack 1"}},
+		{Op: datastore.TxCreateLocation, Location: &models.Location{ID: "slot-2", Name: "Slot 2", ParentLocationID: &parentID}},
+		{Op: datastore.TxDeleteDevice, ID: old.ID},
+	}, "tester")
+	if err != nil || results[1].Location.ParentLocationID == nil || *results[1].Location.ParentLocationID != "rack-1" {
+		t.Fatalf("ApplyTransaction with a location ref = %+v, %v", results, err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		ops  []datastore.TxOperation
+	}{
+		{"UnknownRef", []datastore.TxOperation{{Op: datastore.TxRemoveDevice, LocationID: "$missing"}}},
+		{"RefOnUpdate", []datastore.TxOperation{{Op: datastore.TxDeleteLocation, Ref: "x", ID: "slot-2"}}},
+		{"DuplicateRef", []datastore.TxOperation{
+			{Op: datastore.TxCreateDevice, Ref: "a", Device: &models.Device{Name: "node-3"}},
+			{Op: datastore.TxCreateDevice, Ref: "a", Device: &models.Device{Name: "node-4"}},
+		}},
+		{"UnknownOp", []datastore.TxOperation{{Op: "reboot", ID: newID}}},
+		{"MissingRecord", []datastore.TxOperation{{Op: datastore.TxUpdateDevice, ID: newID}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := store.ApplyTransaction(tt.ops, "tester")
+			expectError(t, "ApplyTransaction", err, datastore.ErrInvalid)
+		})
+	}
+	if _, err := store.GetDeviceByName("node-3"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetDeviceByName(node-3) after the failed transaction: got error %v, want ErrNotFound", err)
+	}
+
+	// An update writes the location it names, whatever ID its record holds.
+	results, err = store.ApplyTransaction([]datastore.TxOperation{
+		{Op: datastore.TxUpdateLocation, ID: "slot-2", Location: &models.Location{Name: "Slot Two", ParentLocationID: &parentID}},
+		{Op: datastore.TxUpdateLocation, ID: "rack-1", Location: &models.Location{ID: "rack-9", Name: "Rack One"}},
+	}, "tester")
+	if err != nil || results[0].Location.ID != "slot-2" || results[1].Location.ID != "rack-1" {
+		t.Fatalf("ApplyTransaction updating by ID = %+v, %v", results, err)
+	}
+	if rack, _ := store.GetLocationByID("rack-1"); rack.Name != "Rack One" {
+		t.Errorf("updated location = %+v, want it renamed", rack)
+	}
+	if _, err := store.GetLocationByID("rack-9"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetLocationByID(rack-9) after the update: got error %v, want ErrNotFound", err)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, store datastore.Datastore) {
+	expiresAt := time.Now().Add(time.Hour)
+	record := datastore.IdempotencyRecord{Key: "key-1", Fingerprint: "POST /devices abc", ExpiresAt: expiresAt}
+	if existing, err := store.ReserveIdempotencyKey(record); err != nil || existing != nil {
+		t.Fatalf("ReserveIdempotencyKey of a new key = %+v, %v; want it reserved", existing, err)
+	}
+	existing, err := store.ReserveIdempotencyKey(datastore.IdempotencyRecord{Key: "key-1", Fingerprint: "other", ExpiresAt: expiresAt})
+	if err != nil || existing == nil || existing.Fingerprint != record.Fingerprint || existing.Status != 0 {
+		t.Fatalf("ReserveIdempotencyKey of a reserved key = %+v, %v; want the pending reservation", existing, err)
+	}
+
+	record.Status = 201
+	record.Header = map[string][]string{"Content-Type": {"application/json"}, "Etag": {`"1"`}}
+	record.Body = []byte(`{"id":"x"}`)
+	if err := store.CompleteIdempotencyKey(record); err != nil {
+		t.Fatalf("CompleteIdempotencyKey: %v", err)
+	}
+	existing, err = store.ReserveIdempotencyKey(record)
+	if err != nil || existing == nil || existing.Status != 201 || string(existing.Body) != `{"id":"x"}` ||
+		existing.Header["Etag"][0] != `"1"` || existing.ExpiresAt.Sub(expiresAt).Abs() > time.Millisecond {
+		t.Errorf("ReserveIdempotencyKey of a completed key = %+v, %v; want the stored response", existing, err)
+	}
+
+	if err := store.ReleaseIdempotencyKey("key-1"); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+	if existing, err := store.ReserveIdempotencyKey(record); err != nil || existing != nil {
+		t.Errorf("ReserveIdempotencyKey of a released key = %+v, %v; want it reserved", existing, err)
+	}
+	if err := store.ReleaseIdempotencyKey("missing"); err != nil {
+		t.Errorf("ReleaseIdempotencyKey of a missing key: %v", err)
+	}
+
+	expired := datastore.IdempotencyRecord{Key: "key-2", Fingerprint: "a", ExpiresAt: time.Now().Add(-time.Minute)}
+	if existing, err := store.ReserveIdempotencyKey(expired); err != nil || existing != nil {
+		t.Fatalf("ReserveIdempotencyKey of an expiring key = %+v, %v", existing, err)
+	}
+	if existing, err := store.ReserveIdempotencyKey(datastore.IdempotencyRecord{Key: "key-2", Fingerprint: "b", ExpiresAt: expiresAt}); err != nil || existing != nil {
+		t.Errorf("ReserveIdempotencyKey of an expired key = %+v, %v; want it reserved again", existing, err)
+	}
+}
+
+// createChildDevice creates a device whose parent is parentID.
+func createChildDevice(t *testing.T, store datastore.Datastore, name, parentID string) *models.Device {
+	t.Helper()
+	device, err := store.CreateDevice(&models.Device{Name: name, ParentDeviceID: &parentID})
+	if err != nil {
+		t.Fatalf("CreateDevice(%s): %v", name, err)
+	}
+	return device
+}
+
+// createChildLocation creates a location whose parent is parentID.
+func createChildLocation(t *testing.T, store datastore.Datastore, id, parentID string) {
+	t.Helper()
+	if _, err := store.CreateLocation(&models.Location{ID: id, Name: id, ParentLocationID: &parentID}); err != nil {
+		t.Fatalf("CreateLocation(%s): %v", id, err)
+	}
+}
+
+// deletedDevice returns the stored device with id, deleted or not.
+func deletedDevice(t *testing.T, store datastore.Datastore, id string) *models.Device {
+	t.Helper()
+	devices, _, _ := store.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{IncludeDeleted: true})
+	for i := range devices {
+		if devices[i].ID == id {
+			return &devices[i]
+		}
+	}
+	t.Fatalf("device %s is gone", id)
+	return nil
+}
+
+func testDeleteDeviceReferences(t *testing.T, store datastore.Datastore) {
+	createLocation(t, store, "slot-1")
+	blade := createDevice(t, store, "blade")
+	node := createChildDevice(t, store, "node", blade.ID)
+	dimm := createChildDevice(t, store, "dimm", node.ID)
+	if _, _, err := store.InstallDevice("slot-1", blade.ID, "tester"); err != nil {
+		t.Fatalf("InstallDevice: %v", err)
+	}
+	if blade, _ = store.GetDeviceByID(blade.ID); strings.Join(blade.ChildrenDeviceIDs, ",") != node.ID {
+		t.Fatalf("parent lists children %v, want %s", blade.ChildrenDeviceIDs, node.ID)
+	}
+
+	err := store.DeleteDevice(blade.ID, datastore.DeleteOptions{})
+	expectError(t, "DeleteDevice of an installed parent", err, datastore.ErrStillReferenced)
+	expectError(t, "DeleteDevice of an installed parent", err, datastore.ErrConflict)
+	expectError(t, "DeleteDevice of a parent", store.DeleteDevice(node.ID, datastore.DeleteOptions{}), datastore.ErrStillReferenced)
+	if got, _ := store.GetDeviceByID(node.ID); got == nil || got.DeletedAt != nil {
+		t.Fatalf("a refused delete changed the device")
+	}
+
+	// A leaf can go, and leaves its parent's list of children.
+	if err := store.DeleteDevice(dimm.ID, datastore.DeleteOptions{Actor: "tester"}); err != nil {
+		t.Fatalf("DeleteDevice of a leaf: %v", err)
+	}
+
+	if err := store.DeleteDevice(node.ID, datastore.DeleteOptions{Actor: "tester", Cascade: datastore.CascadeDetach}); err != nil {
+		t.Fatalf("DeleteDevice with detach: %v", err)
+	}
+	if got, _ := store.GetDeviceByID(blade.ID); len(got.ChildrenDeviceIDs) != 0 {
+		t.Errorf("parent still lists the deleted child: %v", got.ChildrenDeviceIDs)
+	}
+
+	if err := store.DeleteDevice(blade.ID, datastore.DeleteOptions{Actor: "tester", Cascade: datastore.CascadeDetach}); err != nil {
+		t.Fatalf("DeleteDevice of an installed device with detach: %v", err)
+	}
+	if slot, _ := store.GetLocationByID("slot-1"); slot.CurrentDeviceID != nil || slot.Status != "empty" {
+		t.Errorf("location after deleting its device = %+v, want it empty", slot)
+	}
+	if got := deletedDevice(t, store, blade.ID); got.CurrentLocationID != nil {
+		t.Errorf("deleted device still points at %s", *got.CurrentLocationID)
+	}
+	events, _, _ := store.ListEventsByDeviceID(blade.ID, datastore.ListOptions{})
+	types := map[string]bool{}
+	for _, event := range events {
+		types[event.Type] = true
+	}
+	if !types[datastore.EventTypeDeviceRemoved] || !types[datastore.EventTypeDeviceDeleted] {
+		t.Errorf("events of the deleted device = %v, want removed and deleted", eventTypes(events))
+	}
+
+	t.Run("Detach", func(t *testing.T) {
+		parent := createDevice(t, store, "chassis")
+		child := createChildDevice(t, store, "psu", parent.ID)
+		if err := store.DeleteDevice(parent.ID, datastore.DeleteOptions{Actor: "tester", Cascade: datastore.CascadeDetach}); err != nil {
+			t.Fatalf("DeleteDevice with detach: %v", err)
+		}
+		got, err := store.GetDeviceByID(child.ID)
+		if err != nil || got.ParentDeviceID != nil || got.ResourceVersion != 2 {
+			t.Fatalf("detached child = %+v, %v; want it live without a parent at version 2", got, err)
+		}
+		events, _, _ := store.ListEventsByDeviceID(child.ID, datastore.ListOptions{})
+		if len(events) != 1 || events[0].Type != datastore.EventTypeDeviceDetached || events[0].Data.StateBefore["parentDeviceId"] != parent.ID {
+			t.Errorf("child events = %+v, want one detached event naming the parent", events)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		createLocation(t, store, "slot-2")
+		root := createDevice(t, store, "root")
+		child := createChildDevice(t, store, "child", root.ID)
+		grandchild := createChildDevice(t, store, "grandchild", child.ID)
+		if _, _, err := store.InstallDevice("slot-2", grandchild.ID, "tester"); err != nil {
+			t.Fatalf("InstallDevice: %v", err)
+		}
+		if err := store.DeleteDevice(root.ID, datastore.DeleteOptions{Actor: "tester", Cascade: datastore.CascadeDelete}); err != nil {
+			t.Fatalf("DeleteDevice with delete: %v", err)
+		}
+		for _, id := range []string{root.ID, child.ID, grandchild.ID} {
+			if got := deletedDevice(t, store, id); got.DeletedAt == nil {
+				t.Errorf("device %s survived the cascade", got.Name)
+			}
+		}
+		if slot, _ := store.GetLocationByID("slot-2"); slot.CurrentDeviceID != nil {
+			t.Errorf("location still holds the cascaded device")
+		}
+	})
+
+	t.Run("ParentCycle", func(t *testing.T) {
+		a := createDevice(t, store, "cycle-a")
+		b := createChildDevice(t, store, "cycle-b", a.ID)
+		a.ParentDeviceID = &b.ID
+		a.ResourceVersion = 0
+		if _, err := store.UpdateDevice(a.ID, a, "tester"); err != nil {
+			// Backends that reject cycles outright have nothing to cascade.
+			return
+		}
+		if err := store.DeleteDevice(a.ID, datastore.DeleteOptions{Cascade: datastore.CascadeDelete}); err != nil {
+			t.Fatalf("DeleteDevice of a cycle: %v", err)
+		}
+		if _, err := store.GetDeviceByID(b.ID); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("the rest of the cycle survived: %v", err)
+		}
+	})
+}
+
+func testDeleteLocationReferences(t *testing.T, store datastore.Datastore) {
+	device := createDevice(t, store, "node-1")
+	createLocation(t, store, "rack")
+	createChildLocation(t, store, "chassis", "rack")
+	createChildLocation(t, store, "slot", "chassis")
+	if _, _, err := store.InstallDevice("slot", device.ID, "tester"); err != nil {
+		t.Fatalf("InstallDevice: %v", err)
+	}
+
+	expectError(t, "DeleteLocation of an occupied location", store.DeleteLocation("slot", datastore.DeleteOptions{}), datastore.ErrStillReferenced)
+	expectError(t, "DeleteLocation of a parent", store.DeleteLocation("rack", datastore.DeleteOptions{}), datastore.ErrStillReferenced)
+
+	t.Run("Detach", func(t *testing.T) {
+		createLocation(t, store, "row")
+		createChildLocation(t, store, "row-rack", "row")
+		if err := store.DeleteLocation("row", datastore.DeleteOptions{Actor: "tester", Cascade: datastore.CascadeDetach}); err != nil {
+			t.Fatalf("DeleteLocation with detach: %v", err)
+		}
+		got, err := store.GetLocationByID("row-rack")
+		if err != nil || got.ParentLocationID != nil {
+			t.Fatalf("detached child = %+v, %v; want it live without a parent", got, err)
+		}
+		events, _, _ := store.ListEventsByLocationID("row-rack", datastore.ListOptions{})
+		if len(events) != 1 || events[0].Type != datastore.EventTypeLocationDetached {
+			t.Errorf("child events = %v, want one detached event", eventTypes(events))
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := store.DeleteLocation("rack", datastore.DeleteOptions{Actor: "tester", Cascade: datastore.CascadeDelete}); err != nil {
+			t.Fatalf("DeleteLocation with delete: %v", err)
+		}
+		for _, id := range []string{"rack", "chassis", "slot"} {
+			if _, err := store.GetLocationByID(id); !errors.Is(err, datastore.ErrNotFound) {
+				t.Errorf("location %s survived the cascade: %v", id, err)
+			}
+		}
+		got, err := store.GetDeviceByID(device.ID)
+		if err != nil || got.CurrentLocationID != nil {
+			t.Errorf("device in the deleted slot = %+v, %v; want it live and uninstalled", got, err)
+		}
+		events, _, _ := store.ListEventsByLocationID("slot", datastore.ListOptions{})
+		if types := eventTypes(events); len(types) != 3 {
+			t.Errorf("slot events = %v, want installed, removed and deleted", types)
+		}
+	})
+}
+
+func testLocationTree(t *testing.T, store datastore.Datastore) {
+	createLocation(t, store, "site")
+	createChildLocation(t, store, "row-2", "site")
+	createChildLocation(t, store, "row-1", "site")
+	createChildLocation(t, store, "rack", "row-1")
+	createChildLocation(t, store, "slot", "rack")
+	createChildLocation(t, store, "gone", "row-1")
+	if err := store.DeleteLocation("gone", datastore.DeleteOptions{}); err != nil {
+		t.Fatalf("DeleteLocation: %v", err)
+	}
+	node := createDevice(t, store, "node")
+	dimm := createChildDevice(t, store, "dimm", node.ID)
+	if _, _, err := store.InstallDevice("slot", node.ID, "tester"); err != nil {
+		t.Fatalf("InstallDevice: %v", err)
+	}
+
+	tree, err := store.GetLocationTree("site", datastore.TreeOptions{Depth: -1})
+	if err != nil {
+		t.Fatalf("GetLocationTree: %v", err)
+	}
+	if len(tree.Children) != 2 || tree.Children[0].ID != "row-1" || tree.Children[1].ID != "row-2" {
+		t.Fatalf("site children = %+v, want row-1 and row-2", tree.Children)
+	}
+	row := tree.Children[0]
+	if len(row.Children) != 1 || row.Children[0].ID != "rack" {
+		t.Fatalf("row-1 children = %+v, want only the live rack", row.Children)
+	}
+	slot := row.Children[0].Children
+	if len(slot) != 1 || slot[0].Device == nil || slot[0].Device.ID != node.ID {
+		t.Fatalf("slot = %+v, want it to hold %s", slot, node.ID)
+	}
+	if len(slot[0].Device.Children) != 0 {
+		t.Errorf("child devices included without being asked for: %+v", slot[0].Device.Children)
+	}
+
+	tree, err = store.GetLocationTree("rack", datastore.TreeOptions{Depth: -1, IncludeChildDevices: true})
+	if err != nil {
+		t.Fatalf("GetLocationTree with child devices: %v", err)
+	}
+	if device := tree.Children[0].Device; device == nil || len(device.Children) != 1 || device.Children[0].ID != dimm.ID {
+		t.Errorf("installed device = %+v, want it to hold %s", device, dimm.ID)
+	}
+
+	tree, err = store.GetLocationTree("site", datastore.TreeOptions{Depth: 1})
+	if err != nil {
+		t.Fatalf("GetLocationTree to depth 1: %v", err)
+	}
+	if len(tree.Children) != 2 || len(tree.Children[0].Children) != 0 {
+		t.Errorf("tree to depth 1 = %+v, want only the rows", tree)
+	}
+	if tree, err = store.GetLocationTree("slot", datastore.TreeOptions{Depth: 0}); err != nil || tree.ID != "slot" || len(tree.Children) != 0 {
+		t.Errorf("tree of a leaf = %+v, %v; want the leaf alone", tree, err)
+	}
+
+	_, err = store.GetLocationTree("missing", datastore.TreeOptions{Depth: -1})
+	expectError(t, "GetLocationTree of a missing location", err, datastore.ErrNotFound)
+	_, err = store.GetLocationTree("gone", datastore.TreeOptions{Depth: -1})
+	expectError(t, "GetLocationTree of a deleted location", err, datastore.ErrNotFound)
+}
+
+func testChildrenLists(t *testing.T, store datastore.Datastore) {
+	createLocation(t, store, "rack-1")
+	createLocation(t, store, "rack-2")
+	createChildLocation(t, store, "slot-b", "rack-1")
+	createChildLocation(t, store, "slot-a", "rack-1")
+	children := func(id string) string {
+		t.Helper()
+		location, err := store.GetLocationByID(id)
+		if err != nil {
+			t.Fatalf("GetLocationByID(%s): %v", id, err)
+		}
+		return strings.Join(location.ChildrenLocationIDs, ",")
+	}
+	if got := children("rack-1"); got != "slot-a,slot-b" {
+		t.Fatalf("rack-1 children after creates = %q, want slot-a,slot-b", got)
+	}
+
+	// Moving a child updates both parents and records the move.
+	slot, _ := store.GetLocationByID("slot-a")
+	rack2 := "rack-2"
+	slot.ParentLocationID = &rack2
+	if _, err := store.UpdateLocation("slot-a", slot, "tester"); err != nil {
+		t.Fatalf("UpdateLocation moving a child: %v", err)
+	}
+	if got := children("rack-1"); got != "slot-b" {
+		t.Errorf("old parent children = %q, want slot-b", got)
+	}
+	if got := children("rack-2"); got != "slot-a" {
+		t.Errorf("new parent children = %q, want slot-a", got)
+	}
+	events, _, _ := store.ListEventsByLocationID("slot-a", datastore.ListOptions{})
+	if got := strings.Join(eventTypes(events), ","); got != datastore.EventTypeLocationDetached+","+datastore.EventTypeLocationAttached {
+		t.Errorf("moved child events = %s, want detached then attached", got)
+	}
+	for _, event := range events {
+		if event.Data.Actor == nil || *event.Data.Actor != "tester" {
+			t.Errorf("%s event of the move has actor %v, want tester", event.Type, event.Data.Actor)
+		}
+	}
+
+	// Deleting and restoring a child takes it off and back on the list.
+	if err := store.DeleteLocation("slot-b", datastore.DeleteOptions{}); err != nil {
+		t.Fatalf("DeleteLocation: %v", err)
+	}
+	if got := children("rack-1"); got != "" {
+		t.Errorf("children after delete = %q, want none", got)
+	}
+	if _, err := store.RestoreLocation("slot-b", "tester"); err != nil {
+		t.Fatalf("RestoreLocation: %v", err)
+	}
+	if got := children("rack-1"); got != "slot-b" {
+		t.Errorf("children after restore = %q, want slot-b", got)
+	}
+
+	// The lists cannot be written, but a record read back can be written
+	// back unchanged.
+	rack, _ := store.GetLocationByID("rack-1")
+	rack.ChildrenLocationIDs = []string{"slot-a"}
+	_, err := store.UpdateLocation("rack-1", rack, "tester")
+	expectError(t, "UpdateLocation changing children", err, datastore.ErrInvalid)
+	rack.ChildrenLocationIDs = []string{"slot-b"}
+	if _, err := store.UpdateLocation("rack-1", rack, "tester"); err != nil {
+		t.Errorf("UpdateLocation with unchanged children: %v", err)
+	}
+	_, err = store.CreateLocation(&models.Location{ID: "rack-3", Name: "rack-3", ChildrenLocationIDs: []string{"slot-a"}})
+	expectError(t, "CreateLocation with children", err, datastore.ErrInvalid)
+	_, err = store.PatchLocation("rack-2", datastore.Patch{Type: datastore.MergePatch, Document: []byte(`{"childrenLocationIds":[]}`)}, datastore.PatchOptions{})
+	expectError(t, "PatchLocation of children", err, datastore.ErrInvalid)
+
+	parent := createDevice(t, store, "parent")
+	child := createChildDevice(t, store, "child", parent.ID)
+	_, err = store.CreateDevice(&models.Device{Name: "stowaway", ChildrenDeviceIDs: []string{child.ID}})
+	expectError(t, "CreateDevice with children", err, datastore.ErrInvalid)
+	_, err = store.PatchDevice(child.ID, datastore.Patch{Type: datastore.MergePatch, Document: []byte(`{"parentDeviceId":null}`)}, datastore.PatchOptions{Actor: "tester"})
+	if err != nil {
+		t.Fatalf("PatchDevice detaching a child: %v", err)
+	}
+	if got, _ := store.GetDeviceByID(parent.ID); len(got.ChildrenDeviceIDs) != 0 {
+		t.Errorf("parent still lists the detached child: %v", got.ChildrenDeviceIDs)
+	}
+	events, _, _ = store.ListEventsByDeviceID(child.ID, datastore.ListOptions{})
+	if got := strings.Join(eventTypes(events), ","); got != datastore.EventTypeDeviceDetached+","+datastore.EventTypeDeviceUpdated {
+		t.Errorf("detached child events = %s, want detached and updated", got)
+	}
+	for _, event := range events {
+		if event.Data.Actor == nil || *event.Data.Actor != "tester" {
+			t.Errorf("%s event of the patch has actor %v, want tester", event.Type, event.Data.Actor)
+		}
+	}
+}
+
+func testParentValidation(t *testing.T, store datastore.Datastore) {
+	// expectParentError checks that err rejects the parent field.
+	expectParentError := func(op string, err error, field string) {
+		t.Helper()
+		var validation *datastore.ValidationError
+		if !errors.As(err, &validation) || len(validation.Fields) != 1 || validation.Fields[0].Field != field {
+			t.Errorf("%s: got error %v, want a validation error for %s", op, err, field)
+		}
+	}
+	missing := "missing"
+	_, err := store.CreateLocation(&models.Location{ID: "orphan", Name: "orphan", ParentLocationID: &missing})
+	expectParentError("CreateLocation under a missing parent", err, "parentLocationId")
+	self := "self"
+	_, err = store.CreateLocation(&models.Location{ID: "self", Name: "self", ParentLocationID: &self})
+	expectParentError("CreateLocation under itself", err, "parentLocationId")
+	_, err = store.CreateDevice(&models.Device{Name: "orphan", ParentDeviceID: &missing})
+	expectParentError("CreateDevice under a missing parent", err, "parentDeviceId")
+
+	createLocation(t, store, "row")
+	createChildLocation(t, store, "rack", "row")
+	createChildLocation(t, store, "slot", "rack")
+	row, _ := store.GetLocationByID("row")
+	slot := "slot"
+	row.ParentLocationID = &slot
+	_, err = store.UpdateLocation("row", row, "tester")
+	expectParentError("UpdateLocation under its descendant", err, "parentLocationId")
+	_, err = store.PatchLocation("rack", datastore.Patch{Type: datastore.MergePatch, Document: []byte(`{"parentLocationId":"rack"}`)}, datastore.PatchOptions{})
+	expectParentError("PatchLocation under itself", err, "parentLocationId")
+
+	node := createDevice(t, store, "node")
+	dimm := createChildDevice(t, store, "dimm", node.ID)
+	node.ParentDeviceID = &dimm.ID
+	node.ResourceVersion = 0
+	_, err = store.UpdateDevice(node.ID, node, "tester")
+	expectParentError("UpdateDevice under its child", err, "parentDeviceId")
+	if got, _ := store.GetDeviceByID(node.ID); got.ParentDeviceID != nil {
+		t.Errorf("a rejected update changed the parent to %s", *got.ParentDeviceID)
+	}
+
+	// Moving a record elsewhere in the hierarchy is fine.
+	createLocation(t, store, "row-2")
+	rack, _ := store.GetLocationByID("rack")
+	row2 := "row-2"
+	rack.ParentLocationID = &row2
+	if _, err := store.UpdateLocation("rack", rack, "tester"); err != nil {
+		t.Errorf("UpdateLocation to another parent: %v", err)
+	}
+
+	// A child cannot come back before its parent does.
+	if err := store.DeleteDevice(node.ID, datastore.DeleteOptions{Cascade: datastore.CascadeDelete}); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	_, err = store.RestoreDevice(dimm.ID, "tester")
+	expectParentError("RestoreDevice under a deleted parent", err, "parentDeviceId")
+	if _, err := store.RestoreDevice(node.ID, "tester"); err != nil {
+		t.Fatalf("RestoreDevice of the parent: %v", err)
+	}
+	if _, err := store.RestoreDevice(dimm.ID, "tester"); err != nil {
+		t.Errorf("RestoreDevice under a restored parent: %v", err)
+	}
+	if err := store.DeleteLocation("row-2", datastore.DeleteOptions{Cascade: datastore.CascadeDelete}); err != nil {
+		t.Fatalf("DeleteLocation: %v", err)
+	}
+	_, err = store.RestoreLocation("slot", "tester")
+	expectParentError("RestoreLocation under a deleted parent", err, "parentLocationId")
+	if _, err := store.GetLocationByID("slot"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("GetLocationByID(slot) after the rejected restore: got error %v, want ErrNotFound", err)
+	}
+}
+
+func testLocationPaths(t *testing.T, store datastore.Datastore) {
+	createLocation(t, store, "site-a")
+	createChildLocation(t, store, "row-3", "site-a")
+	createChildLocation(t, store, "x1000", "row-3")
+	createChildLocation(t, store, "c2", "x1000")
+
+	ancestors, err := store.GetLocationAncestors("c2")
+	if err != nil {
+		t.Fatalf("GetLocationAncestors: %v", err)
+	}
+	var ids []string
+	for _, ancestor := range ancestors {
+		ids = append(ids, ancestor.ID)
+	}
+	if got := strings.Join(ids, ","); got != "site-a,row-3,x1000" {
+		t.Errorf("got ancestors %s, want site-a,row-3,x1000", got)
+	}
+	if ancestors, err := store.GetLocationAncestors("site-a"); err != nil || len(ancestors) != 0 {
+		t.Errorf("got ancestors %v and error %v for a root, want none", ancestors, err)
+	}
+	_, err = store.GetLocationAncestors("missing")
+	expectError(t, "GetLocationAncestors of a missing location", err, datastore.ErrNotFound)
+
+	location, err := store.GetLocationByPath([]string{"site-a", "row-3", "x1000", "c2"})
+	if err != nil || location.ID != "c2" {
+		t.Errorf("GetLocationByPath: got %v and error %v, want c2", location, err)
+	}
+	_, err = store.GetLocationByPath([]string{"row-3"})
+	expectError(t, "GetLocationByPath not starting at a root", err, datastore.ErrNotFound)
+	_, err = store.GetLocationByPath([]string{"site-a", "x1000"})
+	expectError(t, "GetLocationByPath skipping a level", err, datastore.ErrNotFound)
+
+	paths, err := store.LocationPaths([]string{"site-a", "c2", "missing"})
+	if err != nil {
+		t.Fatalf("LocationPaths: %v", err)
+	}
+	want := map[string]string{"site-a": "site-a", "c2": "site-a/row-3/x1000/c2"}
+	if !maps.Equal(paths, want) {
+		t.Errorf("got paths %v, want %v", paths, want)
+	}
+
+	// Paths follow renames and moves.
+	row, _ := store.GetLocationByID("row-3")
+	row.Name = "row-4"
+	row.ParentLocationID = nil
+	if _, err := store.UpdateLocation("row-3", row, "tester"); err != nil {
+		t.Fatalf("UpdateLocation: %v", err)
+	}
+	if paths, _ := store.LocationPaths([]string{"c2"}); paths["c2"] != "row-4/x1000/c2" {
+		t.Errorf("got path %q after a move, want row-4/x1000/c2", paths["c2"])
+	}
+}
+
+func testLocationDevices(t *testing.T, store datastore.Datastore) {
+	createLocation(t, store, "rack")
+	createChildLocation(t, store, "chassis", "rack")
+	createChildLocation(t, store, "slot-1", "chassis")
+	createChildLocation(t, store, "slot-2", "chassis")
+	switchDevice := createDevice(t, store, "switch")
+	node1 := createDevice(t, store, "node-1")
+	node2 := createDevice(t, store, "node-2")
+	dimm := createChildDevice(t, store, "dimm", node1.ID)
+	createDevice(t, store, "spare")
+	for location, device := range map[string]string{"chassis": switchDevice.ID, "slot-1": node1.ID, "slot-2": node2.ID} {
+		if _, _, err := store.InstallDevice(location, device, "tester"); err != nil {
+			t.Fatalf("InstallDevice(%s): %v", location, err)
+		}
+	}
+
+	cases := []struct {
+		name      string
+		id        string
+		recursive bool
+		filter    datastore.DeviceFilter
+		want      []string
+	}{
+		{"Location", "slot-1", false, datastore.DeviceFilter{}, []string{node1.ID, dimm.ID}},
+		{"Subtree", "rack", true, datastore.DeviceFilter{}, []string{switchDevice.ID, node1.ID, node2.ID, dimm.ID}},
+		{"EmptyLocation", "rack", false, datastore.DeviceFilter{}, nil},
+		{"Filtered", "rack", true, datastore.DeviceFilter{ParentDeviceID: node1.ID}, []string{dimm.ID}},
+	}
+	for _, tc := range cases {
+		devices, page, err := store.ListLocationDevices(tc.id, tc.recursive, tc.filter, datastore.ListOptions{})
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		got := deviceIDs(devices)
+		if len(got) != len(tc.want) || page.Total != len(tc.want) {
+			t.Errorf("%s: got %d devices of %d, want %d", tc.name, len(devices), page.Total, len(tc.want))
+		}
+		for _, id := range tc.want {
+			if !got[id] {
+				t.Errorf("%s: missing device %s", tc.name, id)
+			}
+		}
+	}
+
+	devices, page, err := store.ListLocationDevices("rack", true, datastore.DeviceFilter{}, datastore.ListOptions{Limit: 3})
+	if err != nil || len(devices) != 3 || page.Next == "" {
+		t.Fatalf("first page: got %d devices, next %q and error %v", len(devices), page.Next, err)
+	}
+	rest, page, err := store.ListLocationDevices("rack", true, datastore.DeviceFilter{}, datastore.ListOptions{Limit: 3, After: page.Next})
+	if err != nil || len(rest) != 1 || page.Next != "" {
+		t.Errorf("second page: got %d devices, next %q and error %v", len(rest), page.Next, err)
+	}
+
+	_, _, err = store.ListLocationDevices("missing", true, datastore.DeviceFilter{}, datastore.ListOptions{})
+	expectError(t, "ListLocationDevices of a missing location", err, datastore.ErrNotFound)
+}
+
+func testConcurrentInstalls(t *testing.T, store datastore.Datastore) {
+	createLocation(t, store, "slot-1")
+	const workers = 8
+	devices := make([]*models.Device, workers)
+	for i := range devices {
+		devices[i] = createDevice(t, store, "node-"+string(rune('a'+i)))
+	}
+
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for _, device := range devices {
+		wg.Add(1)
+		go func(deviceID string) {
+			defer wg.Done()
+			_, _, err := store.InstallDevice("slot-1", deviceID, "tester")
+			errs <- err
+		}(device.ID)
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, datastore.ErrLocationOccupied):
+			t.Errorf("concurrent InstallDevice: unexpected error %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d concurrent installs into one location succeeded, want 1", succeeded)
+	}
+	installed := 0
+	for _, device := range devices {
+		if got, _ := store.GetDeviceByID(device.ID); got.CurrentLocationID != nil {
+			installed++
+		}
+	}
+	if installed != 1 {
+		t.Errorf("%d devices point at the location, want 1", installed)
+	}
+}
+
+func testConcurrentReparents(t *testing.T, store datastore.Datastore) {
+	// Two moves in opposite directions would each pass the check on their
+	// own; together they would form a cycle, so one of them must fail.
+	const rounds = 10
+	for round := 0; round < rounds; round++ {
+		suffix := "-" + string(rune('a'+round))
+		a := createDevice(t, store, "node-a"+suffix)
+		b := createDevice(t, store, "node-b"+suffix)
+		c := createLocation(t, store, "row-c"+suffix)
+		d := createLocation(t, store, "row-d"+suffix)
+
+		errs := make(chan error, 4)
+		var wg sync.WaitGroup
+		for _, pair := range [][2]*models.Device{{a, b}, {b, a}} {
+			wg.Add(1)
+			go func(child, parent *models.Device) {
+				defer wg.Done()
+				update := *child
+				update.ResourceVersion = 0
+				update.ParentDeviceID = &parent.ID
+				_, err := store.UpdateDevice(child.ID, &update, "tester")
+				errs <- err
+			}(pair[0], pair[1])
+		}
+		for _, pair := range [][2]*models.Location{{c, d}, {d, c}} {
+			wg.Add(1)
+			go func(child, parent *models.Location) {
+				defer wg.Done()
+				update := *child
+				update.ResourceVersion = 0
+				update.ParentLocationID = &parent.ID
+				_, err := store.UpdateLocation(child.ID, &update, "tester")
+				errs <- err
+			}(pair[0], pair[1])
+		}
+		wg.Wait()
+		close(errs)
+		succeeded := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				succeeded++
+			case !errors.Is(err, datastore.ErrInvalid):
+				t.Errorf("concurrent reparent: unexpected error %v", err)
+			}
+		}
+		if succeeded != 2 {
+			t.Errorf("round %d: %d of 4 opposing reparents succeeded, want 2", round, succeeded)
+		}
+
+		gotA, _ := store.GetDeviceByID(a.ID)
+		gotB, _ := store.GetDeviceByID(b.ID)
+		if gotA.ParentDeviceID != nil && gotB.ParentDeviceID != nil {
+			t.Fatalf("round %d: devices %s and %s are each other's parent", round, a.ID, b.ID)
+		}
+		gotC, _ := store.GetLocationByID(c.ID)
+		gotD, _ := store.GetLocationByID(d.ID)
+		if gotC.ParentLocationID != nil && gotD.ParentLocationID != nil {
+			t.Fatalf("round %d: locations %s and %s are each other's parent", round, c.ID, d.ID)
+		}
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, store datastore.Datastore) {
+	device := createDevice(t, store, "node-1")
+	const workers = 8
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			update := *device
+			update.ResourceVersion = 1
+			_, err := store.UpdateDevice(device.ID, &update, "tester")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, datastore.ErrPreconditionFailed):
+			t.Errorf("concurrent UpdateDevice: unexpected error %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d concurrent updates from version 1 succeeded, want 1", succeeded)
+	}
+	if got, _ := store.GetDeviceByID(device.ID); got.ResourceVersion != 2 {
+		t.Errorf("device is at version %d, want 2", got.ResourceVersion)
+	}
+}
+
+func testConcurrentCreates(t *testing.T, store datastore.Datastore) {
+	const workers = 8
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.CreateDevice(&models.Device{Name: "node-1"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, datastore.ErrAlreadyExists):
+			t.Errorf("concurrent CreateDevice: unexpected error %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d concurrent creates of one name succeeded, want 1", succeeded)
+	}
+}
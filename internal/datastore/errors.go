@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kinds of failure shared by every Datastore backend. Errors returned by the
+// datastore match one of them with errors.Is, so callers can react to the
+// kind of failure without parsing messages.
+var (
+	// ErrNotFound means the requested record does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists means a record with the same ID, or the same value of
+	// another unique field, is already stored.
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrConflict means the write is incompatible with the current state of
+	// the stored records.
+	ErrConflict = errors.New("conflict")
+	// ErrInvalid means the record or request is malformed.
+	ErrInvalid = errors.New("invalid")
+	// ErrPreconditionFailed means a conditional write expected a different
+	// resource version than the one stored.
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// Conflicts reported by the composite install and remove operations and by
+// deletes. Each also matches ErrConflict; backends wrap them with the IDs
+// involved.
+var (
+	// ErrLocationOccupied means a device cannot be installed because the
+	// location already holds one.
+	ErrLocationOccupied = errorf(ErrConflict, "location is already occupied")
+	// ErrLocationEmpty means there is no device to remove from the location.
+	ErrLocationEmpty = errorf(ErrConflict, "location is already empty")
+	// ErrDeviceInstalled means the device is already installed in another
+	// location and must be removed from it first.
+	ErrDeviceInstalled = errorf(ErrConflict, "device is already installed in another location")
+	// ErrStillReferenced means a device or location cannot be deleted without
+	// a cascade policy because other records refer to it.
+	ErrStillReferenced = errorf(ErrConflict, "still referenced by other records")
+	// ErrInvalidCursor means a list was asked to continue after a cursor it
+	// did not issue.
+	ErrInvalidCursor = errorf(ErrInvalid, "malformed page cursor")
+	// ErrInvalidSort means a list was asked to sort by a field it cannot be
+	// sorted by.
+	ErrInvalidSort = errorf(ErrInvalid, "unsupported sort field")
+	// ErrInvalidFilter means a filter expression refers to an unknown field
+	// or compares a field with a literal it cannot hold.
+	ErrInvalidFilter = errorf(ErrInvalid, "invalid filter expression")
+	// ErrInvalidLabelSelector means a label selector has a malformed key or
+	// value, or an operator without the values it needs.
+	ErrInvalidLabelSelector = errorf(ErrInvalid, "invalid label selector")
+	// ErrInvalidPatch means a patch document is malformed.
+	ErrInvalidPatch = errorf(ErrInvalid, "malformed patch")
+	// ErrPatchConflict means a patch does not fit the record it is applied
+	// to: a JSON Patch refers to a missing member or one of its tests fails.
+	ErrPatchConflict = errorf(ErrConflict, "patch does not apply")
+)
+
+// kindError is an error message classified as one of the kinds above.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+func (e *kindError) Unwrap() error { return e.kind }
+
+// errorf formats an error message that matches kind with errors.Is.
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// versionMismatch reports a failed resource version precondition.
+func versionMismatch(kind, id string, want, got int64) error {
+	return errorf(ErrPreconditionFailed, "%s %s is at resource version %d, not %d", kind, id, got, want)
+}
+
+// DuplicateError reports a write that would give a record the same unique
+// field as another live record. It matches ErrAlreadyExists.
+type DuplicateError struct {
+	// Kind is "device" or "location".
+	Kind string
+	// Field names the unique field or fields, such as "name".
+	Field string
+	Value string
+	// ConflictingID is the ID of the record already holding Value.
+	ConflictingID string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("%s %s %q is already used by %s %s", e.Kind, e.Field, e.Value, e.Kind, e.ConflictingID)
+}
+
+func (e *DuplicateError) Unwrap() error { return ErrAlreadyExists }
+
+// BatchError reports the operation that made a batch fail. It matches the
+// error of that operation.
+type BatchError struct {
+	// Index is the position of the failed operation in the batch.
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string { return fmt.Sprintf("operation %d: %v", e.Index, e.Err) }
+func (e *BatchError) Unwrap() error { return e.Err }
+
+// stillReferenced reports the references that block deleting a record.
+func stillReferenced(kind, id string, installedID *string, children []string) error {
+	var refs []string
+	if installedID != nil {
+		if kind == "device" {
+			refs = append(refs, "installed in location "+*installedID)
+		} else {
+			refs = append(refs, "holds device "+*installedID)
+		}
+	}
+	if len(children) > 0 {
+		refs = append(refs, fmt.Sprintf("parent of %s %s", kind+"s", strings.Join(children, ", ")))
+	}
+	return fmt.Errorf("%s %s is %s; delete it with cascade=detach or cascade=delete: %w",
+		kind, id, strings.Join(refs, " and "), ErrStillReferenced)
+}
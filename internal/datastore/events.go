@@ -0,0 +1,67 @@
+package datastore
+
+import "github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+
+// Event types recorded by the datastore itself as part of the operation that
+// caused them.
+const (
+	EventTypeDeviceInstalled  = "com.openchami.inventory.device.installed"
+	EventTypeDeviceRemoved    = "com.openchami.inventory.device.removed"
+	EventTypeDeviceDeleted    = "com.openchami.inventory.device.deleted"
+	EventTypeDeviceRestored   = "com.openchami.inventory.device.restored"
+	EventTypeDeviceAttached   = "com.openchami.inventory.device.attached"
+	EventTypeDeviceDetached   = "com.openchami.inventory.device.detached"
+	EventTypeDeviceUpdated    = "com.openchami.inventory.device.updated"
+	EventTypeLocationDeleted  = "com.openchami.inventory.location.deleted"
+	EventTypeLocationRestored = "com.openchami.inventory.location.restored"
+	EventTypeLocationAttached = "com.openchami.inventory.location.attached"
+	EventTypeLocationDetached = "com.openchami.inventory.location.detached"
+	EventTypeLocationUpdated  = "com.openchami.inventory.location.updated"
+)
+
+// eventSource is the CloudEvents source of every event the service records.
+const eventSource = "/inventory/v1/api"
+
+// newEvent builds an event of eventType about a device, a location or both,
+// attributed to actor. ID and Time are assigned when the event is stored.
+func newEvent(eventType, actor string, deviceID, locationID *string) *models.Event {
+	return &models.Event{
+		Source:      eventSource,
+		SpecVersion: "1.0",
+		Type:        eventType,
+		Data: models.EventData{
+			DeviceID:   deviceID,
+			LocationID: locationID,
+			Actor:      &actor,
+		},
+	}
+}
+
+// newUpdatedEvent builds the event recorded when a patch changes a device or
+// location. Its states hold the changed fields before and after.
+func newUpdatedEvent(eventType, actor string, deviceID, locationID *string, before, after map[string]interface{}) *models.Event {
+	event := newEvent(eventType, actor, deviceID, locationID)
+	event.Data.StateBefore = before
+	event.Data.StateAfter = after
+	return event
+}
+
+// newDetachedEvent builds the event recorded when a device or location loses
+// its parent, because the parent is deleted or the child moved elsewhere.
+// parentField names the cleared field, which the event's states show before
+// and after.
+func newDetachedEvent(eventType, actor string, deviceID, locationID *string, parentField, parentID string) *models.Event {
+	event := newEvent(eventType, actor, deviceID, locationID)
+	event.Data.StateBefore = map[string]interface{}{parentField: parentID}
+	event.Data.StateAfter = map[string]interface{}{parentField: nil}
+	return event
+}
+
+// newAttachedEvent builds the event recorded when a device or location gets
+// a parent, as newDetachedEvent does for losing one.
+func newAttachedEvent(eventType, actor string, deviceID, locationID *string, parentField, parentID string) *models.Event {
+	event := newEvent(eventType, actor, deviceID, locationID)
+	event.Data.StateBefore = map[string]interface{}{parentField: nil}
+	event.Data.StateAfter = map[string]interface{}{parentField: parentID}
+	return event
+}
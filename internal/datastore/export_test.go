@@ -0,0 +1,17 @@
+package datastore
+
+// SetDeviceLocation lets the conformance suite set up a device whose
+// current location disagrees with the locations.
+func (s *MemoryStore) SetDeviceLocation(deviceID string, locationID *string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device := cloneDevice(s.devices[deviceID])
+	device.CurrentLocationID = locationID
+	return s.commit(putDevice(device))
+}
+
+// SetDeviceLocation is MemoryStore.SetDeviceLocation for the SQL stores.
+func (s *sqlStore) SetDeviceLocation(deviceID string, locationID *string) error {
+	_, err := s.db.Exec(`UPDATE devices SET current_location_id = $2 WHERE id = $1`, deviceID, locationID)
+	return err
+}
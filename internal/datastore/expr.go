@@ -0,0 +1,254 @@
+package datastore
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// Expr is a filter expression over the fields of a device or location. The
+// service parses them from the filter query parameter.
+//
+// A Comparison is false when the field is missing or holds a value of
+// another type than the literal, so that "properties.memoryGiB > 512" skips
+// devices without that property or with a string in it. Comparing with nil
+// tests for a missing or null value instead.
+type Expr interface {
+	isExpr()
+}
+
+// AndExpr matches records that match both operands.
+type AndExpr struct{ Left, Right Expr }
+
+// OrExpr matches records that match either operand.
+type OrExpr struct{ Left, Right Expr }
+
+// NotExpr matches records that do not match its operand.
+type NotExpr struct{ Expr Expr }
+
+// Comparison compares a field with a literal. Field is a field's JSON name,
+// or "properties." followed by the dot-separated path of a property. Value
+// is a string, float64, bool or nil; only strings and numbers are ordered.
+type Comparison struct {
+	Field string
+	Op    CompareOp
+	Value any
+}
+
+func (AndExpr) isExpr()    {}
+func (OrExpr) isExpr()     {}
+func (NotExpr) isExpr()    {}
+func (Comparison) isExpr() {}
+
+// CompareOp is the operator of a Comparison.
+type CompareOp string
+
+const (
+	OpEqual          CompareOp = "=="
+	OpNotEqual       CompareOp = "!="
+	OpLess           CompareOp = "<"
+	OpLessOrEqual    CompareOp = "<="
+	OpGreater        CompareOp = ">"
+	OpGreaterOrEqual CompareOp = ">="
+)
+
+// propertiesPrefix starts the fields that refer into Properties.
+const propertiesPrefix = "properties."
+
+// filterField is a scalar string field of T that expressions can test.
+type filterField[T any] struct {
+	column string
+	value  func(*T) *string
+}
+
+// filterable lists the fields of T that expressions can test.
+type filterable[T any] struct {
+	fields     map[string]filterField[T]
+	properties func(*T) map[string]interface{}
+}
+
+var deviceFields = filterable[models.Device]{
+	fields: map[string]filterField[models.Device]{
+		"id":                {"id", func(d *models.Device) *string { return &d.ID }},
+		"name":              {"name", func(d *models.Device) *string { return &d.Name }},
+		"hostname":          {"hostname", func(d *models.Device) *string { return d.Hostname }},
+		"componentType":     {"component_type", func(d *models.Device) *string { return &d.ComponentType }},
+		"manufacturer":      {"manufacturer", func(d *models.Device) *string { return &d.Manufacturer }},
+		"partNumber":        {"part_number", func(d *models.Device) *string { return &d.PartNumber }},
+		"serialNumber":      {"serial_number", func(d *models.Device) *string { return &d.SerialNumber }},
+		"status":            {"status", func(d *models.Device) *string { return &d.Status }},
+		"currentLocationId": {"current_location_id", func(d *models.Device) *string { return d.CurrentLocationID }},
+		"parentDeviceId":    {"parent_device_id", func(d *models.Device) *string { return d.ParentDeviceID }},
+	},
+	properties: func(d *models.Device) map[string]interface{} { return d.Properties },
+}
+
+var locationFields = filterable[models.Location]{
+	fields: map[string]filterField[models.Location]{
+		"id":               {"id", func(l *models.Location) *string { return &l.ID }},
+		"name":             {"name", func(l *models.Location) *string { return &l.Name }},
+		"locationType":     {"location_type", func(l *models.Location) *string { return &l.LocationType }},
+		"status":           {"status", func(l *models.Location) *string { return &l.Status }},
+		"parentLocationId": {"parent_location_id", func(l *models.Location) *string { return l.ParentLocationID }},
+		"currentDeviceId":  {"current_device_id", func(l *models.Location) *string { return l.CurrentDeviceID }},
+	},
+	properties: func(l *models.Location) map[string]interface{} { return l.Properties },
+}
+
+// check rejects expressions that refer to unknown fields or compare a field
+// with a literal it can never match.
+func (f filterable[T]) check(expr Expr) error {
+	switch e := expr.(type) {
+	case nil:
+		return nil
+	case AndExpr:
+		if err := f.check(e.Left); err != nil {
+			return err
+		}
+		return f.check(e.Right)
+	case OrExpr:
+		if err := f.check(e.Left); err != nil {
+			return err
+		}
+		return f.check(e.Right)
+	case NotExpr:
+		return f.check(e.Expr)
+	case Comparison:
+		return f.checkComparison(e)
+	default:
+		return fmt.Errorf("%w: unsupported expression %T", ErrInvalidFilter, expr)
+	}
+}
+
+func (f filterable[T]) checkComparison(c Comparison) error {
+	switch c.Value.(type) {
+	case string, float64:
+	case bool, nil:
+		if c.Op != OpEqual && c.Op != OpNotEqual {
+			return fmt.Errorf("%w: %s only compares strings and numbers, got %v", ErrInvalidFilter, c.Op, c.Value)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported literal %v", ErrInvalidFilter, c.Value)
+	}
+	if path, ok := strings.CutPrefix(c.Field, propertiesPrefix); ok {
+		for _, key := range strings.Split(path, ".") {
+			if key == "" {
+				return fmt.Errorf("%w: malformed property path %q", ErrInvalidFilter, c.Field)
+			}
+		}
+		return nil
+	}
+	if _, ok := f.fields[c.Field]; !ok {
+		return fmt.Errorf("%w: unknown field %q", ErrInvalidFilter, c.Field)
+	}
+	switch c.Value.(type) {
+	case string, nil:
+		return nil
+	}
+	return fmt.Errorf("%w: %s holds strings, not %v", ErrInvalidFilter, c.Field, c.Value)
+}
+
+// matches evaluates expr against record. The expression must have passed
+// check.
+func (f filterable[T]) matches(expr Expr, record *T) bool {
+	switch e := expr.(type) {
+	case nil:
+		return true
+	case AndExpr:
+		return f.matches(e.Left, record) && f.matches(e.Right, record)
+	case OrExpr:
+		return f.matches(e.Left, record) || f.matches(e.Right, record)
+	case NotExpr:
+		return !f.matches(e.Expr, record)
+	case Comparison:
+		return compareValue(f.value(e.Field, record), e.Op, e.Value)
+	}
+	return false
+}
+
+// value returns the value of field in record, nil if it is missing.
+func (f filterable[T]) value(field string, record *T) any {
+	path, ok := strings.CutPrefix(field, propertiesPrefix)
+	if !ok {
+		if value := f.fields[field].value(record); value != nil {
+			return *value
+		}
+		return nil
+	}
+	var value any = f.properties(record)
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// compareValue applies op to a field value and a literal.
+func compareValue(value any, op CompareOp, literal any) bool {
+	if literal == nil {
+		return (value == nil) == (op == OpEqual)
+	}
+	if number, ok := toFloat(value); ok {
+		value = number
+	}
+	var c int
+	switch v := value.(type) {
+	case string:
+		l, ok := literal.(string)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(v, l)
+	case float64:
+		l, ok := literal.(float64)
+		if !ok {
+			return false
+		}
+		c = cmp.Compare(v, l)
+	case bool:
+		l, ok := literal.(bool)
+		if !ok {
+			return false
+		}
+		return (v == l) == (op == OpEqual)
+	default:
+		return false
+	}
+	switch op {
+	case OpEqual:
+		return c == 0
+	case OpNotEqual:
+		return c != 0
+	case OpLess:
+		return c < 0
+	case OpLessOrEqual:
+		return c <= 0
+	case OpGreater:
+		return c > 0
+	case OpGreaterOrEqual:
+		return c >= 0
+	}
+	return false
+}
+
+// toFloat converts the numbers a property can hold to float64.
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// DeviceFilter selects the devices ListDevices returns. Empty fields match
+// every device; the others must equal the device's field exactly.
+type DeviceFilter struct {
+	ComponentType     string
+	Manufacturer      string
+	PartNumber        string
+	Status            string
+	CurrentLocationID string
+	ParentDeviceID    string
+	// Labels, if set, must also match.
+	Labels LabelSelector
+	// Expr, if set, must also match.
+	Expr Expr
+}
+
+// check rejects filters with a malformed label selector or expression.
+func (f DeviceFilter) check() error {
+	if err := f.Labels.check(); err != nil {
+		return err
+	}
+	return deviceFields.check(f.Expr)
+}
+
+func (f DeviceFilter) matches(device *models.Device) bool {
+	return matchField(f.ComponentType, device.ComponentType) &&
+		matchField(f.Manufacturer, device.Manufacturer) &&
+		matchField(f.PartNumber, device.PartNumber) &&
+		matchField(f.Status, device.Status) &&
+		matchPtrField(f.CurrentLocationID, device.CurrentLocationID) &&
+		matchPtrField(f.ParentDeviceID, device.ParentDeviceID) &&
+		f.Labels.matches(device.Labels) &&
+		deviceFields.matches(f.Expr, device)
+}
+
+// LocationFilter selects the locations ListLocations returns. Empty fields
+// match every location; the others must equal the location's field exactly.
+type LocationFilter struct {
+	LocationType     string
+	Status           string
+	ParentLocationID string
+	// Labels, if set, must also match.
+	Labels LabelSelector
+	// Expr, if set, must also match.
+	Expr Expr
+}
+
+func (f LocationFilter) check() error {
+	if err := f.Labels.check(); err != nil {
+		return err
+	}
+	return locationFields.check(f.Expr)
+}
+
+func (f LocationFilter) matches(location *models.Location) bool {
+	return matchField(f.LocationType, location.LocationType) &&
+		matchField(f.Status, location.Status) &&
+		matchPtrField(f.ParentLocationID, location.ParentLocationID) &&
+		f.Labels.matches(location.Labels) &&
+		locationFields.matches(f.Expr, location)
+}
+
+// EventFilter selects the events ListEvents returns. Empty fields match
+// every event. Since and Until bound the event time to [Since, Until); a
+// zero time leaves that end open.
+type EventFilter struct {
+	Type       string
+	Actor      string
+	DeviceID   string
+	LocationID string
+	Since      time.Time
+	Until      time.Time
+}
+
+func (f EventFilter) matches(event *models.Event) bool {
+	return matchField(f.Type, event.Type) &&
+		matchPtrField(f.Actor, event.Data.Actor) &&
+		matchPtrField(f.DeviceID, event.Data.DeviceID) &&
+		matchPtrField(f.LocationID, event.Data.LocationID) &&
+		(f.Since.IsZero() || !event.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || event.Time.Before(f.Until))
+}
+
+func matchField(want, value string) bool {
+	return want == "" || want == value
+}
+
+func matchPtrField(want string, value *string) bool {
+	return want == "" || (value != nil && *value == want)
+}
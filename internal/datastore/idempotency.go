@@ -0,0 +1,33 @@
+package datastore
+
+import (
+	"maps"
+	"slices"
+	"time"
+)
+
+// IdempotencyRecord remembers a request sent with an idempotency key, and
+// the response to it, so that a retry of the request gets the same response
+// instead of repeating the write.
+type IdempotencyRecord struct {
+	Key string `json:"key"`
+	// Fingerprint identifies the request the key was first used with.
+	Fingerprint string `json:"fingerprint"`
+	// Status, Header and Body are the response. Status is zero while the
+	// first request is still being handled, and ExpiresAt then ends its
+	// lease on the key rather than the time the response is kept.
+	Status    int                 `json:"status,omitempty"`
+	Header    map[string][]string `json:"header,omitempty"`
+	Body      []byte              `json:"body,omitempty"`
+	ExpiresAt time.Time           `json:"expiresAt"`
+}
+
+func cloneIdempotencyRecord(record *IdempotencyRecord) *IdempotencyRecord {
+	clone := *record
+	clone.Header = maps.Clone(record.Header)
+	for name, values := range clone.Header {
+		clone.Header[name] = slices.Clone(values)
+	}
+	clone.Body = slices.Clone(record.Body)
+	return &clone
+}
@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+)
+
+// LabelSelector selects records by their labels, as Kubernetes label
+// selectors do. A record matches when it meets every requirement.
+type LabelSelector []LabelRequirement
+
+// LabelRequirement is one condition of a LabelSelector.
+type LabelRequirement struct {
+	Key string
+	Op  LabelOp
+	// Values are the values In and NotIn compare with.
+	Values []string
+}
+
+// LabelOp is the operator of a LabelRequirement.
+type LabelOp string
+
+const (
+	// LabelIn requires the label to be set to one of the values.
+	LabelIn LabelOp = "in"
+	// LabelNotIn requires the label to be unset or set to none of the values.
+	LabelNotIn LabelOp = "notin"
+	// LabelExists requires the label to be set.
+	LabelExists LabelOp = "exists"
+	// LabelDoesNotExist requires the label to be unset.
+	LabelDoesNotExist LabelOp = "!"
+)
+
+// LabelChange is a relabeling: it sets the labels in Set and then removes
+// those in Remove.
+type LabelChange struct {
+	Set    map[string]string
+	Remove []string
+}
+
+var (
+	labelNamePattern   = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	labelPrefixPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// checkLabelKey enforces the Kubernetes syntax for label keys: a name of at
+// most 63 characters, optionally preceded by a DNS subdomain and a slash.
+func checkLabelKey(key string) error {
+	name := key
+	if prefix, rest, ok := strings.Cut(key, "/"); ok {
+		if len(prefix) > 253 || !labelPrefixPattern.MatchString(prefix) {
+			return fmt.Errorf("label key %q must have a DNS subdomain as prefix", key)
+		}
+		name = rest
+	}
+	if len(name) > 63 || !labelNamePattern.MatchString(name) {
+		return fmt.Errorf("label key %q must be at most 63 letters, digits, '-', '_' or '.', "+
+			"starting and ending with a letter or digit", key)
+	}
+	return nil
+}
+
+// checkLabelValue enforces the Kubernetes syntax for label values, which is
+// that of key names, or empty.
+func checkLabelValue(value string) error {
+	if value != "" && (len(value) > 63 || !labelNamePattern.MatchString(value)) {
+		return fmt.Errorf("label value %q must be empty or at most 63 letters, digits, '-', '_' or '.', "+
+			"starting and ending with a letter or digit", value)
+	}
+	return nil
+}
+
+// check rejects selectors with malformed keys or values, or with a
+// requirement its operator cannot evaluate.
+func (s LabelSelector) check() error {
+	for _, r := range s {
+		if err := checkLabelKey(r.Key); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidLabelSelector, err)
+		}
+		switch r.Op {
+		case LabelIn, LabelNotIn:
+			if len(r.Values) == 0 {
+				return fmt.Errorf("%w: %s %s needs at least one value", ErrInvalidLabelSelector, r.Key, r.Op)
+			}
+			for _, value := range r.Values {
+				if err := checkLabelValue(value); err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidLabelSelector, err)
+				}
+			}
+		case LabelExists, LabelDoesNotExist:
+		default:
+			return fmt.Errorf("%w: unsupported operator %q", ErrInvalidLabelSelector, r.Op)
+		}
+	}
+	return nil
+}
+
+func (s LabelSelector) matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, ok := labels[r.Key]
+		var match bool
+		switch r.Op {
+		case LabelIn:
+			match = ok && containsString(r.Values, value)
+		case LabelNotIn:
+			match = !ok || !containsString(r.Values, value)
+		case LabelExists:
+			match = ok
+		case LabelDoesNotExist:
+			match = !ok
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+func (c LabelChange) validate() error {
+	var errs fieldErrors
+	errs.labels("set", c.Set)
+	for _, key := range c.Remove {
+		if err := checkLabelKey(key); err != nil {
+			errs.add("remove", err.Error())
+		}
+	}
+	return errs.err()
+}
+
+// apply returns labels changed by c, and whether that differs from labels.
+func (c LabelChange) apply(labels map[string]string) (map[string]string, bool) {
+	changed := maps.Clone(labels)
+	if changed == nil {
+		changed = map[string]string{}
+	}
+	maps.Copy(changed, c.Set)
+	for _, key := range c.Remove {
+		delete(changed, key)
+	}
+	if len(changed) == 0 {
+		changed = nil
+	}
+	return changed, !maps.Equal(labels, changed)
+}
@@ -2,6 +2,10 @@ package datastore
 
 import (
 	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,169 +14,1200 @@ import (
 )
 
 // MemoryStore is an in-memory implementation of the Datastore interface.
+//
+// Records are copied on the way in and out, so callers never share memory
+// with the store. Every mutation is expressed as a list of memoryOps applied
+// by commit, which also appends them to the write-ahead log when persistence
+// is enabled.
 type MemoryStore struct {
 	mu        sync.RWMutex
 	devices   map[string]*models.Device
 	locations map[string]*models.Location
 	events    map[string]*models.Event
+	// idempotency holds the idempotency records by key.
+	idempotency map[string]*IdempotencyRecord
+
+	locationNameScope LocationNameScope
+
+	persistDir    string
+	snapshotEvery int
+	wal           *writeAheadLog
+	seq           uint64
+
+	// eventSeq is the highest event sequence number handed out.
+	eventSeq int64
+
+	// tx collects the ops of the transaction in progress, if any.
+	tx *memoryTx
+}
+
+var _ Datastore = (*MemoryStore)(nil)
+
+// MemoryStoreOption configures optional MemoryStore behaviour.
+type MemoryStoreOption func(*MemoryStore)
+
+// WithPersistence makes the store durable: every mutation is appended to a
+// write-ahead log in dir, which is periodically compacted into a snapshot.
+// Both are replayed when the store is created.
+func WithPersistence(dir string) MemoryStoreOption {
+	return func(s *MemoryStore) { s.persistDir = dir }
 }
 
-// NewMemoryStore creates and returns a new MemoryStore.
-func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{
-		devices:   make(map[string]*models.Device),
-		locations: make(map[string]*models.Location),
-		events:    make(map[string]*models.Event),
+// WithSnapshotEvery sets how many logged mutations trigger a new snapshot
+// and a fresh log. It has no effect without WithPersistence.
+func WithSnapshotEvery(n int) MemoryStoreOption {
+	return func(s *MemoryStore) { s.snapshotEvery = n }
+}
+
+// WithLocationNameScope sets among which locations a location name must be
+// unique. The default is LocationNamesGlobal.
+func WithLocationNameScope(scope LocationNameScope) MemoryStoreOption {
+	return func(s *MemoryStore) { s.locationNameScope = scope }
+}
+
+// NewMemoryStore creates and returns a new MemoryStore, restoring its
+// contents from disk when persistence is enabled.
+func NewMemoryStore(opts ...MemoryStoreOption) (*MemoryStore, error) {
+	s := &MemoryStore{
+		devices:       make(map[string]*models.Device),
+		locations:     make(map[string]*models.Location),
+		events:        make(map[string]*models.Event),
+		idempotency:   make(map[string]*IdempotencyRecord),
+		snapshotEvery: defaultSnapshotEvery,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.persistDir != "" {
+		if err := s.restore(); err != nil {
+			return nil, err
+		}
 	}
+	return s, nil
 }
 
 // --- Device Methods ---
 
 func (s *MemoryStore) CreateDevice(device *models.Device) (*models.Device, error) {
+	if err := validateDevice(device); err != nil {
+		return nil, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.createDevice(device)
+}
+
+// createDevice implements CreateDevice for a validated device. The caller
+// must hold the write lock.
+func (s *MemoryStore) createDevice(device *models.Device) (*models.Device, error) {
+	if err := checkChildren("childrenDeviceIds", device.ChildrenDeviceIDs, nil); err != nil {
+		return nil, err
+	}
 	device.ID = uuid.NewString()
+	device.ResourceVersion = 1
 	device.CreatedAt = time.Now()
-	s.devices[device.ID] = device
+	device.DeletedAt = nil
+	device.ChildrenDeviceIDs = nil
+	device.CurrentLocationID = nil
+	if err := checkParent("device", "parentDeviceId", device.ID, device.ParentDeviceID, s.deviceParent); err != nil {
+		return nil, err
+	}
+	if err := s.checkDeviceUnique(device); err != nil {
+		return nil, err
+	}
+	err := s.withTx(func() error {
+		if err := s.commit(putDevice(device)); err != nil {
+			return err
+		}
+		if device.ParentDeviceID != nil {
+			return s.refreshChildDevices(*device.ParentDeviceID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return device, nil
 }
 
 func (s *MemoryStore) GetDeviceByID(id string) (*models.Device, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	device, exists := s.devices[id]
+	device, exists := s.liveDevice(id)
 	if !exists {
-		return nil, fmt.Errorf("device with ID %s not found", id)
+		return nil, errorf(ErrNotFound, "device with ID %s not found", id)
 	}
-	return device, nil
+	return cloneDevice(device), nil
 }
 
 func (s *MemoryStore) GetDeviceByName(name string) (*models.Device, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	for _, device := range s.devices {
-		if device.Name == name {
-			return device, nil
+		if device.Name == name && device.DeletedAt == nil {
+			return cloneDevice(device), nil
 		}
 	}
-	return nil, fmt.Errorf("device with name '%s' not found", name)
+	return nil, errorf(ErrNotFound, "device with name '%s' not found", name)
 }
 
-func (s *MemoryStore) ListDevices() ([]models.Device, error) {
+func (s *MemoryStore) ListDevices(filter DeviceFilter, opts ListOptions) ([]models.Device, Page, error) {
+	if err := filter.check(); err != nil {
+		return nil, Page{}, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	allDevices := make([]models.Device, 0, len(s.devices))
 	for _, device := range s.devices {
-		allDevices = append(allDevices, *device)
+		if (device.DeletedAt != nil && !opts.IncludeDeleted) || !filter.matches(device) {
+			continue
+		}
+		allDevices = append(allDevices, *cloneDevice(device))
 	}
-	return allDevices, nil
+	return paginate(allDevices, opts, deviceOrder)
 }
 
-func (s *MemoryStore) UpdateDevice(id string, device *models.Device) (*models.Device, error) {
+func (s *MemoryStore) ListLocationDevices(id string, recursive bool, filter DeviceFilter, opts ListOptions) ([]models.Device, Page, error) {
+	if err := filter.check(); err != nil {
+		return nil, Page{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	root, exists := s.liveLocation(id)
+	if !exists {
+		return nil, Page{}, errorf(ErrNotFound, "location with ID %s not found", id)
+	}
+	locations := []*models.Location{root}
+	if recursive {
+		childLocations := map[string][]*models.Location{}
+		for _, location := range s.locations {
+			if location.DeletedAt == nil && location.ParentLocationID != nil {
+				childLocations[*location.ParentLocationID] = append(childLocations[*location.ParentLocationID], location)
+			}
+		}
+		seen := map[string]bool{id: true}
+		for i := 0; i < len(locations); i++ {
+			for _, child := range childLocations[locations[i].ID] {
+				if !seen[child.ID] {
+					seen[child.ID] = true
+					locations = append(locations, child)
+				}
+			}
+		}
+	}
+	var installed []*models.Device
+	for _, location := range locations {
+		if location.CurrentDeviceID != nil {
+			if device, ok := s.liveDevice(*location.CurrentDeviceID); ok {
+				installed = append(installed, device)
+			}
+		}
+	}
+	devices := []models.Device{}
+	for _, device := range append(installed, s.descendantDevices(installed)...) {
+		if filter.matches(device) {
+			devices = append(devices, *cloneDevice(device))
+		}
+	}
+	return paginate(devices, opts, deviceOrder)
+}
+
+func (s *MemoryStore) UpdateDevice(id string, device *models.Device, actor string) (*models.Device, error) {
+	if err := validateDevice(device); err != nil {
+		return nil, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	existingDevice, exists := s.devices[id]
+	return s.updateDevice(id, device, actor)
+}
+
+// updateDevice implements UpdateDevice for a validated device. The caller
+// must hold the write lock.
+func (s *MemoryStore) updateDevice(id string, device *models.Device, actor string) (*models.Device, error) {
+	existingDevice, exists := s.liveDevice(id)
 	if !exists {
-		return nil, fmt.Errorf("device with ID %s not found", id)
+		return nil, errorf(ErrNotFound, "device with ID %s not found", id)
+	}
+	if device.ResourceVersion != 0 && device.ResourceVersion != existingDevice.ResourceVersion {
+		return nil, versionMismatch("device", id, device.ResourceVersion, existingDevice.ResourceVersion)
+	}
+	if err := checkChildren("childrenDeviceIds", device.ChildrenDeviceIDs, existingDevice.ChildrenDeviceIDs); err != nil {
+		return nil, err
+	}
+	if !sameParent(device.ParentDeviceID, existingDevice.ParentDeviceID) {
+		if err := checkParent("device", "parentDeviceId", id, device.ParentDeviceID, s.deviceParent); err != nil {
+			return nil, err
+		}
 	}
 	// Preserve original creation time and ID
 	device.CreatedAt = existingDevice.CreatedAt
 	device.ID = id
+	device.ResourceVersion = existingDevice.ResourceVersion + 1
 	now := time.Now()
 	device.UpdatedAt = &now
-	s.devices[id] = device
+	device.DeletedAt = nil
+	device.ChildrenDeviceIDs = cloneStrings(existingDevice.ChildrenDeviceIDs)
+	device.CurrentLocationID = existingDevice.CurrentLocationID
+	if err := s.checkDeviceUnique(device); err != nil {
+		return nil, err
+	}
+	err := s.withTx(func() error {
+		if err := s.commit(putDevice(device)); err != nil {
+			return err
+		}
+		return s.reparentDevice(id, existingDevice.ParentDeviceID, device.ParentDeviceID, actor)
+	})
+	if err != nil {
+		return nil, err
+	}
 	return device, nil
 }
 
-func (s *MemoryStore) DeleteDevice(id string) error {
+func (s *MemoryStore) PatchDevice(id string, patch Patch, opts PatchOptions) (*models.Device, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, exists := s.devices[id]; !exists {
-		return fmt.Errorf("device with ID %s not found", id)
+	return s.patchDevice(id, patch, opts)
+}
+
+// patchDevice implements PatchDevice. The caller must hold the write lock.
+func (s *MemoryStore) patchDevice(id string, patch Patch, opts PatchOptions) (*models.Device, error) {
+	existing, exists := s.liveDevice(id)
+	if !exists {
+		return nil, errorf(ErrNotFound, "device with ID %s not found", id)
+	}
+	if opts.ResourceVersion != 0 && opts.ResourceVersion != existing.ResourceVersion {
+		return nil, versionMismatch("device", id, opts.ResourceVersion, existing.ResourceVersion)
+	}
+	patched, before, after, err := patchRecord(existing, patch)
+	if err != nil {
+		return nil, err
+	}
+	if len(after) == 0 {
+		return cloneDevice(existing), nil
+	}
+	if err := validateDevice(patched); err != nil {
+		return nil, err
+	}
+	var device *models.Device
+	err = s.withTx(func() error {
+		var err error
+		if device, err = s.updateDevice(id, patched, opts.Actor); err != nil {
+			return err
+		}
+		event := newUpdatedEvent(EventTypeDeviceUpdated, opts.Actor, &id, nil, before, after)
+		s.prepareEvent(event)
+		return s.commit(putEvent(event))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (s *MemoryStore) DeleteDevice(id string, opts DeleteOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.withTx(func() error { return s.deleteDevice(id, opts, map[string]bool{}) })
+}
+
+// deleteDevice soft-deletes a device after dealing with its installation and
+// child devices as opts.Cascade says, and drops it from its parent's list of
+// children. deleting holds the devices already being
+// deleted further up a cascade, which a cycle of parents would otherwise
+// revisit. The caller must hold the write lock and run it inside withTx.
+func (s *MemoryStore) deleteDevice(id string, opts DeleteOptions, deleting map[string]bool) error {
+	device, exists := s.liveDevice(id)
+	if !exists {
+		return errorf(ErrNotFound, "device with ID %s not found", id)
+	}
+	if opts.ResourceVersion != 0 && opts.ResourceVersion != device.ResourceVersion {
+		return versionMismatch("device", id, opts.ResourceVersion, device.ResourceVersion)
+	}
+	deleting[id] = true
+	children := s.childDevices(id, deleting)
+	if opts.Cascade == CascadeNone && (device.CurrentLocationID != nil || len(children) > 0) {
+		return stillReferenced("device", id, device.CurrentLocationID, children)
+	}
+	if device.CurrentLocationID != nil {
+		if err := s.uninstallDevice(device, opts.Actor); err != nil {
+			return err
+		}
+	}
+	for _, childID := range children {
+		var err error
+		if opts.Cascade == CascadeDelete {
+			err = s.deleteDevice(childID, DeleteOptions{Actor: opts.Actor, Cascade: CascadeDelete}, deleting)
+		} else {
+			err = s.detachDevice(childID, opts.Actor)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Uninstalling changed the device, so start from the stored copy.
+	device, _ = s.liveDevice(id)
+	now := time.Now()
+	deleted := cloneDevice(device)
+	deleted.DeletedAt = &now
+	deleted.UpdatedAt = &now
+	deleted.ResourceVersion++
+	event := newEvent(EventTypeDeviceDeleted, opts.Actor, &id, nil)
+	s.prepareEvent(event)
+	if err := s.commit(putDevice(deleted), putEvent(event)); err != nil {
+		return err
+	}
+	if device.ParentDeviceID != nil {
+		return s.refreshChildDevices(*device.ParentDeviceID)
+	}
+	return nil
+}
+
+// childDevices returns the IDs of the live devices whose parent is id,
+// except those in skip.
+func (s *MemoryStore) childDevices(id string, skip map[string]bool) []string {
+	var children []string
+	for _, device := range s.devices {
+		if device.DeletedAt == nil && device.ParentDeviceID != nil && *device.ParentDeviceID == id && !skip[device.ID] {
+			children = append(children, device.ID)
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+// uninstallDevice takes device out of the location it is installed in. A
+// location that no longer holds it leaves only the device's pointer to clear.
+func (s *MemoryStore) uninstallDevice(device *models.Device, actor string) error {
+	locationID := *device.CurrentLocationID
+	if location, exists := s.liveLocation(locationID); exists && location.CurrentDeviceID != nil && *location.CurrentDeviceID == device.ID {
+		_, _, err := s.removeDevice(locationID, actor)
+		return err
+	}
+	updated := cloneDevice(device)
+	updated.CurrentLocationID = nil
+	updated.ResourceVersion++
+	now := time.Now()
+	updated.UpdatedAt = &now
+	event := newEvent(EventTypeDeviceRemoved, actor, &updated.ID, &locationID)
+	s.prepareEvent(event)
+	return s.commit(putDevice(updated), putEvent(event))
+}
+
+// detachDevice clears the parent of a child device whose parent is deleted.
+func (s *MemoryStore) detachDevice(id, actor string) error {
+	device, _ := s.liveDevice(id)
+	parentID := *device.ParentDeviceID
+	updated := cloneDevice(device)
+	updated.ParentDeviceID = nil
+	updated.ResourceVersion++
+	now := time.Now()
+	updated.UpdatedAt = &now
+	event := newDetachedEvent(EventTypeDeviceDetached, actor, &id, nil, "parentDeviceId", parentID)
+	s.prepareEvent(event)
+	if err := s.commit(putDevice(updated), putEvent(event)); err != nil {
+		return err
+	}
+	return s.refreshChildDevices(parentID)
+}
+
+// reparentDevice follows a change of the parent of device id from
+// oldParent to newParent: it refreshes both parents' lists of children and
+// records the device's detachment and attachment.
+func (s *MemoryStore) reparentDevice(id string, oldParent, newParent *string, actor string) error {
+	events := reparentEvents(EventTypeDeviceDetached, EventTypeDeviceAttached, "parentDeviceId", actor, &id, nil, oldParent, newParent)
+	for _, event := range events {
+		s.prepareEvent(event)
+		if err := s.commit(putEvent(event)); err != nil {
+			return err
+		}
+	}
+	for _, parent := range []*string{oldParent, newParent} {
+		if parent != nil && len(events) > 0 {
+			if err := s.refreshChildDevices(*parent); err != nil {
+				return err
+			}
+		}
 	}
-	delete(s.devices, id)
 	return nil
 }
 
+// refreshChildDevices sets the children list of device parentID to its live
+// child devices, if the device is live and the list has changed.
+func (s *MemoryStore) refreshChildDevices(parentID string) error {
+	parent, exists := s.liveDevice(parentID)
+	if !exists {
+		return nil
+	}
+	children := s.childDevices(parentID, nil)
+	if slices.Equal(children, parent.ChildrenDeviceIDs) {
+		return nil
+	}
+	updated := cloneDevice(parent)
+	updated.ChildrenDeviceIDs = children
+	updated.ResourceVersion++
+	now := time.Now()
+	updated.UpdatedAt = &now
+	return s.commit(putDevice(updated))
+}
+
+func (s *MemoryStore) RestoreDevice(id, actor string) (*models.Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, exists := s.devices[id]
+	if !exists {
+		return nil, errorf(ErrNotFound, "device with ID %s not found", id)
+	}
+	if device.DeletedAt == nil {
+		return nil, errorf(ErrConflict, "device %s is not deleted", id)
+	}
+	now := time.Now()
+	restored := cloneDevice(device)
+	restored.DeletedAt = nil
+	restored.UpdatedAt = &now
+	restored.ResourceVersion++
+	// A device cannot come back under a parent that is gone.
+	if err := checkParent("device", "parentDeviceId", id, restored.ParentDeviceID, s.deviceParent); err != nil {
+		return nil, err
+	}
+	if err := s.checkDeviceUnique(restored); err != nil {
+		return nil, err
+	}
+	event := newEvent(EventTypeDeviceRestored, actor, &id, nil)
+	s.prepareEvent(event)
+	err := s.withTx(func() error {
+		if err := s.commit(putDevice(restored), putEvent(event)); err != nil {
+			return err
+		}
+		if err := s.refreshChildDevices(id); err != nil {
+			return err
+		}
+		if restored.ParentDeviceID != nil {
+			return s.refreshChildDevices(*restored.ParentDeviceID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cloneDevice(s.devices[id]), nil
+}
+
+func (s *MemoryStore) RelabelDevices(filter DeviceFilter, change LabelChange) ([]models.Device, error) {
+	if err := filter.check(); err != nil {
+		return nil, err
+	}
+	if err := change.validate(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	relabeled := []models.Device{}
+	err := s.withTx(func() error {
+		for _, device := range s.devices {
+			if device.DeletedAt != nil || !filter.matches(device) {
+				continue
+			}
+			labels, changed := change.apply(device.Labels)
+			if !changed {
+				continue
+			}
+			updated := cloneDevice(device)
+			updated.Labels = labels
+			updated.ResourceVersion++
+			now := time.Now()
+			updated.UpdatedAt = &now
+			if err := s.commit(putDevice(updated)); err != nil {
+				return err
+			}
+			relabeled = append(relabeled, *updated)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	relabeled, _, err = paginate(relabeled, ListOptions{}, deviceOrder)
+	return relabeled, err
+}
+
+func (s *MemoryStore) ApplyDeviceBatch(ops []DeviceOperation) ([]*models.Device, error) {
+	for i, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]*models.Device, len(ops))
+	err := s.withTx(func() error {
+		for i, op := range ops {
+			var device *models.Device
+			var err error
+			switch op.Op {
+			case BatchCreate:
+				device, err = s.createDevice(op.Device)
+			case BatchUpdate:
+				device, err = s.updateDevice(op.ID, op.Device, op.Actor)
+			case BatchDelete:
+				err = s.deleteDevice(op.ID, op.Delete, map[string]bool{})
+			}
+			if err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+			if device != nil {
+				results[i] = cloneDevice(device)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// checkDeviceUnique rejects device if a live device already holds one of its
+// unique fields. The caller must hold the lock.
+func (s *MemoryStore) checkDeviceUnique(device *models.Device) error {
+	for _, other := range s.devices {
+		if err := deviceDuplicate(device, other); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deviceParent looks up the parent of a live device for checkParent.
+func (s *MemoryStore) deviceParent(id string) (*string, bool, error) {
+	device, exists := s.liveDevice(id)
+	if !exists {
+		return nil, false, nil
+	}
+	return device.ParentDeviceID, true, nil
+}
+
+// liveDevice looks up a device that has not been soft-deleted. The caller
+// must hold the lock.
+func (s *MemoryStore) liveDevice(id string) (*models.Device, bool) {
+	device, exists := s.devices[id]
+	if !exists || device.DeletedAt != nil {
+		return nil, false
+	}
+	return device, true
+}
+
 // --- Location Methods ---
 
 func (s *MemoryStore) CreateLocation(location *models.Location) (*models.Location, error) {
+	if err := validateLocation(location); err != nil {
+		return nil, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.createLocation(location)
+}
+
+// createLocation implements CreateLocation for a validated location. The
+// caller must hold the write lock.
+func (s *MemoryStore) createLocation(location *models.Location) (*models.Location, error) {
+	if err := checkChildren("childrenLocationIds", location.ChildrenLocationIDs, nil); err != nil {
+		return nil, err
+	}
+	location.ResourceVersion = 1
 	location.CreatedAt = time.Now()
+	location.DeletedAt = nil
+	location.Path = ""
+	location.CurrentDeviceID = nil
 	if _, exists := s.locations[location.ID]; exists {
-		return nil, fmt.Errorf("location with ID %s already exists", location.ID)
+		return nil, errorf(ErrAlreadyExists, "location with ID %s already exists", location.ID)
+	}
+	if err := checkParent("location", "parentLocationId", location.ID, location.ParentLocationID, s.locationParent); err != nil {
+		return nil, err
+	}
+	if err := s.checkLocationUnique(location); err != nil {
+		return nil, err
+	}
+	location.ChildrenLocationIDs = s.childLocations(location.ID, nil)
+	err := s.withTx(func() error {
+		if err := s.commit(putLocation(location)); err != nil {
+			return err
+		}
+		if location.ParentLocationID != nil {
+			return s.refreshChildLocations(*location.ParentLocationID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	s.locations[location.ID] = location
 	return location, nil
 }
 
 func (s *MemoryStore) GetLocationByID(id string) (*models.Location, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	location, exists := s.locations[id]
+	location, exists := s.liveLocation(id)
 	if !exists {
-		return nil, fmt.Errorf("location with ID %s not found", id)
+		return nil, errorf(ErrNotFound, "location with ID %s not found", id)
 	}
-	return location, nil
+	return cloneLocation(location), nil
 }
 
 func (s *MemoryStore) GetLocationByName(name string) (*models.Location, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	for _, location := range s.locations {
-		if location.Name == name {
-			return location, nil
+		if location.Name == name && location.DeletedAt == nil {
+			return cloneLocation(location), nil
+		}
+	}
+	return nil, errorf(ErrNotFound, "location with name '%s' not found", name)
+}
+
+func (s *MemoryStore) GetLocationTree(id string, opts TreeOptions) (*models.LocationTree, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	root, exists := s.liveLocation(id)
+	if !exists {
+		return nil, errorf(ErrNotFound, "location with ID %s not found", id)
+	}
+	childLocations := map[string][]*models.Location{}
+	for _, location := range s.locations {
+		if location.DeletedAt == nil && location.ParentLocationID != nil {
+			childLocations[*location.ParentLocationID] = append(childLocations[*location.ParentLocationID], location)
+		}
+	}
+	var locations []*models.Location
+	var devices []*models.Device
+	seen := map[string]bool{id: true}
+	level := []*models.Location{root}
+	for depth := 0; len(level) > 0; depth++ {
+		var next []*models.Location
+		for _, location := range level {
+			locations = append(locations, cloneLocation(location))
+			if location.CurrentDeviceID != nil {
+				if device, ok := s.liveDevice(*location.CurrentDeviceID); ok {
+					devices = append(devices, cloneDevice(device))
+				}
+			}
+			for _, child := range childLocations[location.ID] {
+				if !seen[child.ID] {
+					seen[child.ID] = true
+					next = append(next, child)
+				}
+			}
+		}
+		if depth == opts.Depth {
+			break
+		}
+		level = next
+	}
+	if opts.IncludeChildDevices {
+		devices = append(devices, s.descendantDevices(devices)...)
+	}
+	return buildLocationTree(id, locations, devices, opts), nil
+}
+
+func (s *MemoryStore) GetLocationAncestors(id string) ([]models.Location, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, exists := s.liveLocation(id); !exists {
+		return nil, errorf(ErrNotFound, "location with ID %s not found", id)
+	}
+	var chain []*models.Location
+	seen := map[string]bool{}
+	for current := &id; current != nil && !seen[*current]; {
+		seen[*current] = true
+		location, exists := s.liveLocation(*current)
+		if !exists {
+			break
+		}
+		chain = append(chain, location)
+		current = location.ParentLocationID
+	}
+	ancestors, _ := orderAncestors(id, chain)
+	for i := range ancestors {
+		ancestors[i] = *cloneLocation(&ancestors[i])
+	}
+	return ancestors, nil
+}
+
+func (s *MemoryStore) GetLocationByPath(names []string) (*models.Location, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found *models.Location
+	for _, name := range names {
+		var next *models.Location
+		for _, location := range s.locations {
+			if location.Name != name || location.DeletedAt != nil {
+				continue
+			}
+			if found == nil && location.ParentLocationID != nil ||
+				found != nil && (location.ParentLocationID == nil || *location.ParentLocationID != found.ID) {
+				continue
+			}
+			if next == nil || location.ID < next.ID {
+				next = location
+			}
+		}
+		if next == nil {
+			found = nil
+			break
+		}
+		found = next
+	}
+	if found == nil {
+		return nil, errorf(ErrNotFound, "location with path '%s' not found", strings.Join(names, PathSeparator))
+	}
+	return cloneLocation(found), nil
+}
+
+func (s *MemoryStore) LocationPaths(ids []string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	lookup := func(id string) (string, *string, bool) {
+		location, exists := s.locations[id]
+		if !exists {
+			return "", nil, false
+		}
+		return location.Name, location.ParentLocationID, true
+	}
+	paths := make(map[string]string, len(ids))
+	for _, id := range ids {
+		if _, exists := s.locations[id]; exists {
+			paths[id] = locationPath(id, lookup)
+		}
+	}
+	return paths, nil
+}
+
+// descendantDevices returns copies of the live devices below those in
+// devices, by their parent pointers.
+func (s *MemoryStore) descendantDevices(devices []*models.Device) []*models.Device {
+	childDevices := map[string][]*models.Device{}
+	for _, device := range s.devices {
+		if device.DeletedAt == nil && device.ParentDeviceID != nil {
+			childDevices[*device.ParentDeviceID] = append(childDevices[*device.ParentDeviceID], device)
 		}
 	}
-	return nil, fmt.Errorf("location with name '%s' not found", name)
+	seen := map[string]bool{}
+	for _, device := range devices {
+		seen[device.ID] = true
+	}
+	var descendants []*models.Device
+	for queue := devices; len(queue) > 0; queue = queue[1:] {
+		for _, child := range childDevices[queue[0].ID] {
+			if !seen[child.ID] {
+				seen[child.ID] = true
+				descendants = append(descendants, cloneDevice(child))
+				queue = append(queue, child)
+			}
+		}
+	}
+	return descendants
 }
 
-func (s *MemoryStore) ListLocations() ([]models.Location, error) {
+func (s *MemoryStore) ListLocations(filter LocationFilter, opts ListOptions) ([]models.Location, Page, error) {
+	if err := filter.check(); err != nil {
+		return nil, Page{}, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	allLocations := make([]models.Location, 0, len(s.locations))
 	for _, location := range s.locations {
-		allLocations = append(allLocations, *location)
+		if (location.DeletedAt != nil && !opts.IncludeDeleted) || !filter.matches(location) {
+			continue
+		}
+		allLocations = append(allLocations, *cloneLocation(location))
 	}
-	return allLocations, nil
+	return paginate(allLocations, opts, locationOrder)
 }
 
-func (s *MemoryStore) UpdateLocation(id string, location *models.Location) (*models.Location, error) {
+func (s *MemoryStore) UpdateLocation(id string, location *models.Location, actor string) (*models.Location, error) {
+	location.ID = id
+	if err := validateLocation(location); err != nil {
+		return nil, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	existingLocation, exists := s.locations[id]
+	return s.updateLocation(id, location, actor)
+}
+
+// updateLocation implements UpdateLocation for a validated location. The
+// caller must hold the write lock.
+func (s *MemoryStore) updateLocation(id string, location *models.Location, actor string) (*models.Location, error) {
+	existingLocation, exists := s.liveLocation(id)
 	if !exists {
-		return nil, fmt.Errorf("location with ID %s not found", id)
+		return nil, errorf(ErrNotFound, "location with ID %s not found", id)
+	}
+	if location.ResourceVersion != 0 && location.ResourceVersion != existingLocation.ResourceVersion {
+		return nil, versionMismatch("location", id, location.ResourceVersion, existingLocation.ResourceVersion)
+	}
+	if err := checkChildren("childrenLocationIds", location.ChildrenLocationIDs, existingLocation.ChildrenLocationIDs); err != nil {
+		return nil, err
+	}
+	if !sameParent(location.ParentLocationID, existingLocation.ParentLocationID) {
+		if err := checkParent("location", "parentLocationId", id, location.ParentLocationID, s.locationParent); err != nil {
+			return nil, err
+		}
 	}
 	// Preserve original creation time and ID
 	location.CreatedAt = existingLocation.CreatedAt
 	location.ID = id
+	location.ResourceVersion = existingLocation.ResourceVersion + 1
 	now := time.Now()
 	location.UpdatedAt = &now
-	s.locations[id] = location
+	location.DeletedAt = nil
+	location.Path = ""
+	location.ChildrenLocationIDs = cloneStrings(existingLocation.ChildrenLocationIDs)
+	location.CurrentDeviceID = existingLocation.CurrentDeviceID
+	if err := s.checkLocationUnique(location); err != nil {
+		return nil, err
+	}
+	err := s.withTx(func() error {
+		if err := s.commit(putLocation(location)); err != nil {
+			return err
+		}
+		return s.reparentLocation(id, existingLocation.ParentLocationID, location.ParentLocationID, actor)
+	})
+	if err != nil {
+		return nil, err
+	}
 	return location, nil
 }
 
-func (s *MemoryStore) DeleteLocation(id string) error {
+func (s *MemoryStore) PatchLocation(id string, patch Patch, opts PatchOptions) (*models.Location, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, exists := s.locations[id]; !exists {
-		return fmt.Errorf("location with ID %s not found", id)
+	return s.patchLocation(id, patch, opts)
+}
+
+// patchLocation implements PatchLocation. The caller must hold the write lock.
+func (s *MemoryStore) patchLocation(id string, patch Patch, opts PatchOptions) (*models.Location, error) {
+	existing, exists := s.liveLocation(id)
+	if !exists {
+		return nil, errorf(ErrNotFound, "location with ID %s not found", id)
+	}
+	if opts.ResourceVersion != 0 && opts.ResourceVersion != existing.ResourceVersion {
+		return nil, versionMismatch("location", id, opts.ResourceVersion, existing.ResourceVersion)
+	}
+	patched, before, after, err := patchRecord(existing, patch)
+	if err != nil {
+		return nil, err
+	}
+	if len(after) == 0 {
+		return cloneLocation(existing), nil
+	}
+	if err := validateLocation(patched); err != nil {
+		return nil, err
+	}
+	var location *models.Location
+	err = s.withTx(func() error {
+		var err error
+		if location, err = s.updateLocation(id, patched, opts.Actor); err != nil {
+			return err
+		}
+		event := newUpdatedEvent(EventTypeLocationUpdated, opts.Actor, nil, &id, before, after)
+		s.prepareEvent(event)
+		return s.commit(putEvent(event))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return location, nil
+}
+
+func (s *MemoryStore) DeleteLocation(id string, opts DeleteOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.withTx(func() error { return s.deleteLocation(id, opts, map[string]bool{}) })
+}
+
+// deleteLocation soft-deletes a location after dealing with its installed
+// device and child locations as opts.Cascade says, and drops it from its
+// parent's list of children. deleting is as for
+// deleteDevice. The caller must hold the write lock and run it inside withTx.
+func (s *MemoryStore) deleteLocation(id string, opts DeleteOptions, deleting map[string]bool) error {
+	location, exists := s.liveLocation(id)
+	if !exists {
+		return errorf(ErrNotFound, "location with ID %s not found", id)
+	}
+	if opts.ResourceVersion != 0 && opts.ResourceVersion != location.ResourceVersion {
+		return versionMismatch("location", id, opts.ResourceVersion, location.ResourceVersion)
+	}
+	deleting[id] = true
+	children := s.childLocations(id, deleting)
+	if opts.Cascade == CascadeNone && (location.CurrentDeviceID != nil || len(children) > 0) {
+		return stillReferenced("location", id, location.CurrentDeviceID, children)
+	}
+	if location.CurrentDeviceID != nil {
+		if _, _, err := s.removeDevice(id, opts.Actor); err != nil {
+			return err
+		}
+	}
+	for _, childID := range children {
+		var err error
+		if opts.Cascade == CascadeDelete {
+			err = s.deleteLocation(childID, DeleteOptions{Actor: opts.Actor, Cascade: CascadeDelete}, deleting)
+		} else {
+			err = s.detachLocation(childID, opts.Actor)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Removing the device changed the location, so start from the stored copy.
+	location, _ = s.liveLocation(id)
+	now := time.Now()
+	deleted := cloneLocation(location)
+	deleted.DeletedAt = &now
+	deleted.UpdatedAt = &now
+	deleted.ResourceVersion++
+	event := newEvent(EventTypeLocationDeleted, opts.Actor, nil, &id)
+	s.prepareEvent(event)
+	if err := s.commit(putLocation(deleted), putEvent(event)); err != nil {
+		return err
+	}
+	if location.ParentLocationID != nil {
+		return s.refreshChildLocations(*location.ParentLocationID)
+	}
+	return nil
+}
+
+// childLocations returns the IDs of the live locations whose parent is id,
+// except those in skip.
+func (s *MemoryStore) childLocations(id string, skip map[string]bool) []string {
+	var children []string
+	for _, location := range s.locations {
+		if location.DeletedAt == nil && location.ParentLocationID != nil && *location.ParentLocationID == id && !skip[location.ID] {
+			children = append(children, location.ID)
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+// detachLocation clears the parent of a child location whose parent is
+// deleted.
+func (s *MemoryStore) detachLocation(id, actor string) error {
+	location, _ := s.liveLocation(id)
+	parentID := *location.ParentLocationID
+	updated := cloneLocation(location)
+	updated.ParentLocationID = nil
+	updated.ResourceVersion++
+	now := time.Now()
+	updated.UpdatedAt = &now
+	event := newDetachedEvent(EventTypeLocationDetached, actor, nil, &id, "parentLocationId", parentID)
+	s.prepareEvent(event)
+	if err := s.commit(putLocation(updated), putEvent(event)); err != nil {
+		return err
+	}
+	return s.refreshChildLocations(parentID)
+}
+
+// reparentLocation is reparentDevice for locations.
+func (s *MemoryStore) reparentLocation(id string, oldParent, newParent *string, actor string) error {
+	events := reparentEvents(EventTypeLocationDetached, EventTypeLocationAttached, "parentLocationId", actor, nil, &id, oldParent, newParent)
+	for _, event := range events {
+		s.prepareEvent(event)
+		if err := s.commit(putEvent(event)); err != nil {
+			return err
+		}
+	}
+	for _, parent := range []*string{oldParent, newParent} {
+		if parent != nil && len(events) > 0 {
+			if err := s.refreshChildLocations(*parent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refreshChildLocations is refreshChildDevices for locations.
+func (s *MemoryStore) refreshChildLocations(parentID string) error {
+	parent, exists := s.liveLocation(parentID)
+	if !exists {
+		return nil
+	}
+	children := s.childLocations(parentID, nil)
+	if slices.Equal(children, parent.ChildrenLocationIDs) {
+		return nil
+	}
+	updated := cloneLocation(parent)
+	updated.ChildrenLocationIDs = children
+	updated.ResourceVersion++
+	now := time.Now()
+	updated.UpdatedAt = &now
+	return s.commit(putLocation(updated))
+}
+
+func (s *MemoryStore) RestoreLocation(id, actor string) (*models.Location, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	location, exists := s.locations[id]
+	if !exists {
+		return nil, errorf(ErrNotFound, "location with ID %s not found", id)
+	}
+	if location.DeletedAt == nil {
+		return nil, errorf(ErrConflict, "location %s is not deleted", id)
+	}
+	now := time.Now()
+	restored := cloneLocation(location)
+	restored.DeletedAt = nil
+	restored.UpdatedAt = &now
+	restored.ResourceVersion++
+	// A location cannot come back under a parent that is gone.
+	if err := checkParent("location", "parentLocationId", id, restored.ParentLocationID, s.locationParent); err != nil {
+		return nil, err
+	}
+	if err := s.checkLocationUnique(restored); err != nil {
+		return nil, err
+	}
+	event := newEvent(EventTypeLocationRestored, actor, nil, &id)
+	s.prepareEvent(event)
+	err := s.withTx(func() error {
+		if err := s.commit(putLocation(restored), putEvent(event)); err != nil {
+			return err
+		}
+		if err := s.refreshChildLocations(id); err != nil {
+			return err
+		}
+		if restored.ParentLocationID != nil {
+			return s.refreshChildLocations(*restored.ParentLocationID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cloneLocation(s.locations[id]), nil
+}
+
+func (s *MemoryStore) RelabelLocations(filter LocationFilter, change LabelChange) ([]models.Location, error) {
+	if err := filter.check(); err != nil {
+		return nil, err
+	}
+	if err := change.validate(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	relabeled := []models.Location{}
+	err := s.withTx(func() error {
+		for _, location := range s.locations {
+			if location.DeletedAt != nil || !filter.matches(location) {
+				continue
+			}
+			labels, changed := change.apply(location.Labels)
+			if !changed {
+				continue
+			}
+			updated := cloneLocation(location)
+			updated.Labels = labels
+			updated.ResourceVersion++
+			now := time.Now()
+			updated.UpdatedAt = &now
+			if err := s.commit(putLocation(updated)); err != nil {
+				return err
+			}
+			relabeled = append(relabeled, *updated)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	relabeled, _, err = paginate(relabeled, ListOptions{}, locationOrder)
+	return relabeled, err
+}
+
+func (s *MemoryStore) ApplyLocationBatch(ops []LocationOperation) ([]*models.Location, error) {
+	for i, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]*models.Location, len(ops))
+	err := s.withTx(func() error {
+		for i, op := range ops {
+			var location *models.Location
+			var err error
+			switch op.Op {
+			case BatchCreate:
+				location, err = s.createLocation(op.Location)
+			case BatchUpdate:
+				location, err = s.updateLocation(op.ID, op.Location, op.Actor)
+			case BatchDelete:
+				err = s.deleteLocation(op.ID, op.Delete, map[string]bool{})
+			}
+			if err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+			if location != nil {
+				results[i] = cloneLocation(location)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// checkLocationUnique rejects location if a live location in its scope
+// already has its name. The caller must hold the lock.
+func (s *MemoryStore) checkLocationUnique(location *models.Location) error {
+	for _, other := range s.locations {
+		if err := locationDuplicate(location, other, s.locationNameScope); err != nil {
+			return err
+		}
 	}
-	delete(s.locations, id)
 	return nil
 }
 
+// locationParent looks up the parent of a live location for checkParent.
+func (s *MemoryStore) locationParent(id string) (*string, bool, error) {
+	location, exists := s.liveLocation(id)
+	if !exists {
+		return nil, false, nil
+	}
+	return location.ParentLocationID, true, nil
+}
+
+// liveLocation looks up a location that has not been soft-deleted. The
+// caller must hold the lock.
+func (s *MemoryStore) liveLocation(id string) (*models.Location, bool) {
+	location, exists := s.locations[id]
+	if !exists || location.DeletedAt != nil {
+		return nil, false
+	}
+	return location, true
+}
+
 // --- Event Methods ---
 
 func (s *MemoryStore) CreateEvent(event *models.Event) (*models.Event, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.prepareEvent(event)
+	if err := s.commit(putEvent(event)); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// prepareEvent assigns the ID, timestamp and sequence number of a new event.
+func (s *MemoryStore) prepareEvent(event *models.Event) {
 	event.ID = uuid.NewString()
 	event.Time = time.Now()
-	s.events[event.ID] = event
-	return event, nil
+	s.eventSeq++
+	event.Sequence = s.eventSeq
 }
 
 func (s *MemoryStore) GetEventByID(id string) (*models.Event, error) {
@@ -180,41 +1215,504 @@ func (s *MemoryStore) GetEventByID(id string) (*models.Event, error) {
 	defer s.mu.RUnlock()
 	event, exists := s.events[id]
 	if !exists {
-		return nil, fmt.Errorf("event with ID %s not found", id)
+		return nil, errorf(ErrNotFound, "event with ID %s not found", id)
 	}
-	return event, nil
+	return cloneEvent(event), nil
 }
 
-func (s *MemoryStore) ListEvents() ([]models.Event, error) {
+func (s *MemoryStore) ListEvents(filter EventFilter, opts ListOptions) ([]models.Event, Page, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	allEvents := make([]models.Event, 0, len(s.events))
 	for _, event := range s.events {
-		allEvents = append(allEvents, *event)
+		if filter.matches(event) {
+			allEvents = append(allEvents, *cloneEvent(event))
+		}
 	}
-	return allEvents, nil
+	return paginate(allEvents, opts, eventOrder)
 }
 
-func (s *MemoryStore) ListEventsByDeviceID(deviceID string) ([]models.Event, error) {
+func (s *MemoryStore) ListEventsByDeviceID(deviceID string, opts ListOptions) ([]models.Event, Page, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	var deviceEvents []models.Event
+	deviceEvents := []models.Event{}
 	for _, event := range s.events {
 		if event.Data.DeviceID != nil && *event.Data.DeviceID == deviceID {
-			deviceEvents = append(deviceEvents, *event)
+			deviceEvents = append(deviceEvents, *cloneEvent(event))
 		}
 	}
-	return deviceEvents, nil
+	return paginate(deviceEvents, opts, eventOrder)
 }
 
-func (s *MemoryStore) ListEventsByLocationID(locationID string) ([]models.Event, error) {
+func (s *MemoryStore) ListEventsByLocationID(locationID string, opts ListOptions) ([]models.Event, Page, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	var locationEvents []models.Event
+	locationEvents := []models.Event{}
 	for _, event := range s.events {
 		if event.Data.LocationID != nil && *event.Data.LocationID == locationID {
-			locationEvents = append(locationEvents, *event)
+			locationEvents = append(locationEvents, *cloneEvent(event))
+		}
+	}
+	return paginate(locationEvents, opts, eventOrder)
+}
+
+// --- Composite Methods ---
+
+func (s *MemoryStore) InstallDevice(locationID, deviceID, actor string) (*models.Location, *models.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.installDevice(locationID, deviceID, actor)
+}
+
+// installDevice implements InstallDevice. The caller must hold the write lock.
+func (s *MemoryStore) installDevice(locationID, deviceID, actor string) (*models.Location, *models.Event, error) {
+	location, exists := s.liveLocation(locationID)
+	if !exists {
+		return nil, nil, errorf(ErrNotFound, "location with ID %s not found", locationID)
+	}
+	if location.CurrentDeviceID != nil {
+		return nil, nil, fmt.Errorf("location %s: %w", locationID, ErrLocationOccupied)
+	}
+	device, exists := s.liveDevice(deviceID)
+	if !exists {
+		return nil, nil, errorf(ErrNotFound, "device with ID %s not found", deviceID)
+	}
+	if device.CurrentLocationID != nil {
+		return nil, nil, fmt.Errorf("device %s is in location %s: %w", deviceID, *device.CurrentLocationID, ErrDeviceInstalled)
+	}
+
+	now := time.Now()
+	updatedLocation := cloneLocation(location)
+	updatedLocation.CurrentDeviceID = &deviceID
+	updatedLocation.Status = "occupied"
+	updatedLocation.ResourceVersion++
+	updatedLocation.UpdatedAt = &now
+	updatedDevice := cloneDevice(device)
+	updatedDevice.CurrentLocationID = &locationID
+	updatedDevice.ResourceVersion++
+	updatedDevice.UpdatedAt = &now
+	event := newEvent(EventTypeDeviceInstalled, actor, &deviceID, &locationID)
+	s.prepareEvent(event)
+
+	if err := s.commit(putLocation(updatedLocation), putDevice(updatedDevice), putEvent(event)); err != nil {
+		return nil, nil, err
+	}
+	return updatedLocation, event, nil
+}
+
+func (s *MemoryStore) RemoveDevice(locationID, actor string) (*models.Location, *models.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.removeDevice(locationID, actor)
+}
+
+// removeDevice implements RemoveDevice. The caller must hold the write lock.
+func (s *MemoryStore) removeDevice(locationID, actor string) (*models.Location, *models.Event, error) {
+	location, exists := s.liveLocation(locationID)
+	if !exists {
+		return nil, nil, errorf(ErrNotFound, "location with ID %s not found", locationID)
+	}
+	if location.CurrentDeviceID == nil {
+		return nil, nil, fmt.Errorf("location %s: %w", locationID, ErrLocationEmpty)
+	}
+	deviceID := *location.CurrentDeviceID
+
+	now := time.Now()
+	updatedLocation := cloneLocation(location)
+	updatedLocation.CurrentDeviceID = nil
+	updatedLocation.Status = "empty"
+	updatedLocation.ResourceVersion++
+	updatedLocation.UpdatedAt = &now
+	ops := []memoryOp{putLocation(updatedLocation)}
+	// A dangling device reference is cleared from the location regardless,
+	// and a device that points at another location is left there.
+	if device, exists := s.devices[deviceID]; exists && device.CurrentLocationID != nil && *device.CurrentLocationID == locationID {
+		updatedDevice := cloneDevice(device)
+		updatedDevice.CurrentLocationID = nil
+		updatedDevice.ResourceVersion++
+		updatedDevice.UpdatedAt = &now
+		ops = append(ops, putDevice(updatedDevice))
+	}
+	event := newEvent(EventTypeDeviceRemoved, actor, &deviceID, &locationID)
+	s.prepareEvent(event)
+	ops = append(ops, putEvent(event))
+
+	if err := s.commit(ops...); err != nil {
+		return nil, nil, err
+	}
+	return updatedLocation, event, nil
+}
+
+func (s *MemoryStore) ApplyTransaction(ops []TxOperation, actor string) ([]TxResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var results []TxResult
+	err := s.withTx(func() error {
+		var err error
+		results, err = runTransaction(ops, func(op TxOperation) (TxResult, error) {
+			var result TxResult
+			var err error
+			deleteOpts := DeleteOptions{ResourceVersion: op.ResourceVersion, Actor: actor, Cascade: op.Cascade}
+			patchOpts := PatchOptions{ResourceVersion: op.ResourceVersion, Actor: actor}
+			switch op.Op {
+			case TxCreateDevice:
+				result.Device, err = s.createDevice(op.Device)
+			case TxUpdateDevice:
+				result.Device, err = s.updateDevice(op.ID, op.Device, actor)
+			case TxPatchDevice:
+				result.Device, err = s.patchDevice(op.ID, op.Patch, patchOpts)
+			case TxDeleteDevice:
+				err = s.deleteDevice(op.ID, deleteOpts, map[string]bool{})
+			case TxCreateLocation:
+				result.Location, err = s.createLocation(op.Location)
+			case TxUpdateLocation:
+				result.Location, err = s.updateLocation(op.ID, op.Location, actor)
+			case TxPatchLocation:
+				result.Location, err = s.patchLocation(op.ID, op.Patch, patchOpts)
+			case TxDeleteLocation:
+				err = s.deleteLocation(op.ID, deleteOpts, map[string]bool{})
+			case TxInstallDevice:
+				result.Location, result.Event, err = s.installDevice(op.LocationID, op.DeviceID, actor)
+			case TxRemoveDevice:
+				result.Location, result.Event, err = s.removeDevice(op.LocationID, actor)
+			}
+			if err != nil {
+				return TxResult{}, err
+			}
+			if result.Device != nil {
+				result.Device = cloneDevice(result.Device)
+			}
+			if result.Location != nil {
+				result.Location = cloneLocation(result.Location)
+			}
+			if result.Event != nil {
+				result.Event = cloneEvent(result.Event)
+			}
+			return result, nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// --- Idempotency Methods ---
+
+func (s *MemoryStore) ReserveIdempotencyKey(record IdempotencyRecord) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if existing, exists := s.idempotency[record.Key]; exists && now.Before(existing.ExpiresAt) {
+		return cloneIdempotencyRecord(existing), nil
+	}
+	var ops []memoryOp
+	for key, existing := range s.idempotency {
+		if !now.Before(existing.ExpiresAt) {
+			ops = append(ops, deleteIdempotencyKey(key))
+		}
+	}
+	reserved := IdempotencyRecord{Key: record.Key, Fingerprint: record.Fingerprint, ExpiresAt: record.ExpiresAt}
+	return nil, s.commit(append(ops, putIdempotencyRecord(&reserved))...)
+}
+
+func (s *MemoryStore) CompleteIdempotencyKey(record IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit(putIdempotencyRecord(cloneIdempotencyRecord(&record)))
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.idempotency[key]; !exists {
+		return nil
+	}
+	return s.commit(deleteIdempotencyKey(key))
+}
+
+// --- Maintenance Methods ---
+
+func (s *MemoryStore) PurgeDeleted(deletedBefore time.Time) (PurgeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result PurgeResult
+	var ops []memoryOp
+	for id, device := range s.devices {
+		if device.DeletedAt != nil && device.DeletedAt.Before(deletedBefore) {
+			ops = append(ops, memoryOp{DeleteDevice: &id})
+			result.Devices++
+		}
+	}
+	for id, location := range s.locations {
+		if location.DeletedAt != nil && location.DeletedAt.Before(deletedBefore) {
+			ops = append(ops, memoryOp{DeleteLocation: &id})
+			result.Locations++
+		}
+	}
+	if len(ops) == 0 {
+		return result, nil
+	}
+	if err := s.commit(ops...); err != nil {
+		return PurgeResult{}, err
+	}
+	return result, nil
+}
+
+// --- Mutations ---
+
+// memoryOp is a single change to the store's maps: exactly one field is set.
+// Ops are also the payload of the write-ahead log, so replaying them rebuilds
+// the store exactly.
+type memoryOp struct {
+	PutDevice      *models.Device   `json:"putDevice,omitempty"`
+	PutLocation    *models.Location `json:"putLocation,omitempty"`
+	PutEvent       *models.Event    `json:"putEvent,omitempty"`
+	DeleteDevice   *string          `json:"deleteDevice,omitempty"`
+	DeleteLocation *string          `json:"deleteLocation,omitempty"`
+
+	PutIdempotencyRecord *IdempotencyRecord `json:"putIdempotencyRecord,omitempty"`
+	DeleteIdempotencyKey *string            `json:"deleteIdempotencyKey,omitempty"`
+}
+
+// putDevice, putLocation and putEvent build ops storing a private copy of
+// the record, leaving the caller free to keep using its own.
+func putDevice(device *models.Device) memoryOp {
+	return memoryOp{PutDevice: cloneDevice(device)}
+}
+
+func putLocation(location *models.Location) memoryOp {
+	return memoryOp{PutLocation: cloneLocation(location)}
+}
+
+func putEvent(event *models.Event) memoryOp {
+	return memoryOp{PutEvent: cloneEvent(event)}
+}
+
+func putIdempotencyRecord(record *IdempotencyRecord) memoryOp {
+	return memoryOp{PutIdempotencyRecord: record}
+}
+
+func deleteIdempotencyKey(key string) memoryOp {
+	return memoryOp{DeleteIdempotencyKey: &key}
+}
+
+// memoryTx is a transaction in progress on a MemoryStore. Its ops are applied
+// as they are committed, so later steps see the earlier ones, and are logged
+// together when the transaction ends.
+type memoryTx struct {
+	ops []memoryOp
+	// undo restores the maps to their state before each op, in order.
+	undo []func()
+}
+
+// withTx runs fn so that everything it commits is logged as a single record
+// and rolled back from the maps if fn fails. Nested calls join the outer
+// transaction. The caller must hold the write lock.
+func (s *MemoryStore) withTx(fn func() error) error {
+	if s.tx != nil {
+		return fn()
+	}
+	tx := &memoryTx{}
+	s.tx = tx
+	err := fn()
+	s.tx = nil
+	if err == nil && len(tx.ops) > 0 {
+		err = s.log(tx.ops)
+	}
+	if err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		return err
+	}
+	s.maybeCompact()
+	return nil
+}
+
+// commit makes ops durable, when persistence is enabled, and then applies
+// them. Ops passed to a single commit are logged as one record, so they are
+// replayed all together or not at all. Inside withTx they are only applied;
+// the transaction logs them when it ends. The caller must hold the write lock.
+func (s *MemoryStore) commit(ops ...memoryOp) error {
+	if s.tx != nil {
+		for _, op := range ops {
+			s.tx.undo = append(s.tx.undo, s.undoFor(op))
+			s.apply(op)
+		}
+		s.tx.ops = append(s.tx.ops, ops...)
+		return nil
+	}
+	if err := s.log(ops); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		s.apply(op)
+	}
+	s.maybeCompact()
+	return nil
+}
+
+// log appends ops to the write-ahead log as the next record. Without
+// persistence it only advances the sequence number.
+func (s *MemoryStore) log(ops []memoryOp) error {
+	if s.wal != nil {
+		if err := s.wal.append(walRecord{Seq: s.seq + 1, Ops: ops}); err != nil {
+			return err
+		}
+	}
+	s.seq++
+	return nil
+}
+
+// maybeCompact snapshots the store once the log is long enough.
+func (s *MemoryStore) maybeCompact() {
+	if s.wal != nil && s.wal.records >= s.snapshotEvery {
+		s.compact()
+	}
+}
+
+// undoFor returns a function reverting the maps to their state before op.
+func (s *MemoryStore) undoFor(op memoryOp) func() {
+	switch {
+	case op.PutDevice != nil:
+		return s.restoreDeviceEntry(op.PutDevice.ID)
+	case op.PutLocation != nil:
+		return s.restoreLocationEntry(op.PutLocation.ID)
+	case op.PutEvent != nil:
+		id := op.PutEvent.ID
+		return func() { delete(s.events, id) }
+	case op.DeleteDevice != nil:
+		return s.restoreDeviceEntry(*op.DeleteDevice)
+	case op.DeleteLocation != nil:
+		return s.restoreLocationEntry(*op.DeleteLocation)
+	case op.PutIdempotencyRecord != nil:
+		return s.restoreIdempotencyEntry(op.PutIdempotencyRecord.Key)
+	case op.DeleteIdempotencyKey != nil:
+		return s.restoreIdempotencyEntry(*op.DeleteIdempotencyKey)
+	}
+	return func() {}
+}
+
+func (s *MemoryStore) restoreDeviceEntry(id string) func() {
+	previous, existed := s.devices[id]
+	return func() {
+		if existed {
+			s.devices[id] = previous
+		} else {
+			delete(s.devices, id)
+		}
+	}
+}
+
+func (s *MemoryStore) restoreLocationEntry(id string) func() {
+	previous, existed := s.locations[id]
+	return func() {
+		if existed {
+			s.locations[id] = previous
+		} else {
+			delete(s.locations, id)
+		}
+	}
+}
+
+func (s *MemoryStore) restoreIdempotencyEntry(key string) func() {
+	previous, existed := s.idempotency[key]
+	return func() {
+		if existed {
+			s.idempotency[key] = previous
+		} else {
+			delete(s.idempotency, key)
+		}
+	}
+}
+
+func (s *MemoryStore) apply(op memoryOp) {
+	switch {
+	case op.PutDevice != nil:
+		s.devices[op.PutDevice.ID] = op.PutDevice
+	case op.PutLocation != nil:
+		s.locations[op.PutLocation.ID] = op.PutLocation
+	case op.PutEvent != nil:
+		s.events[op.PutEvent.ID] = op.PutEvent
+		s.eventSeq = max(s.eventSeq, op.PutEvent.Sequence)
+	case op.DeleteDevice != nil:
+		delete(s.devices, *op.DeleteDevice)
+	case op.DeleteLocation != nil:
+		delete(s.locations, *op.DeleteLocation)
+	case op.PutIdempotencyRecord != nil:
+		s.idempotency[op.PutIdempotencyRecord.Key] = op.PutIdempotencyRecord
+	case op.DeleteIdempotencyKey != nil:
+		delete(s.idempotency, *op.DeleteIdempotencyKey)
+	}
+}
+
+// --- Copy Helpers ---
+
+func cloneDevice(device *models.Device) *models.Device {
+	clone := *device
+	clone.Properties = cloneProperties(device.Properties)
+	clone.Labels = maps.Clone(device.Labels)
+	clone.ChildrenDeviceIDs = cloneStrings(device.ChildrenDeviceIDs)
+	return &clone
+}
+
+func cloneLocation(location *models.Location) *models.Location {
+	clone := *location
+	clone.Properties = cloneProperties(location.Properties)
+	clone.Labels = maps.Clone(location.Labels)
+	clone.ChildrenLocationIDs = cloneStrings(location.ChildrenLocationIDs)
+	return &clone
+}
+
+func cloneEvent(event *models.Event) *models.Event {
+	clone := *event
+	clone.Data.StateBefore = cloneProperties(event.Data.StateBefore)
+	clone.Data.StateAfter = cloneProperties(event.Data.StateAfter)
+	return &clone
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func cloneStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	return append([]string(nil), values...)
+}
+
+// cloneProperties deep-copies a decoded JSON object, so nested objects and
+// arrays are not shared either.
+func cloneProperties(properties map[string]interface{}) map[string]interface{} {
+	if properties == nil {
+		return nil
+	}
+	clone := make(map[string]interface{}, len(properties))
+	for key, value := range properties {
+		clone[key] = cloneJSONValue(value)
+	}
+	return clone
+}
+
+func cloneJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return cloneProperties(v)
+	case []interface{}:
+		clone := make([]interface{}, len(v))
+		for i, item := range v {
+			clone[i] = cloneJSONValue(item)
 		}
+		return clone
+	default:
+		return v
 	}
-	return locationEvents, nil
 }
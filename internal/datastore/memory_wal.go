@@ -0,0 +1,286 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+const (
+	// defaultSnapshotEvery is the number of logged mutations after which a
+	// persistent MemoryStore compacts its log into a snapshot.
+	defaultSnapshotEvery = 1000
+
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+
+	// walHeaderSize is the size of the frame in front of every log record: a
+	// big-endian uint32 payload length followed by the payload's CRC-32.
+	walHeaderSize = 8
+)
+
+// walRecord is one committed mutation of a MemoryStore. Seq increases by one
+// with every commit and lets replay skip records already in the snapshot.
+type walRecord struct {
+	Seq uint64     `json:"seq"`
+	Ops []memoryOp `json:"ops"`
+}
+
+// memorySnapshot is the compacted state of a MemoryStore as of record Seq.
+type memorySnapshot struct {
+	Seq       uint64             `json:"seq"`
+	Devices   []*models.Device   `json:"devices"`
+	Locations []*models.Location `json:"locations"`
+	Events    []*models.Event    `json:"events"`
+
+	IdempotencyRecords []*IdempotencyRecord `json:"idempotencyRecords,omitempty"`
+}
+
+// writeAheadLog is the append-only log of a persistent MemoryStore.
+type writeAheadLog struct {
+	file *os.File
+	// size is the length of the valid prefix of the file.
+	size int64
+	// records counts the records appended since the last snapshot.
+	records int
+	// failed is set when a failed write could not be cut off again. The
+	// file may then end in a partial record that would hide anything
+	// appended after it, so nothing more is.
+	failed error
+}
+
+// append writes rec to the end of the log and syncs it to disk. A failed
+// write is cut off again so later records are not stranded behind it; if
+// that fails too, the log refuses every later record.
+func (w *writeAheadLog) append(rec walRecord) error {
+	if w.failed != nil {
+		return fmt.Errorf("write-ahead log is unusable: %w", w.failed)
+	}
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encoding write-ahead log record: %w", err)
+	}
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[walHeaderSize:], payload)
+
+	if _, err := w.file.Write(frame); err != nil {
+		return w.cutOff(fmt.Errorf("writing write-ahead log: %w", err))
+	}
+	if err := w.file.Sync(); err != nil {
+		return w.cutOff(fmt.Errorf("syncing write-ahead log: %w", err))
+	}
+	w.size += int64(len(frame))
+	w.records++
+	return nil
+}
+
+// cutOff removes what a failed append left behind and returns err, along
+// with the reason the log is unusable if it could not.
+func (w *writeAheadLog) cutOff(err error) error {
+	if resetErr := w.reset(w.size); resetErr != nil {
+		w.failed = fmt.Errorf("cutting off a failed write: %w", resetErr)
+		return errors.Join(err, w.failed)
+	}
+	return err
+}
+
+// reset truncates the log to size and positions the next write there.
+func (w *writeAheadLog) reset(size int64) error {
+	if err := w.file.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = size
+	return nil
+}
+
+// readWALRecords decodes the records in data. It stops at the first record
+// that is incomplete or fails its checksum, which is what a crash in the
+// middle of an append leaves behind, and reports the length of the valid
+// prefix so the damaged tail can be discarded.
+func readWALRecords(data []byte) ([]walRecord, int64) {
+	var records []walRecord
+	var offset int64
+	for {
+		rest := data[offset:]
+		if len(rest) < walHeaderSize {
+			return records, offset
+		}
+		length := int64(binary.BigEndian.Uint32(rest[0:4]))
+		if int64(len(rest)-walHeaderSize) < length {
+			return records, offset
+		}
+		payload := rest[walHeaderSize : walHeaderSize+length]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(rest[4:8]) {
+			return records, offset
+		}
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return records, offset
+		}
+		records = append(records, rec)
+		offset += walHeaderSize + length
+	}
+}
+
+// restore loads the snapshot and replays the write-ahead log found in the
+// persistence directory, then opens the log for appending.
+func (s *MemoryStore) restore() error {
+	if err := os.MkdirAll(s.persistDir, 0o755); err != nil {
+		return fmt.Errorf("creating persistence directory: %w", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.persistDir, snapshotFileName))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("reading snapshot: %w", err)
+	default:
+		var snapshot memorySnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return fmt.Errorf("decoding snapshot: %w", err)
+		}
+		for _, device := range snapshot.Devices {
+			s.devices[device.ID] = device
+		}
+		for _, location := range snapshot.Locations {
+			s.locations[location.ID] = location
+		}
+		for _, event := range snapshot.Events {
+			s.events[event.ID] = event
+			s.eventSeq = max(s.eventSeq, event.Sequence)
+		}
+		for _, record := range snapshot.IdempotencyRecords {
+			s.idempotency[record.Key] = record
+		}
+		s.seq = snapshot.Seq
+	}
+
+	file, err := os.OpenFile(filepath.Join(s.persistDir, walFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening write-ahead log: %w", err)
+	}
+	data, err = io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("reading write-ahead log: %w", err)
+	}
+	records, validSize := readWALRecords(data)
+	wal := &writeAheadLog{file: file}
+	if err := wal.reset(validSize); err != nil {
+		file.Close()
+		return fmt.Errorf("truncating write-ahead log: %w", err)
+	}
+	for _, rec := range records {
+		// Records up to the snapshot's sequence number are already part of
+		// it; they remain when a crash hits between the two files.
+		if rec.Seq <= s.seq {
+			continue
+		}
+		for _, op := range rec.Ops {
+			s.apply(op)
+		}
+		s.seq = rec.Seq
+		wal.records++
+	}
+	s.wal = wal
+	return nil
+}
+
+// compact writes a snapshot of the current state and empties the log. The
+// snapshot replaces the previous one atomically, so a crash at any point
+// leaves either the old snapshot and full log or the new snapshot behind.
+// The caller must hold the write lock.
+func (s *MemoryStore) compact() error {
+	if err := s.writeSnapshot(); err != nil {
+		// The log still holds every record, so nothing is lost; the next
+		// commit will try again.
+		log.Printf("memory store: writing snapshot: %v", err)
+		return err
+	}
+	if err := s.wal.reset(0); err != nil {
+		return fmt.Errorf("truncating write-ahead log: %w", err)
+	}
+	s.wal.records = 0
+	return nil
+}
+
+func (s *MemoryStore) writeSnapshot() error {
+	snapshot := memorySnapshot{
+		Seq:       s.seq,
+		Devices:   make([]*models.Device, 0, len(s.devices)),
+		Locations: make([]*models.Location, 0, len(s.locations)),
+		Events:    make([]*models.Event, 0, len(s.events)),
+	}
+	for _, device := range s.devices {
+		snapshot.Devices = append(snapshot.Devices, device)
+	}
+	for _, location := range s.locations {
+		snapshot.Locations = append(snapshot.Locations, location)
+	}
+	for _, event := range s.events {
+		snapshot.Events = append(snapshot.Events, event)
+	}
+	now := time.Now()
+	for _, record := range s.idempotency {
+		if now.Before(record.ExpiresAt) {
+			snapshot.IdempotencyRecords = append(snapshot.IdempotencyRecords, record)
+		}
+	}
+
+	tmp, err := os.CreateTemp(s.persistDir, snapshotFileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := json.NewEncoder(tmp).Encode(snapshot); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.persistDir, snapshotFileName)); err != nil {
+		return err
+	}
+	// Make the rename itself durable before the log is emptied.
+	dir, err := os.Open(s.persistDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Close writes a final snapshot and closes the write-ahead log. It is a
+// no-op for stores without persistence.
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wal == nil {
+		return nil
+	}
+	err := s.compact()
+	if closeErr := s.wal.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.wal = nil
+	return err
+}
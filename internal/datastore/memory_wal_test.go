@@ -0,0 +1,275 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+func openPersistentStore(t *testing.T, dir string, opts ...MemoryStoreOption) *MemoryStore {
+	t.Helper()
+	store, err := NewMemoryStore(append([]MemoryStoreOption{WithPersistence(dir)}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	return store
+}
+
+// crash abandons a store without the final snapshot Close would write.
+func crash(store *MemoryStore) {
+	store.wal.file.Close()
+}
+
+func createTestDevice(t *testing.T, store *MemoryStore, name string) *models.Device {
+	t.Helper()
+	device, err := store.CreateDevice(&models.Device{Name: name, ComponentType: "Node", Status: "active"})
+	if err != nil {
+		t.Fatalf("CreateDevice: %v", err)
+	}
+	return device
+}
+
+func TestMemoryStoreReplaysLog(t *testing.T) {
+	dir := t.TempDir()
+	store := openPersistentStore(t, dir)
+
+	node := createTestDevice(t, store, "node-1")
+	removed := createTestDevice(t, store, "node-2")
+	if _, err := store.CreateLocation(&models.Location{ID: "slot-1", Name: "Slot 1", Status: "empty"}); err != nil {
+		t.Fatalf("CreateLocation: %v", err)
+	}
+	if _, _, err := store.InstallDevice("slot-1", node.ID, "tester"); err != nil {
+		t.Fatalf("InstallDevice: %v", err)
+	}
+	node, _ = store.GetDeviceByID(node.ID)
+	node.Status = "failed"
+	if _, err := store.UpdateDevice(node.ID, node, "tester"); err != nil {
+		t.Fatalf("UpdateDevice: %v", err)
+	}
+	if err := store.DeleteDevice(removed.ID, DeleteOptions{}); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	crash(store)
+
+	store = openPersistentStore(t, dir)
+	defer store.Close()
+	got, err := store.GetDeviceByID(node.ID)
+	if err != nil {
+		t.Fatalf("device lost after replay: %v", err)
+	}
+	if got.Status != "failed" || got.CurrentLocationID == nil || *got.CurrentLocationID != "slot-1" {
+		t.Errorf("replayed device = %+v, want the updated, installed device", got)
+	}
+	if _, err := store.GetDeviceByID(removed.ID); err == nil {
+		t.Errorf("deleted device came back after replay")
+	}
+	location, err := store.GetLocationByID("slot-1")
+	if err != nil || location.CurrentDeviceID == nil || *location.CurrentDeviceID != node.ID {
+		t.Errorf("replayed location = %+v, %v; want it to hold %s", location, err, node.ID)
+	}
+	if events, _, _ := store.ListEventsByDeviceID(node.ID, ListOptions{}); len(events) != 1 {
+		t.Errorf("got %d events for the installed device, want 1", len(events))
+	}
+}
+
+func TestMemoryStoreKeepsEventSequence(t *testing.T) {
+	dir := t.TempDir()
+	store := openPersistentStore(t, dir, WithSnapshotEvery(2))
+	var last int64
+	for i := 0; i < 3; i++ {
+		event, err := store.CreateEvent(&models.Event{Type: "com.example.test"})
+		if err != nil {
+			t.Fatalf("CreateEvent: %v", err)
+		}
+		last = event.Sequence
+	}
+	crash(store)
+
+	// The first two events are in the snapshot, the third in the log.
+	store = openPersistentStore(t, dir)
+	defer store.Close()
+	event, err := store.CreateEvent(&models.Event{Type: "com.example.test"})
+	if err != nil || event.Sequence != last+1 {
+		t.Errorf("sequence after reopening = %d, %v; want %d", event.Sequence, err, last+1)
+	}
+}
+
+func TestMemoryStoreKeepsIdempotencyKeys(t *testing.T) {
+	dir := t.TempDir()
+	store := openPersistentStore(t, dir, WithSnapshotEvery(2))
+	expiresAt := time.Now().Add(time.Hour)
+	for _, key := range []string{"a", "b", "c"} {
+		record := IdempotencyRecord{Key: key, Fingerprint: "f", ExpiresAt: expiresAt}
+		store.ReserveIdempotencyKey(record)
+		record.Status = 201
+		if err := store.CompleteIdempotencyKey(record); err != nil {
+			t.Fatalf("CompleteIdempotencyKey(%s): %v", key, err)
+		}
+	}
+	crash(store)
+
+	// Some records are in the snapshot, the rest in the log.
+	store = openPersistentStore(t, dir)
+	defer store.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		existing, err := store.ReserveIdempotencyKey(IdempotencyRecord{Key: key, Fingerprint: "f", ExpiresAt: expiresAt})
+		if err != nil || existing == nil || existing.Status != 201 {
+			t.Errorf("idempotency key %s after reopening = %+v, %v; want the stored response", key, existing, err)
+		}
+	}
+}
+
+func TestMemoryStoreSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	store := openPersistentStore(t, dir, WithSnapshotEvery(3))
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		createTestDevice(t, store, name)
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotFileName)); err != nil {
+		t.Fatalf("no snapshot after exceeding the threshold: %v", err)
+	}
+	if store.wal.records != 2 {
+		t.Errorf("log holds %d records after compaction, want 2", store.wal.records)
+	}
+	crash(store)
+
+	store = openPersistentStore(t, dir, WithSnapshotEvery(3))
+	if devices, _, _ := store.ListDevices(DeviceFilter{}, ListOptions{}); len(devices) != 5 {
+		t.Fatalf("got %d devices from snapshot and log, want 5", len(devices))
+	}
+	createTestDevice(t, store, "f")
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, walFileName)); err != nil || info.Size() != 0 {
+		t.Errorf("log not emptied by the final snapshot: %v, %v", info, err)
+	}
+
+	store = openPersistentStore(t, dir)
+	defer store.Close()
+	if devices, _, _ := store.ListDevices(DeviceFilter{}, ListOptions{}); len(devices) != 6 {
+		t.Fatalf("got %d devices after a clean shutdown, want 6", len(devices))
+	}
+}
+
+func TestMemoryStoreSkipsRecordsInSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store := openPersistentStore(t, dir)
+	createTestDevice(t, store, "a")
+	createTestDevice(t, store, "b")
+	// Simulate a crash after the snapshot was renamed into place but before
+	// the log was emptied.
+	if err := store.writeSnapshot(); err != nil {
+		t.Fatalf("writeSnapshot: %v", err)
+	}
+	crash(store)
+
+	store = openPersistentStore(t, dir)
+	defer store.Close()
+	if devices, _, _ := store.ListDevices(DeviceFilter{}, ListOptions{}); len(devices) != 2 {
+		t.Fatalf("got %d devices, want 2", len(devices))
+	}
+	if store.seq != 2 {
+		t.Errorf("sequence = %d after replay, want 2", store.seq)
+	}
+}
+
+func TestMemoryStoreRecoversFromTornLog(t *testing.T) {
+	tests := []struct {
+		name string
+		// survivors is how many of the three logged devices remain.
+		survivors int
+		damage    func(t *testing.T, path string)
+	}{
+		{"TruncatedPayload", 2, func(t *testing.T, path string) {
+			info, _ := os.Stat(path)
+			if err := os.Truncate(path, info.Size()-5); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"TruncatedHeader", 3, func(t *testing.T, path string) {
+			appendBytes(t, path, []byte{0, 0, 1})
+		}},
+		{"CorruptChecksum", 2, func(t *testing.T, path string) {
+			data, _ := os.ReadFile(path)
+			data[len(data)-2] ^= 0xff
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openPersistentStore(t, dir)
+			createTestDevice(t, store, "a")
+			createTestDevice(t, store, "b")
+			last := createTestDevice(t, store, "c")
+			crash(store)
+
+			tt.damage(t, filepath.Join(dir, walFileName))
+
+			store = openPersistentStore(t, dir)
+			want := tt.survivors
+			if devices, _, _ := store.ListDevices(DeviceFilter{}, ListOptions{}); len(devices) != want {
+				t.Fatalf("got %d devices after recovery, want %d", len(devices), want)
+			}
+			if _, err := store.GetDeviceByID(last.ID); (err == nil) != (want == 3) {
+				t.Errorf("last device present = %v, want %v", err == nil, want == 3)
+			}
+
+			// The damaged tail must be gone, or it would hide new records.
+			createTestDevice(t, store, "d")
+			crash(store)
+			store = openPersistentStore(t, dir)
+			defer store.Close()
+			if devices, _, _ := store.ListDevices(DeviceFilter{}, ListOptions{}); len(devices) != want+1 {
+				t.Fatalf("got %d devices after writing past the damage, want %d", len(devices), want+1)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreRefusesWritesAfterLogFailure(t *testing.T) {
+	dir := t.TempDir()
+	store := openPersistentStore(t, dir)
+	kept := createTestDevice(t, store, "a")
+
+	// A read-only handle fails both the write and cutting it off again.
+	writable := store.wal.file
+	readOnly, err := os.Open(writable.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.wal.file = readOnly
+	if _, err := store.CreateDevice(&models.Device{Name: "b", ComponentType: "Node", Status: "active"}); err == nil {
+		t.Fatalf("CreateDevice succeeded on a read-only log")
+	}
+	readOnly.Close()
+	store.wal.file = writable
+	if _, err := store.CreateDevice(&models.Device{Name: "c", ComponentType: "Node", Status: "active"}); err == nil {
+		t.Fatalf("CreateDevice succeeded after the log could not be repaired")
+	}
+	crash(store)
+
+	store = openPersistentStore(t, dir)
+	defer store.Close()
+	if devices, _, _ := store.ListDevices(DeviceFilter{}, ListOptions{}); len(devices) != 1 || devices[0].ID != kept.ID {
+		t.Errorf("devices after reopening = %+v, want only %s", devices, kept.ID)
+	}
+}
+
+func appendBytes(t *testing.T, path string, data []byte) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
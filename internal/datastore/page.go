@@ -0,0 +1,230 @@
+package datastore
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// sortKind is the type of a sortable field's values.
+type sortKind int
+
+const (
+	sortString sortKind = iota
+	sortTime
+	sortInt
+)
+
+// sortField is a field of T that lists can be ordered by.
+type sortField[T any] struct {
+	column string
+	kind   sortKind
+	// value returns the field of a record as a string, time.Time or int64,
+	// as kind says.
+	value func(*T) any
+}
+
+// sortable lists the fields records of type T can be ordered by, and the
+// order used when a list asks for none. The default order ends in a unique
+// field, and breaks the ties of any requested order.
+type sortable[T any] struct {
+	fields   map[string]sortField[T]
+	defaults []string
+}
+
+var deviceOrder = sortable[models.Device]{
+	fields: map[string]sortField[models.Device]{
+		"id":            {"id", sortString, func(d *models.Device) any { return d.ID }},
+		"name":          {"name", sortString, func(d *models.Device) any { return d.Name }},
+		"componentType": {"component_type", sortString, func(d *models.Device) any { return d.ComponentType }},
+		"manufacturer":  {"manufacturer", sortString, func(d *models.Device) any { return d.Manufacturer }},
+		"partNumber":    {"part_number", sortString, func(d *models.Device) any { return d.PartNumber }},
+		"serialNumber":  {"serial_number", sortString, func(d *models.Device) any { return d.SerialNumber }},
+		"status":        {"status", sortString, func(d *models.Device) any { return d.Status }},
+		"createdAt":     {"created_at", sortTime, func(d *models.Device) any { return d.CreatedAt }},
+	},
+	defaults: []string{"createdAt", "id"},
+}
+
+var locationOrder = sortable[models.Location]{
+	fields: map[string]sortField[models.Location]{
+		"id":           {"id", sortString, func(l *models.Location) any { return l.ID }},
+		"name":         {"name", sortString, func(l *models.Location) any { return l.Name }},
+		"locationType": {"location_type", sortString, func(l *models.Location) any { return l.LocationType }},
+		"status":       {"status", sortString, func(l *models.Location) any { return l.Status }},
+		"createdAt":    {"created_at", sortTime, func(l *models.Location) any { return l.CreatedAt }},
+	},
+	defaults: []string{"createdAt", "id"},
+}
+
+var eventOrder = sortable[models.Event]{
+	fields: map[string]sortField[models.Event]{
+		"id":       {"id", sortString, func(e *models.Event) any { return e.ID }},
+		"type":     {"type", sortString, func(e *models.Event) any { return e.Type }},
+		"time":     {"time", sortTime, func(e *models.Event) any { return e.Time }},
+		"sequence": {"sequence", sortInt, func(e *models.Event) any { return e.Sequence }},
+	},
+	defaults: []string{"time", "sequence", "id"},
+}
+
+// sortKey is one field of a resolved list order.
+type sortKey struct {
+	name       string
+	column     string
+	kind       sortKind
+	descending bool
+}
+
+// order resolves the requested sort into the full list of keys, appending
+// the default order to break ties.
+func (o sortable[T]) order(requested []SortField) ([]sortKey, error) {
+	var keys []sortKey
+	seen := map[string]bool{}
+	add := func(name string, descending bool) error {
+		field, ok := o.fields[name]
+		if !ok {
+			return fmt.Errorf("%w %q", ErrInvalidSort, name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			keys = append(keys, sortKey{name: name, column: field.column, kind: field.kind, descending: descending})
+		}
+		return nil
+	}
+	for _, field := range requested {
+		if err := add(field.Field, field.Descending); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range o.defaults {
+		add(name, false)
+	}
+	return keys, nil
+}
+
+// values returns the sort key values of record.
+func (o sortable[T]) values(keys []sortKey, record *T) []any {
+	values := make([]any, len(keys))
+	for i, key := range keys {
+		values[i] = o.fields[key.name].value(record)
+	}
+	return values
+}
+
+// compareKeys orders two records by their sort key values.
+func compareKeys(keys []sortKey, a, b []any) int {
+	for i, key := range keys {
+		var c int
+		switch av := a[i].(type) {
+		case string:
+			c = strings.Compare(av, b[i].(string))
+		case time.Time:
+			c = av.Compare(b[i].(time.Time))
+		case int64:
+			c = cmp.Compare(av, b[i].(int64))
+		}
+		if key.descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// cursor is the position of a record in a list: the values of its sort
+// keys, along with the requested sort they belong to. It travels to clients
+// as an opaque token.
+type cursor struct {
+	Sort   string   `json:"s,omitempty"`
+	Values []string `json:"v"`
+}
+
+// sortSpec formats a requested sort the way the service accepts it.
+func sortSpec(requested []SortField) string {
+	fields := make([]string, len(requested))
+	for i, field := range requested {
+		fields[i] = field.Field
+		if field.Descending {
+			fields[i] = "-" + field.Field
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+func encodeCursor(requested []SortField, values []any) string {
+	c := cursor{Sort: sortSpec(requested), Values: make([]string, len(values))}
+	for i, value := range values {
+		switch v := value.(type) {
+		case string:
+			c.Values[i] = v
+		case time.Time:
+			c.Values[i] = v.UTC().Format(time.RFC3339Nano)
+		case int64:
+			c.Values[i] = strconv.FormatInt(v, 10)
+		}
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor returns the sort key values encoded in token, which must
+// have been issued for the same requested sort.
+func decodeCursor(token string, requested []SortField, keys []sortKey) ([]any, error) {
+	invalid := fmt.Errorf("%w %q", ErrInvalidCursor, token)
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || json.Unmarshal(data, &c) != nil || len(c.Values) != len(keys) {
+		return nil, invalid
+	}
+	if c.Sort != sortSpec(requested) {
+		return nil, fmt.Errorf("%w: it continues a list sorted by %q", ErrInvalidCursor, c.Sort)
+	}
+	values := make([]any, len(keys))
+	for i, key := range keys {
+		switch key.kind {
+		case sortString:
+			values[i] = c.Values[i]
+		case sortTime:
+			values[i], err = time.Parse(time.RFC3339Nano, c.Values[i])
+		case sortInt:
+			values[i], err = strconv.ParseInt(c.Values[i], 10, 64)
+		}
+		if err != nil {
+			return nil, invalid
+		}
+	}
+	return values, nil
+}
+
+// paginate sorts items as opts asks and cuts out the requested page.
+func paginate[T any](items []T, opts ListOptions, order sortable[T]) ([]T, Page, error) {
+	keys, err := order.order(opts.Sort)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	values := func(i int) []any { return order.values(keys, &items[i]) }
+	sort.Slice(items, func(i, j int) bool { return compareKeys(keys, values(i), values(j)) < 0 })
+	page := Page{Total: len(items)}
+	if opts.After != "" {
+		after, err := decodeCursor(opts.After, opts.Sort, keys)
+		if err != nil {
+			return nil, Page{}, err
+		}
+		items = items[sort.Search(len(items), func(i int) bool { return compareKeys(keys, values(i), after) > 0 }):]
+	}
+	items = items[min(opts.Offset, len(items)):]
+	if opts.Limit > 0 && len(items) > opts.Limit {
+		items = items[:opts.Limit]
+		page.Next = encodeCursor(opts.Sort, values(len(items)-1))
+	}
+	return items, page, nil
+}
@@ -0,0 +1,361 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Patch is a partial update of a device or location, expressed against its
+// JSON form.
+type Patch struct {
+	Type PatchType
+	// Document is the patch itself, in the format Type names.
+	Document []byte
+}
+
+// PatchType is the media type of a patch document.
+type PatchType string
+
+const (
+	// MergePatch is a JSON Merge Patch (RFC 7396): an object whose members
+	// replace those of the record, null removing them.
+	MergePatch PatchType = "application/merge-patch+json"
+	// JSONPatch is a JSON Patch (RFC 6902): a list of operations on the
+	// record, applied in order.
+	JSONPatch PatchType = "application/json-patch+json"
+)
+
+// PatchOptions controls how a device or location is patched.
+type PatchOptions struct {
+	// ResourceVersion, when non-zero, only patches the record if it is still
+	// at this version.
+	ResourceVersion int64
+	// Actor is recorded on the updated event, and on the detached and
+	// attached events of a move to another parent.
+	Actor string
+}
+
+// immutableFields are the JSON fields a patch must leave as they are.
+var immutableFields = []string{"id", "createdAt"}
+
+// serverFields are the JSON fields the datastore maintains itself. Patches
+// to them are ignored, as they are in full updates; a JSON Patch can still
+// test them.
+var serverFields = []string{"resourceVersion", "updatedAt", "deletedAt", "path", "currentLocationId", "currentDeviceId"}
+
+// patchRecord applies patch to the JSON form of record and returns the
+// result, along with the fields whose values changed as they were before and
+// after.
+func patchRecord[T any](record *T, patch Patch) (patched *T, before, after map[string]interface{}, err error) {
+	doc, err := toJSONObject(record)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	original := cloneProperties(doc)
+	var result interface{}
+	switch patch.Type {
+	case MergePatch:
+		var document interface{}
+		if err := json.Unmarshal(patch.Document, &document); err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		if _, ok := document.(map[string]interface{}); !ok {
+			return nil, nil, nil, fmt.Errorf("%w: a merge patch must be an object", ErrInvalidPatch)
+		}
+		result = mergePatch(doc, document)
+	case JSONPatch:
+		var ops []patchOperation
+		if err := json.Unmarshal(patch.Document, &ops); err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		if result, err = applyJSONPatch(doc, ops); err != nil {
+			return nil, nil, nil, err
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("%w: unsupported patch type %q", ErrInvalidPatch, patch.Type)
+	}
+
+	object, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, nil, nil, errorf(ErrInvalid, "a patch must leave an object")
+	}
+	for _, field := range immutableFields {
+		if !reflect.DeepEqual(object[field], original[field]) {
+			return nil, nil, nil, &ValidationError{Fields: []FieldError{{Field: field, Message: field + " cannot be changed"}}}
+		}
+	}
+	for _, field := range serverFields {
+		if value, ok := original[field]; ok {
+			object[field] = value
+		} else {
+			delete(object, field)
+		}
+	}
+	data, _ := json.Marshal(object)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	patched = new(T)
+	if err := decoder.Decode(patched); err != nil {
+		return nil, nil, nil, errorf(ErrInvalid, "patched record is malformed: %v", err)
+	}
+	// Compare the decoded result, so that changes the model cannot hold do
+	// not count.
+	object, _ = toJSONObject(patched)
+	before, after = map[string]interface{}{}, map[string]interface{}{}
+	for field := range mergeKeys(original, object) {
+		if !reflect.DeepEqual(original[field], object[field]) {
+			before[field], after[field] = original[field], object[field]
+		}
+	}
+	return patched, before, after, nil
+}
+
+func toJSONObject(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encoding record: %w", err)
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+	return object, nil
+}
+
+func mergeKeys(a, b map[string]interface{}) map[string]bool {
+	keys := make(map[string]bool, len(a)+len(b))
+	for key := range a {
+		keys[key] = true
+	}
+	for key := range b {
+		keys[key] = true
+	}
+	return keys
+}
+
+// mergePatch applies a JSON Merge Patch to target, as RFC 7396 describes.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// patchOperation is one operation of a JSON Patch.
+type patchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// applyJSONPatch applies ops to doc in order, as RFC 6902 describes. A
+// malformed operation fails with ErrInvalidPatch, and one that does not fit
+// the document, including a failed test, with ErrPatchConflict.
+func applyJSONPatch(doc interface{}, ops []patchOperation) (interface{}, error) {
+	for i, op := range ops {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+		}
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("%w: operation %d: %s needs a value", ErrInvalidPatch, i, op.Op)
+			}
+			if err := json.Unmarshal(*op.Value, &value); err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+			}
+		case "move", "copy":
+			from, err := parsePointer(op.From)
+			if err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %v", ErrInvalidPatch, i, err)
+			}
+			if value, err = pointerGet(doc, from); err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %v", ErrPatchConflict, i, err)
+			}
+			if op.Op == "move" {
+				if strings.HasPrefix(op.Path, op.From+"/") {
+					return nil, fmt.Errorf("%w: operation %d: cannot move %s into itself", ErrInvalidPatch, i, op.From)
+				}
+				if doc, err = pointerRemove(doc, from); err != nil {
+					return nil, fmt.Errorf("%w: operation %d: %v", ErrPatchConflict, i, err)
+				}
+			} else {
+				value = cloneJSONValue(value)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("%w: operation %d: unknown op %q", ErrInvalidPatch, i, op.Op)
+		}
+
+		switch op.Op {
+		case "add", "move", "copy":
+			doc, err = pointerAdd(doc, path, value)
+		case "replace":
+			if _, err = pointerGet(doc, path); err == nil {
+				doc, err = pointerSet(doc, path, value)
+			}
+		case "remove":
+			doc, err = pointerRemove(doc, path)
+		case "test":
+			var current interface{}
+			if current, err = pointerGet(doc, path); err == nil && !reflect.DeepEqual(current, value) {
+				err = fmt.Errorf("%s is not %s", op.Path, *op.Value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: operation %d: %v", ErrPatchConflict, i, err)
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("path %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex resolves token as an index into an array of length n; "-"
+// stands for n when end is allowed.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if token == "-" && end {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("%q is not an array index", token)
+	}
+	if i > n || (i == n && !end) {
+		return 0, fmt.Errorf("index %d is out of range", i)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q does not exist", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("cannot look up %q in a scalar", token)
+		}
+	}
+	return doc, nil
+}
+
+// pointerAdd returns doc with value added at path. Objects are modified in
+// place; arrays are replaced by grown copies.
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), true)
+		if err != nil {
+			return nil, err
+		}
+		grown := append(append(append([]interface{}{}, node[:i]...), value), node[i:]...)
+		return pointerSet(doc, path[:len(path)-1], grown)
+	}
+	return nil, fmt.Errorf("cannot add %q to a scalar", last)
+}
+
+// pointerRemove returns doc with the value at path removed.
+func pointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole record")
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := node[last]; !ok {
+			return nil, fmt.Errorf("member %q does not exist", last)
+		}
+		delete(node, last)
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		shrunk := append(append([]interface{}{}, node[:i]...), node[i+1:]...)
+		return pointerSet(doc, path[:len(path)-1], shrunk)
+	}
+	return nil, fmt.Errorf("cannot remove %q from a scalar", last)
+}
+
+// pointerSet returns doc with the existing value at path replaced by value.
+func pointerSet(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		i, err := arrayIndex(last, len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = value
+	default:
+		return nil, fmt.Errorf("cannot set %q in a scalar", last)
+	}
+	return doc, nil
+}
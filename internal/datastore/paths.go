@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// PathSeparator joins the names of a location and its ancestors into its
+// path, as in "site-a/row-3/x1000".
+const PathSeparator = "/"
+
+// locationPath builds the path of location id. lookup returns the name and
+// parent of a stored location; the path stops where the chain of parents is
+// broken or loops, and is empty if id itself is unknown.
+func locationPath(id string, lookup func(id string) (name string, parent *string, ok bool)) string {
+	var names []string
+	seen := map[string]bool{}
+	for current := &id; current != nil && !seen[*current]; {
+		seen[*current] = true
+		name, parent, ok := lookup(*current)
+		if !ok {
+			break
+		}
+		names = append(names, name)
+		current = parent
+	}
+	slices.Reverse(names)
+	return strings.Join(names, PathSeparator)
+}
+
+// orderAncestors returns the ancestors of location id among locations, from
+// the root down to its parent. It reports false if id is not among them.
+func orderAncestors(id string, locations []*models.Location) ([]models.Location, bool) {
+	byID := make(map[string]*models.Location, len(locations))
+	for _, location := range locations {
+		byID[location.ID] = location
+	}
+	location, ok := byID[id]
+	if !ok {
+		return nil, false
+	}
+	ancestors := []models.Location{}
+	seen := map[string]bool{id: true}
+	for parent := location.ParentLocationID; parent != nil && !seen[*parent]; {
+		seen[*parent] = true
+		ancestor, ok := byID[*parent]
+		if !ok {
+			break
+		}
+		ancestors = append(ancestors, *ancestor)
+		parent = ancestor.ParentLocationID
+	}
+	slices.Reverse(ancestors)
+	return ancestors, true
+}
@@ -0,0 +1,152 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the "pgx" database/sql driver
+)
+
+// postgresMigrations are the schema changes for PostgresStore, applied in order by
+// migrate. Append new steps; never edit one that has been released.
+var postgresMigrations = []string{
+	postgresSchema,
+	addResourceVersionColumns,
+	addUniqueIndexes,
+	postgresAddEventSequence,
+	postgresAddLabels,
+	postgresAddIdempotencyKeys,
+}
+
+// postgresSchema creates the tables used by PostgresStore.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS devices (
+	id                  TEXT PRIMARY KEY,
+	name                TEXT NOT NULL,
+	hostname            TEXT,
+	component_type      TEXT NOT NULL,
+	manufacturer        TEXT NOT NULL,
+	part_number         TEXT NOT NULL,
+	serial_number       TEXT NOT NULL,
+	current_location_id TEXT,
+	status              TEXT NOT NULL,
+	properties          JSONB,
+	parent_device_id    TEXT,
+	children_device_ids JSONB,
+	created_at          TIMESTAMPTZ NOT NULL,
+	updated_at          TIMESTAMPTZ,
+	deleted_at          TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS devices_name_idx ON devices (name);
+CREATE INDEX IF NOT EXISTS devices_serial_number_idx ON devices (serial_number);
+
+CREATE TABLE IF NOT EXISTS locations (
+	id                    TEXT PRIMARY KEY,
+	name                  TEXT NOT NULL,
+	location_type         TEXT NOT NULL,
+	parent_location_id    TEXT,
+	children_location_ids JSONB,
+	current_device_id     TEXT,
+	status                TEXT NOT NULL,
+	properties            JSONB,
+	created_at            TIMESTAMPTZ NOT NULL,
+	updated_at            TIMESTAMPTZ,
+	deleted_at            TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS locations_name_idx ON locations (name);
+
+CREATE TABLE IF NOT EXISTS events (
+	id                TEXT PRIMARY KEY,
+	source            TEXT NOT NULL,
+	spec_version      TEXT NOT NULL,
+	type              TEXT NOT NULL,
+	data_content_type TEXT,
+	subject           TEXT,
+	time              TIMESTAMPTZ NOT NULL,
+	device_id         TEXT,
+	location_id       TEXT,
+	actor             TEXT,
+	comment           TEXT,
+	duration          INTEGER,
+	state_before      JSONB,
+	state_after       JSONB
+);
+CREATE INDEX IF NOT EXISTS events_device_id_idx ON events (device_id, time);
+CREATE INDEX IF NOT EXISTS events_location_id_idx ON events (location_id, time);
+`
+
+// postgresAddEventSequence numbers the existing events in an arbitrary order;
+// only events sharing a timestamp are ordered by it.
+const postgresAddEventSequence = `
+ALTER TABLE events ADD COLUMN sequence BIGSERIAL;
+CREATE INDEX events_time_sequence_idx ON events (time, sequence);
+`
+
+// postgresAddLabels adds the labels of devices and locations.
+const postgresAddLabels = `
+ALTER TABLE devices ADD COLUMN labels JSONB;
+ALTER TABLE locations ADD COLUMN labels JSONB;
+` + addLabelTables
+
+// postgresAddIdempotencyKeys remembers requests sent with an Idempotency-Key
+// and the responses to them.
+const postgresAddIdempotencyKeys = `
+CREATE TABLE idempotency_keys (
+	key         TEXT PRIMARY KEY,
+	fingerprint TEXT NOT NULL,
+	status      INTEGER NOT NULL,
+	header      JSONB,
+	body        BYTEA,
+	expires_at  TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+`
+
+var postgresDialect = sqlDialect{
+	textCollation:     ` COLLATE "C"`,
+	nextEventSequence: `nextval('events_sequence_seq')`,
+	lockHierarchy:     `SELECT pg_advisory_xact_lock(hashtext('inventory hierarchy'))`,
+	forShare:          ` FOR SHARE`,
+	jsonPath:          func(keys []string) any { return keys },
+	jsonType: func(column, path string) string {
+		return fmt.Sprintf("jsonb_typeof(jsonb_extract_path(%s, VARIADIC %s::text[]))", column, path)
+	},
+	jsonScalar: func(column, path, kind string) string {
+		text := fmt.Sprintf("jsonb_extract_path_text(%s, VARIADIC %s::text[])", column, path)
+		switch kind {
+		case "number":
+			return text + "::double precision"
+		case "boolean":
+			return text + "::boolean"
+		}
+		return text
+	},
+}
+
+// PostgresStore is a PostgreSQL implementation of the Datastore interface.
+type PostgresStore struct {
+	*sqlStore
+}
+
+// NewPostgresStore connects to the database described by dsn, migrates the
+// schema to the current version and returns a ready to use PostgresStore.
+func NewPostgresStore(dsn string, opts ...SQLStoreOption) (*PostgresStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening postgres connection: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+	if err := migrate(db, postgresMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating postgres schema: %w", err)
+	}
+	store := newSQLStore(db, postgresDialect, opts)
+	if err := applyLocationNameScope(db, store.locationNameScope); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresStore{sqlStore: store}, nil
+}
@@ -0,0 +1,1919 @@
+package datastore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+	"github.com/google/uuid"
+)
+
+// Schema migrations shared by the PostgreSQL and SQLite backends.
+const (
+	addResourceVersionColumns = `
+ALTER TABLE devices ADD COLUMN resource_version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE locations ADD COLUMN resource_version BIGINT NOT NULL DEFAULT 1;
+`
+	// addUniqueIndexes backs the uniqueness checks against concurrent
+	// writers. Location names are always unique per parent; applyLocationNameScope
+	// adds the stricter global index when configured.
+	addUniqueIndexes = `
+CREATE UNIQUE INDEX devices_name_key ON devices (name) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX devices_serial_number_key ON devices (manufacturer, serial_number)
+	WHERE deleted_at IS NULL AND serial_number <> '';
+CREATE UNIQUE INDEX locations_parent_name_key ON locations (COALESCE(parent_location_id, ''), name)
+	WHERE deleted_at IS NULL;
+`
+)
+
+const (
+	deviceColumns = `id, name, hostname, component_type, manufacturer, part_number, serial_number,
+		current_location_id, status, properties, parent_device_id, children_device_ids,
+		created_at, updated_at, deleted_at, resource_version, labels`
+	locationColumns = `id, name, location_type, parent_location_id, children_location_ids,
+		current_device_id, status, properties, created_at, updated_at, deleted_at, resource_version, labels`
+	eventColumns = `id, source, spec_version, type, data_content_type, subject, time,
+		device_id, location_id, actor, comment, duration, state_before, state_after, sequence`
+)
+
+var (
+	_ Datastore = (*PostgresStore)(nil)
+	_ Datastore = (*SQLiteStore)(nil)
+)
+
+// sqlStore implements the Datastore interface on top of database/sql. The
+// queries stick to SQL understood by both PostgreSQL and SQLite so the two
+// backends only differ in their schema and connection setup.
+type sqlStore struct {
+	conn *sql.DB
+	// db is conn itself, or the transaction this store is bound to.
+	db      querier
+	inTx    bool
+	dialect sqlDialect
+
+	locationNameScope LocationNameScope
+}
+
+// SQLStoreOption configures optional behaviour of the PostgreSQL and SQLite
+// backends.
+type SQLStoreOption func(*sqlStore)
+
+// WithSQLLocationNameScope sets among which locations a location name must
+// be unique. The default is LocationNamesGlobal.
+func WithSQLLocationNameScope(scope LocationNameScope) SQLStoreOption {
+	return func(s *sqlStore) { s.locationNameScope = scope }
+}
+
+// sqlDialect holds the few pieces of SQL that differ between the backends.
+type sqlDialect struct {
+	// textCollation follows text columns in ORDER BY clauses and cursor
+	// comparisons, so that text sorts bytewise as in MemoryStore.
+	textCollation string
+	// nextEventSequence is an expression for the sequence number of a new
+	// event.
+	nextEventSequence string
+	// lockHierarchy is a statement that makes writes setting a parent wait
+	// for each other until the end of their transactions, and forShare
+	// follows a SELECT to lock the rows it reads against writes until then.
+	// Both are empty where transactions never run concurrently.
+	lockHierarchy string
+	forShare      string
+
+	// jsonPath turns a property path into the argument the JSON functions
+	// below take as path.
+	jsonPath func(keys []string) any
+	// jsonType returns an expression for the type of the JSON value at path
+	// in column, named as by PostgreSQL's jsonb_typeof, or NULL if there is
+	// none.
+	jsonType func(column, path string) string
+	// jsonScalar returns an expression for the JSON value at path in column
+	// as an SQL value, given that its type is kind.
+	jsonScalar func(column, path, kind string) string
+}
+
+// querier is the subset of database/sql shared by *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func newSQLStore(conn *sql.DB, dialect sqlDialect, opts []SQLStoreOption) *sqlStore {
+	s := &sqlStore{conn: conn, db: conn, dialect: dialect}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Close releases the underlying database handle.
+func (s *sqlStore) Close() error {
+	return s.conn.Close()
+}
+
+// withTx runs fn with a store bound to a transaction, committing if fn
+// succeeds and rolling back otherwise. Nested calls join the outer
+// transaction.
+func (s *sqlStore) withTx(fn func(tx *sqlStore) error) error {
+	if s.inTx {
+		return fn(s)
+	}
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	txStore := *s
+	txStore.db, txStore.inTx = tx, true
+	if err := fn(&txStore); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+// migrate brings the schema up to date by applying the steps that are not
+// yet recorded in schema_migrations, each in its own transaction.
+func migrate(db *sql.DB, steps []string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var applied int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	for version := applied + 1; version <= len(steps); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(steps[version-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("applying migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("recording migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("committing migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// applyLocationNameScope creates the index that makes location names
+// globally unique, or drops it when names only need to be unique per parent.
+func applyLocationNameScope(db *sql.DB, scope LocationNameScope) error {
+	query := `CREATE UNIQUE INDEX IF NOT EXISTS locations_name_key ON locations (name) WHERE deleted_at IS NULL`
+	if scope == LocationNamesPerParent {
+		query = `DROP INDEX IF EXISTS locations_name_key`
+	}
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("applying location name scope: %w", err)
+	}
+	return nil
+}
+
+// --- Device Methods ---
+
+func (s *sqlStore) CreateDevice(device *models.Device) (*models.Device, error) {
+	if err := validateDevice(device); err != nil {
+		return nil, err
+	}
+	if err := checkChildren("childrenDeviceIds", device.ChildrenDeviceIDs, nil); err != nil {
+		return nil, err
+	}
+	device.ID = uuid.NewString()
+	device.ResourceVersion = 1
+	device.CreatedAt = now()
+	device.DeletedAt = nil
+	device.ChildrenDeviceIDs = nil
+	device.CurrentLocationID = nil
+	properties, children, labels, err := marshalDeviceJSON(device)
+	if err != nil {
+		return nil, err
+	}
+	err = s.withTx(func(tx *sqlStore) error {
+		if err := tx.lockHierarchy(device.ParentDeviceID); err != nil {
+			return err
+		}
+		if err := checkParent("device", "parentDeviceId", device.ID, device.ParentDeviceID, tx.deviceParent); err != nil {
+			return err
+		}
+		if err := tx.checkDeviceUnique(device); err != nil {
+			return err
+		}
+		_, err := tx.db.Exec(`INSERT INTO devices (`+deviceColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`,
+			device.ID, device.Name, device.Hostname, device.ComponentType, device.Manufacturer,
+			device.PartNumber, device.SerialNumber, device.CurrentLocationID, device.Status,
+			properties, device.ParentDeviceID, children, device.CreatedAt, device.UpdatedAt, device.DeletedAt,
+			device.ResourceVersion, labels)
+		if err != nil {
+			return fmt.Errorf("creating device: %w", err)
+		}
+		if err := tx.writeLabels(deviceLabels, device.ID, device.Labels); err != nil {
+			return err
+		}
+		if device.ParentDeviceID != nil {
+			return tx.refreshChildDevices(*device.ParentDeviceID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, s.explainWriteError(err, func() error { return s.checkDeviceUnique(device) })
+	}
+	return device, nil
+}
+
+func (s *sqlStore) GetDeviceByID(id string) (*models.Device, error) {
+	row := s.db.QueryRow(`SELECT `+deviceColumns+` FROM devices WHERE id = $1 AND deleted_at IS NULL`, id)
+	device, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errorf(ErrNotFound, "device with ID %s not found", id)
+	}
+	return device, err
+}
+
+func (s *sqlStore) GetDeviceByName(name string) (*models.Device, error) {
+	row := s.db.QueryRow(`SELECT `+deviceColumns+` FROM devices WHERE name = $1 AND deleted_at IS NULL LIMIT 1`, name)
+	device, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errorf(ErrNotFound, "device with name '%s' not found", name)
+	}
+	return device, err
+}
+
+func (s *sqlStore) ListDevices(filter DeviceFilter, opts ListOptions) ([]models.Device, Page, error) {
+	query, err := s.deviceQuery(filter, opts)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	return queryPage(s, query, opts, deviceOrder, scanDevice)
+}
+
+func (s *sqlStore) ListLocationDevices(id string, recursive bool, filter DeviceFilter, opts ListOptions) ([]models.Device, Page, error) {
+	query, err := s.deviceQuery(filter, opts)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	if _, err := s.GetLocationByID(id); err != nil {
+		return nil, Page{}, err
+	}
+	// UNION rather than UNION ALL stops at locations and devices already
+	// seen.
+	subtree := `SELECT id FROM locations WHERE id = ` + query.arg(id) + ` AND deleted_at IS NULL`
+	if recursive {
+		subtree += `
+		UNION
+		SELECT l.id FROM locations l JOIN subtree ON l.parent_location_id = subtree.id WHERE l.deleted_at IS NULL`
+	}
+	query.where = append(query.where, `id IN (WITH RECURSIVE subtree(id) AS (`+subtree+`),
+		installed(id) AS (
+		SELECT current_device_id FROM locations WHERE id IN (SELECT id FROM subtree) AND current_device_id IS NOT NULL
+		UNION
+		SELECT d.id FROM devices d JOIN installed ON d.parent_device_id = installed.id WHERE d.deleted_at IS NULL)
+		SELECT id FROM installed)`)
+	return queryPage(s, query, opts, deviceOrder, scanDevice)
+}
+
+// deviceQuery selects the devices filter matches.
+func (s *sqlStore) deviceQuery(filter DeviceFilter, opts ListOptions) (listQuery, error) {
+	query := listQuery{table: "devices", columns: deviceColumns}
+	query.excludeDeleted(opts)
+	query.equal("component_type", filter.ComponentType)
+	query.equal("manufacturer", filter.Manufacturer)
+	query.equal("part_number", filter.PartNumber)
+	query.equal("status", filter.Status)
+	query.equal("current_location_id", filter.CurrentLocationID)
+	query.equal("parent_device_id", filter.ParentDeviceID)
+	if err := filter.check(); err != nil {
+		return query, err
+	}
+	deviceLabels.where(&query, filter.Labels)
+	if filter.Expr != nil {
+		query.where = append(query.where, deviceFields.where(s, &query, filter.Expr))
+	}
+	return query, nil
+}
+
+func (s *sqlStore) UpdateDevice(id string, device *models.Device, actor string) (*models.Device, error) {
+	if err := validateDevice(device); err != nil {
+		return nil, err
+	}
+	device.ID = id
+	updatedAt := now()
+	device.UpdatedAt = &updatedAt
+	device.DeletedAt = nil
+	err := s.withTx(func(tx *sqlStore) error {
+		if err := tx.lockHierarchy(device.ParentDeviceID); err != nil {
+			return err
+		}
+		existing, err := tx.lockDevice(id, device.ResourceVersion)
+		if err != nil {
+			return err
+		}
+		if err := checkChildren("childrenDeviceIds", device.ChildrenDeviceIDs, existing.ChildrenDeviceIDs); err != nil {
+			return err
+		}
+		if !sameParent(device.ParentDeviceID, existing.ParentDeviceID) {
+			if err := checkParent("device", "parentDeviceId", id, device.ParentDeviceID, tx.deviceParent); err != nil {
+				return err
+			}
+		}
+		device.ChildrenDeviceIDs = existing.ChildrenDeviceIDs
+		device.CurrentLocationID = existing.CurrentLocationID
+		properties, children, labels, err := marshalDeviceJSON(device)
+		if err != nil {
+			return err
+		}
+		if err := tx.checkDeviceUnique(device); err != nil {
+			return err
+		}
+		// Preserve original creation time and ID
+		row := tx.db.QueryRow(`UPDATE devices SET name = $2, hostname = $3, component_type = $4,
+			manufacturer = $5, part_number = $6, serial_number = $7, current_location_id = $8,
+			status = $9, properties = $10, parent_device_id = $11, children_device_ids = $12,
+			updated_at = $13, labels = $15, resource_version = resource_version + 1
+			WHERE id = $1 AND deleted_at IS NULL AND (resource_version = $14 OR $14 = 0)
+			RETURNING created_at, resource_version`,
+			device.ID, device.Name, device.Hostname, device.ComponentType, device.Manufacturer,
+			device.PartNumber, device.SerialNumber, device.CurrentLocationID, device.Status,
+			properties, device.ParentDeviceID, children, device.UpdatedAt, device.ResourceVersion, labels)
+		if err := row.Scan(&device.CreatedAt, &device.ResourceVersion); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return tx.deviceWriteMissed(id, device.ResourceVersion)
+			}
+			return fmt.Errorf("updating device: %w", err)
+		}
+		if err := tx.writeLabels(deviceLabels, device.ID, device.Labels); err != nil {
+			return err
+		}
+		return tx.reparentDevice(id, existing.ParentDeviceID, device.ParentDeviceID, actor)
+	})
+	if err != nil {
+		return nil, s.explainWriteError(err, func() error { return s.checkDeviceUnique(device) })
+	}
+	return device, nil
+}
+
+func (s *sqlStore) PatchDevice(id string, patch Patch, opts PatchOptions) (*models.Device, error) {
+	var device *models.Device
+	err := s.withTx(func(tx *sqlStore) error {
+		// The row lock keeps the device from changing between reading and
+		// patching it.
+		existing, err := tx.lockDevice(id, opts.ResourceVersion)
+		if err != nil {
+			return err
+		}
+		patched, before, after, err := patchRecord(existing, patch)
+		if err != nil {
+			return err
+		}
+		if len(after) == 0 {
+			device = existing
+			return nil
+		}
+		if device, err = tx.UpdateDevice(id, patched, opts.Actor); err != nil {
+			return err
+		}
+		_, err = tx.CreateEvent(newUpdatedEvent(EventTypeDeviceUpdated, opts.Actor, &id, nil, before, after))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (s *sqlStore) DeleteDevice(id string, opts DeleteOptions) error {
+	return s.withTx(func(tx *sqlStore) error { return tx.deleteDevice(id, opts, map[string]bool{}) })
+}
+
+// deleteDevice soft-deletes a device after dealing with its references as
+// opts.Cascade says. deleting holds the devices already being deleted further
+// up a cascade, which a cycle of parents would otherwise revisit.
+func (s *sqlStore) deleteDevice(id string, opts DeleteOptions, deleting map[string]bool) error {
+	device, err := s.lockDevice(id, opts.ResourceVersion)
+	if err != nil {
+		return err
+	}
+	deleting[id] = true
+	children, err := s.queryIDs(`SELECT id FROM devices WHERE parent_device_id = $1 AND deleted_at IS NULL ORDER BY id`, id)
+	if err != nil {
+		return err
+	}
+	children = skipIDs(children, deleting)
+	if opts.Cascade == CascadeNone && (device.CurrentLocationID != nil || len(children) > 0) {
+		return stillReferenced("device", id, device.CurrentLocationID, children)
+	}
+	if device.CurrentLocationID != nil {
+		if err := s.uninstallDevice(device, opts.Actor); err != nil {
+			return err
+		}
+	}
+	for _, childID := range children {
+		if opts.Cascade == CascadeDelete {
+			err = s.deleteDevice(childID, DeleteOptions{Actor: opts.Actor, Cascade: CascadeDelete}, deleting)
+		} else {
+			err = s.detachDevice(childID, id, opts.Actor)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	deletedAt := now()
+	_, err = s.db.Exec(`UPDATE devices SET deleted_at = $2, updated_at = $2,
+		resource_version = resource_version + 1 WHERE id = $1`, id, deletedAt)
+	if err != nil {
+		return fmt.Errorf("deleting device: %w", err)
+	}
+	if _, err = s.CreateEvent(newEvent(EventTypeDeviceDeleted, opts.Actor, &id, nil)); err != nil {
+		return err
+	}
+	if device.ParentDeviceID != nil {
+		return s.refreshChildDevices(*device.ParentDeviceID)
+	}
+	return nil
+}
+
+// uninstallDevice takes device out of the location it is installed in. A
+// location that no longer holds it leaves only the device's pointer to clear.
+func (s *sqlStore) uninstallDevice(device *models.Device, actor string) error {
+	locationID := *device.CurrentLocationID
+	location, err := s.GetLocationByID(locationID)
+	if err == nil && location.CurrentDeviceID != nil && *location.CurrentDeviceID == device.ID {
+		_, _, err := s.RemoveDevice(locationID, actor)
+		return err
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE devices SET current_location_id = NULL, updated_at = $2,
+		resource_version = resource_version + 1 WHERE id = $1`, device.ID, now())
+	if err != nil {
+		return fmt.Errorf("removing device: %w", err)
+	}
+	_, err = s.CreateEvent(newEvent(EventTypeDeviceRemoved, actor, &device.ID, &locationID))
+	return err
+}
+
+// detachDevice clears the parent of a child device whose parent is deleted.
+func (s *sqlStore) detachDevice(id, parentID, actor string) error {
+	_, err := s.db.Exec(`UPDATE devices SET parent_device_id = NULL, updated_at = $2,
+		resource_version = resource_version + 1 WHERE id = $1`, id, now())
+	if err != nil {
+		return fmt.Errorf("detaching device: %w", err)
+	}
+	if _, err = s.CreateEvent(newDetachedEvent(EventTypeDeviceDetached, actor, &id, nil, "parentDeviceId", parentID)); err != nil {
+		return err
+	}
+	return s.refreshChildDevices(parentID)
+}
+
+// deviceParent looks up the parent of a live device for checkParent. The
+// device stays locked against deletes and moves until the transaction ends.
+func (s *sqlStore) deviceParent(id string) (*string, bool, error) {
+	var parent sql.NullString
+	err := s.db.QueryRow(`SELECT parent_device_id FROM devices WHERE id = $1 AND deleted_at IS NULL`+s.dialect.forShare, id).Scan(&parent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return nullStringPtr(parent), true, nil
+}
+
+// lockHierarchy makes a write that sets parent, when it is not nil, wait for
+// the other writes that do until the end of the transaction. Without it two
+// moves could each pass checkParent and together form a cycle. It must come
+// before the write takes any row lock.
+func (s *sqlStore) lockHierarchy(parent *string) error {
+	if parent == nil || s.dialect.lockHierarchy == "" {
+		return nil
+	}
+	if _, err := s.db.Exec(s.dialect.lockHierarchy); err != nil {
+		return fmt.Errorf("locking the hierarchy: %w", err)
+	}
+	return nil
+}
+
+// lockDevice takes the row lock of a live device for the rest of the
+// transaction, provided it is at resourceVersion when that is non-zero, and
+// returns the device.
+func (s *sqlStore) lockDevice(id string, resourceVersion int64) (*models.Device, error) {
+	// Bumping nothing still takes the lock.
+	result, err := s.db.Exec(`UPDATE devices SET resource_version = resource_version
+		WHERE id = $1 AND deleted_at IS NULL AND (resource_version = $2 OR $2 = 0)`,
+		id, resourceVersion)
+	if err != nil {
+		return nil, fmt.Errorf("locking device: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, s.deviceWriteMissed(id, resourceVersion)
+	}
+	return s.GetDeviceByID(id)
+}
+
+// reparentDevice follows a change of the parent of device id from
+// oldParent to newParent: it refreshes both parents' lists of children and
+// records the device's detachment and attachment.
+func (s *sqlStore) reparentDevice(id string, oldParent, newParent *string, actor string) error {
+	events := reparentEvents(EventTypeDeviceDetached, EventTypeDeviceAttached, "parentDeviceId", actor, &id, nil, oldParent, newParent)
+	for _, event := range events {
+		if _, err := s.CreateEvent(event); err != nil {
+			return err
+		}
+	}
+	for _, parent := range []*string{oldParent, newParent} {
+		if parent != nil && len(events) > 0 {
+			if err := s.refreshChildDevices(*parent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refreshChildDevices sets the children list of device parentID to its live
+// child devices, if the device is live and the list has changed.
+func (s *sqlStore) refreshChildDevices(parentID string) error {
+	parent, err := s.GetDeviceByID(parentID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	children, err := s.queryIDs(`SELECT id FROM devices WHERE parent_device_id = $1 AND deleted_at IS NULL ORDER BY id`, parentID)
+	if err != nil || slices.Equal(children, parent.ChildrenDeviceIDs) {
+		return err
+	}
+	encoded, err := marshalJSON(children)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE devices SET children_device_ids = $2, updated_at = $3,
+		resource_version = resource_version + 1 WHERE id = $1`, parentID, encoded, now())
+	if err != nil {
+		return fmt.Errorf("updating parent device: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) RestoreDevice(id, actor string) (*models.Device, error) {
+	var device *models.Device
+	err := s.withTx(func(tx *sqlStore) error {
+		current, err := scanDevice(tx.db.QueryRow(`SELECT `+deviceColumns+` FROM devices WHERE id = $1`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return errorf(ErrNotFound, "device with ID %s not found", id)
+		}
+		if err != nil {
+			return err
+		}
+		if current.DeletedAt == nil {
+			return errorf(ErrConflict, "device %s is not deleted", id)
+		}
+		current.DeletedAt = nil
+		// A device cannot come back under a parent that is gone.
+		if err := tx.lockHierarchy(current.ParentDeviceID); err != nil {
+			return err
+		}
+		if err := checkParent("device", "parentDeviceId", id, current.ParentDeviceID, tx.deviceParent); err != nil {
+			return err
+		}
+		if err := tx.checkDeviceUnique(current); err != nil {
+			return err
+		}
+		row := tx.db.QueryRow(`UPDATE devices SET deleted_at = NULL, updated_at = $2,
+			resource_version = resource_version + 1
+			WHERE id = $1 AND deleted_at IS NOT NULL
+			RETURNING `+deviceColumns, id, now())
+		device, err = scanDevice(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errorf(ErrConflict, "device %s is not deleted", id)
+		}
+		if err != nil {
+			return fmt.Errorf("restoring device: %w", err)
+		}
+		if _, err = tx.CreateEvent(newEvent(EventTypeDeviceRestored, actor, &id, nil)); err != nil {
+			return err
+		}
+		if err := tx.refreshChildDevices(id); err != nil {
+			return err
+		}
+		if device.ParentDeviceID != nil {
+			if err := tx.refreshChildDevices(*device.ParentDeviceID); err != nil {
+				return err
+			}
+		}
+		device, err = tx.GetDeviceByID(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (s *sqlStore) RelabelDevices(filter DeviceFilter, change LabelChange) ([]models.Device, error) {
+	if err := change.validate(); err != nil {
+		return nil, err
+	}
+	var relabeled []models.Device
+	err := s.withTx(func(tx *sqlStore) error {
+		devices, _, err := tx.ListDevices(filter, ListOptions{})
+		if err != nil {
+			return err
+		}
+		relabeled = []models.Device{}
+		for _, device := range devices {
+			labels, changed := change.apply(device.Labels)
+			if !changed {
+				continue
+			}
+			encoded, err := marshalJSON(labels)
+			if err != nil {
+				return err
+			}
+			updatedAt := now()
+			// A device changed since it was listed is not relabeled behind
+			// the writer's back.
+			row := tx.db.QueryRow(`UPDATE devices SET labels = $2, updated_at = $3,
+				resource_version = resource_version + 1
+				WHERE id = $1 AND deleted_at IS NULL AND resource_version = $4
+				RETURNING resource_version`, device.ID, encoded, updatedAt, device.ResourceVersion)
+			if err := row.Scan(&device.ResourceVersion); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return errorf(ErrConflict, "device %s changed while being relabeled", device.ID)
+				}
+				return fmt.Errorf("relabeling device: %w", err)
+			}
+			if err := tx.writeLabels(deviceLabels, device.ID, labels); err != nil {
+				return err
+			}
+			device.Labels, device.UpdatedAt = labels, &updatedAt
+			relabeled = append(relabeled, device)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return relabeled, nil
+}
+
+func (s *sqlStore) ApplyDeviceBatch(ops []DeviceOperation) ([]*models.Device, error) {
+	for i, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+	}
+	results := make([]*models.Device, len(ops))
+	err := s.withTx(func(tx *sqlStore) error {
+		for i, op := range ops {
+			var err error
+			switch op.Op {
+			case BatchCreate:
+				results[i], err = tx.CreateDevice(op.Device)
+			case BatchUpdate:
+				results[i], err = tx.UpdateDevice(op.ID, op.Device, op.Actor)
+			case BatchDelete:
+				err = tx.DeleteDevice(op.ID, op.Delete)
+			}
+			if err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// checkDeviceUnique rejects device if a live device already holds one of its
+// unique fields.
+func (s *sqlStore) checkDeviceUnique(device *models.Device) error {
+	rows, err := s.db.Query(`SELECT `+deviceColumns+` FROM devices
+		WHERE deleted_at IS NULL AND id <> $1
+		AND (name = $2 OR (manufacturer = $3 AND serial_number = $4 AND serial_number <> ''))`,
+		device.ID, device.Name, device.Manufacturer, device.SerialNumber)
+	if err != nil {
+		return fmt.Errorf("checking device uniqueness: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		other, err := scanDevice(rows)
+		if err != nil {
+			return err
+		}
+		if err := deviceDuplicate(device, other); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// deviceWriteMissed explains why a conditional write to a device matched no
+// rows: either the device does not exist or it is at another version.
+func (s *sqlStore) deviceWriteMissed(id string, resourceVersion int64) error {
+	device, err := s.GetDeviceByID(id)
+	if err != nil {
+		return err
+	}
+	return versionMismatch("device", id, resourceVersion, device.ResourceVersion)
+}
+
+// --- Location Methods ---
+
+func (s *sqlStore) CreateLocation(location *models.Location) (*models.Location, error) {
+	if err := validateLocation(location); err != nil {
+		return nil, err
+	}
+	if err := checkChildren("childrenLocationIds", location.ChildrenLocationIDs, nil); err != nil {
+		return nil, err
+	}
+	location.ResourceVersion = 1
+	location.CreatedAt = now()
+	location.DeletedAt = nil
+	location.Path = ""
+	location.CurrentDeviceID = nil
+	err := s.withTx(func(tx *sqlStore) error {
+		if err := tx.lockHierarchy(location.ParentLocationID); err != nil {
+			return err
+		}
+		if err := checkParent("location", "parentLocationId", location.ID, location.ParentLocationID, tx.locationParent); err != nil {
+			return err
+		}
+		if err := tx.checkLocationUnique(location); err != nil {
+			return err
+		}
+		children, err := tx.queryIDs(`SELECT id FROM locations WHERE parent_location_id = $1 AND deleted_at IS NULL ORDER BY id`, location.ID)
+		if err != nil {
+			return err
+		}
+		location.ChildrenLocationIDs = children
+		properties, encodedChildren, labels, err := marshalLocationJSON(location)
+		if err != nil {
+			return err
+		}
+		result, err := tx.db.Exec(`INSERT INTO locations (`+locationColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			ON CONFLICT (id) DO NOTHING`,
+			location.ID, location.Name, location.LocationType, location.ParentLocationID, encodedChildren,
+			location.CurrentDeviceID, location.Status, properties, location.CreatedAt,
+			location.UpdatedAt, location.DeletedAt, location.ResourceVersion, labels)
+		if err != nil {
+			return fmt.Errorf("creating location: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errorf(ErrAlreadyExists, "location with ID %s already exists", location.ID)
+		}
+		if err := tx.writeLabels(locationLabels, location.ID, location.Labels); err != nil {
+			return err
+		}
+		if location.ParentLocationID != nil {
+			return tx.refreshChildLocations(*location.ParentLocationID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, s.explainWriteError(err, func() error { return s.checkLocationUnique(location) })
+	}
+	return location, nil
+}
+
+func (s *sqlStore) GetLocationByID(id string) (*models.Location, error) {
+	row := s.db.QueryRow(`SELECT `+locationColumns+` FROM locations WHERE id = $1 AND deleted_at IS NULL`, id)
+	location, err := scanLocation(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errorf(ErrNotFound, "location with ID %s not found", id)
+	}
+	return location, err
+}
+
+func (s *sqlStore) GetLocationByName(name string) (*models.Location, error) {
+	row := s.db.QueryRow(`SELECT `+locationColumns+` FROM locations WHERE name = $1 AND deleted_at IS NULL LIMIT 1`, name)
+	location, err := scanLocation(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errorf(ErrNotFound, "location with name '%s' not found", name)
+	}
+	return location, err
+}
+
+func (s *sqlStore) GetLocationTree(id string, opts TreeOptions) (*models.LocationTree, error) {
+	// The root is left out of the recursive step, so that parent pointers
+	// forming a cycle through it cannot make the walk endless.
+	tree := `WITH RECURSIVE tree(id, depth) AS (
+		SELECT id, 0 FROM locations WHERE id = $1 AND deleted_at IS NULL
+		UNION ALL
+		SELECT l.id, tree.depth + 1 FROM locations l JOIN tree ON l.parent_location_id = tree.id
+		WHERE l.deleted_at IS NULL AND l.id <> $1`
+	args := []interface{}{id}
+	if opts.Depth >= 0 {
+		tree += ` AND tree.depth < $2`
+		args = append(args, opts.Depth)
+	}
+	tree += `)`
+	locations, err := queryRows(s, tree+` SELECT `+locationColumns+` FROM locations WHERE id IN (SELECT id FROM tree)`, args, scanLocation)
+	if err != nil {
+		return nil, err
+	}
+	// UNION rather than UNION ALL stops at devices already seen.
+	installed := `, installed(id) AS (
+		SELECT current_device_id FROM locations WHERE id IN (SELECT id FROM tree) AND current_device_id IS NOT NULL`
+	if opts.IncludeChildDevices {
+		installed += `
+		UNION
+		SELECT d.id FROM devices d JOIN installed ON d.parent_device_id = installed.id WHERE d.deleted_at IS NULL`
+	}
+	installed += `)`
+	devices, err := queryRows(s, tree+installed+` SELECT `+deviceColumns+` FROM devices WHERE id IN (SELECT id FROM installed) AND deleted_at IS NULL`, args, scanDevice)
+	if err != nil {
+		return nil, err
+	}
+	root := buildLocationTree(id, locations, devices, opts)
+	if root == nil {
+		return nil, errorf(ErrNotFound, "location with ID %s not found", id)
+	}
+	return root, nil
+}
+
+// locationChain is a recursive query for the IDs of the locations it is
+// seeded with and of all their ancestors. UNION rather than UNION ALL stops
+// at locations already seen.
+const locationChain = `WITH RECURSIVE chain(id) AS (
+		SELECT id FROM locations WHERE %s
+		UNION
+		SELECT l.parent_location_id FROM locations l JOIN chain ON l.id = chain.id WHERE l.parent_location_id IS NOT NULL)`
+
+func (s *sqlStore) GetLocationAncestors(id string) ([]models.Location, error) {
+	query := fmt.Sprintf(locationChain, `id = $1 AND deleted_at IS NULL`) +
+		` SELECT ` + locationColumns + ` FROM locations WHERE id IN (SELECT id FROM chain) AND deleted_at IS NULL`
+	chain, err := queryRows(s, query, []interface{}{id}, scanLocation)
+	if err != nil {
+		return nil, err
+	}
+	ancestors, ok := orderAncestors(id, chain)
+	if !ok {
+		return nil, errorf(ErrNotFound, "location with ID %s not found", id)
+	}
+	return ancestors, nil
+}
+
+func (s *sqlStore) GetLocationByPath(names []string) (*models.Location, error) {
+	var id string
+	for i, name := range names {
+		var ids []string
+		var err error
+		if i == 0 {
+			ids, err = s.queryIDs(`SELECT id FROM locations WHERE name = $1 AND parent_location_id IS NULL AND deleted_at IS NULL ORDER BY id LIMIT 1`, name)
+		} else {
+			ids, err = s.queryIDs(`SELECT id FROM locations WHERE name = $1 AND parent_location_id = $2 AND deleted_at IS NULL ORDER BY id LIMIT 1`, name, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			id = ""
+			break
+		}
+		id = ids[0]
+	}
+	if id == "" {
+		return nil, errorf(ErrNotFound, "location with path '%s' not found", strings.Join(names, PathSeparator))
+	}
+	return s.GetLocationByID(id)
+}
+
+func (s *sqlStore) LocationPaths(ids []string) (map[string]string, error) {
+	paths := make(map[string]string, len(ids))
+	if len(ids) == 0 {
+		return paths, nil
+	}
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = id
+	}
+	query := fmt.Sprintf(locationChain, `id IN (`+strings.Join(placeholders, ", ")+`)`) +
+		` SELECT id, name, parent_location_id FROM locations WHERE id IN (SELECT id FROM chain)`
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type entry struct {
+		name   string
+		parent *string
+	}
+	entries := map[string]entry{}
+	for rows.Next() {
+		var id string
+		var e entry
+		if err := rows.Scan(&id, &e.name, &e.parent); err != nil {
+			return nil, err
+		}
+		entries[id] = e
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	lookup := func(id string) (string, *string, bool) {
+		e, ok := entries[id]
+		return e.name, e.parent, ok
+	}
+	for _, id := range ids {
+		if _, ok := entries[id]; ok {
+			paths[id] = locationPath(id, lookup)
+		}
+	}
+	return paths, nil
+}
+
+func (s *sqlStore) ListLocations(filter LocationFilter, opts ListOptions) ([]models.Location, Page, error) {
+	query := listQuery{table: "locations", columns: locationColumns}
+	query.excludeDeleted(opts)
+	query.equal("location_type", filter.LocationType)
+	query.equal("status", filter.Status)
+	query.equal("parent_location_id", filter.ParentLocationID)
+	if err := filter.check(); err != nil {
+		return nil, Page{}, err
+	}
+	locationLabels.where(&query, filter.Labels)
+	if filter.Expr != nil {
+		query.where = append(query.where, locationFields.where(s, &query, filter.Expr))
+	}
+	return queryPage(s, query, opts, locationOrder, scanLocation)
+}
+
+func (s *sqlStore) UpdateLocation(id string, location *models.Location, actor string) (*models.Location, error) {
+	location.ID = id
+	if err := validateLocation(location); err != nil {
+		return nil, err
+	}
+	updatedAt := now()
+	location.UpdatedAt = &updatedAt
+	location.DeletedAt = nil
+	location.Path = ""
+	err := s.withTx(func(tx *sqlStore) error {
+		if err := tx.lockHierarchy(location.ParentLocationID); err != nil {
+			return err
+		}
+		existing, err := tx.lockLocation(id, location.ResourceVersion)
+		if err != nil {
+			return err
+		}
+		if err := checkChildren("childrenLocationIds", location.ChildrenLocationIDs, existing.ChildrenLocationIDs); err != nil {
+			return err
+		}
+		if !sameParent(location.ParentLocationID, existing.ParentLocationID) {
+			if err := checkParent("location", "parentLocationId", id, location.ParentLocationID, tx.locationParent); err != nil {
+				return err
+			}
+		}
+		location.ChildrenLocationIDs = existing.ChildrenLocationIDs
+		location.CurrentDeviceID = existing.CurrentDeviceID
+		properties, children, labels, err := marshalLocationJSON(location)
+		if err != nil {
+			return err
+		}
+		if err := tx.checkLocationUnique(location); err != nil {
+			return err
+		}
+		// Preserve original creation time and ID
+		row := tx.db.QueryRow(`UPDATE locations SET name = $2, location_type = $3,
+			parent_location_id = $4, children_location_ids = $5, current_device_id = $6,
+			status = $7, properties = $8, updated_at = $9, labels = $11, resource_version = resource_version + 1
+			WHERE id = $1 AND deleted_at IS NULL AND (resource_version = $10 OR $10 = 0)
+			RETURNING created_at, resource_version`,
+			location.ID, location.Name, location.LocationType, location.ParentLocationID, children,
+			location.CurrentDeviceID, location.Status, properties, location.UpdatedAt, location.ResourceVersion, labels)
+		if err := row.Scan(&location.CreatedAt, &location.ResourceVersion); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return tx.locationWriteMissed(id, location.ResourceVersion)
+			}
+			return fmt.Errorf("updating location: %w", err)
+		}
+		if err := tx.writeLabels(locationLabels, location.ID, location.Labels); err != nil {
+			return err
+		}
+		return tx.reparentLocation(id, existing.ParentLocationID, location.ParentLocationID, actor)
+	})
+	if err != nil {
+		return nil, s.explainWriteError(err, func() error { return s.checkLocationUnique(location) })
+	}
+	return location, nil
+}
+
+func (s *sqlStore) PatchLocation(id string, patch Patch, opts PatchOptions) (*models.Location, error) {
+	var location *models.Location
+	err := s.withTx(func(tx *sqlStore) error {
+		existing, err := tx.lockLocation(id, opts.ResourceVersion)
+		if err != nil {
+			return err
+		}
+		patched, before, after, err := patchRecord(existing, patch)
+		if err != nil {
+			return err
+		}
+		if len(after) == 0 {
+			location = existing
+			return nil
+		}
+		if location, err = tx.UpdateLocation(id, patched, opts.Actor); err != nil {
+			return err
+		}
+		_, err = tx.CreateEvent(newUpdatedEvent(EventTypeLocationUpdated, opts.Actor, nil, &id, before, after))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return location, nil
+}
+
+func (s *sqlStore) DeleteLocation(id string, opts DeleteOptions) error {
+	return s.withTx(func(tx *sqlStore) error { return tx.deleteLocation(id, opts, map[string]bool{}) })
+}
+
+// deleteLocation soft-deletes a location after dealing with its references as
+// opts.Cascade says. deleting holds the locations already being deleted further
+// up a cascade, which a cycle of parents would otherwise revisit.
+func (s *sqlStore) deleteLocation(id string, opts DeleteOptions, deleting map[string]bool) error {
+	location, err := s.lockLocation(id, opts.ResourceVersion)
+	if err != nil {
+		return err
+	}
+	deleting[id] = true
+	children, err := s.queryIDs(`SELECT id FROM locations WHERE parent_location_id = $1 AND deleted_at IS NULL ORDER BY id`, id)
+	if err != nil {
+		return err
+	}
+	children = skipIDs(children, deleting)
+	if opts.Cascade == CascadeNone && (location.CurrentDeviceID != nil || len(children) > 0) {
+		return stillReferenced("location", id, location.CurrentDeviceID, children)
+	}
+	if location.CurrentDeviceID != nil {
+		if _, _, err := s.RemoveDevice(id, opts.Actor); err != nil {
+			return err
+		}
+	}
+	for _, childID := range children {
+		if opts.Cascade == CascadeDelete {
+			err = s.deleteLocation(childID, DeleteOptions{Actor: opts.Actor, Cascade: CascadeDelete}, deleting)
+		} else {
+			err = s.detachLocation(childID, id, opts.Actor)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	deletedAt := now()
+	_, err = s.db.Exec(`UPDATE locations SET deleted_at = $2, updated_at = $2,
+		resource_version = resource_version + 1 WHERE id = $1`, id, deletedAt)
+	if err != nil {
+		return fmt.Errorf("deleting location: %w", err)
+	}
+	if _, err = s.CreateEvent(newEvent(EventTypeLocationDeleted, opts.Actor, nil, &id)); err != nil {
+		return err
+	}
+	if location.ParentLocationID != nil {
+		return s.refreshChildLocations(*location.ParentLocationID)
+	}
+	return nil
+}
+
+// detachLocation clears the parent of a child location whose parent is
+// deleted.
+func (s *sqlStore) detachLocation(id, parentID, actor string) error {
+	_, err := s.db.Exec(`UPDATE locations SET parent_location_id = NULL, updated_at = $2,
+		resource_version = resource_version + 1 WHERE id = $1`, id, now())
+	if err != nil {
+		return fmt.Errorf("detaching location: %w", err)
+	}
+	if _, err = s.CreateEvent(newDetachedEvent(EventTypeLocationDetached, actor, nil, &id, "parentLocationId", parentID)); err != nil {
+		return err
+	}
+	return s.refreshChildLocations(parentID)
+}
+
+// locationParent is deviceParent for locations.
+func (s *sqlStore) locationParent(id string) (*string, bool, error) {
+	var parent sql.NullString
+	err := s.db.QueryRow(`SELECT parent_location_id FROM locations WHERE id = $1 AND deleted_at IS NULL`+s.dialect.forShare, id).Scan(&parent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return nullStringPtr(parent), true, nil
+}
+
+// lockLocation is lockDevice for locations.
+func (s *sqlStore) lockLocation(id string, resourceVersion int64) (*models.Location, error) {
+	result, err := s.db.Exec(`UPDATE locations SET resource_version = resource_version
+		WHERE id = $1 AND deleted_at IS NULL AND (resource_version = $2 OR $2 = 0)`,
+		id, resourceVersion)
+	if err != nil {
+		return nil, fmt.Errorf("locking location: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, s.locationWriteMissed(id, resourceVersion)
+	}
+	return s.GetLocationByID(id)
+}
+
+// reparentLocation is reparentDevice for locations.
+func (s *sqlStore) reparentLocation(id string, oldParent, newParent *string, actor string) error {
+	events := reparentEvents(EventTypeLocationDetached, EventTypeLocationAttached, "parentLocationId", actor, nil, &id, oldParent, newParent)
+	for _, event := range events {
+		if _, err := s.CreateEvent(event); err != nil {
+			return err
+		}
+	}
+	for _, parent := range []*string{oldParent, newParent} {
+		if parent != nil && len(events) > 0 {
+			if err := s.refreshChildLocations(*parent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refreshChildLocations is refreshChildDevices for locations.
+func (s *sqlStore) refreshChildLocations(parentID string) error {
+	parent, err := s.GetLocationByID(parentID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	children, err := s.queryIDs(`SELECT id FROM locations WHERE parent_location_id = $1 AND deleted_at IS NULL ORDER BY id`, parentID)
+	if err != nil || slices.Equal(children, parent.ChildrenLocationIDs) {
+		return err
+	}
+	encoded, err := marshalJSON(children)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE locations SET children_location_ids = $2, updated_at = $3,
+		resource_version = resource_version + 1 WHERE id = $1`, parentID, encoded, now())
+	if err != nil {
+		return fmt.Errorf("updating parent location: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) RestoreLocation(id, actor string) (*models.Location, error) {
+	var location *models.Location
+	err := s.withTx(func(tx *sqlStore) error {
+		current, err := scanLocation(tx.db.QueryRow(`SELECT `+locationColumns+` FROM locations WHERE id = $1`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return errorf(ErrNotFound, "location with ID %s not found", id)
+		}
+		if err != nil {
+			return err
+		}
+		if current.DeletedAt == nil {
+			return errorf(ErrConflict, "location %s is not deleted", id)
+		}
+		current.DeletedAt = nil
+		// A location cannot come back under a parent that is gone.
+		if err := tx.lockHierarchy(current.ParentLocationID); err != nil {
+			return err
+		}
+		if err := checkParent("location", "parentLocationId", id, current.ParentLocationID, tx.locationParent); err != nil {
+			return err
+		}
+		if err := tx.checkLocationUnique(current); err != nil {
+			return err
+		}
+		row := tx.db.QueryRow(`UPDATE locations SET deleted_at = NULL, updated_at = $2,
+			resource_version = resource_version + 1
+			WHERE id = $1 AND deleted_at IS NOT NULL
+			RETURNING `+locationColumns, id, now())
+		location, err = scanLocation(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errorf(ErrConflict, "location %s is not deleted", id)
+		}
+		if err != nil {
+			return fmt.Errorf("restoring location: %w", err)
+		}
+		if _, err = tx.CreateEvent(newEvent(EventTypeLocationRestored, actor, nil, &id)); err != nil {
+			return err
+		}
+		if err := tx.refreshChildLocations(id); err != nil {
+			return err
+		}
+		if location.ParentLocationID != nil {
+			if err := tx.refreshChildLocations(*location.ParentLocationID); err != nil {
+				return err
+			}
+		}
+		location, err = tx.GetLocationByID(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return location, nil
+}
+
+func (s *sqlStore) RelabelLocations(filter LocationFilter, change LabelChange) ([]models.Location, error) {
+	if err := change.validate(); err != nil {
+		return nil, err
+	}
+	var relabeled []models.Location
+	err := s.withTx(func(tx *sqlStore) error {
+		locations, _, err := tx.ListLocations(filter, ListOptions{})
+		if err != nil {
+			return err
+		}
+		relabeled = []models.Location{}
+		for _, location := range locations {
+			labels, changed := change.apply(location.Labels)
+			if !changed {
+				continue
+			}
+			encoded, err := marshalJSON(labels)
+			if err != nil {
+				return err
+			}
+			updatedAt := now()
+			row := tx.db.QueryRow(`UPDATE locations SET labels = $2, updated_at = $3,
+				resource_version = resource_version + 1
+				WHERE id = $1 AND deleted_at IS NULL AND resource_version = $4
+				RETURNING resource_version`, location.ID, encoded, updatedAt, location.ResourceVersion)
+			if err := row.Scan(&location.ResourceVersion); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return errorf(ErrConflict, "location %s changed while being relabeled", location.ID)
+				}
+				return fmt.Errorf("relabeling location: %w", err)
+			}
+			if err := tx.writeLabels(locationLabels, location.ID, labels); err != nil {
+				return err
+			}
+			location.Labels, location.UpdatedAt = labels, &updatedAt
+			relabeled = append(relabeled, location)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return relabeled, nil
+}
+
+func (s *sqlStore) ApplyLocationBatch(ops []LocationOperation) ([]*models.Location, error) {
+	for i, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+	}
+	results := make([]*models.Location, len(ops))
+	err := s.withTx(func(tx *sqlStore) error {
+		for i, op := range ops {
+			var err error
+			switch op.Op {
+			case BatchCreate:
+				results[i], err = tx.CreateLocation(op.Location)
+			case BatchUpdate:
+				results[i], err = tx.UpdateLocation(op.ID, op.Location, op.Actor)
+			case BatchDelete:
+				err = tx.DeleteLocation(op.ID, op.Delete)
+			}
+			if err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// checkLocationUnique rejects location if a live location in its scope
+// already has its name.
+func (s *sqlStore) checkLocationUnique(location *models.Location) error {
+	rows, err := s.db.Query(`SELECT `+locationColumns+` FROM locations
+		WHERE deleted_at IS NULL AND id <> $1 AND name = $2`, location.ID, location.Name)
+	if err != nil {
+		return fmt.Errorf("checking location uniqueness: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		other, err := scanLocation(rows)
+		if err != nil {
+			return err
+		}
+		if err := locationDuplicate(location, other, s.locationNameScope); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// explainWriteError reports a write that a unique index rejected as the
+// duplicate behind it. The checks run before every write, so this only
+// happens when a concurrent writer commits the duplicate in between.
+func (s *sqlStore) explainWriteError(err error, check func() error) error {
+	var kind *kindError
+	if errors.As(err, &kind) || s.inTx {
+		return err
+	}
+	if dup := check(); errors.Is(dup, ErrAlreadyExists) {
+		return dup
+	}
+	return err
+}
+
+// locationWriteMissed explains why a conditional write to a location matched
+// no rows: either the location does not exist or it is at another version.
+func (s *sqlStore) locationWriteMissed(id string, resourceVersion int64) error {
+	location, err := s.GetLocationByID(id)
+	if err != nil {
+		return err
+	}
+	return versionMismatch("location", id, resourceVersion, location.ResourceVersion)
+}
+
+// --- Event Methods ---
+
+func (s *sqlStore) CreateEvent(event *models.Event) (*models.Event, error) {
+	event.ID = uuid.NewString()
+	event.Time = now()
+	stateBefore, err := marshalJSON(event.Data.StateBefore)
+	if err != nil {
+		return nil, err
+	}
+	stateAfter, err := marshalJSON(event.Data.StateAfter)
+	if err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRow(`INSERT INTO events (`+eventColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, `+s.dialect.nextEventSequence+`)
+		RETURNING sequence`,
+		event.ID, event.Source, event.SpecVersion, event.Type, event.DataContentType, event.Subject,
+		event.Time, event.Data.DeviceID, event.Data.LocationID, event.Data.Actor, event.Data.Comment,
+		event.Data.Duration, stateBefore, stateAfter).Scan(&event.Sequence)
+	if err != nil {
+		return nil, fmt.Errorf("creating event: %w", err)
+	}
+	return event, nil
+}
+
+func (s *sqlStore) GetEventByID(id string) (*models.Event, error) {
+	row := s.db.QueryRow(`SELECT `+eventColumns+` FROM events WHERE id = $1`, id)
+	event, err := scanEvent(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errorf(ErrNotFound, "event with ID %s not found", id)
+	}
+	return event, err
+}
+
+func (s *sqlStore) ListEvents(filter EventFilter, opts ListOptions) ([]models.Event, Page, error) {
+	var query listQuery
+	query.equal("type", filter.Type)
+	query.equal("actor", filter.Actor)
+	query.equal("device_id", filter.DeviceID)
+	query.equal("location_id", filter.LocationID)
+	if !filter.Since.IsZero() {
+		query.where = append(query.where, "time >= "+query.arg(filter.Since.UTC()))
+	}
+	if !filter.Until.IsZero() {
+		query.where = append(query.where, "time < "+query.arg(filter.Until.UTC()))
+	}
+	return s.queryEvents(query, opts)
+}
+
+func (s *sqlStore) ListEventsByDeviceID(deviceID string, opts ListOptions) ([]models.Event, Page, error) {
+	return s.queryEvents(listQuery{where: []string{"device_id = $1"}, args: []interface{}{deviceID}}, opts)
+}
+
+func (s *sqlStore) ListEventsByLocationID(locationID string, opts ListOptions) ([]models.Event, Page, error) {
+	return s.queryEvents(listQuery{where: []string{"location_id = $1"}, args: []interface{}{locationID}}, opts)
+}
+
+// queryEvents lists the events matching query, in time order.
+func (s *sqlStore) queryEvents(query listQuery, opts ListOptions) ([]models.Event, Page, error) {
+	query.table, query.columns = "events", eventColumns
+	return queryPage(s, query, opts, eventOrder, scanEvent)
+}
+
+// --- Composite Methods ---
+
+// InstallDevice and RemoveDevice guard each pointer update with the state it
+// expects, so a concurrent install or removal that got there first makes the
+// update match no rows instead of being silently overwritten.
+
+func (s *sqlStore) InstallDevice(locationID, deviceID, actor string) (*models.Location, *models.Event, error) {
+	var location *models.Location
+	var event *models.Event
+	err := s.withTx(func(tx *sqlStore) error {
+		updatedAt := now()
+		result, err := tx.db.Exec(`UPDATE locations SET current_device_id = $2, status = 'occupied', updated_at = $3,
+			resource_version = resource_version + 1
+			WHERE id = $1 AND deleted_at IS NULL AND current_device_id IS NULL`, locationID, deviceID, updatedAt)
+		if err != nil {
+			return fmt.Errorf("installing device: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			if _, err := tx.GetLocationByID(locationID); err != nil {
+				return err
+			}
+			return fmt.Errorf("location %s: %w", locationID, ErrLocationOccupied)
+		}
+
+		result, err = tx.db.Exec(`UPDATE devices SET current_location_id = $2, updated_at = $3,
+			resource_version = resource_version + 1
+			WHERE id = $1 AND deleted_at IS NULL AND current_location_id IS NULL`, deviceID, locationID, updatedAt)
+		if err != nil {
+			return fmt.Errorf("installing device: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			device, err := tx.GetDeviceByID(deviceID)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("device %s is in location %s: %w", deviceID, *device.CurrentLocationID, ErrDeviceInstalled)
+		}
+
+		if location, err = tx.GetLocationByID(locationID); err != nil {
+			return err
+		}
+		event, err = tx.CreateEvent(newEvent(EventTypeDeviceInstalled, actor, &deviceID, &locationID))
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return location, event, nil
+}
+
+func (s *sqlStore) RemoveDevice(locationID, actor string) (*models.Location, *models.Event, error) {
+	var location *models.Location
+	var event *models.Event
+	err := s.withTx(func(tx *sqlStore) error {
+		current, err := tx.GetLocationByID(locationID)
+		if err != nil {
+			return err
+		}
+		if current.CurrentDeviceID == nil {
+			return fmt.Errorf("location %s: %w", locationID, ErrLocationEmpty)
+		}
+		deviceID := *current.CurrentDeviceID
+
+		updatedAt := now()
+		result, err := tx.db.Exec(`UPDATE locations SET current_device_id = NULL, status = 'empty', updated_at = $3,
+			resource_version = resource_version + 1
+			WHERE id = $1 AND deleted_at IS NULL AND current_device_id = $2`, locationID, deviceID, updatedAt)
+		if err != nil {
+			return fmt.Errorf("removing device: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fmt.Errorf("location %s: %w", locationID, ErrLocationEmpty)
+		}
+		// A dangling device reference is cleared from the location regardless.
+		_, err = tx.db.Exec(`UPDATE devices SET current_location_id = NULL, updated_at = $3,
+			resource_version = resource_version + 1
+			WHERE id = $1 AND current_location_id = $2`, deviceID, locationID, updatedAt)
+		if err != nil {
+			return fmt.Errorf("removing device: %w", err)
+		}
+
+		if location, err = tx.GetLocationByID(locationID); err != nil {
+			return err
+		}
+		event, err = tx.CreateEvent(newEvent(EventTypeDeviceRemoved, actor, &deviceID, &locationID))
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return location, event, nil
+}
+
+func (s *sqlStore) ApplyTransaction(ops []TxOperation, actor string) ([]TxResult, error) {
+	var results []TxResult
+	err := s.withTx(func(tx *sqlStore) error {
+		var err error
+		results, err = runTransaction(ops, func(op TxOperation) (result TxResult, err error) {
+			deleteOpts := DeleteOptions{ResourceVersion: op.ResourceVersion, Actor: actor, Cascade: op.Cascade}
+			patchOpts := PatchOptions{ResourceVersion: op.ResourceVersion, Actor: actor}
+			switch op.Op {
+			case TxCreateDevice:
+				result.Device, err = tx.CreateDevice(op.Device)
+			case TxUpdateDevice:
+				result.Device, err = tx.UpdateDevice(op.ID, op.Device, actor)
+			case TxPatchDevice:
+				result.Device, err = tx.PatchDevice(op.ID, op.Patch, patchOpts)
+			case TxDeleteDevice:
+				err = tx.DeleteDevice(op.ID, deleteOpts)
+			case TxCreateLocation:
+				result.Location, err = tx.CreateLocation(op.Location)
+			case TxUpdateLocation:
+				result.Location, err = tx.UpdateLocation(op.ID, op.Location, actor)
+			case TxPatchLocation:
+				result.Location, err = tx.PatchLocation(op.ID, op.Patch, patchOpts)
+			case TxDeleteLocation:
+				err = tx.DeleteLocation(op.ID, deleteOpts)
+			case TxInstallDevice:
+				result.Location, result.Event, err = tx.InstallDevice(op.LocationID, op.DeviceID, actor)
+			case TxRemoveDevice:
+				result.Location, result.Event, err = tx.RemoveDevice(op.LocationID, actor)
+			}
+			return result, err
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// --- Maintenance Methods ---
+
+func (s *sqlStore) PurgeDeleted(deletedBefore time.Time) (PurgeResult, error) {
+	var purged PurgeResult
+	err := s.withTx(func(tx *sqlStore) error {
+		cutoff := deletedBefore.UTC()
+		for _, index := range []labelIndex{deviceLabels, locationLabels} {
+			if err := tx.purgeLabels(index, cutoff); err != nil {
+				return err
+			}
+		}
+		result, err := tx.db.Exec(`DELETE FROM devices WHERE deleted_at < $1`, cutoff)
+		if err != nil {
+			return fmt.Errorf("purging devices: %w", err)
+		}
+		devices, _ := result.RowsAffected()
+		result, err = tx.db.Exec(`DELETE FROM locations WHERE deleted_at < $1`, cutoff)
+		if err != nil {
+			return fmt.Errorf("purging locations: %w", err)
+		}
+		locations, _ := result.RowsAffected()
+		purged = PurgeResult{Devices: int(devices), Locations: int(locations)}
+		return nil
+	})
+	if err != nil {
+		return PurgeResult{}, err
+	}
+	return purged, nil
+}
+
+// --- Row Helpers ---
+
+// skipIDs returns ids without those in skip.
+func skipIDs(ids []string, skip map[string]bool) []string {
+	var kept []string
+	for _, id := range ids {
+		if !skip[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// queryIDs runs a query selecting a single ID column.
+func (s *sqlStore) queryIDs(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// queryRows runs a query and scans every row it returns.
+func queryRows[T any](s *sqlStore, query string, args []interface{}, scan func(row rowScanner) (*T, error)) ([]*T, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []*T
+	for rows.Next() {
+		record, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// listQuery selects the rows of a list: those of table matching every
+// condition in where. The conditions refer to args as $1, $2 and so on.
+type listQuery struct {
+	table   string
+	columns string
+	where   []string
+	args    []interface{}
+}
+
+// excludeDeleted hides soft-deleted rows unless opts asks for them.
+func (q *listQuery) excludeDeleted(opts ListOptions) {
+	if !opts.IncludeDeleted {
+		q.where = append(q.where, "deleted_at IS NULL")
+	}
+}
+
+// equal restricts the query to rows whose column equals value, unless value
+// is empty.
+func (q *listQuery) equal(column, value string) {
+	if value != "" {
+		q.where = append(q.where, column+" = "+q.arg(value))
+	}
+}
+
+// arg adds value to the query's arguments and returns its placeholder.
+func (q *listQuery) arg(value interface{}) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+func (q *listQuery) whereClause() string {
+	if len(q.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.where, " AND ")
+}
+
+// queryPage counts the rows q selects and runs q for the page opts asks for,
+// in the order opts asks for, reading each row with scan.
+func queryPage[T any](s *sqlStore, q listQuery, opts ListOptions, order sortable[T], scan func(row rowScanner) (*T, error)) ([]T, Page, error) {
+	keys, err := order.order(opts.Sort)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	var page Page
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM `+q.table+q.whereClause(), q.args...).Scan(&page.Total); err != nil {
+		return nil, Page{}, fmt.Errorf("counting %s: %w", q.table, err)
+	}
+	if opts.After != "" {
+		after, err := decodeCursor(opts.After, opts.Sort, keys)
+		if err != nil {
+			return nil, Page{}, err
+		}
+		q.where = append(q.where, s.afterCondition(&q, keys, after))
+	}
+	orderBy := make([]string, len(keys))
+	for i, key := range keys {
+		orderBy[i] = s.sortColumn(key)
+		if key.descending {
+			orderBy[i] += " DESC"
+		}
+	}
+	// Fetch one row past the page to learn whether another page follows.
+	limit := int64(math.MaxInt64)
+	if opts.Limit > 0 {
+		limit = int64(opts.Limit) + 1
+	}
+	query := `SELECT ` + q.columns + ` FROM ` + q.table + q.whereClause() + ` ORDER BY ` + strings.Join(orderBy, ", ") +
+		` LIMIT ` + q.arg(limit) + ` OFFSET ` + q.arg(opts.Offset)
+	rows, err := s.db.Query(query, q.args...)
+	if err != nil {
+		return nil, Page{}, fmt.Errorf("listing %s: %w", q.table, err)
+	}
+	defer rows.Close()
+	records := []T{}
+	for rows.Next() {
+		if opts.Limit > 0 && len(records) == opts.Limit {
+			page.Next = encodeCursor(opts.Sort, order.values(keys, &records[len(records)-1]))
+			break
+		}
+		record, err := scan(rows)
+		if err != nil {
+			return nil, Page{}, err
+		}
+		records = append(records, *record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, Page{}, err
+	}
+	return records, page, nil
+}
+
+// sortColumn returns the expression a list is ordered by for key.
+func (s *sqlStore) sortColumn(key sortKey) string {
+	if key.kind == sortString {
+		return key.column + s.dialect.textCollation
+	}
+	return key.column
+}
+
+// afterCondition returns the condition selecting the rows that sort after
+// the cursor values after: those that tie on the first n-1 keys and sort
+// later on the nth, for some n.
+func (s *sqlStore) afterCondition(q *listQuery, keys []sortKey, after []any) string {
+	placeholders := make([]string, len(keys))
+	for i, value := range after {
+		if t, ok := value.(time.Time); ok {
+			value = t.UTC()
+		}
+		placeholders[i] = q.arg(value)
+	}
+	alternatives := make([]string, len(keys))
+	for i, key := range keys {
+		var terms []string
+		for j, tied := range keys[:i] {
+			terms = append(terms, s.sortColumn(tied)+" = "+placeholders[j])
+		}
+		op := " > "
+		if key.descending {
+			op = " < "
+		}
+		terms = append(terms, s.sortColumn(key)+op+placeholders[i])
+		alternatives[i] = "(" + strings.Join(terms, " AND ") + ")"
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")"
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDevice(row rowScanner) (*models.Device, error) {
+	var device models.Device
+	var hostname, currentLocationID, parentDeviceID sql.NullString
+	var properties, children, labels []byte
+	var updatedAt, deletedAt sql.NullTime
+	err := row.Scan(&device.ID, &device.Name, &hostname, &device.ComponentType, &device.Manufacturer,
+		&device.PartNumber, &device.SerialNumber, &currentLocationID, &device.Status, &properties,
+		&parentDeviceID, &children, &device.CreatedAt, &updatedAt, &deletedAt, &device.ResourceVersion, &labels)
+	if err != nil {
+		return nil, err
+	}
+	device.Hostname = nullStringPtr(hostname)
+	device.CurrentLocationID = nullStringPtr(currentLocationID)
+	device.ParentDeviceID = nullStringPtr(parentDeviceID)
+	device.UpdatedAt = nullTimePtr(updatedAt)
+	device.DeletedAt = nullTimePtr(deletedAt)
+	if err := unmarshalJSON(properties, &device.Properties); err != nil {
+		return nil, err
+	}
+	if err := unmarshalJSON(children, &device.ChildrenDeviceIDs); err != nil {
+		return nil, err
+	}
+	if err := unmarshalJSON(labels, &device.Labels); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func scanLocation(row rowScanner) (*models.Location, error) {
+	var location models.Location
+	var parentLocationID, currentDeviceID sql.NullString
+	var properties, children, labels []byte
+	var updatedAt, deletedAt sql.NullTime
+	err := row.Scan(&location.ID, &location.Name, &location.LocationType, &parentLocationID, &children,
+		&currentDeviceID, &location.Status, &properties, &location.CreatedAt, &updatedAt, &deletedAt,
+		&location.ResourceVersion, &labels)
+	if err != nil {
+		return nil, err
+	}
+	location.ParentLocationID = nullStringPtr(parentLocationID)
+	location.CurrentDeviceID = nullStringPtr(currentDeviceID)
+	location.UpdatedAt = nullTimePtr(updatedAt)
+	location.DeletedAt = nullTimePtr(deletedAt)
+	if err := unmarshalJSON(properties, &location.Properties); err != nil {
+		return nil, err
+	}
+	if err := unmarshalJSON(children, &location.ChildrenLocationIDs); err != nil {
+		return nil, err
+	}
+	if err := unmarshalJSON(labels, &location.Labels); err != nil {
+		return nil, err
+	}
+	return &location, nil
+}
+
+func scanEvent(row rowScanner) (*models.Event, error) {
+	var event models.Event
+	var dataContentType, subject, deviceID, locationID, actor, comment sql.NullString
+	var duration sql.NullInt32
+	var stateBefore, stateAfter []byte
+	err := row.Scan(&event.ID, &event.Source, &event.SpecVersion, &event.Type, &dataContentType,
+		&subject, &event.Time, &deviceID, &locationID, &actor, &comment, &duration,
+		&stateBefore, &stateAfter, &event.Sequence)
+	if err != nil {
+		return nil, err
+	}
+	event.DataContentType = nullStringPtr(dataContentType)
+	event.Subject = nullStringPtr(subject)
+	event.Data.DeviceID = nullStringPtr(deviceID)
+	event.Data.LocationID = nullStringPtr(locationID)
+	event.Data.Actor = nullStringPtr(actor)
+	event.Data.Comment = nullStringPtr(comment)
+	if duration.Valid {
+		event.Data.Duration = &duration.Int32
+	}
+	if err := unmarshalJSON(stateBefore, &event.Data.StateBefore); err != nil {
+		return nil, err
+	}
+	if err := unmarshalJSON(stateAfter, &event.Data.StateAfter); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func marshalDeviceJSON(device *models.Device) (properties, children, labels *string, err error) {
+	if properties, err = marshalJSON(device.Properties); err != nil {
+		return nil, nil, nil, err
+	}
+	if children, err = marshalJSON(device.ChildrenDeviceIDs); err != nil {
+		return nil, nil, nil, err
+	}
+	if labels, err = marshalJSON(device.Labels); err != nil {
+		return nil, nil, nil, err
+	}
+	return properties, children, labels, nil
+}
+
+func marshalLocationJSON(location *models.Location) (properties, children, labels *string, err error) {
+	if properties, err = marshalJSON(location.Properties); err != nil {
+		return nil, nil, nil, err
+	}
+	if children, err = marshalJSON(location.ChildrenLocationIDs); err != nil {
+		return nil, nil, nil, err
+	}
+	if labels, err = marshalJSON(location.Labels); err != nil {
+		return nil, nil, nil, err
+	}
+	return properties, children, labels, nil
+}
+
+// marshalJSON encodes v for storage in a JSON column, mapping nil maps and
+// slices to SQL NULL.
+func marshalJSON(v interface{}) (*string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encoding JSON column: %w", err)
+	}
+	if string(data) == "null" {
+		return nil, nil
+	}
+	encoded := string(data)
+	return &encoded, nil
+}
+
+func unmarshalJSON(data []byte, v interface{}) error {
+	if data == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("decoding JSON column: %w", err)
+	}
+	return nil
+}
+
+func nullStringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// now returns the current time truncated to the microsecond precision that
+// PostgreSQL timestamps can store, so returned records round-trip unchanged.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
@@ -0,0 +1,70 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sqlOperators maps comparison operators to SQL.
+var sqlOperators = map[CompareOp]string{
+	OpEqual:          "=",
+	OpNotEqual:       "<>",
+	OpLess:           "<",
+	OpLessOrEqual:    "<=",
+	OpGreater:        ">",
+	OpGreaterOrEqual: ">=",
+}
+
+// where translates expr, which must have passed check, into a condition of
+// q. Comparisons that SQL would leave unknown, such as those with a missing
+// property, are false, so that NOT behaves as in MemoryStore.
+func (f filterable[T]) where(s *sqlStore, q *listQuery, expr Expr) string {
+	switch e := expr.(type) {
+	case AndExpr:
+		return "(" + f.where(s, q, e.Left) + " AND " + f.where(s, q, e.Right) + ")"
+	case OrExpr:
+		return "(" + f.where(s, q, e.Left) + " OR " + f.where(s, q, e.Right) + ")"
+	case NotExpr:
+		return "(NOT " + f.where(s, q, e.Expr) + ")"
+	case Comparison:
+		if path, ok := strings.CutPrefix(e.Field, propertiesPrefix); ok {
+			return s.propertyComparison(q, strings.Split(path, "."), e.Op, e.Value)
+		}
+		column := f.fields[e.Field].column
+		if e.Value == nil {
+			return nullTest(column, e.Op)
+		}
+		return fmt.Sprintf("COALESCE(%s%s %s %s, FALSE)", column, s.dialect.textCollation, sqlOperators[e.Op], q.arg(e.Value))
+	}
+	return "TRUE"
+}
+
+// propertyComparison compares the property at path in the properties column
+// with value.
+func (s *sqlStore) propertyComparison(q *listQuery, path []string, op CompareOp, value any) string {
+	d := s.dialect
+	p := q.arg(d.jsonPath(path))
+	typ := d.jsonType("properties", p)
+	if value == nil {
+		// A missing property and a JSON null are both null.
+		return fmt.Sprintf("COALESCE(%s, 'null') %s 'null'", typ, sqlOperators[op])
+	}
+	var kind, collation string
+	switch value.(type) {
+	case string:
+		kind, collation = "string", d.textCollation
+	case float64:
+		kind = "number"
+	case bool:
+		kind = "boolean"
+	}
+	scalar := fmt.Sprintf("(CASE WHEN %s = '%s' THEN %s END)", typ, kind, d.jsonScalar("properties", p, kind))
+	return fmt.Sprintf("COALESCE(%s%s %s %s, FALSE)", scalar, collation, sqlOperators[op], q.arg(value))
+}
+
+func nullTest(expr string, op CompareOp) string {
+	if op == OpEqual {
+		return expr + " IS NULL"
+	}
+	return expr + " IS NOT NULL"
+}
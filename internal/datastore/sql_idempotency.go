@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+func (s *sqlStore) ReserveIdempotencyKey(record IdempotencyRecord) (*IdempotencyRecord, error) {
+	var existing *IdempotencyRecord
+	err := s.withTx(func(tx *sqlStore) error {
+		if _, err := tx.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= $1`, now()); err != nil {
+			return fmt.Errorf("dropping expired idempotency keys: %w", err)
+		}
+		// A concurrent reservation of the same key makes this one wait
+		// and then insert nothing.
+		result, err := tx.db.Exec(`INSERT INTO idempotency_keys (key, fingerprint, status, expires_at)
+			VALUES ($1, $2, 0, $3) ON CONFLICT (key) DO NOTHING`,
+			record.Key, record.Fingerprint, record.ExpiresAt.UTC())
+		if err != nil {
+			return fmt.Errorf("reserving idempotency key: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			return nil
+		}
+		existing, err = tx.getIdempotencyRecord(record.Key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+func (s *sqlStore) getIdempotencyRecord(key string) (*IdempotencyRecord, error) {
+	record := IdempotencyRecord{Key: key}
+	var header []byte
+	err := s.db.QueryRow(`SELECT fingerprint, status, header, body, expires_at FROM idempotency_keys WHERE key = $1`, key).
+		Scan(&record.Fingerprint, &record.Status, &header, &record.Body, &record.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errorf(ErrNotFound, "idempotency key %s not found", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading idempotency key: %w", err)
+	}
+	if err := unmarshalJSON(header, &record.Header); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s *sqlStore) CompleteIdempotencyKey(record IdempotencyRecord) error {
+	header, err := json.Marshal(record.Header)
+	if err != nil {
+		return fmt.Errorf("encoding response header: %w", err)
+	}
+	_, err = s.db.Exec(`INSERT INTO idempotency_keys (key, fingerprint, status, header, body, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (key) DO UPDATE SET fingerprint = excluded.fingerprint, status = excluded.status,
+			header = excluded.header, body = excluded.body, expires_at = excluded.expires_at`,
+		record.Key, record.Fingerprint, record.Status, string(header), record.Body, record.ExpiresAt.UTC())
+	if err != nil {
+		return fmt.Errorf("storing idempotent response: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) ReleaseIdempotencyKey(key string) error {
+	if _, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE key = $1`, key); err != nil {
+		return fmt.Errorf("releasing idempotency key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// addLabelTables indexes the labels of devices and locations, one row per
+// label, so that label selectors need not decode the labels columns.
+const addLabelTables = `
+CREATE TABLE device_labels (
+	device_id TEXT NOT NULL,
+	key       TEXT NOT NULL,
+	value     TEXT NOT NULL,
+	PRIMARY KEY (device_id, key)
+);
+CREATE INDEX device_labels_key_value_idx ON device_labels (key, value);
+CREATE TABLE location_labels (
+	location_id TEXT NOT NULL,
+	key         TEXT NOT NULL,
+	value       TEXT NOT NULL,
+	PRIMARY KEY (location_id, key)
+);
+CREATE INDEX location_labels_key_value_idx ON location_labels (key, value);
+`
+
+// labelIndex is a table indexing the labels of the records in owner.
+type labelIndex struct {
+	table    string
+	idColumn string
+	owner    string
+}
+
+var (
+	deviceLabels   = labelIndex{table: "device_labels", idColumn: "device_id", owner: "devices"}
+	locationLabels = labelIndex{table: "location_labels", idColumn: "location_id", owner: "locations"}
+)
+
+// writeLabels replaces the indexed labels of record id with labels.
+func (s *sqlStore) writeLabels(index labelIndex, id string, labels map[string]string) error {
+	if _, err := s.db.Exec(`DELETE FROM `+index.table+` WHERE `+index.idColumn+` = $1`, id); err != nil {
+		return fmt.Errorf("updating %s: %w", index.table, err)
+	}
+	for key, value := range labels {
+		_, err := s.db.Exec(`INSERT INTO `+index.table+` (`+index.idColumn+`, key, value) VALUES ($1, $2, $3)`, id, key, value)
+		if err != nil {
+			return fmt.Errorf("updating %s: %w", index.table, err)
+		}
+	}
+	return nil
+}
+
+// purgeLabels drops the indexed labels of the records PurgeDeleted removes.
+func (s *sqlStore) purgeLabels(index labelIndex, cutoff time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM `+index.table+` WHERE `+index.idColumn+` IN
+		(SELECT id FROM `+index.owner+` WHERE deleted_at < $1)`, cutoff)
+	if err != nil {
+		return fmt.Errorf("purging %s: %w", index.table, err)
+	}
+	return nil
+}
+
+// where restricts q to the records that selector matches.
+func (index labelIndex) where(q *listQuery, selector LabelSelector) {
+	for _, r := range selector {
+		condition := `SELECT 1 FROM ` + index.table + ` WHERE ` + index.idColumn + ` = ` + index.owner + `.id AND key = ` + q.arg(r.Key)
+		if r.Op == LabelIn || r.Op == LabelNotIn {
+			values := make([]string, len(r.Values))
+			for i, value := range r.Values {
+				values[i] = q.arg(value)
+			}
+			condition += ` AND value IN (` + strings.Join(values, ", ") + `)`
+		}
+		if r.Op == LabelIn || r.Op == LabelExists {
+			q.where = append(q.where, `EXISTS (`+condition+`)`)
+		} else {
+			q.where = append(q.where, `NOT EXISTS (`+condition+`)`)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	_ "modernc.org/sqlite" // registers the pure-Go "sqlite" database/sql driver
+)
+
+// sqliteMigrations are the schema changes for SQLiteStore, applied in order by
+// migrate. Append new steps; never edit one that has been released.
+var sqliteMigrations = []string{
+	sqliteSchema,
+	addResourceVersionColumns,
+	addUniqueIndexes,
+	sqliteAddEventSequence,
+	sqliteAddLabels,
+	sqliteAddIdempotencyKeys,
+}
+
+// sqliteSchema creates the tables used by SQLiteStore.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS devices (
+	id                  TEXT PRIMARY KEY,
+	name                TEXT NOT NULL,
+	hostname            TEXT,
+	component_type      TEXT NOT NULL,
+	manufacturer        TEXT NOT NULL,
+	part_number         TEXT NOT NULL,
+	serial_number       TEXT NOT NULL,
+	current_location_id TEXT,
+	status              TEXT NOT NULL,
+	properties          TEXT,
+	parent_device_id    TEXT,
+	children_device_ids TEXT,
+	created_at          TIMESTAMP NOT NULL,
+	updated_at          TIMESTAMP,
+	deleted_at          TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS devices_name_idx ON devices (name);
+CREATE INDEX IF NOT EXISTS devices_serial_number_idx ON devices (serial_number);
+
+CREATE TABLE IF NOT EXISTS locations (
+	id                    TEXT PRIMARY KEY,
+	name                  TEXT NOT NULL,
+	location_type         TEXT NOT NULL,
+	parent_location_id    TEXT,
+	children_location_ids TEXT,
+	current_device_id     TEXT,
+	status                TEXT NOT NULL,
+	properties            TEXT,
+	created_at            TIMESTAMP NOT NULL,
+	updated_at            TIMESTAMP,
+	deleted_at            TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS locations_name_idx ON locations (name);
+
+CREATE TABLE IF NOT EXISTS events (
+	id                TEXT PRIMARY KEY,
+	source            TEXT NOT NULL,
+	spec_version      TEXT NOT NULL,
+	type              TEXT NOT NULL,
+	data_content_type TEXT,
+	subject           TEXT,
+	time              TIMESTAMP NOT NULL,
+	device_id         TEXT,
+	location_id       TEXT,
+	actor             TEXT,
+	comment           TEXT,
+	duration          INTEGER,
+	state_before      TEXT,
+	state_after       TEXT
+);
+CREATE INDEX IF NOT EXISTS events_device_id_idx ON events (device_id, time);
+CREATE INDEX IF NOT EXISTS events_location_id_idx ON events (location_id, time);
+`
+
+// sqliteAddEventSequence numbers the existing events in insertion order.
+const sqliteAddEventSequence = `
+ALTER TABLE events ADD COLUMN sequence INTEGER NOT NULL DEFAULT 0;
+UPDATE events SET sequence = rowid;
+CREATE INDEX events_time_sequence_idx ON events (time, sequence);
+`
+
+// sqliteAddLabels adds the labels of devices and locations.
+const sqliteAddLabels = `
+ALTER TABLE devices ADD COLUMN labels TEXT;
+ALTER TABLE locations ADD COLUMN labels TEXT;
+` + addLabelTables
+
+// sqliteAddIdempotencyKeys remembers requests sent with an Idempotency-Key
+// and the responses to them.
+const sqliteAddIdempotencyKeys = `
+CREATE TABLE idempotency_keys (
+	key         TEXT PRIMARY KEY,
+	fingerprint TEXT NOT NULL,
+	status      INTEGER NOT NULL,
+	header      TEXT,
+	body        BLOB,
+	expires_at  TIMESTAMP NOT NULL
+);
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+`
+
+// sqliteDialect relies on SQLite's single writer to number events without
+// a race, and on its default BINARY collation to sort text bytewise.
+var sqliteDialect = sqlDialect{
+	nextEventSequence: `(SELECT COALESCE(MAX(sequence), 0) + 1 FROM events)`,
+	jsonPath: func(keys []string) any {
+		return `$."` + strings.Join(keys, `"."`) + `"`
+	},
+	jsonType: func(column, path string) string {
+		// Map SQLite's JSON types onto the names PostgreSQL uses.
+		return fmt.Sprintf(`(CASE json_type(%[1]s, %[2]s) WHEN 'text' THEN 'string'
+			WHEN 'integer' THEN 'number' WHEN 'real' THEN 'number'
+			WHEN 'true' THEN 'boolean' WHEN 'false' THEN 'boolean'
+			ELSE json_type(%[1]s, %[2]s) END)`, column, path)
+	},
+	jsonScalar: func(column, path, kind string) string {
+		return fmt.Sprintf("json_extract(%s, %s)", column, path)
+	},
+}
+
+// SQLiteStore is an implementation of the Datastore interface backed by a
+// single SQLite database file, for deployments without a database server.
+type SQLiteStore struct {
+	*sqlStore
+}
+
+// NewSQLiteStore opens (creating if necessary) the SQLite database at path,
+// migrates the schema to the current version and returns a ready to use
+// SQLiteStore. The special path ":memory:" yields a throwaway database.
+func NewSQLiteStore(path string, opts ...SQLStoreOption) (*SQLiteStore, error) {
+	pragmas := url.Values{}
+	pragmas.Add("_pragma", "busy_timeout(5000)")
+	pragmas.Add("_pragma", "journal_mode(WAL)")
+	pragmas.Add("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+pragmas.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite database: %w", err)
+	}
+	// SQLite allows a single writer at a time; funnelling every statement
+	// through one connection avoids SQLITE_BUSY errors and keeps ":memory:"
+	// databases from being split across connections.
+	db.SetMaxOpenConns(1)
+	if err := migrate(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating sqlite schema: %w", err)
+	}
+	store := newSQLStore(db, sqliteDialect, opts)
+	if err := applyLocationNameScope(db, store.locationNameScope); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{sqlStore: store}, nil
+}
@@ -0,0 +1,175 @@
+package datastore
+
+import (
+	"strings"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// TxOp is what one operation of a transaction does.
+type TxOp string
+
+const (
+	TxCreateDevice   TxOp = "createDevice"
+	TxUpdateDevice   TxOp = "updateDevice"
+	TxPatchDevice    TxOp = "patchDevice"
+	TxDeleteDevice   TxOp = "deleteDevice"
+	TxCreateLocation TxOp = "createLocation"
+	TxUpdateLocation TxOp = "updateLocation"
+	TxPatchLocation  TxOp = "patchLocation"
+	TxDeleteLocation TxOp = "deleteLocation"
+	TxInstallDevice  TxOp = "installDevice"
+	TxRemoveDevice   TxOp = "removeDevice"
+)
+
+// TxOperation is one operation of a transaction.
+//
+// A create can name the record it makes with Ref. Later operations refer to
+// that record by giving "$" followed by the name wherever they take a device
+// or location ID, including the parent IDs of the records they write.
+type TxOperation struct {
+	Op  TxOp
+	Ref string
+	// ID names the device or location to update, patch or delete.
+	ID string
+	// DeviceID and LocationID name the device and location of an install,
+	// and LocationID the location of a remove.
+	DeviceID   string
+	LocationID string
+	// Device and Location are the record to create, or the new state of the
+	// record to update.
+	Device   *models.Device
+	Location *models.Location
+	// Patch is the patch of a patch operation.
+	Patch Patch
+	// ResourceVersion, when non-zero, makes an update, patch or delete
+	// conditional on the record still being at this version.
+	ResourceVersion int64
+	// Cascade is the cascade policy of a delete.
+	Cascade CascadePolicy
+}
+
+// TxResult is what one operation of a transaction left: the device or
+// location it wrote and the event it recorded, if any.
+type TxResult struct {
+	Device   *models.Device
+	Location *models.Location
+	Event    *models.Event
+}
+
+// check rejects an operation that lacks what its Op needs, or whose record
+// is invalid.
+func (op TxOperation) check() error {
+	if op.Ref != "" && op.Op != TxCreateDevice && op.Op != TxCreateLocation {
+		return errorf(ErrInvalid, "only creates can name a ref")
+	}
+	switch op.Op {
+	case TxCreateDevice, TxUpdateDevice:
+		if op.Device == nil || (op.Op == TxUpdateDevice && op.ID == "") {
+			return errorf(ErrInvalid, "%s needs a device", op.Op)
+		}
+		return validateDevice(op.Device)
+	case TxCreateLocation, TxUpdateLocation:
+		if op.Location == nil || (op.Op == TxUpdateLocation && op.ID == "") {
+			return errorf(ErrInvalid, "%s needs a location", op.Op)
+		}
+		return validateLocation(op.Location)
+	case TxPatchDevice, TxPatchLocation, TxDeleteDevice, TxDeleteLocation:
+		if op.ID == "" {
+			return errorf(ErrInvalid, "%s needs an ID", op.Op)
+		}
+	case TxInstallDevice:
+		if op.DeviceID == "" || op.LocationID == "" {
+			return errorf(ErrInvalid, "%s needs a device ID and a location ID", op.Op)
+		}
+	case TxRemoveDevice:
+		if op.LocationID == "" {
+			return errorf(ErrInvalid, "%s needs a location ID", op.Op)
+		}
+	default:
+		return errorf(ErrInvalid, "unknown operation %q", op.Op)
+	}
+	return nil
+}
+
+// txRefs maps the refs of a transaction to the IDs of the records they name.
+type txRefs map[string]string
+
+// resolve returns the ID id stands for.
+func (refs txRefs) resolve(id string) (string, error) {
+	name, ok := strings.CutPrefix(id, "$")
+	if !ok {
+		return id, nil
+	}
+	resolved, ok := refs[name]
+	if !ok {
+		return "", errorf(ErrInvalid, "reference %s does not name a record created earlier", id)
+	}
+	return resolved, nil
+}
+
+// resolveOp replaces the references in op, and in the record it writes, by
+// the IDs they stand for.
+func (refs txRefs) resolveOp(op *TxOperation) error {
+	ids := []*string{&op.ID, &op.DeviceID, &op.LocationID}
+	if op.Device != nil && op.Device.ParentDeviceID != nil {
+		ids = append(ids, op.Device.ParentDeviceID)
+	}
+	if op.Location != nil && op.Location.ParentLocationID != nil {
+		ids = append(ids, op.Location.ParentLocationID)
+	}
+	for _, id := range ids {
+		resolved, err := refs.resolve(*id)
+		if err != nil {
+			return err
+		}
+		*id = resolved
+	}
+	return nil
+}
+
+// runTransaction resolves, checks and applies each operation in turn. apply
+// performs a single operation inside the backend's transaction. The first
+// failure is returned as a *BatchError.
+func runTransaction(ops []TxOperation, apply func(op TxOperation) (TxResult, error)) ([]TxResult, error) {
+	refs := txRefs{}
+	results := make([]TxResult, len(ops))
+	for i, op := range ops {
+		result, err := func() (TxResult, error) {
+			if _, exists := refs[op.Ref]; exists {
+				return TxResult{}, errorf(ErrInvalid, "ref %q is already taken", op.Ref)
+			}
+			if err := refs.resolveOp(&op); err != nil {
+				return TxResult{}, err
+			}
+			// An update writes the location it names, whatever ID its
+			// record holds, as UpdateLocation does.
+			if op.Op == TxUpdateLocation && op.Location != nil {
+				op.Location.ID = op.ID
+			}
+			if err := op.check(); err != nil {
+				return TxResult{}, err
+			}
+			// Updates take their precondition from the operation, like the
+			// other writes.
+			switch op.Op {
+			case TxUpdateDevice:
+				op.Device.ResourceVersion = op.ResourceVersion
+			case TxUpdateLocation:
+				op.Location.ResourceVersion = op.ResourceVersion
+			}
+			return apply(op)
+		}()
+		if err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		switch {
+		case op.Ref != "" && result.Device != nil:
+			refs[op.Ref] = result.Device.ID
+		case op.Ref != "" && result.Location != nil:
+			refs[op.Ref] = result.Location.ID
+		}
+		results[i] = result
+	}
+	return results, nil
+}
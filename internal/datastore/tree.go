@@ -0,0 +1,82 @@
+package datastore
+
+import (
+	"sort"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// TreeOptions controls how much of a location tree GetLocationTree returns.
+type TreeOptions struct {
+	// Depth is how many levels of locations below the root are included;
+	// a negative Depth includes them all.
+	Depth int
+	// IncludeChildDevices nests the child devices, and theirs, under each
+	// installed device.
+	IncludeChildDevices bool
+}
+
+// buildLocationTree nests locations and devices under the location rootID
+// by their parent pointers. The records must already be limited to the
+// tree; children are ordered by ID. It returns nil if rootID is not among
+// the locations.
+func buildLocationTree(rootID string, locations []*models.Location, devices []*models.Device, opts TreeOptions) *models.LocationTree {
+	var root *models.Location
+	childLocations := map[string][]*models.Location{}
+	for _, location := range locations {
+		if location.ID == rootID {
+			root = location
+		} else if location.ParentLocationID != nil {
+			childLocations[*location.ParentLocationID] = append(childLocations[*location.ParentLocationID], location)
+		}
+	}
+	if root == nil {
+		return nil
+	}
+	devicesByID := map[string]*models.Device{}
+	childDevices := map[string][]*models.Device{}
+	for _, device := range devices {
+		devicesByID[device.ID] = device
+		if device.ParentDeviceID != nil {
+			childDevices[*device.ParentDeviceID] = append(childDevices[*device.ParentDeviceID], device)
+		}
+	}
+
+	// visited guards against parent pointers that form a cycle.
+	visited := map[string]bool{}
+	var deviceTree func(device *models.Device) *models.DeviceTree
+	deviceTree = func(device *models.Device) *models.DeviceTree {
+		visited["device:"+device.ID] = true
+		node := &models.DeviceTree{Device: *device}
+		if opts.IncludeChildDevices {
+			children := childDevices[device.ID]
+			sort.Slice(children, func(i, j int) bool { return children[i].ID < children[j].ID })
+			for _, child := range children {
+				if !visited["device:"+child.ID] {
+					node.Children = append(node.Children, *deviceTree(child))
+				}
+			}
+		}
+		return node
+	}
+	var locationTree func(location *models.Location) models.LocationTree
+	locationTree = func(location *models.Location) models.LocationTree {
+		visited["location:"+location.ID] = true
+		node := models.LocationTree{Location: *location}
+		if location.CurrentDeviceID != nil {
+			if device, ok := devicesByID[*location.CurrentDeviceID]; ok {
+				node.Device = deviceTree(device)
+			}
+		}
+		children := childLocations[location.ID]
+		sort.Slice(children, func(i, j int) bool { return children[i].ID < children[j].ID })
+		for _, child := range children {
+			if !visited["location:"+child.ID] {
+				node.Children = append(node.Children, locationTree(child))
+			}
+		}
+		return node
+	}
+	tree := locationTree(root)
+	return &tree
+}
@@ -0,0 +1,59 @@
+package datastore
+
+import "github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+
+// Unique fields enforced by every backend among records that are not
+// soft-deleted:
+//
+//   - Device.Name
+//   - Device.Manufacturer together with Device.SerialNumber, when the serial
+//     number is set
+//   - Location.Name, either across all locations or only among locations
+//     with the same parent, depending on the LocationNameScope
+
+// LocationNameScope selects the locations among which a location name must
+// be unique.
+type LocationNameScope int
+
+const (
+	// LocationNamesGlobal requires every location name to be unique.
+	LocationNamesGlobal LocationNameScope = iota
+	// LocationNamesPerParent only requires names to be unique among
+	// locations with the same parent, so that e.g. every chassis can have a
+	// "slot-1".
+	LocationNamesPerParent
+)
+
+// deviceDuplicate reports whether device would take a unique field of other.
+func deviceDuplicate(device, other *models.Device) error {
+	if other.ID == device.ID || other.DeletedAt != nil {
+		return nil
+	}
+	if other.Name == device.Name {
+		return &DuplicateError{Kind: "device", Field: "name", Value: device.Name, ConflictingID: other.ID}
+	}
+	if device.SerialNumber != "" && other.Manufacturer == device.Manufacturer && other.SerialNumber == device.SerialNumber {
+		return &DuplicateError{Kind: "device", Field: "manufacturer and serial number", Value: device.Manufacturer + " " + device.SerialNumber, ConflictingID: other.ID}
+	}
+	return nil
+}
+
+// locationDuplicate reports whether location would take the name of other
+// within scope.
+func locationDuplicate(location, other *models.Location, scope LocationNameScope) error {
+	if other.ID == location.ID || other.DeletedAt != nil || other.Name != location.Name {
+		return nil
+	}
+	if scope == LocationNamesPerParent && parentKey(other.ParentLocationID) != parentKey(location.ParentLocationID) {
+		return nil
+	}
+	return &DuplicateError{Kind: "location", Field: "name", Value: location.Name, ConflictingID: other.ID}
+}
+
+// parentKey maps a parent pointer to the value the SQL backends index it by.
+func parentKey(parentLocationID *string) string {
+	if parentLocationID == nil {
+		return ""
+	}
+	return *parentLocationID
+}
@@ -0,0 +1,42 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+func TestLocationNameScope(t *testing.T) {
+	chassis := func(id string) *string { return &id }
+	tests := []struct {
+		scope     LocationNameScope
+		wantDupes bool
+	}{
+		{LocationNamesGlobal, true},
+		{LocationNamesPerParent, false},
+	}
+	for _, tt := range tests {
+		store, err := NewMemoryStore(WithLocationNameScope(tt.scope))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, parent := range []string{"chassis-1", "chassis-2"} {
+			if _, err := store.CreateLocation(&models.Location{ID: parent, Name: parent}); err != nil {
+				t.Fatalf("CreateLocation(%s): %v", parent, err)
+			}
+		}
+		if _, err := store.CreateLocation(&models.Location{ID: "c1-slot-1", Name: "slot-1", ParentLocationID: chassis("chassis-1")}); err != nil {
+			t.Fatalf("CreateLocation(c1-slot-1): %v", err)
+		}
+		_, err = store.CreateLocation(&models.Location{ID: "c2-slot-1", Name: "slot-1", ParentLocationID: chassis("chassis-2")})
+		var duplicate *DuplicateError
+		if got := errors.As(err, &duplicate); got != tt.wantDupes {
+			t.Errorf("scope %d: same name under another parent rejected = %v (%v), want %v", tt.scope, got, err, tt.wantDupes)
+		}
+		_, err = store.CreateLocation(&models.Location{ID: "c1-slot-1b", Name: "slot-1", ParentLocationID: chassis("chassis-1")})
+		if !errors.As(err, &duplicate) || duplicate.ConflictingID != "c1-slot-1" {
+			t.Errorf("scope %d: same name under the same parent: got %v, want a duplicate of c1-slot-1", tt.scope, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// validateDevice and validateLocation enforce the fields every backend
+// requires before a record is written. They report every failing field at
+// once, as a *ValidationError.
+
+func validateDevice(device *models.Device) error {
+	var errs fieldErrors
+	if device.Name == "" {
+		errs.add("name", "device name is required")
+	}
+	errs.labels("labels", device.Labels)
+	return errs.err()
+}
+
+func validateLocation(location *models.Location) error {
+	var errs fieldErrors
+	if location.ID == "" {
+		errs.add("id", "location ID is required")
+	}
+	if location.Name == "" {
+		errs.add("name", "location name is required")
+	}
+	errs.labels("labels", location.Labels)
+	return errs.err()
+}
+
+// FieldError is the failure of one field of a record or request.
+type FieldError struct {
+	// Field is the JSON name of the field. Map entries follow their field
+	// after a dot, as in "labels.rack".
+	Field   string
+	Message string
+}
+
+// ValidationError reports the fields that failed validation. It matches
+// ErrInvalid.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Unwrap() error { return ErrInvalid }
+
+// fieldErrors collects the failures of a validation.
+type fieldErrors []FieldError
+
+func (errs *fieldErrors) add(field, message string) {
+	*errs = append(*errs, FieldError{Field: field, Message: message})
+}
+
+// labels checks the syntax of the keys and values of the labels in field,
+// in key order.
+func (errs *fieldErrors) labels(field string, labels map[string]string) {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if err := checkLabelKey(key); err != nil {
+			errs.add(field+"."+key, err.Error())
+		} else if err := checkLabelValue(labels[key]); err != nil {
+			errs.add(field+"."+key, err.Error())
+		}
+	}
+}
+
+// err returns the failures as a *ValidationError, or nil if there are none.
+func (errs fieldErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: errs}
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// maxBatchOperations caps the number of operations in one batch request.
+const maxBatchOperations = 1000
+
+// batchOperation is one operation in the body of a batch request.
+type batchOperation struct {
+	Op datastore.BatchOp `json:"op"`
+	// ID names the record to update or delete.
+	ID string `json:"id"`
+	// ResourceVersion, when non-zero, makes an update or delete conditional,
+	// as If-Match does for a single record.
+	ResourceVersion int64 `json:"resourceVersion"`
+	// Cascade is the cascade policy of a delete.
+	Cascade  string           `json:"cascade"`
+	Device   *models.Device   `json:"device"`
+	Location *models.Location `json:"location"`
+}
+
+// batchResult reports the outcome of one operation of a batch.
+type batchResult struct {
+	Index  int `json:"index"`
+	Status int `json:"status"`
+	// Item is the record the operation left; deletes leave none.
+	Item  interface{}           `json:"item,omitempty"`
+	Error *models.ErrorResponse `json:"error,omitempty"`
+}
+
+// batchRequest reads the operations of a batch request and whether they
+// are to be applied atomically.
+func batchRequest(r *http.Request) (ops []batchOperation, atomic bool, err error) {
+	if value := r.URL.Query().Get("atomic"); value != "" {
+		if atomic, err = strconv.ParseBool(value); err != nil {
+			return nil, false, fmt.Errorf("atomic must be true or false, got %q", value)
+		}
+	}
+	var body struct {
+		Operations []batchOperation `json:"operations"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		return nil, false, err
+	}
+	if len(body.Operations) == 0 || len(body.Operations) > maxBatchOperations {
+		return nil, false, fmt.Errorf("operations must hold between 1 and %d operations", maxBatchOperations)
+	}
+	for i, op := range body.Operations {
+		if _, err := parseCascade(op.Cascade); err != nil {
+			return nil, false, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return body.Operations, atomic, nil
+}
+
+// deleteOptions returns the options of a delete operation.
+func (op batchOperation) deleteOptions() datastore.DeleteOptions {
+	cascade, _ := parseCascade(op.Cascade)
+	return datastore.DeleteOptions{ResourceVersion: op.ResourceVersion, Actor: defaultActor, Cascade: cascade}
+}
+
+// applyBatch applies ops through apply, all in one call when atomic and one
+// at a time otherwise, and reports the outcome of each. Only an atomic batch
+// fails as a whole.
+func applyBatch[O, T any](r *http.Request, ops []O, kinds []datastore.BatchOp, atomic bool, apply func([]O) ([]*T, error)) ([]batchResult, error) {
+	results := make([]batchResult, len(ops))
+	if atomic {
+		records, err := apply(ops)
+		if err != nil {
+			return nil, err
+		}
+		for i, record := range records {
+			results[i] = batchSuccess(i, kinds[i], record)
+		}
+		return results, nil
+	}
+	for i, op := range ops {
+		records, err := apply([]O{op})
+		if err != nil {
+			var batchErr *datastore.BatchError
+			if errors.As(err, &batchErr) {
+				err = batchErr.Err
+			}
+			problem := errorProblem(r, err)
+			results[i] = batchResult{Index: i, Status: problem.Status, Error: &problem}
+			continue
+		}
+		results[i] = batchSuccess(i, kinds[i], records[0])
+	}
+	return results, nil
+}
+
+// batchSuccess reports an operation that succeeded with the status its
+// single-record endpoint answers with.
+func batchSuccess[T any](index int, kind datastore.BatchOp, record *T) batchResult {
+	switch kind {
+	case datastore.BatchCreate:
+		return batchResult{Index: index, Status: http.StatusCreated, Item: record}
+	case datastore.BatchUpdate:
+		return batchResult{Index: index, Status: http.StatusOK, Item: record}
+	}
+	return batchResult{Index: index, Status: http.StatusNoContent}
+}
+
+// writeBatchResults writes the outcome of every operation of a batch.
+func writeBatchResults(w http.ResponseWriter, results []batchResult) {
+	response := struct {
+		Results   []batchResult `json:"results"`
+		Succeeded int           `json:"succeeded"`
+		Failed    int           `json:"failed"`
+	}{Results: results}
+	for _, result := range results {
+		if result.Error != nil {
+			response.Failed++
+		} else {
+			response.Succeeded++
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) batchDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	ops, atomic, err := batchRequest(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	deviceOps := make([]datastore.DeviceOperation, len(ops))
+	kinds := make([]datastore.BatchOp, len(ops))
+	for i, op := range ops {
+		if op.Device != nil {
+			// The precondition comes from the operation, never from the record.
+			op.Device.ResourceVersion = op.ResourceVersion
+		}
+		deviceOps[i] = datastore.DeviceOperation{Op: op.Op, ID: op.ID, Device: op.Device, Delete: op.deleteOptions(), Actor: defaultActor}
+		kinds[i] = op.Op
+	}
+	results, err := applyBatch(r, deviceOps, kinds, atomic, s.DB.ApplyDeviceBatch)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeBatchResults(w, results)
+}
+
+func (s *Server) batchLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	ops, atomic, err := batchRequest(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	locationOps := make([]datastore.LocationOperation, len(ops))
+	kinds := make([]datastore.BatchOp, len(ops))
+	for i, op := range ops {
+		if op.Location != nil {
+			// The precondition comes from the operation, never from the record.
+			op.Location.ResourceVersion = op.ResourceVersion
+		}
+		locationOps[i] = datastore.LocationOperation{Op: op.Op, ID: op.ID, Location: op.Location, Delete: op.deleteOptions(), Actor: defaultActor}
+		kinds[i] = op.Op
+	}
+	results, err := applyBatch(r, locationOps, kinds, atomic, s.DB.ApplyLocationBatch)
+	if err == nil {
+		var locations []*models.Location
+		for _, result := range results {
+			if location, ok := result.Item.(*models.Location); ok {
+				locations = append(locations, location)
+			}
+		}
+		err = s.setPaths(locations...)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeBatchResults(w, results)
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+)
+
+// parseFilter parses the filter query parameter of the device and location
+// lists into an expression:
+//
+//	expr       = term { "or" term }
+//	term       = factor { "and" factor }
+//	factor     = "not" factor | "(" expr ")" | comparison
+//	comparison = field ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) literal
+//	field      = name { "." name }
+//	literal    = string | number | "true" | "false" | "null"
+//
+// Keywords are case-insensitive, strings are double-quoted with Go escapes,
+// and names are letters, digits, "_" and "-". The datastore checks that the
+// fields exist.
+func parseFilter(input string) (datastore.Expr, error) {
+	p := &filterParser{input: input}
+	p.next()
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return expr, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokError
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of filter"
+	}
+	return strconv.Quote(t.text)
+}
+
+type filterParser struct {
+	input string
+	pos   int
+	tok   token
+}
+
+func (p *filterParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("filter: at offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+// next reads the next token into p.tok.
+func (p *filterParser) next() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	emit := func(kind tokenKind) {
+		p.tok = token{kind: kind, text: p.input[start:p.pos], pos: start}
+	}
+	if p.pos == len(p.input) {
+		emit(tokEOF)
+		return
+	}
+	c := p.input[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		emit(tokLParen)
+	case c == ')':
+		p.pos++
+		emit(tokRParen)
+	case c == '"':
+		p.pos++
+		for p.pos < len(p.input) && p.input[p.pos] != '"' {
+			if p.input[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.input) {
+			p.pos = len(p.input)
+			emit(tokError)
+			return
+		}
+		p.pos++
+		emit(tokString)
+	case strings.ContainsRune("=!<>", rune(c)):
+		p.pos++
+		if p.pos < len(p.input) && p.input[p.pos] == '=' {
+			p.pos++
+		}
+		emit(tokOp)
+	case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		for p.pos < len(p.input) && strings.IndexByte("0123456789.eE+-", p.input[p.pos]) >= 0 {
+			p.pos++
+		}
+		emit(tokNumber)
+	case isNameByte(c):
+		for p.pos < len(p.input) && (isNameByte(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		emit(tokName)
+	default:
+		p.pos++
+		emit(tokError)
+	}
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// keyword reports whether the current token is the keyword word.
+func (p *filterParser) keyword(word string) bool {
+	return p.tok.kind == tokName && strings.EqualFold(p.tok.text, word)
+}
+
+func (p *filterParser) expr() (datastore.Expr, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		p.next()
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = datastore.OrExpr{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) term() (datastore.Expr, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		p.next()
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = datastore.AndExpr{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) factor() (datastore.Expr, error) {
+	switch {
+	case p.keyword("not"):
+		p.next()
+		expr, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return datastore.NotExpr{Expr: expr}, nil
+	case p.tok.kind == tokLParen:
+		p.next()
+		expr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected \")\", got %s", p.tok)
+		}
+		p.next()
+		return expr, nil
+	}
+	return p.comparison()
+}
+
+var filterOps = map[string]datastore.CompareOp{
+	"==": datastore.OpEqual,
+	"!=": datastore.OpNotEqual,
+	"<":  datastore.OpLess,
+	"<=": datastore.OpLessOrEqual,
+	">":  datastore.OpGreater,
+	">=": datastore.OpGreaterOrEqual,
+}
+
+func (p *filterParser) comparison() (datastore.Expr, error) {
+	if p.tok.kind != tokName || p.keyword("and") || p.keyword("or") {
+		return nil, p.errorf("expected a field name, got %s", p.tok)
+	}
+	field := p.tok.text
+	p.next()
+	op, ok := filterOps[p.tok.text]
+	if p.tok.kind != tokOp || !ok {
+		return nil, p.errorf("expected a comparison operator after %s, got %s", field, p.tok)
+	}
+	p.next()
+	value, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	return datastore.Comparison{Field: field, Op: op, Value: value}, nil
+}
+
+func (p *filterParser) literal() (any, error) {
+	tok := p.tok
+	var value any
+	switch {
+	case tok.kind == tokString:
+		s, err := strconv.Unquote(tok.text)
+		if err != nil {
+			return nil, p.errorf("malformed string %s", tok.text)
+		}
+		value = s
+	case tok.kind == tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("malformed number %s", tok.text)
+		}
+		value = n
+	case p.keyword("true"):
+		value = true
+	case p.keyword("false"):
+		value = false
+	case p.keyword("null"):
+		value = nil
+	case tok.kind == tokError && strings.HasPrefix(tok.text, `"`):
+		return nil, p.errorf("unterminated string")
+	default:
+		return nil, p.errorf("expected a string, number, true, false or null, got %s", tok)
+	}
+	p.next()
+	return value, nil
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+)
+
+func TestParseFilter(t *testing.T) {
+	cmp := func(field string, op datastore.CompareOp, value any) datastore.Comparison {
+		return datastore.Comparison{Field: field, Op: op, Value: value}
+	}
+	tests := []struct {
+		input string
+		want  datastore.Expr
+	}{
+		{`name == "node-1"`, cmp("name", datastore.OpEqual, "node-1")},
+		{`properties.bmc.firmware>="2.1"`, cmp("properties.bmc.firmware", datastore.OpGreaterOrEqual, "2.1")},
+		{`properties.memoryGiB < -1.5e3`, cmp("properties.memoryGiB", datastore.OpLess, -1500.0)},
+		{`properties.up != TRUE`, cmp("properties.up", datastore.OpNotEqual, true)},
+		{`hostname == null`, cmp("hostname", datastore.OpEqual, nil)},
+		{`name == "say \"hi\""`, cmp("name", datastore.OpEqual, `say "hi"`)},
+		{
+			`a == 1 or b == 2 and not c == 3`,
+			datastore.OrExpr{
+				Left:  cmp("a", datastore.OpEqual, 1.0),
+				Right: datastore.AndExpr{Left: cmp("b", datastore.OpEqual, 2.0), Right: datastore.NotExpr{Expr: cmp("c", datastore.OpEqual, 3.0)}},
+			},
+		},
+		{
+			`(a == 1 OR b == 2) And c == false`,
+			datastore.AndExpr{
+				Left:  datastore.OrExpr{Left: cmp("a", datastore.OpEqual, 1.0), Right: cmp("b", datastore.OpEqual, 2.0)},
+				Right: cmp("c", datastore.OpEqual, false),
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseFilter(tt.input)
+		if err != nil {
+			t.Errorf("parseFilter(%s): %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFilter(%s) = %#v, want %#v", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{
+		``,
+		`name`,
+		`name ==`,
+		`name = "a"`,
+		`name == "a`,
+		`name == 'a'`,
+		`name == 1.2.3`,
+		`== "a"`,
+		`(name == "a"`,
+		`name == "a")`,
+		`name == "a" and`,
+		`name == "a" name == "b"`,
+		`not`,
+	} {
+		if _, err := parseFilter(input); err == nil {
+			t.Errorf("parseFilter(%s) succeeded, want an error", input)
+		}
+	}
+}
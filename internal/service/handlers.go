@@ -2,13 +2,26 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
 	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
+// defaultActor is recorded on events until requests carry an authenticated identity.
+const defaultActor = "api-user"
+
 // --- Helper Functions ---
 
 func writeJSON(w http.ResponseWriter, statusCode int, data interface{}) {
@@ -19,15 +32,415 @@ func writeJSON(w http.ResponseWriter, statusCode int, data interface{}) {
 	}
 }
 
+// errorStatuses maps datastore errors to HTTP statuses and stable error
+// codes. Entries are checked in order, so specific errors come before the
+// general kinds they also match.
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{datastore.ErrLocationOccupied, http.StatusConflict, "location_occupied"},
+	{datastore.ErrLocationEmpty, http.StatusConflict, "location_empty"},
+	{datastore.ErrDeviceInstalled, http.StatusConflict, "device_installed"},
+	{datastore.ErrStillReferenced, http.StatusConflict, "still_referenced"},
+	{datastore.ErrInvalidCursor, http.StatusBadRequest, "bad_request"},
+	{datastore.ErrInvalidSort, http.StatusBadRequest, "bad_request"},
+	{datastore.ErrInvalidFilter, http.StatusBadRequest, "bad_request"},
+	{datastore.ErrInvalidLabelSelector, http.StatusBadRequest, "bad_request"},
+	{datastore.ErrInvalidPatch, http.StatusBadRequest, "bad_request"},
+	{datastore.ErrPatchConflict, http.StatusConflict, "patch_conflict"},
+	{datastore.ErrNotFound, http.StatusNotFound, "not_found"},
+	{datastore.ErrAlreadyExists, http.StatusConflict, "already_exists"},
+	{datastore.ErrConflict, http.StatusConflict, "conflict"},
+	{datastore.ErrInvalid, http.StatusUnprocessableEntity, "invalid"},
+	{datastore.ErrPreconditionFailed, http.StatusPreconditionFailed, "precondition_failed"},
+}
+
+// problemTypePrefix starts the type URI of every problem; the code of the
+// problem follows it.
+const problemTypePrefix = "urn:openchami:inventory:problem:"
+
+// newProblem describes a failed request as an RFC 7807 problem. Its type and
+// title follow from code, and its instance is the ID of the request.
+func newProblem(r *http.Request, status int, code, detail string) models.ErrorResponse {
+	title := strings.ReplaceAll(code, "_", " ")
+	return models.ErrorResponse{
+		Type:     problemTypePrefix + code,
+		Title:    strings.ToUpper(title[:1]) + title[1:],
+		Status:   status,
+		Detail:   detail,
+		Message:  detail,
+		Instance: middleware.GetReqID(r.Context()),
+		Code:     code,
+	}
+}
+
+// writeProblem sends problem as the response.
+func writeProblem(w http.ResponseWriter, problem models.ErrorResponse) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// writeError writes the response for an error returned by the datastore.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, errorProblem(r, err))
+}
+
+// writeBadRequest rejects a request that could not be read, listing the
+// fields at fault when err is a *requestError.
+func writeBadRequest(w http.ResponseWriter, r *http.Request, err error) {
+	problem := newProblem(r, http.StatusBadRequest, "bad_request", err.Error())
+	var requestErr *requestError
+	if errors.As(err, &requestErr) {
+		problem.Errors = requestErr.fields
+	}
+	writeProblem(w, problem)
+}
+
+// errorProblem describes an error returned by the datastore. Errors that
+// match none of the known kinds are internal errors.
+func errorProblem(r *http.Request, err error) models.ErrorResponse {
+	for _, e := range errorStatuses {
+		if errors.Is(err, e.err) {
+			problem := newProblem(r, e.status, e.code, err.Error())
+			var duplicate *datastore.DuplicateError
+			if errors.As(err, &duplicate) {
+				problem.ConflictingID = duplicate.ConflictingID
+			}
+			var validation *datastore.ValidationError
+			if errors.As(err, &validation) {
+				for _, field := range validation.Fields {
+					problem.Errors = append(problem.Errors, models.FieldError{Field: field.Field, Detail: field.Message})
+				}
+			}
+			return problem
+		}
+	}
+	return newProblem(r, http.StatusInternalServerError, "internal_error", err.Error())
+}
+
+// requestError is a request body that could not be decoded.
+type requestError struct {
+	detail string
+	// fields lists the fields that did not hold a value of their type.
+	fields []models.FieldError
+}
+
+func (e *requestError) Error() string { return e.detail }
+
+// decodeJSON decodes the request body into v. It fails with a
+// *requestError saying where the body went wrong.
+func decodeJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, io.EOF):
+		return &requestError{detail: "Invalid JSON format: the request body is empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &requestError{detail: "Invalid JSON format: the request body ends early"}
+	case errors.As(err, &syntaxErr):
+		return &requestError{detail: fmt.Sprintf("Invalid JSON format at offset %d: %v", syntaxErr.Offset, err)}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		detail := "must be " + jsonTypeName(typeErr.Type)
+		return &requestError{
+			detail: fmt.Sprintf("Invalid JSON format: %s %s", typeErr.Field, detail),
+			fields: []models.FieldError{{Field: typeErr.Field, Detail: detail}},
+		}
+	}
+	return &requestError{detail: "Invalid JSON format: " + err.Error()}
+}
+
+// jsonTypeName names the JSON values that decode into a Go type.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return "an RFC 3339 time"
+		}
+		return "an object"
+	}
+	return "a " + t.String()
+}
+
+// setETag advertises the resource version of the record in the response.
+func setETag(w http.ResponseWriter, resourceVersion int64) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(resourceVersion, 10)))
+}
+
+// ifMatchVersion returns the resource version required by the request's
+// If-Match header, or 0 when the write is unconditional. Only "*" and a single
+// strong ETag as served by setETag are understood; ok is false otherwise, as
+// such a header can never match.
+func ifMatchVersion(r *http.Request) (version int64, ok bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, true
+	}
+	unquoted, err := strconv.Unquote(header)
+	if err != nil || !strings.HasPrefix(header, `"`) {
+		return 0, false
+	}
+	version, err = strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// writeIfMatchError rejects an If-Match header that ifMatchVersion could not use.
+func writeIfMatchError(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, newProblem(r, http.StatusPreconditionFailed, "precondition_failed", "If-Match must be \"*\" or a single ETag returned by this service"))
+}
+
+// Page sizes of list endpoints. A request with neither limit nor after
+// gets the whole list, as before lists were paged.
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// pageOptions reads the paging and sorting parameters shared by all list
+// endpoints. sort is a comma-separated list of fields, each prefixed with
+// "-" to sort in descending order.
+func pageOptions(r *http.Request) (datastore.ListOptions, error) {
+	query := r.URL.Query()
+	opts := datastore.ListOptions{After: query.Get("after")}
+	if opts.After != "" {
+		opts.Limit = defaultPageLimit
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return opts, fmt.Errorf("limit must be a number from 1 to %d, got %q", maxPageLimit, value)
+		}
+		opts.Limit = limit
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return opts, fmt.Errorf("offset must be a non-negative number, got %q", value)
+		}
+		opts.Offset = offset
+	}
+	if value := query.Get("sort"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			name, descending := strings.CutPrefix(field, "-")
+			if name == "" {
+				return opts, fmt.Errorf("sort must be a comma-separated list of fields, got %q", value)
+			}
+			opts.Sort = append(opts.Sort, datastore.SortField{Field: name, Descending: descending})
+		}
+	}
+	return opts, nil
+}
+
+// pagination describes a page of count items listed with opts. Next links
+// to the following page by its cursor, keeping the request's other
+// parameters.
+func pagination(r *http.Request, opts datastore.ListOptions, count int, page datastore.Page) models.PaginationInfo {
+	info := models.PaginationInfo{Count: count, Total: page.Total, Offset: opts.Offset, Limit: opts.Limit}
+	if page.Next != "" {
+		query := r.URL.Query()
+		query.Del("offset")
+		query.Set("after", page.Next)
+		query.Set("limit", strconv.Itoa(opts.Limit))
+		info.Next = r.URL.Path + "?" + query.Encode()
+	}
+	return info
+}
+
+// listOptions reads the query parameters shared by the device and location
+// list endpoints.
+func listOptions(r *http.Request) (datastore.ListOptions, error) {
+	opts, err := pageOptions(r)
+	if err != nil {
+		return opts, err
+	}
+	if value := r.URL.Query().Get("includeDeleted"); value != "" {
+		includeDeleted, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, fmt.Errorf("includeDeleted must be a boolean, got %q", value)
+		}
+		opts.IncludeDeleted = includeDeleted
+	}
+	return opts, nil
+}
+
+// deviceFilter reads the device list filters, including the label selector
+// and the filter expression, from the query string.
+func deviceFilter(r *http.Request) (datastore.DeviceFilter, error) {
+	query := r.URL.Query()
+	filter := datastore.DeviceFilter{
+		ComponentType:     query.Get("componentType"),
+		Manufacturer:      query.Get("manufacturer"),
+		PartNumber:        query.Get("partNumber"),
+		Status:            query.Get("status"),
+		CurrentLocationID: query.Get("currentLocationId"),
+		ParentDeviceID:    query.Get("parentDeviceId"),
+	}
+	var err error
+	if filter.Labels, err = parseLabelSelector(query.Get("labelSelector")); err != nil {
+		return filter, err
+	}
+	filter.Expr, err = filterExpr(r)
+	return filter, err
+}
+
+// locationFilter reads the location list filters, including the label
+// selector and the filter expression, from the query string.
+func locationFilter(r *http.Request) (datastore.LocationFilter, error) {
+	query := r.URL.Query()
+	filter := datastore.LocationFilter{
+		LocationType:     query.Get("locationType"),
+		Status:           query.Get("status"),
+		ParentLocationID: query.Get("parentLocationId"),
+	}
+	var err error
+	if filter.Labels, err = parseLabelSelector(query.Get("labelSelector")); err != nil {
+		return filter, err
+	}
+	filter.Expr, err = filterExpr(r)
+	return filter, err
+}
+
+// filterExpr parses the filter query parameter, if there is one.
+func filterExpr(r *http.Request) (datastore.Expr, error) {
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		return parseFilter(filter)
+	}
+	return nil, nil
+}
+
+// eventFilter reads the event list filters from the query string. since and
+// until are RFC 3339 times.
+func eventFilter(r *http.Request) (datastore.EventFilter, error) {
+	query := r.URL.Query()
+	filter := datastore.EventFilter{
+		Type:       query.Get("type"),
+		Actor:      query.Get("actor"),
+		DeviceID:   query.Get("deviceId"),
+		LocationID: query.Get("locationId"),
+	}
+	for _, bound := range []struct {
+		param string
+		time  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		value := query.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be an RFC 3339 time, got %q", bound.param, value)
+		}
+		*bound.time = t
+	}
+	return filter, nil
+}
+
+// deleteOptions reads the cascade policy of a delete request.
+func deleteOptions(r *http.Request) (datastore.DeleteOptions, error) {
+	cascade, err := parseCascade(r.URL.Query().Get("cascade"))
+	return datastore.DeleteOptions{Actor: defaultActor, Cascade: cascade}, err
+}
+
+// parseCascade parses the cascade policy of a delete.
+func parseCascade(value string) (datastore.CascadePolicy, error) {
+	switch value {
+	case "", "none":
+		return datastore.CascadeNone, nil
+	case "detach":
+		return datastore.CascadeDetach, nil
+	case "delete":
+		return datastore.CascadeDelete, nil
+	}
+	return "", fmt.Errorf("cascade must be none, detach or delete, got %q", value)
+}
+
+// relabelRequest reads the body of a relabel request: the label selector
+// picking the records, and the labels to set and remove. The selector is
+// required, so that a request cannot relabel everything by accident.
+func relabelRequest(r *http.Request) (datastore.LabelSelector, datastore.LabelChange, error) {
+	var body struct {
+		LabelSelector string            `json:"labelSelector"`
+		Set           map[string]string `json:"set"`
+		Remove        []string          `json:"remove"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		return nil, datastore.LabelChange{}, err
+	}
+	selector, err := parseLabelSelector(body.LabelSelector)
+	if err != nil {
+		return nil, datastore.LabelChange{}, err
+	}
+	if len(selector) == 0 {
+		return nil, datastore.LabelChange{}, errors.New("labelSelector is required")
+	}
+	if len(body.Set) == 0 && len(body.Remove) == 0 {
+		return nil, datastore.LabelChange{}, errors.New("set or remove must name at least one label")
+	}
+	return selector, datastore.LabelChange{Set: body.Set, Remove: body.Remove}, nil
+}
+
+// patchRequest reads the body of a PATCH request as the patch format its
+// Content-Type names. It writes the error response itself and returns false
+// when the request cannot be read, answering other media types with
+// 415 Unsupported Media Type.
+func patchRequest(w http.ResponseWriter, r *http.Request) (datastore.Patch, bool) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	patchType := datastore.PatchType(mediaType)
+	if patchType != datastore.MergePatch && patchType != datastore.JSONPatch {
+		w.Header().Set("Accept-Patch", string(datastore.MergePatch)+", "+string(datastore.JSONPatch))
+		writeProblem(w, newProblem(r, http.StatusUnsupportedMediaType, "unsupported_media_type",
+			fmt.Sprintf("Content-Type must be %s or %s", datastore.MergePatch, datastore.JSONPatch)))
+		return datastore.Patch{}, false
+	}
+	document, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return datastore.Patch{}, false
+	}
+	return datastore.Patch{Type: patchType, Document: document}, true
+}
+
 func strPtr(s string) *string        { return &s }
 func timePtr(t time.Time) *time.Time { return &t }
 
 // --- Device Handlers ---
 
 func (s *Server) listDevicesHandler(w http.ResponseWriter, r *http.Request) {
-	devices, err := s.DB.ListDevices()
+	opts, err := listOptions(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	filter, err := deviceFilter(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	devices, page, err := s.DB.ListDevices(filter, opts)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, models.ErrorResponse{Code: "internal_error", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
 	response := struct {
@@ -35,32 +448,55 @@ func (s *Server) listDevicesHandler(w http.ResponseWriter, r *http.Request) {
 		Pagination models.PaginationInfo `json:"pagination"`
 	}{
 		Items:      devices,
-		Pagination: models.PaginationInfo{Count: len(devices), Total: len(devices), Offset: 0},
+		Pagination: pagination(r, opts, len(devices), page),
 	}
 	writeJSON(w, http.StatusOK, response)
 }
 
 func (s *Server) createDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	var device models.Device
-	if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
-		writeJSON(w, http.StatusBadRequest, models.ErrorResponse{Code: "bad_request", Message: "Invalid JSON format"})
+	if err := decodeJSON(r, &device); err != nil {
+		writeBadRequest(w, r, err)
 		return
 	}
 	createdDevice, err := s.DB.CreateDevice(&device)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, models.ErrorResponse{Code: "internal_error", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
+	setETag(w, createdDevice.ResourceVersion)
 	writeJSON(w, http.StatusCreated, createdDevice)
 }
 
+func (s *Server) relabelDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	selector, change, err := relabelRequest(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	devices, err := s.DB.RelabelDevices(datastore.DeviceFilter{Labels: selector}, change)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	response := struct {
+		Items []models.Device `json:"items"`
+		Count int             `json:"count"`
+	}{
+		Items: devices,
+		Count: len(devices),
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
 func (s *Server) getDeviceByIDHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	device, err := s.DB.GetDeviceByID(id)
 	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
+	setETag(w, device.ResourceVersion)
 	writeJSON(w, http.StatusOK, device)
 }
 
@@ -68,42 +504,106 @@ func (s *Server) getDeviceByNameHandler(w http.ResponseWriter, r *http.Request)
 	name := chi.URLParam(r, "name")
 	device, err := s.DB.GetDeviceByName(name)
 	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
+	setETag(w, device.ResourceVersion)
 	writeJSON(w, http.StatusOK, device)
 }
 
 func (s *Server) updateDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		writeIfMatchError(w, r)
+		return
+	}
 	var device models.Device
-	if err := json.NewDecoder(r.Body).Decode(&device); err != nil {
-		writeJSON(w, http.StatusBadRequest, models.ErrorResponse{Code: "bad_request", Message: "Invalid JSON format"})
+	if err := decodeJSON(r, &device); err != nil {
+		writeBadRequest(w, r, err)
 		return
 	}
-	updatedDevice, err := s.DB.UpdateDevice(id, &device)
+	// The precondition comes from If-Match only, never from the body.
+	device.ResourceVersion = version
+	updatedDevice, err := s.DB.UpdateDevice(id, &device, defaultActor)
 	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
+	setETag(w, updatedDevice.ResourceVersion)
 	writeJSON(w, http.StatusOK, updatedDevice)
 }
 
+func (s *Server) patchDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		writeIfMatchError(w, r)
+		return
+	}
+	patch, ok := patchRequest(w, r)
+	if !ok {
+		return
+	}
+	device, err := s.DB.PatchDevice(id, patch, datastore.PatchOptions{ResourceVersion: version, Actor: defaultActor})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	setETag(w, device.ResourceVersion)
+	writeJSON(w, http.StatusOK, device)
+}
+
 func (s *Server) deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	if err := s.DB.DeleteDevice(id); err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: err.Error()})
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		writeIfMatchError(w, r)
+		return
+	}
+	opts, err := deleteOptions(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	opts.ResourceVersion = version
+	if err := s.DB.DeleteDevice(id, opts); err != nil {
+		writeError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *Server) restoreDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	device, err := s.DB.RestoreDevice(id, defaultActor)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	setETag(w, device.ResourceVersion)
+	writeJSON(w, http.StatusOK, device)
+}
+
 // --- Location Handlers ---
 
 func (s *Server) listLocationsHandler(w http.ResponseWriter, r *http.Request) {
-	locations, err := s.DB.ListLocations()
+	opts, err := listOptions(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	filter, err := locationFilter(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	locations, page, err := s.DB.ListLocations(filter, opts)
+	if err == nil {
+		err = s.setPaths(locationPointers(locations)...)
+	}
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, models.ErrorResponse{Code: "internal_error", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
 	response := struct {
@@ -111,75 +611,354 @@ func (s *Server) listLocationsHandler(w http.ResponseWriter, r *http.Request) {
 		Pagination models.PaginationInfo `json:"pagination"`
 	}{
 		Items:      locations,
-		Pagination: models.PaginationInfo{Count: len(locations), Total: len(locations), Offset: 0},
+		Pagination: pagination(r, opts, len(locations), page),
 	}
 	writeJSON(w, http.StatusOK, response)
 }
 
 func (s *Server) createLocationHandler(w http.ResponseWriter, r *http.Request) {
 	var location models.Location
-	if err := json.NewDecoder(r.Body).Decode(&location); err != nil {
-		writeJSON(w, http.StatusBadRequest, models.ErrorResponse{Code: "bad_request", Message: "Invalid JSON format"})
+	if err := decodeJSON(r, &location); err != nil {
+		writeBadRequest(w, r, err)
 		return
 	}
 	createdLocation, err := s.DB.CreateLocation(&location)
+	if err == nil {
+		err = s.setPaths(createdLocation)
+	}
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, models.ErrorResponse{Code: "internal_error", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
+	setETag(w, createdLocation.ResourceVersion)
 	writeJSON(w, http.StatusCreated, createdLocation)
 }
 
+func (s *Server) relabelLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	selector, change, err := relabelRequest(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	locations, err := s.DB.RelabelLocations(datastore.LocationFilter{Labels: selector}, change)
+	if err == nil {
+		err = s.setPaths(locationPointers(locations)...)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	response := struct {
+		Items []models.Location `json:"items"`
+		Count int               `json:"count"`
+	}{
+		Items: locations,
+		Count: len(locations),
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
 func (s *Server) getLocationByIDHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	location, err := s.DB.GetLocationByID(id)
+	if err == nil {
+		err = s.setPaths(location)
+	}
 	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
+	setETag(w, location.ResourceVersion)
 	writeJSON(w, http.StatusOK, location)
 }
 
 func (s *Server) getLocationByNameHandler(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 	location, err := s.DB.GetLocationByName(name)
+	if err == nil {
+		err = s.setPaths(location)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	setETag(w, location.ResourceVersion)
+	writeJSON(w, http.StatusOK, location)
+}
+
+func (s *Server) getLocationTreeHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	opts, err := treeOptions(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	tree, err := s.DB.GetLocationTree(id, opts)
+	if err == nil {
+		err = s.setTreePaths(tree)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tree)
+}
+
+// treeOptions reads how much of a location tree to return. Without depth
+// the whole tree is returned.
+func treeOptions(r *http.Request) (datastore.TreeOptions, error) {
+	opts := datastore.TreeOptions{Depth: -1}
+	if value := r.URL.Query().Get("depth"); value != "" {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			return opts, fmt.Errorf("depth must be a non-negative integer, got %q", value)
+		}
+		opts.Depth = depth
+	}
+	if value := r.URL.Query().Get("includeChildDevices"); value != "" {
+		include, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, fmt.Errorf("includeChildDevices must be a boolean, got %q", value)
+		}
+		opts.IncludeChildDevices = include
+	}
+	return opts, nil
+}
+
+func (s *Server) getLocationAncestorsHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	ancestors, err := s.DB.GetLocationAncestors(id)
+	if err == nil {
+		err = s.setPaths(locationPointers(ancestors)...)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	response := struct {
+		Items []models.Location `json:"items"`
+	}{
+		Items: ancestors,
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) listLocationDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	opts, err := listOptions(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	filter, err := deviceFilter(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	recursive := false
+	if value := r.URL.Query().Get("recursive"); value != "" {
+		if recursive, err = strconv.ParseBool(value); err != nil {
+			writeBadRequest(w, r, fmt.Errorf("recursive must be a boolean, got %q", value))
+			return
+		}
+	}
+	devices, page, err := s.DB.ListLocationDevices(id, recursive, filter, opts)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	response := struct {
+		Items      []models.Device       `json:"items"`
+		Pagination models.PaginationInfo `json:"pagination"`
+	}{
+		Items:      devices,
+		Pagination: pagination(r, opts, len(devices), page),
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// byPathPrefix precedes the path of a location in a by-path lookup.
+const byPathPrefix = "/inventory/v1/locations/by-path/"
+
+func (s *Server) getLocationByPathHandler(w http.ResponseWriter, r *http.Request) {
+	names, err := locationPathNames(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	location, err := s.DB.GetLocationByPath(names)
+	if err == nil {
+		err = s.setPaths(location)
+	}
 	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
+	setETag(w, location.ResourceVersion)
 	writeJSON(w, http.StatusOK, location)
 }
 
+// locationPathNames splits the path of a by-path lookup into location names.
+// The escaped form is split so that a name can hold an escaped "/".
+func locationPathNames(r *http.Request) ([]string, error) {
+	escaped := strings.TrimPrefix(r.URL.EscapedPath(), byPathPrefix)
+	if escaped == "" {
+		return nil, errors.New("a location path is required")
+	}
+	var names []string
+	for _, segment := range strings.Split(escaped, datastore.PathSeparator) {
+		name, err := url.PathUnescape(segment)
+		if err != nil || name == "" {
+			return nil, fmt.Errorf("location path %q has an empty or malformed name", escaped)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// setPaths fills in the path of each location.
+func (s *Server) setPaths(locations ...*models.Location) error {
+	ids := make([]string, len(locations))
+	for i, location := range locations {
+		ids[i] = location.ID
+	}
+	paths, err := s.DB.LocationPaths(ids)
+	if err != nil {
+		return err
+	}
+	for _, location := range locations {
+		location.Path = paths[location.ID]
+	}
+	return nil
+}
+
+// setTreePaths fills in the path of every location in tree from that of its
+// root.
+func (s *Server) setTreePaths(tree *models.LocationTree) error {
+	if err := s.setPaths(&tree.Location); err != nil {
+		return err
+	}
+	var walk func(node *models.LocationTree)
+	walk = func(node *models.LocationTree) {
+		for i := range node.Children {
+			child := &node.Children[i]
+			child.Path = node.Path + datastore.PathSeparator + child.Name
+			walk(child)
+		}
+	}
+	walk(tree)
+	return nil
+}
+
+// locationPointers points into locations, so that they can be changed in
+// place.
+func locationPointers(locations []models.Location) []*models.Location {
+	pointers := make([]*models.Location, len(locations))
+	for i := range locations {
+		pointers[i] = &locations[i]
+	}
+	return pointers
+}
+
 func (s *Server) updateLocationHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		writeIfMatchError(w, r)
+		return
+	}
 	var location models.Location
-	if err := json.NewDecoder(r.Body).Decode(&location); err != nil {
-		writeJSON(w, http.StatusBadRequest, models.ErrorResponse{Code: "bad_request", Message: "Invalid JSON format"})
+	if err := decodeJSON(r, &location); err != nil {
+		writeBadRequest(w, r, err)
 		return
 	}
-	updatedLocation, err := s.DB.UpdateLocation(id, &location)
+	// The precondition comes from If-Match only, never from the body.
+	location.ResourceVersion = version
+	updatedLocation, err := s.DB.UpdateLocation(id, &location, defaultActor)
+	if err == nil {
+		err = s.setPaths(updatedLocation)
+	}
 	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
+	setETag(w, updatedLocation.ResourceVersion)
 	writeJSON(w, http.StatusOK, updatedLocation)
 }
 
+func (s *Server) patchLocationHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		writeIfMatchError(w, r)
+		return
+	}
+	patch, ok := patchRequest(w, r)
+	if !ok {
+		return
+	}
+	location, err := s.DB.PatchLocation(id, patch, datastore.PatchOptions{ResourceVersion: version, Actor: defaultActor})
+	if err == nil {
+		err = s.setPaths(location)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	setETag(w, location.ResourceVersion)
+	writeJSON(w, http.StatusOK, location)
+}
+
 func (s *Server) deleteLocationHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	if err := s.DB.DeleteLocation(id); err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: err.Error()})
+	version, ok := ifMatchVersion(r)
+	if !ok {
+		writeIfMatchError(w, r)
+		return
+	}
+	opts, err := deleteOptions(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	opts.ResourceVersion = version
+	if err := s.DB.DeleteLocation(id, opts); err != nil {
+		writeError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *Server) restoreLocationHandler(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	location, err := s.DB.RestoreLocation(id, defaultActor)
+	if err == nil {
+		err = s.setPaths(location)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	setETag(w, location.ResourceVersion)
+	writeJSON(w, http.StatusOK, location)
+}
+
 // --- Event and History Handlers ---
 
 func (s *Server) listEventsHandler(w http.ResponseWriter, r *http.Request) {
-	events, err := s.DB.ListEvents()
+	opts, err := pageOptions(r)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, models.ErrorResponse{Code: "internal_error", Message: err.Error()})
+		writeBadRequest(w, r, err)
+		return
+	}
+	filter, err := eventFilter(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	events, page, err := s.DB.ListEvents(filter, opts)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	response := struct {
@@ -187,7 +966,7 @@ func (s *Server) listEventsHandler(w http.ResponseWriter, r *http.Request) {
 		Pagination models.PaginationInfo `json:"pagination"`
 	}{
 		Items:      events,
-		Pagination: models.PaginationInfo{Count: len(events), Total: len(events), Offset: 0},
+		Pagination: pagination(r, opts, len(events), page),
 	}
 	writeJSON(w, http.StatusOK, response)
 }
@@ -196,7 +975,7 @@ func (s *Server) getEventByIDHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	event, err := s.DB.GetEventByID(id)
 	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
 	writeJSON(w, http.StatusOK, event)
@@ -204,9 +983,14 @@ func (s *Server) getEventByIDHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) getDeviceHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	events, err := s.DB.ListEventsByDeviceID(id)
+	opts, err := pageOptions(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	events, page, err := s.DB.ListEventsByDeviceID(id, opts)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, models.ErrorResponse{Code: "internal_error", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
 	response := struct {
@@ -214,16 +998,21 @@ func (s *Server) getDeviceHistoryHandler(w http.ResponseWriter, r *http.Request)
 		Pagination models.PaginationInfo `json:"pagination"`
 	}{
 		Items:      events,
-		Pagination: models.PaginationInfo{Count: len(events), Total: len(events), Offset: 0},
+		Pagination: pagination(r, opts, len(events), page),
 	}
 	writeJSON(w, http.StatusOK, response)
 }
 
 func (s *Server) getLocationHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	events, err := s.DB.ListEventsByLocationID(id)
+	opts, err := pageOptions(r)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, models.ErrorResponse{Code: "internal_error", Message: err.Error()})
+		writeBadRequest(w, r, err)
+		return
+	}
+	events, page, err := s.DB.ListEventsByLocationID(id, opts)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	response := struct {
@@ -231,7 +1020,7 @@ func (s *Server) getLocationHistoryHandler(w http.ResponseWriter, r *http.Reques
 		Pagination models.PaginationInfo `json:"pagination"`
 	}{
 		Items:      events,
-		Pagination: models.PaginationInfo{Count: len(events), Total: len(events), Offset: 0},
+		Pagination: pagination(r, opts, len(events), page),
 	}
 	writeJSON(w, http.StatusOK, response)
 }
@@ -242,16 +1031,16 @@ func (s *Server) getDeviceAtLocationHandler(w http.ResponseWriter, r *http.Reque
 	locationId := chi.URLParam(r, "id")
 	location, err := s.DB.GetLocationByID(locationId)
 	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: err.Error()})
+		writeError(w, r, err)
 		return
 	}
 	if location.CurrentDeviceID == nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: "No device at this location"})
+		writeProblem(w, newProblem(r, http.StatusNotFound, "not_found", "No device at this location"))
 		return
 	}
 	device, err := s.DB.GetDeviceByID(*location.CurrentDeviceID)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, models.ErrorResponse{Code: "internal_error", Message: "Data inconsistency: device for this location not found"})
+		writeProblem(w, newProblem(r, http.StatusInternalServerError, "internal_error", "Data inconsistency: device for this location not found"))
 		return
 	}
 	writeJSON(w, http.StatusOK, device)
@@ -262,88 +1051,79 @@ func (s *Server) installDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		DeviceID string `json:"deviceId"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		writeJSON(w, http.StatusBadRequest, models.ErrorResponse{Code: "bad_request", Message: "Invalid JSON format"})
+	if err := decodeJSON(r, &body); err != nil {
+		writeBadRequest(w, r, err)
 		return
 	}
-	location, err := s.DB.GetLocationByID(locationId)
-	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: "Location not found"})
+	if body.DeviceID == "" {
+		writeError(w, r, &datastore.ValidationError{Fields: []datastore.FieldError{{Field: "deviceId", Message: "device ID is required"}}})
 		return
 	}
-	if location.CurrentDeviceID != nil {
-		writeJSON(w, http.StatusBadRequest, models.ErrorResponse{Code: "bad_request", Message: "Location is already occupied"})
-		return
+	location, event, err := s.DB.InstallDevice(locationId, body.DeviceID, defaultActor)
+	if err == nil {
+		err = s.setPaths(location)
 	}
-	device, err := s.DB.GetDeviceByID(body.DeviceID)
 	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: "Device not found"})
+		writeError(w, r, err)
 		return
 	}
-	location.CurrentDeviceID = &device.ID
-	location.Status = "occupied"
-	device.CurrentLocationID = &location.ID
-	s.DB.UpdateLocation(location.ID, location)
-	s.DB.UpdateDevice(device.ID, device)
-	installEvent := &models.Event{
-		Source:      "/inventory/v1/api",
-		SpecVersion: "1.0",
-		Type:        "com.openchami.inventory.device.installed",
-		Data: models.EventData{
-			DeviceID:   &device.ID,
-			LocationID: &location.ID,
-			Actor:      strPtr("api-user"),
-		},
-	}
-	createdEvent, _ := s.DB.CreateEvent(installEvent)
 	response := struct {
 		Location models.Location `json:"location"`
 		Event    models.Event    `json:"event"`
 	}{
 		Location: *location,
-		Event:    *createdEvent,
+		Event:    *event,
 	}
 	writeJSON(w, http.StatusOK, response)
 }
 
 func (s *Server) removeDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	locationId := chi.URLParam(r, "id")
-	location, err := s.DB.GetLocationByID(locationId)
-	if err != nil {
-		writeJSON(w, http.StatusNotFound, models.ErrorResponse{Code: "not_found", Message: "Location not found"})
-		return
+	location, event, err := s.DB.RemoveDevice(locationId, defaultActor)
+	if err == nil {
+		err = s.setPaths(location)
 	}
-	if location.CurrentDeviceID == nil {
-		writeJSON(w, http.StatusBadRequest, models.ErrorResponse{Code: "bad_request", Message: "Location is already empty"})
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	device, err := s.DB.GetDeviceByID(*location.CurrentDeviceID)
-	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, models.ErrorResponse{Code: "internal_error", Message: "Could not find device associated with this location"})
-		return
-	}
-	location.CurrentDeviceID = nil
-	location.Status = "empty"
-	device.CurrentLocationID = nil
-	s.DB.UpdateLocation(location.ID, location)
-	s.DB.UpdateDevice(device.ID, device)
-	removeEvent := &models.Event{
-		Source:      "/inventory/v1/api",
-		SpecVersion: "1.0",
-		Type:        "com.openchami.inventory.device.removed",
-		Data: models.EventData{
-			DeviceID:   &device.ID,
-			LocationID: &location.ID,
-			Actor:      strPtr("api-user"),
-		},
-	}
-	createdEvent, _ := s.DB.CreateEvent(removeEvent)
 	response := struct {
 		Location models.Location `json:"location"`
 		Event    models.Event    `json:"event"`
 	}{
 		Location: *location,
-		Event:    *createdEvent,
+		Event:    *event,
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// --- Admin Handlers ---
+
+// defaultPurgeAge is how long soft-deleted records are kept when a purge
+// request does not say otherwise.
+const defaultPurgeAge = 30 * 24 * time.Hour
+
+func (s *Server) purgeDeletedHandler(w http.ResponseWriter, r *http.Request) {
+	olderThan := defaultPurgeAge
+	if value := r.URL.Query().Get("olderThan"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			writeBadRequest(w, r, fmt.Errorf("olderThan must be a non-negative duration such as 720h, got %q", value))
+			return
+		}
+		olderThan = parsed
+	}
+	result, err := s.DB.PurgeDeleted(time.Now().Add(-olderThan))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	response := struct {
+		DevicesPurged   int `json:"devicesPurged"`
+		LocationsPurged int `json:"locationsPurged"`
+	}{
+		DevicesPurged:   result.Devices,
+		LocationsPurged: result.Locations,
 	}
 	writeJSON(w, http.StatusOK, response)
 }
@@ -2,26 +2,95 @@ package service
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
 	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 )
 
-func setupTestServer() *chi.Mux {
-	db := datastore.NewMemoryStore()
+func setupTestServer(t *testing.T) *chi.Mux {
+	db := newTestDatastore(t)
 	server := NewServer(db)
 	router := NewRouter(server)
 	return router
 }
 
+// newTestDatastore returns the backend selected by INVENTORY_TEST_DATASTORE:
+// a MemoryStore by default, a SQLiteStore in a temporary file, or a
+// PostgresStore in a throwaway schema of INVENTORY_TEST_POSTGRES_DSN.
+func newTestDatastore(t *testing.T) datastore.Datastore {
+	t.Helper()
+	switch backend := os.Getenv("INVENTORY_TEST_DATASTORE"); backend {
+	case "", "memory":
+		store, err := datastore.NewMemoryStore()
+		if err != nil {
+			t.Fatalf("creating memory store: %v", err)
+		}
+		return store
+	case "sqlite":
+		store, err := datastore.NewSQLiteStore(filepath.Join(t.TempDir(), "inventory.db"))
+		if err != nil {
+			t.Fatalf("creating sqlite store: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	case "postgres":
+		return newTestPostgresStore(t, os.Getenv("INVENTORY_TEST_POSTGRES_DSN"))
+	default:
+		t.Fatalf("unknown INVENTORY_TEST_DATASTORE %q", backend)
+		return nil
+	}
+}
+
+func newTestPostgresStore(t *testing.T, dsn string) *datastore.PostgresStore {
+	t.Helper()
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("opening postgres: %v", err)
+	}
+	schema := "inventory_test_" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("creating test schema: %v", err)
+	}
+	store, err := datastore.NewPostgresStore(dsnWithSearchPath(dsn, schema))
+	if err != nil {
+		t.Fatalf("creating postgres store: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+	return store
+}
+
+// dsnWithSearchPath points either form of PostgreSQL connection string at schema.
+func dsnWithSearchPath(dsn, schema string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
 func TestDeviceLifecycle(t *testing.T) {
-	router := setupTestServer()
+	router := setupTestServer(t)
 	var createdDeviceID string
 
 	t.Run("CreateDevice", func(t *testing.T) {
@@ -67,7 +136,7 @@ func TestDeviceLifecycle(t *testing.T) {
 }
 
 func TestInstallAndRemoveDevice(t *testing.T) {
-	router := setupTestServer()
+	router := setupTestServer(t)
 	var testDevice models.Device
 	var testLocation models.Location
 
@@ -149,3 +218,1181 @@ func TestInstallAndRemoveDevice(t *testing.T) {
 		}
 	})
 }
+
+func TestInstallConflicts(t *testing.T) {
+	router := setupTestServer(t)
+
+	createDevice := func(name string) models.Device {
+		payload := `{"name":"` + name + `","componentType":"Node","manufacturer":"Test","partNumber":"T2","serialNumber":"SN-` + name + `","status":"active"}`
+		req := httptest.NewRequest("POST", "/inventory/v1/devices", bytes.NewBufferString(payload))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var device models.Device
+		json.NewDecoder(rr.Body).Decode(&device)
+		return device
+	}
+	createLocation := func(id string) {
+		payload := `{"id":"` + id + `","name":"` + id + `","locationType":"node_slot","status":"empty"}`
+		req := httptest.NewRequest("POST", "/inventory/v1/locations", bytes.NewBufferString(payload))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	install := func(locationID, deviceID string) int {
+		req := httptest.NewRequest("PUT", "/inventory/v1/locations/"+locationID+"/device", bytes.NewBufferString(`{"deviceId":"`+deviceID+`"}`))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	createLocation("slot-a")
+	createLocation("slot-b")
+	devices := []models.Device{createDevice("node-1"), createDevice("node-2"), createDevice("node-3"), createDevice("node-4")}
+
+	t.Run("ConcurrentInstallsIntoSameSlot", func(t *testing.T) {
+		codes := make(chan int, len(devices))
+		var wg sync.WaitGroup
+		for _, device := range devices {
+			wg.Add(1)
+			go func(deviceID string) {
+				defer wg.Done()
+				codes <- install("slot-a", deviceID)
+			}(device.ID)
+		}
+		wg.Wait()
+		close(codes)
+		succeeded := 0
+		for code := range codes {
+			switch code {
+			case http.StatusOK:
+				succeeded++
+			case http.StatusConflict:
+			default:
+				t.Errorf("unexpected status %d", code)
+			}
+		}
+		if succeeded != 1 {
+			t.Fatalf("expected exactly one install to succeed, got %d", succeeded)
+		}
+	})
+
+	t.Run("DeviceInstalledElsewhere", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/inventory/v1/locations/slot-a/device", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var installed models.Device
+		json.NewDecoder(rr.Body).Decode(&installed)
+		if status := install("slot-b", installed.ID); status != http.StatusConflict {
+			t.Fatalf("installing an installed device: got status %v want %v", status, http.StatusConflict)
+		}
+	})
+
+	t.Run("RemoveFromEmptySlot", func(t *testing.T) {
+		req := httptest.NewRequest("DELETE", "/inventory/v1/locations/slot-b/device", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusConflict {
+			t.Fatalf("RemoveFromEmptySlot: got status %v want %v", status, http.StatusConflict)
+		}
+	})
+}
+
+func TestErrorResponses(t *testing.T) {
+	router := setupTestServer(t)
+	locationPayload := `{"id":"dup-slot","name":"Dup Slot","locationType":"node_slot","status":"empty"}`
+	req := httptest.NewRequest("POST", "/inventory/v1/locations", bytes.NewBufferString(locationPayload))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantCode   string
+		// wantFields are the fields the problem's errors name, in order.
+		wantFields []string
+	}{
+		{"DuplicateLocation", "POST", "/inventory/v1/locations", locationPayload, http.StatusConflict, "already_exists", nil},
+		{"UpdateMissingDevice", "PUT", "/inventory/v1/devices/missing", `{"name":"ghost"}`, http.StatusNotFound, "not_found", nil},
+		{"DeviceWithoutName", "POST", "/inventory/v1/devices", `{"componentType":"Node"}`, http.StatusUnprocessableEntity, "invalid", []string{"name"}},
+		{"LocationWithoutID", "POST", "/inventory/v1/locations", `{"name":"No ID"}`, http.StatusUnprocessableEntity, "invalid", []string{"id"}},
+		{"LocationWithoutIDOrName", "POST", "/inventory/v1/locations", `{"labels":{"bad key!":"x"}}`, http.StatusUnprocessableEntity, "invalid", []string{"id", "name", "labels.bad key!"}},
+		{"LocationWithChildren", "POST", "/inventory/v1/locations", `{"id":"parent","name":"Parent","childrenLocationIds":["dup-slot"]}`, http.StatusUnprocessableEntity, "invalid", []string{"childrenLocationIds"}},
+		{"LocationUnderMissingParent", "POST", "/inventory/v1/locations", `{"id":"orphan","name":"Orphan","parentLocationId":"nowhere"}`, http.StatusUnprocessableEntity, "invalid", []string{"parentLocationId"}},
+		{"LocationUnderItself", "PUT", "/inventory/v1/locations/dup-slot", `{"name":"Dup Slot","parentLocationId":"dup-slot"}`, http.StatusUnprocessableEntity, "invalid", []string{"parentLocationId"}},
+		{"InstallWithoutDevice", "PUT", "/inventory/v1/locations/dup-slot/device", `{}`, http.StatusUnprocessableEntity, "invalid", []string{"deviceId"}},
+		{"RemoveFromEmptySlot", "DELETE", "/inventory/v1/locations/dup-slot/device", "", http.StatusConflict, "location_empty", nil},
+		{"MalformedJSON", "POST", "/inventory/v1/devices", `{"name":`, http.StatusBadRequest, "bad_request", nil},
+		{"WrongFieldType", "POST", "/inventory/v1/devices", `{"name":5}`, http.StatusBadRequest, "bad_request", []string{"name"}},
+		{"UnsupportedPatch", "PATCH", "/inventory/v1/devices/missing", `{}`, http.StatusUnsupportedMediaType, "unsupported_media_type", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %v want %v", rr.Code, tt.wantStatus)
+			}
+			if contentType := rr.Header().Get("Content-Type"); contentType != "application/problem+json" {
+				t.Errorf("got Content-Type %q want application/problem+json", contentType)
+			}
+			var response models.ErrorResponse
+			json.NewDecoder(rr.Body).Decode(&response)
+			if response.Code != tt.wantCode {
+				t.Errorf("got code %q want %q", response.Code, tt.wantCode)
+			}
+			if response.Type != "urn:openchami:inventory:problem:"+tt.wantCode || response.Title == "" || response.Detail == "" {
+				t.Errorf("got type %q, title %q, detail %q; want all set", response.Type, response.Title, response.Detail)
+			}
+			if response.Message != response.Detail {
+				t.Errorf("got message %q, want the detail %q", response.Message, response.Detail)
+			}
+			if response.Status != tt.wantStatus || response.Instance == "" {
+				t.Errorf("got status %d, instance %q; want %d and the request ID", response.Status, response.Instance, tt.wantStatus)
+			}
+			var fields []string
+			for _, fieldErr := range response.Errors {
+				fields = append(fields, fieldErr.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.wantFields, ",") {
+				t.Errorf("got errors for %v want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+// doRequest sends a request with the given body and headers through router.
+func doRequest(router http.Handler, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestConditionalRequests(t *testing.T) {
+	router := setupTestServer(t)
+	devicePayload := `{"name":"etag-node","componentType":"Node","manufacturer":"HPE","partNumber":"P1","serialNumber":"SN-ETAG","status":"active"}`
+
+	rr := doRequest(router, "POST", "/inventory/v1/devices", devicePayload, nil)
+	var device models.Device
+	json.NewDecoder(rr.Body).Decode(&device)
+	if etag := rr.Header().Get("ETag"); etag != `"1"` {
+		t.Fatalf("create: got ETag %q want %q", etag, `"1"`)
+	}
+	devicePath := "/inventory/v1/devices/" + device.ID
+
+	if etag := doRequest(router, "GET", devicePath, "", nil).Header().Get("ETag"); etag != `"1"` {
+		t.Fatalf("get: got ETag %q want %q", etag, `"1"`)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		ifMatch    string
+		wantStatus int
+		wantETag   string
+	}{
+		{"UpdateWithCurrentVersion", "PUT", `"1"`, http.StatusOK, `"2"`},
+		{"UpdateWithStaleVersion", "PUT", `"1"`, http.StatusPreconditionFailed, ""},
+		{"UpdateWithWildcard", "PUT", "*", http.StatusOK, `"3"`},
+		{"UpdateUnconditionally", "PUT", "", http.StatusOK, `"4"`},
+		{"UpdateWithWeakETag", "PUT", `W/"4"`, http.StatusPreconditionFailed, ""},
+		{"DeleteWithStaleVersion", "DELETE", `"3"`, http.StatusPreconditionFailed, ""},
+		{"DeleteWithCurrentVersion", "DELETE", `"4"`, http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.ifMatch != "" {
+				headers["If-Match"] = tt.ifMatch
+			}
+			body := ""
+			if tt.method == "PUT" {
+				body = devicePayload
+			}
+			rr := doRequest(router, tt.method, devicePath, body, headers)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %v want %v: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if etag := rr.Header().Get("ETag"); etag != tt.wantETag {
+				t.Errorf("got ETag %q want %q", etag, tt.wantETag)
+			}
+		})
+	}
+
+	t.Run("LocationVersions", func(t *testing.T) {
+		locationPayload := `{"id":"etag-slot","name":"ETag Slot","locationType":"node_slot","status":"empty"}`
+		doRequest(router, "POST", "/inventory/v1/locations", locationPayload, nil)
+		rr := doRequest(router, "PUT", "/inventory/v1/locations/etag-slot", locationPayload, map[string]string{"If-Match": `"2"`})
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Fatalf("stale update: got status %v want %v", rr.Code, http.StatusPreconditionFailed)
+		}
+		rr = doRequest(router, "PUT", "/inventory/v1/locations/etag-slot", locationPayload, map[string]string{"If-Match": `"1"`})
+		if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"2"` {
+			t.Fatalf("update: got status %v and ETag %q", rr.Code, rr.Header().Get("ETag"))
+		}
+		rr = doRequest(router, "DELETE", "/inventory/v1/locations/etag-slot", "", map[string]string{"If-Match": `"2"`})
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("delete: got status %v want %v", rr.Code, http.StatusNoContent)
+		}
+	})
+}
+
+func TestSoftDelete(t *testing.T) {
+	router := setupTestServer(t)
+	rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"retired-node","componentType":"Node","status":"active"}`, nil)
+	var device models.Device
+	json.NewDecoder(rr.Body).Decode(&device)
+	devicePath := "/inventory/v1/devices/" + device.ID
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"retired-slot","name":"Retired Slot","locationType":"node_slot","status":"empty"}`, nil)
+
+	listCount := func(t *testing.T, path string) int {
+		t.Helper()
+		rr := doRequest(router, "GET", path, "", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %v want %v", path, rr.Code, http.StatusOK)
+		}
+		var response struct{ Items []json.RawMessage }
+		json.NewDecoder(rr.Body).Decode(&response)
+		return len(response.Items)
+	}
+
+	if rr := doRequest(router, "DELETE", devicePath, "", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %v want %v", rr.Code, http.StatusNoContent)
+	}
+
+	t.Run("HiddenAfterDelete", func(t *testing.T) {
+		if rr := doRequest(router, "GET", devicePath, "", nil); rr.Code != http.StatusNotFound {
+			t.Errorf("get: got status %v want %v", rr.Code, http.StatusNotFound)
+		}
+		if rr := doRequest(router, "PUT", devicePath, `{"name":"retired-node"}`, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("update: got status %v want %v", rr.Code, http.StatusNotFound)
+		}
+		if rr := doRequest(router, "PUT", "/inventory/v1/locations/retired-slot/device", `{"deviceId":"`+device.ID+`"}`, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("install: got status %v want %v", rr.Code, http.StatusNotFound)
+		}
+		if n := listCount(t, "/inventory/v1/devices"); n != 0 {
+			t.Errorf("list: got %d devices want 0", n)
+		}
+		if n := listCount(t, "/inventory/v1/devices?includeDeleted=true"); n != 1 {
+			t.Errorf("list with includeDeleted: got %d devices want 1", n)
+		}
+		if rr := doRequest(router, "GET", "/inventory/v1/devices?includeDeleted=maybe", "", nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("list with bad includeDeleted: got status %v want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		rr := doRequest(router, "POST", devicePath+"/restore", "", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("restore: got status %v want %v", rr.Code, http.StatusOK)
+		}
+		var restored models.Device
+		json.NewDecoder(rr.Body).Decode(&restored)
+		if restored.DeletedAt != nil || rr.Header().Get("ETag") != `"3"` {
+			t.Errorf("restored device = %+v with ETag %q, want no deletedAt and ETag \"3\"", restored, rr.Header().Get("ETag"))
+		}
+		if rr := doRequest(router, "GET", devicePath, "", nil); rr.Code != http.StatusOK {
+			t.Errorf("get after restore: got status %v want %v", rr.Code, http.StatusOK)
+		}
+		if rr := doRequest(router, "POST", devicePath+"/restore", "", nil); rr.Code != http.StatusConflict {
+			t.Errorf("restoring a live device: got status %v want %v", rr.Code, http.StatusConflict)
+		}
+	})
+
+	t.Run("History", func(t *testing.T) {
+		rr := doRequest(router, "GET", devicePath+"/history", "", nil)
+		var response struct{ Items []models.Event }
+		json.NewDecoder(rr.Body).Decode(&response)
+		types := map[string]bool{}
+		for _, event := range response.Items {
+			types[event.Type] = true
+		}
+		if len(response.Items) != 2 || !types[datastore.EventTypeDeviceDeleted] || !types[datastore.EventTypeDeviceRestored] {
+			t.Errorf("got events %+v, want one deleted and one restored event", response.Items)
+		}
+	})
+
+	t.Run("Locations", func(t *testing.T) {
+		if rr := doRequest(router, "DELETE", "/inventory/v1/locations/retired-slot", "", nil); rr.Code != http.StatusNoContent {
+			t.Fatalf("delete: got status %v want %v", rr.Code, http.StatusNoContent)
+		}
+		if n := listCount(t, "/inventory/v1/locations"); n != 0 {
+			t.Errorf("list: got %d locations want 0", n)
+		}
+		if rr := doRequest(router, "POST", "/inventory/v1/locations/retired-slot/restore", "", nil); rr.Code != http.StatusOK {
+			t.Fatalf("restore: got status %v want %v", rr.Code, http.StatusOK)
+		}
+		if n := listCount(t, "/inventory/v1/locations"); n != 1 {
+			t.Errorf("list after restore: got %d locations want 1", n)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		doRequest(router, "DELETE", devicePath, "", nil)
+		rr := doRequest(router, "POST", "/inventory/v1/admin/purge", "", nil)
+		var response struct{ DevicesPurged, LocationsPurged int }
+		json.NewDecoder(rr.Body).Decode(&response)
+		if rr.Code != http.StatusOK || response.DevicesPurged != 0 {
+			t.Fatalf("purge with default age: got status %v and %+v, want nothing purged", rr.Code, response)
+		}
+		rr = doRequest(router, "POST", "/inventory/v1/admin/purge?olderThan=0s", "", nil)
+		json.NewDecoder(rr.Body).Decode(&response)
+		if rr.Code != http.StatusOK || response.DevicesPurged != 1 || response.LocationsPurged != 0 {
+			t.Fatalf("purge: got status %v and %+v, want one device purged", rr.Code, response)
+		}
+		if rr := doRequest(router, "POST", devicePath+"/restore", "", nil); rr.Code != http.StatusNotFound {
+			t.Errorf("restoring a purged device: got status %v want %v", rr.Code, http.StatusNotFound)
+		}
+		if rr := doRequest(router, "POST", "/inventory/v1/admin/purge?olderThan=soon", "", nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("purge with bad olderThan: got status %v want %v", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestUniqueness(t *testing.T) {
+	router := setupTestServer(t)
+	rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1","manufacturer":"HPE","serialNumber":"SN-1"}`, nil)
+	var existing models.Device
+	json.NewDecoder(rr.Body).Decode(&existing)
+	rr = doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-2","manufacturer":"HPE","serialNumber":"SN-2"}`, nil)
+	var other models.Device
+	json.NewDecoder(rr.Body).Decode(&other)
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"rack-1","name":"Rack 1"}`, nil)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantID     string
+	}{
+		{"DuplicateDeviceName", "POST", "/inventory/v1/devices", `{"name":"node-1"}`, http.StatusConflict, existing.ID},
+		{"DuplicateSerialNumber", "POST", "/inventory/v1/devices", `{"name":"node-3","manufacturer":"HPE","serialNumber":"SN-1"}`, http.StatusConflict, existing.ID},
+		{"SameSerialOtherManufacturer", "POST", "/inventory/v1/devices", `{"name":"node-4","manufacturer":"Dell","serialNumber":"SN-1"}`, http.StatusCreated, ""},
+		{"EmptySerialNumbers", "POST", "/inventory/v1/devices", `{"name":"node-5","manufacturer":"HPE"}`, http.StatusCreated, ""},
+		{"RenameOntoExistingName", "PUT", "/inventory/v1/devices/" + other.ID, `{"name":"node-1","manufacturer":"HPE","serialNumber":"SN-2"}`, http.StatusConflict, existing.ID},
+		{"UpdateKeepsOwnName", "PUT", "/inventory/v1/devices/" + other.ID, `{"name":"node-2","manufacturer":"HPE","serialNumber":"SN-2","status":"failed"}`, http.StatusOK, ""},
+		{"DuplicateLocationName", "POST", "/inventory/v1/locations", `{"id":"rack-2","name":"Rack 1"}`, http.StatusConflict, "rack-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := doRequest(router, tt.method, tt.path, tt.body, nil)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %v want %v: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantID == "" {
+				return
+			}
+			var response models.ErrorResponse
+			json.NewDecoder(rr.Body).Decode(&response)
+			if response.Code != "already_exists" || response.ConflictingID != tt.wantID {
+				t.Errorf("got code %q and conflicting ID %q, want already_exists and %q", response.Code, response.ConflictingID, tt.wantID)
+			}
+		})
+	}
+
+	t.Run("DeletedNamesAreReusable", func(t *testing.T) {
+		doRequest(router, "DELETE", "/inventory/v1/devices/"+existing.ID, "", nil)
+		rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1","manufacturer":"HPE","serialNumber":"SN-1"}`, nil)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("reusing a deleted device's name: got status %v want %v", rr.Code, http.StatusCreated)
+		}
+		var replacement models.Device
+		json.NewDecoder(rr.Body).Decode(&replacement)
+		rr = doRequest(router, "POST", "/inventory/v1/devices/"+existing.ID+"/restore", "", nil)
+		var response models.ErrorResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		if rr.Code != http.StatusConflict || response.ConflictingID != replacement.ID {
+			t.Errorf("restoring over a reused name: got status %v and conflicting ID %q, want %v and %q", rr.Code, response.ConflictingID, http.StatusConflict, replacement.ID)
+		}
+	})
+}
+
+func TestDeleteReferences(t *testing.T) {
+	router := setupTestServer(t)
+	rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1"}`, nil)
+	var device models.Device
+	json.NewDecoder(rr.Body).Decode(&device)
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"rack-1","name":"Rack 1"}`, nil)
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"slot-1","name":"Slot 1","parentLocationId":"rack-1"}`, nil)
+	doRequest(router, "PUT", "/inventory/v1/locations/slot-1/device", `{"deviceId":"`+device.ID+`"}`, nil)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"InstalledDevice", "DELETE", "/inventory/v1/devices/" + device.ID, http.StatusConflict, "still_referenced"},
+		{"OccupiedLocation", "DELETE", "/inventory/v1/locations/slot-1", http.StatusConflict, "still_referenced"},
+		{"ParentLocation", "DELETE", "/inventory/v1/locations/rack-1", http.StatusConflict, "still_referenced"},
+		{"UnknownCascade", "DELETE", "/inventory/v1/locations/rack-1?cascade=bogus", http.StatusBadRequest, "bad_request"},
+		{"DetachDevice", "DELETE", "/inventory/v1/devices/" + device.ID + "?cascade=detach", http.StatusNoContent, ""},
+		{"SlotIsEmpty", "GET", "/inventory/v1/locations/slot-1/device", http.StatusNotFound, "not_found"},
+		{"DeleteSubtree", "DELETE", "/inventory/v1/locations/rack-1?cascade=delete", http.StatusNoContent, ""},
+		{"ChildIsDeleted", "GET", "/inventory/v1/locations/slot-1", http.StatusNotFound, "not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := doRequest(router, tt.method, tt.path, "", nil)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("got status %v want %v: %s", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var response models.ErrorResponse
+			json.NewDecoder(rr.Body).Decode(&response)
+			if response.Code != tt.wantCode {
+				t.Errorf("got code %q want %q", response.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestPagination(t *testing.T) {
+	router := setupTestServer(t)
+	for i := 1; i <= 5; i++ {
+		doRequest(router, "POST", "/inventory/v1/devices", fmt.Sprintf(`{"name":"node-%d"}`, i), nil)
+	}
+
+	type listResponse struct {
+		Items      []models.Device       `json:"items"`
+		Pagination models.PaginationInfo `json:"pagination"`
+	}
+	var names []string
+	path := "/inventory/v1/devices?limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages == 3 {
+			t.Fatalf("more than 3 pages of 5 devices")
+		}
+		rr := doRequest(router, "GET", path, "", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %v want %v", path, rr.Code, http.StatusOK)
+		}
+		var response listResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		if p := response.Pagination; p.Total != 5 || p.Limit != 2 || p.Count != len(response.Items) {
+			t.Errorf("GET %s: pagination %+v", path, p)
+		}
+		for _, device := range response.Items {
+			names = append(names, device.Name)
+		}
+		path = response.Pagination.Next
+	}
+	if strings.Join(names, ",") != "node-1,node-2,node-3,node-4,node-5" {
+		t.Errorf("walked devices %v, want all 5 in creation order", names)
+	}
+
+	rr := doRequest(router, "GET", "/inventory/v1/devices?offset=4", "", nil)
+	var response listResponse
+	json.NewDecoder(rr.Body).Decode(&response)
+	if p := response.Pagination; len(response.Items) != 1 || p.Offset != 4 || p.Limit != 0 || p.Next != "" {
+		t.Errorf("offset 4: got %d items and pagination %+v", len(response.Items), p)
+	}
+
+	// Without limit or after the list is not paged; after alone pages it.
+	rr = doRequest(router, "GET", "/inventory/v1/devices", "", nil)
+	response = listResponse{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if p := response.Pagination; len(response.Items) != 5 || p.Limit != 0 || p.Next != "" {
+		t.Errorf("unpaged list: got %d items and pagination %+v", len(response.Items), p)
+	}
+	rr = doRequest(router, "GET", "/inventory/v1/devices?limit=1", "", nil)
+	response = listResponse{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	next, _ := url.Parse(response.Pagination.Next)
+	rr = doRequest(router, "GET", "/inventory/v1/devices?after="+url.QueryEscape(next.Query().Get("after")), "", nil)
+	response = listResponse{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if p := response.Pagination; len(response.Items) != 4 || p.Limit != defaultPageLimit {
+		t.Errorf("after the first device: got %d items and pagination %+v", len(response.Items), p)
+	}
+
+	for _, path := range []string{
+		"/inventory/v1/devices?limit=0",
+		"/inventory/v1/devices?limit=5000",
+		"/inventory/v1/locations?offset=-1",
+		"/inventory/v1/events?limit=ten",
+		"/inventory/v1/devices?after=bogus",
+	} {
+		if rr := doRequest(router, "GET", path, "", nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got status %v want %v", path, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	router := setupTestServer(t)
+	doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1","componentType":"Node","manufacturer":"HPE","status":"failed"}`, nil)
+	rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-2","componentType":"Node","manufacturer":"HPE","status":"active"}`, nil)
+	var node models.Device
+	json.NewDecoder(rr.Body).Decode(&node)
+	doRequest(router, "POST", "/inventory/v1/devices", `{"name":"dimm-1","componentType":"DIMM","manufacturer":"Micron","status":"active"}`, nil)
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"slot-1","name":"Slot 1","locationType":"node_slot","status":"empty"}`, nil)
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"slot-2","name":"Slot 2","locationType":"dimm_slot","status":"empty"}`, nil)
+	doRequest(router, "PUT", "/inventory/v1/locations/slot-1/device", `{"deviceId":"`+node.ID+`"}`, nil)
+
+	tests := []struct {
+		name      string
+		path      string
+		wantCount int
+	}{
+		{"DevicesByManufacturerAndStatus", "/inventory/v1/devices?manufacturer=HPE&status=failed", 1},
+		{"DevicesByComponentType", "/inventory/v1/devices?componentType=Node", 2},
+		{"DevicesByLocation", "/inventory/v1/devices?currentLocationId=slot-1", 1},
+		{"EmptySlotsOfType", "/inventory/v1/locations?locationType=dimm_slot&status=empty", 1},
+		{"OccupiedSlots", "/inventory/v1/locations?status=occupied", 1},
+		{"EventsByType", "/inventory/v1/events?type=com.openchami.inventory.device.installed", 1},
+		{"EventsByDevice", "/inventory/v1/events?deviceId=" + node.ID + "&actor=" + defaultActor, 1},
+		{"EventsSince", "/inventory/v1/events?since=" + url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)), 0},
+		{"EventsUntil", "/inventory/v1/events?until=" + url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := doRequest(router, "GET", tt.path, "", nil)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("got status %v want %v: %s", rr.Code, http.StatusOK, rr.Body)
+			}
+			var response struct {
+				Pagination models.PaginationInfo `json:"pagination"`
+			}
+			json.NewDecoder(rr.Body).Decode(&response)
+			if response.Pagination.Count != tt.wantCount || response.Pagination.Total != tt.wantCount {
+				t.Errorf("got %+v, want %d matches", response.Pagination, tt.wantCount)
+			}
+		})
+	}
+
+	if rr := doRequest(router, "GET", "/inventory/v1/events?since=yesterday", "", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("malformed since: got status %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestListSorting(t *testing.T) {
+	router := setupTestServer(t)
+	for _, name := range []string{"node-c", "node-a", "node-b"} {
+		doRequest(router, "POST", "/inventory/v1/devices", `{"name":"`+name+`"}`, nil)
+	}
+	names := func(path string) []string {
+		t.Helper()
+		var result []string
+		for path != "" {
+			rr := doRequest(router, "GET", path, "", nil)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("GET %s: got status %v want %v", path, rr.Code, http.StatusOK)
+			}
+			var response struct {
+				Items      []models.Device       `json:"items"`
+				Pagination models.PaginationInfo `json:"pagination"`
+			}
+			json.NewDecoder(rr.Body).Decode(&response)
+			for _, device := range response.Items {
+				result = append(result, device.Name)
+			}
+			path = response.Pagination.Next
+		}
+		return result
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/inventory/v1/devices", "node-c,node-a,node-b"},
+		{"/inventory/v1/devices?sort=name", "node-a,node-b,node-c"},
+		{"/inventory/v1/devices?sort=-name", "node-c,node-b,node-a"},
+		{"/inventory/v1/devices?sort=-name&limit=1", "node-c,node-b,node-a"},
+		{"/inventory/v1/devices?sort=-createdAt,name&limit=2", "node-b,node-a,node-c"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(names(tt.path), ","); got != tt.want {
+			t.Errorf("GET %s = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	for _, path := range []string{
+		"/inventory/v1/devices?sort=properties",
+		"/inventory/v1/devices?sort=name,",
+		"/inventory/v1/events?sort=-",
+	} {
+		if rr := doRequest(router, "GET", path, "", nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got status %v want %v", path, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestListFilterExpressions(t *testing.T) {
+	router := setupTestServer(t)
+	doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1","manufacturer":"HPE","properties":{"memoryGiB":1024,"bmc":{"firmware":"2.1"}}}`, nil)
+	doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-2","manufacturer":"HPE","properties":{"memoryGiB":256}}`, nil)
+	doRequest(router, "POST", "/inventory/v1/devices", `{"name":"dimm-1","manufacturer":"Micron"}`, nil)
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"slot-1","name":"Slot 1","locationType":"node_slot","properties":{"row":3}}`, nil)
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/inventory/v1/devices?filter=" + url.QueryEscape(`properties.memoryGiB > 512`), 1},
+		{"/inventory/v1/devices?filter=" + url.QueryEscape(`manufacturer == "HPE" and not properties.bmc.firmware == "2.1"`), 1},
+		{"/inventory/v1/devices?filter=" + url.QueryEscape(`properties.memoryGiB == null OR name == "node-1"`), 2},
+		{"/inventory/v1/devices?manufacturer=HPE&filter=" + url.QueryEscape(`properties.memoryGiB <= 256`), 1},
+		{"/inventory/v1/locations?filter=" + url.QueryEscape(`properties.row >= 3 and locationType == "node_slot"`), 1},
+	}
+	for _, tt := range tests {
+		rr := doRequest(router, "GET", tt.path, "", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %v want %v: %s", tt.path, rr.Code, http.StatusOK, rr.Body)
+		}
+		var response struct {
+			Pagination models.PaginationInfo `json:"pagination"`
+		}
+		json.NewDecoder(rr.Body).Decode(&response)
+		if response.Pagination.Total != tt.want {
+			t.Errorf("GET %s = %d matches, want %d", tt.path, response.Pagination.Total, tt.want)
+		}
+	}
+
+	for _, filter := range []string{
+		`properties.memoryGiB >`,
+		`(name == "a"`,
+		`name = "a"`,
+		`serial == "a"`,
+		`name == 3`,
+		`properties.up < true`,
+	} {
+		path := "/inventory/v1/devices?filter=" + url.QueryEscape(filter)
+		if rr := doRequest(router, "GET", path, "", nil); rr.Code != http.StatusBadRequest {
+			t.Errorf("filter %s: got status %v want %v", filter, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	router := setupTestServer(t)
+	doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1","labels":{"partition":"compute","env":"prod","gpu":""}}`, nil)
+	doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-2","labels":{"partition":"compute","env":"test"}}`, nil)
+	doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-3","labels":{"partition":"storage"}}`, nil)
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"rack-1","name":"Rack 1","labels":{"row":"a"}}`, nil)
+
+	names := func(path string) string {
+		t.Helper()
+		rr := doRequest(router, "GET", path, "", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %v want %v: %s", path, rr.Code, http.StatusOK, rr.Body)
+		}
+		var response struct {
+			Items []models.Device `json:"items"`
+		}
+		json.NewDecoder(rr.Body).Decode(&response)
+		var names []string
+		for _, device := range response.Items {
+			names = append(names, device.Name)
+		}
+		return strings.Join(names, ",")
+	}
+	tests := []struct {
+		selector string
+		want     string
+	}{
+		{"partition=compute,env!=test,gpu", "node-1"},
+		{"partition=compute", "node-1,node-2"},
+		{"env notin (prod)", "node-2,node-3"},
+		{"!env", "node-3"},
+	}
+	for _, tt := range tests {
+		if got := names("/inventory/v1/devices?labelSelector=" + url.QueryEscape(tt.selector)); got != tt.want {
+			t.Errorf("labelSelector=%s = %s, want %s", tt.selector, got, tt.want)
+		}
+	}
+
+	rr := doRequest(router, "POST", "/inventory/v1/devices:relabel", `{"labelSelector":"partition=compute","set":{"burnin":"b7"},"remove":["gpu"]}`, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("relabel devices: got status %v want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var relabeled struct {
+		Items []models.Device `json:"items"`
+		Count int             `json:"count"`
+	}
+	json.NewDecoder(rr.Body).Decode(&relabeled)
+	if relabeled.Count != 2 || relabeled.Items[0].Labels["burnin"] != "b7" {
+		t.Errorf("relabel devices = %+v, want node-1 and node-2 in burn-in batch b7", relabeled)
+	}
+	if got := names("/inventory/v1/devices?labelSelector=burnin%3Db7,!gpu"); got != "node-1,node-2" {
+		t.Errorf("relabeled devices = %s, want node-1,node-2", got)
+	}
+
+	rr = doRequest(router, "POST", "/inventory/v1/locations:relabel", `{"labelSelector":"row=a","set":{"row":"b"}}`, nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"count":1`) {
+		t.Errorf("relabel locations: got status %v: %s", rr.Code, rr.Body)
+	}
+
+	for _, tt := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"GET", "/inventory/v1/devices?labelSelector=" + url.QueryEscape("env in (prod"), "", http.StatusBadRequest},
+		{"GET", "/inventory/v1/locations?labelSelector=" + url.QueryEscape("row=not valid"), "", http.StatusBadRequest},
+		{"POST", "/inventory/v1/devices", `{"name":"node-4","labels":{"bad key":"x"}}`, http.StatusUnprocessableEntity},
+		{"POST", "/inventory/v1/devices:relabel", `{"set":{"a":"b"}}`, http.StatusBadRequest},
+		{"POST", "/inventory/v1/devices:relabel", `{"labelSelector":"a"}`, http.StatusBadRequest},
+		{"POST", "/inventory/v1/devices:relabel", `{"labelSelector":"a","set":{"-a":"b"}}`, http.StatusUnprocessableEntity},
+	} {
+		if rr := doRequest(router, tt.method, tt.path, tt.body, nil); rr.Code != tt.want {
+			t.Errorf("%s %s %s: got status %v want %v: %s", tt.method, tt.path, tt.body, rr.Code, tt.want, rr.Body)
+		}
+	}
+}
+
+func TestPatch(t *testing.T) {
+	router := setupTestServer(t)
+	rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1","status":"active","properties":{"memoryGiB":512}}`, nil)
+	var device models.Device
+	json.NewDecoder(rr.Body).Decode(&device)
+	devicePath := "/inventory/v1/devices/" + device.ID
+	merge := map[string]string{"Content-Type": "application/merge-patch+json"}
+	jsonPatch := map[string]string{"Content-Type": "application/json-patch+json", "If-Match": `"2"`}
+
+	rr = doRequest(router, "PATCH", devicePath, `{"status":"failed"}`, merge)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"2"` {
+		t.Fatalf("merge patch: got status %v and ETag %q: %s", rr.Code, rr.Header().Get("ETag"), rr.Body)
+	}
+	json.NewDecoder(rr.Body).Decode(&device)
+	if device.Status != "failed" || device.Properties["memoryGiB"] != 512.0 {
+		t.Errorf("merge-patched device = %+v", device)
+	}
+
+	rr = doRequest(router, "PATCH", devicePath, `[{"op":"test","path":"/status","value":"failed"},{"op":"add","path":"/properties/bmc","value":"ok"}]`, jsonPatch)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"3"` {
+		t.Fatalf("JSON patch: got status %v and ETag %q: %s", rr.Code, rr.Header().Get("ETag"), rr.Body)
+	}
+
+	var history struct {
+		Items []models.Event `json:"items"`
+	}
+	json.NewDecoder(doRequest(router, "GET", devicePath+"/history", "", nil).Body).Decode(&history)
+	if len(history.Items) != 2 || history.Items[0].Type != datastore.EventTypeDeviceUpdated ||
+		history.Items[0].Data.StateAfter["status"] != "failed" {
+		t.Errorf("history after patches = %+v, want two updated events", history.Items)
+	}
+
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"slot-1","name":"Slot 1"}`, nil)
+	for _, tt := range []struct {
+		name, path, body string
+		headers          map[string]string
+		want             int
+	}{
+		{"Location", "/inventory/v1/locations/slot-1", `{"status":"empty"}`, merge, http.StatusOK},
+		{"PlainJSON", devicePath, `{"status":"active"}`, map[string]string{"Content-Type": "application/json"}, http.StatusUnsupportedMediaType},
+		{"StaleVersion", devicePath, `[]`, jsonPatch, http.StatusPreconditionFailed},
+		{"FailedTest", devicePath, `[{"op":"test","path":"/status","value":"active"}]`, merge, http.StatusBadRequest},
+		{"FailedTestOperation", devicePath, `[{"op":"test","path":"/status","value":"active"}]`, map[string]string{"Content-Type": "application/json-patch+json"}, http.StatusConflict},
+		{"ChangedID", devicePath, `{"id":"other"}`, merge, http.StatusUnprocessableEntity},
+		{"UnknownField", devicePath, `{"colour":"red"}`, merge, http.StatusUnprocessableEntity},
+		{"MalformedPatch", devicePath, `{"status":`, merge, http.StatusBadRequest},
+		{"MissingDevice", "/inventory/v1/devices/missing", `{}`, merge, http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if rr := doRequest(router, "PATCH", tt.path, tt.body, tt.headers); rr.Code != tt.want {
+				t.Errorf("got status %v want %v: %s", rr.Code, tt.want, rr.Body)
+			}
+		})
+	}
+}
+
+func TestBatch(t *testing.T) {
+	router := setupTestServer(t)
+	rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1"}`, nil)
+	var device models.Device
+	json.NewDecoder(rr.Body).Decode(&device)
+
+	type batchResponse struct {
+		Results []struct {
+			Index  int                   `json:"index"`
+			Status int                   `json:"status"`
+			Item   *models.Device        `json:"item"`
+			Error  *models.ErrorResponse `json:"error"`
+		} `json:"results"`
+		Succeeded int `json:"succeeded"`
+		Failed    int `json:"failed"`
+	}
+	batch := func(path, body string, want int) batchResponse {
+		t.Helper()
+		rr := doRequest(router, "POST", path, body, nil)
+		if rr.Code != want {
+			t.Fatalf("POST %s: got status %v want %v: %s", path, rr.Code, want, rr.Body)
+		}
+		var response batchResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		return response
+	}
+
+	response := batch("/inventory/v1/devices:batch", `{"operations":[
+		{"op":"create","device":{"name":"node-2"}},
+		{"op":"create","device":{"name":"node-1"}},
+		{"op":"update","id":"`+device.ID+`","resourceVersion":1,"device":{"name":"node-1","status":"failed"}},
+		{"op":"delete","id":"missing"}
+	]}`, http.StatusOK)
+	if response.Succeeded != 2 || response.Failed != 2 {
+		t.Fatalf("per-item batch = %+v, want two successes and two failures", response)
+	}
+	for i, want := range []int{http.StatusCreated, http.StatusConflict, http.StatusOK, http.StatusNotFound} {
+		if result := response.Results[i]; result.Index != i || result.Status != want {
+			t.Errorf("result %d = %+v, want status %v", i, result, want)
+		}
+	}
+	if item := response.Results[2].Item; item == nil || item.Status != "failed" || item.ResourceVersion != 2 {
+		t.Errorf("updated device = %+v", item)
+	}
+	if code := response.Results[1].Error; code == nil || code.Code != "already_exists" {
+		t.Errorf("duplicate error = %+v, want already_exists", code)
+	}
+
+	rr = doRequest(router, "POST", "/inventory/v1/devices:batch?atomic=true", `{"operations":[
+		{"op":"create","device":{"name":"node-3"}},
+		{"op":"delete","id":"`+device.ID+`","resourceVersion":1}
+	]}`, nil)
+	if rr.Code != http.StatusPreconditionFailed || !strings.Contains(rr.Body.String(), "operation 1") {
+		t.Fatalf("failed atomic batch: got status %v: %s", rr.Code, rr.Body)
+	}
+	if rr := doRequest(router, "GET", "/inventory/v1/devices/by-name/node-3", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("device from the failed atomic batch: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	response = batch("/inventory/v1/locations:batch?atomic=true", `{"operations":[
+		{"op":"create","location":{"id":"rack-1","name":"Rack 1"}},
+		{"op":"create","location":{"id":"slot-1","name":"Slot 1","parentLocationId":"rack-1"}},
+		{"op":"delete","id":"rack-1","cascade":"delete"}
+	]}`, http.StatusOK)
+	if response.Succeeded != 3 || response.Results[2].Status != http.StatusNoContent || response.Results[2].Item != nil {
+		t.Errorf("atomic location batch = %+v", response)
+	}
+
+	for _, body := range []string{
+		`{"operations":[]}`,
+		`{"operations":[{"op":"delete","id":"rack-1","cascade":"sideways"}]}`,
+		`{"operations":`,
+	} {
+		batch("/inventory/v1/locations:batch", body, http.StatusBadRequest)
+	}
+	batch("/inventory/v1/locations:batch?atomic=maybe", `{"operations":[{"op":"delete","id":"rack-1"}]}`, http.StatusBadRequest)
+	if response := batch("/inventory/v1/locations:batch", `{"operations":[{"op":"upsert","id":"rack-1"}]}`, http.StatusOK); response.Results[0].Status != http.StatusUnprocessableEntity {
+		t.Errorf("unknown op = %+v, want 422", response.Results[0])
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	router := setupTestServer(t)
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"slot-1","name":"Slot 1"}`, nil)
+	rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1","status":"active"}`, nil)
+	var old models.Device
+	json.NewDecoder(rr.Body).Decode(&old)
+	doRequest(router, "PUT", "/inventory/v1/locations/slot-1/device", `{"deviceId":"`+old.ID+`"}`, nil)
+
+	replace := `{"operations":[
+		{"op":"createDevice","ref":"new","device":{"name":"node-2","status":"active"}},
+		{"op":"removeDevice","locationId":"slot-1"},
+		{"op":"installDevice","deviceId":"$new","locationId":"slot-1"},
+		{"op":"patchDevice","id":"` + old.ID + `","patch":[{"op":"replace","path":"/status","value":"failed"}]},
+		{"op":"patchDevice","id":"$new","patch":{"labels":{"replaces":"node-1"}}}
+	]}`
+	rr = doRequest(router, "POST", "/inventory/v1/transactions", replace, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("transaction: got status %v want %v: %s", rr.Code, http.StatusOK, rr.Body)
+	}
+	var response struct {
+		Results []struct {
+			Index    int              `json:"index"`
+			Device   *models.Device   `json:"device"`
+			Location *models.Location `json:"location"`
+			Event    *models.Event    `json:"event"`
+		} `json:"results"`
+	}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if len(response.Results) != 5 || response.Results[2].Event == nil || response.Results[4].Device.Labels["replaces"] != "node-1" {
+		t.Fatalf("transaction results = %+v", response.Results)
+	}
+	newID := response.Results[0].Device.ID
+	var slot models.Location
+	json.NewDecoder(doRequest(router, "GET", "/inventory/v1/locations/slot-1", "", nil).Body).Decode(&slot)
+	if slot.CurrentDeviceID == nil || *slot.CurrentDeviceID != newID {
+		t.Errorf("slot after the transaction = %+v, want it to hold %s", slot, newID)
+	}
+
+	// The old device is no longer installed, so removing it from the slot
+	// again fails and takes the new device's status change with it.
+	rr = doRequest(router, "POST", "/inventory/v1/transactions", `{"operations":[
+		{"op":"patchDevice","id":"`+newID+`","patch":{"status":"failed"}},
+		{"op":"removeDevice","locationId":"slot-1"},
+		{"op":"removeDevice","locationId":"slot-1"}
+	]}`, nil)
+	if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "operation 2") {
+		t.Fatalf("failed transaction: got status %v: %s", rr.Code, rr.Body)
+	}
+	var device models.Device
+	json.NewDecoder(doRequest(router, "GET", "/inventory/v1/devices/"+newID, "", nil).Body).Decode(&device)
+	if device.Status != "active" || device.CurrentLocationID == nil {
+		t.Errorf("new device after the failed transaction = %+v, want it unchanged", device)
+	}
+
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`{"operations":[]}`, http.StatusBadRequest},
+		{`{"operations":[{"op":"deleteDevice","id":"x","cascade":"sideways"}]}`, http.StatusBadRequest},
+		{`{"operations":[{"op":"installDevice","deviceId":"$nope","locationId":"slot-1"}]}`, http.StatusUnprocessableEntity},
+		{`{"operations":[{"op":"patchDevice","id":"` + newID + `","patch":[{"op":"test","path":"/status","value":"failed"}]}]}`, http.StatusConflict},
+	} {
+		if rr := doRequest(router, "POST", "/inventory/v1/transactions", tt.body, nil); rr.Code != tt.want {
+			t.Errorf("POST %s: got status %v want %v: %s", tt.body, rr.Code, tt.want, rr.Body)
+		}
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	db := newTestDatastore(t)
+	router := NewRouter(NewServer(db))
+	withKey := func(key string) map[string]string { return map[string]string{"Idempotency-Key": key} }
+
+	first := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1"}`, withKey("create-1"))
+	retry := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-1"}`, withKey("create-1"))
+	if first.Code != http.StatusCreated || retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Fatalf("retried create: got %v %s and %v %s", first.Code, first.Body, retry.Code, retry.Body)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || retry.Header().Get("ETag") != first.Header().Get("ETag") {
+		t.Errorf("retried create headers = %v, want the replayed ETag", retry.Header())
+	}
+	var device models.Device
+	json.NewDecoder(first.Body).Decode(&device)
+	if devices, _, _ := db.ListDevices(datastore.DeviceFilter{}, datastore.ListOptions{}); len(devices) != 1 {
+		t.Errorf("devices after a retried create = %d, want 1", len(devices))
+	}
+	if rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-2"}`, withKey("create-1")); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("reused key with another body: got status %v want %v: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+
+	doRequest(router, "POST", "/inventory/v1/locations", `{"id":"slot-1","name":"Slot 1"}`, withKey("create-2"))
+	install := `{"deviceId":"` + device.ID + `"}`
+	for i := 0; i < 2; i++ {
+		if rr := doRequest(router, "PUT", "/inventory/v1/locations/slot-1/device", install, withKey("install-1")); rr.Code != http.StatusOK {
+			t.Fatalf("install attempt %d: got status %v want %v: %s", i, rr.Code, http.StatusOK, rr.Body)
+		}
+		if rr := doRequest(router, "DELETE", "/inventory/v1/locations/slot-1/device", "", withKey("remove-1")); rr.Code != http.StatusOK {
+			t.Fatalf("remove attempt %d: got status %v want %v: %s", i, rr.Code, http.StatusOK, rr.Body)
+		}
+	}
+	if events, _, _ := db.ListEventsByLocationID("slot-1", datastore.ListOptions{}); len(events) != 2 {
+		t.Errorf("slot events after retries = %d, want one install and one removal", len(events))
+	}
+
+	// Without a key, the same request is handled again.
+	if rr := doRequest(router, "DELETE", "/inventory/v1/locations/slot-1/device", "", nil); rr.Code != http.StatusConflict {
+		t.Errorf("remove without a key: got status %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	pending := datastore.IdempotencyRecord{Key: "pending", ExpiresAt: time.Now().Add(time.Hour)}
+	pending.Fingerprint = "POST /inventory/v1/devices " + fmt.Sprintf("%x", sha256.Sum256([]byte(`{"name":"node-3"}`)))
+	db.ReserveIdempotencyKey(pending)
+	if rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-3"}`, withKey("pending")); rr.Code != http.StatusConflict {
+		t.Errorf("key still being handled: got status %v want %v: %s", rr.Code, http.StatusConflict, rr.Body)
+	}
+
+	// A handler that panics frees its key, so that the request can be
+	// retried at once.
+	server := NewServer(db)
+	panicking := server.idempotent(func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("the panic of the handler was swallowed")
+			}
+		}()
+		req := httptest.NewRequest("POST", "/inventory/v1/devices", strings.NewReader(`{"name":"node-4"}`))
+		req.Header.Set("Idempotency-Key", "panic-1")
+		panicking(httptest.NewRecorder(), req)
+	}()
+	if rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-4"}`, withKey("panic-1")); rr.Code != http.StatusCreated {
+		t.Errorf("retry after a panic: got status %v want %v: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+
+	// A request holds its key only for its lease, and the response is then
+	// kept for the TTL.
+	var held *datastore.IdempotencyRecord
+	leased := server.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		held, _ = db.ReserveIdempotencyKey(datastore.IdempotencyRecord{Key: "lease-1"})
+		w.WriteHeader(http.StatusNoContent)
+	})
+	req := httptest.NewRequest("POST", "/inventory/v1/devices", strings.NewReader(`{"name":"node-5"}`))
+	req.Header.Set("Idempotency-Key", "lease-1")
+	leased(httptest.NewRecorder(), req)
+	if held == nil || held.Status != 0 || held.ExpiresAt.After(time.Now().Add(DefaultIdempotencyLease)) {
+		t.Errorf("reservation while handled = %+v, want one held for the lease", held)
+	}
+	if done, _ := db.ReserveIdempotencyKey(datastore.IdempotencyRecord{Key: "lease-1"}); done == nil || done.ExpiresAt.Before(time.Now().Add(DefaultIdempotencyTTL-time.Hour)) {
+		t.Errorf("completed record = %+v, want one kept for the TTL", done)
+	}
+
+	// A reservation whose lease ran out, as after a crash, is taken over.
+	stale := datastore.IdempotencyRecord{Key: "stale", Fingerprint: "POST /inventory/v1/devices " + fmt.Sprintf("%x", sha256.Sum256([]byte(`{"name":"node-6"}`))), ExpiresAt: time.Now().Add(-time.Second)}
+	db.ReserveIdempotencyKey(stale)
+	if rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-6"}`, withKey("stale")); rr.Code != http.StatusCreated {
+		t.Errorf("retry after the lease ran out: got status %v want %v: %s", rr.Code, http.StatusCreated, rr.Body)
+	}
+}
+
+func TestLocationTree(t *testing.T) {
+	router := setupTestServer(t)
+	for _, payload := range []string{
+		`{"id":"site","name":"Site"}`,
+		`{"id":"rack","name":"Rack","parentLocationId":"site"}`,
+		`{"id":"slot","name":"Slot","parentLocationId":"rack"}`,
+	} {
+		if rr := doRequest(router, "POST", "/inventory/v1/locations", payload, nil); rr.Code != http.StatusCreated {
+			t.Fatalf("create location: got status %v: %s", rr.Code, rr.Body)
+		}
+	}
+	rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node"}`, nil)
+	var node models.Device
+	json.NewDecoder(rr.Body).Decode(&node)
+	doRequest(router, "POST", "/inventory/v1/devices", `{"name":"dimm","parentDeviceId":"`+node.ID+`"}`, nil)
+	doRequest(router, "PUT", "/inventory/v1/locations/slot/device", `{"deviceId":"`+node.ID+`"}`, nil)
+
+	rr = doRequest(router, "GET", "/inventory/v1/locations/site/tree?includeChildDevices=true", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("tree: got status %v: %s", rr.Code, rr.Body)
+	}
+	var tree models.LocationTree
+	json.NewDecoder(rr.Body).Decode(&tree)
+	if tree.ID != "site" || len(tree.Children) != 1 || len(tree.Children[0].Children) != 1 {
+		t.Fatalf("tree = %+v, want site, rack and slot", tree)
+	}
+	if device := tree.Children[0].Children[0].Device; device == nil || device.ID != node.ID || len(device.Children) != 1 {
+		t.Errorf("slot device = %+v, want %s holding the dimm", device, node.ID)
+	}
+
+	rr = doRequest(router, "GET", "/inventory/v1/locations/site/tree?depth=1", "", nil)
+	tree = models.LocationTree{}
+	json.NewDecoder(rr.Body).Decode(&tree)
+	if len(tree.Children) != 1 || len(tree.Children[0].Children) != 0 {
+		t.Errorf("tree to depth 1 = %+v, want only the rack", tree)
+	}
+	if rr := doRequest(router, "GET", "/inventory/v1/locations/site/tree?depth=-1", "", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("negative depth: got status %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := doRequest(router, "GET", "/inventory/v1/locations/missing/tree", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("missing location: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestLocationPaths(t *testing.T) {
+	router := setupTestServer(t)
+	for _, payload := range []string{
+		`{"id":"site","name":"site-a"}`,
+		`{"id":"row","name":"row-3","parentLocationId":"site"}`,
+		`{"id":"slot","name":"s 4","parentLocationId":"row"}`,
+	} {
+		if rr := doRequest(router, "POST", "/inventory/v1/locations", payload, nil); rr.Code != http.StatusCreated {
+			t.Fatalf("create location: got status %v: %s", rr.Code, rr.Body)
+		}
+	}
+
+	rr := doRequest(router, "GET", "/inventory/v1/locations/slot", "", nil)
+	var location models.Location
+	json.NewDecoder(rr.Body).Decode(&location)
+	if location.Path != "site-a/row-3/s 4" {
+		t.Errorf("path = %q, want site-a/row-3/s 4", location.Path)
+	}
+
+	rr = doRequest(router, "GET", "/inventory/v1/locations/slot/ancestors", "", nil)
+	var ancestors struct {
+		Items []models.Location `json:"items"`
+	}
+	json.NewDecoder(rr.Body).Decode(&ancestors)
+	if len(ancestors.Items) != 2 || ancestors.Items[0].ID != "site" || ancestors.Items[1].Path != "site-a/row-3" {
+		t.Errorf("ancestors = %+v, want site and row", ancestors.Items)
+	}
+
+	rr = doRequest(router, "GET", "/inventory/v1/locations/by-path/site-a/row-3/s%204", "", nil)
+	location = models.Location{}
+	json.NewDecoder(rr.Body).Decode(&location)
+	if rr.Code != http.StatusOK || location.ID != "slot" {
+		t.Errorf("by path: got status %v and location %q, want slot", rr.Code, location.ID)
+	}
+	if rr := doRequest(router, "GET", "/inventory/v1/locations/by-path/site-a/s%204", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("by path skipping a level: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := doRequest(router, "GET", "/inventory/v1/locations/by-path/site-a//row-3", "", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("by path with an empty name: got status %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = doRequest(router, "GET", "/inventory/v1/locations/site/tree", "", nil)
+	var tree models.LocationTree
+	json.NewDecoder(rr.Body).Decode(&tree)
+	if len(tree.Children) != 1 || len(tree.Children[0].Children) != 1 || tree.Children[0].Children[0].Path != "site-a/row-3/s 4" {
+		t.Errorf("tree = %+v, want paths down to the slot", tree)
+	}
+}
+
+func TestLocationDevices(t *testing.T) {
+	router := setupTestServer(t)
+	for _, payload := range []string{
+		`{"id":"rack","name":"Rack"}`,
+		`{"id":"slot-1","name":"Slot 1","parentLocationId":"rack"}`,
+		`{"id":"slot-2","name":"Slot 2","parentLocationId":"rack"}`,
+	} {
+		if rr := doRequest(router, "POST", "/inventory/v1/locations", payload, nil); rr.Code != http.StatusCreated {
+			t.Fatalf("create location: got status %v: %s", rr.Code, rr.Body)
+		}
+	}
+	for _, slot := range []string{"slot-1", "slot-2"} {
+		rr := doRequest(router, "POST", "/inventory/v1/devices", `{"name":"node-`+slot+`","status":"active"}`, nil)
+		var node models.Device
+		json.NewDecoder(rr.Body).Decode(&node)
+		doRequest(router, "POST", "/inventory/v1/devices", `{"name":"dimm-`+slot+`","parentDeviceId":"`+node.ID+`"}`, nil)
+		doRequest(router, "PUT", "/inventory/v1/locations/"+slot+"/device", `{"deviceId":"`+node.ID+`"}`, nil)
+	}
+
+	type devicePage struct {
+		Items      []models.Device       `json:"items"`
+		Pagination models.PaginationInfo `json:"pagination"`
+	}
+	var response devicePage
+	rr := doRequest(router, "GET", "/inventory/v1/locations/rack/devices?recursive=true&limit=3", "", nil)
+	json.NewDecoder(rr.Body).Decode(&response)
+	if rr.Code != http.StatusOK || len(response.Items) != 3 || response.Pagination.Total != 4 || response.Pagination.Next == "" {
+		t.Fatalf("recursive: got status %v and %+v, want 3 of 4 devices", rr.Code, response)
+	}
+	rr = doRequest(router, "GET", response.Pagination.Next, "", nil)
+	response = devicePage{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if len(response.Items) != 1 || response.Pagination.Next != "" {
+		t.Errorf("next page: got %+v, want the last device", response)
+	}
+
+	rr = doRequest(router, "GET", "/inventory/v1/locations/rack/devices?recursive=true&status=active", "", nil)
+	response = devicePage{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if len(response.Items) != 2 {
+		t.Errorf("filtered: got %d devices, want the 2 nodes", len(response.Items))
+	}
+	rr = doRequest(router, "GET", "/inventory/v1/locations/rack/devices", "", nil)
+	response = devicePage{}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if rr.Code != http.StatusOK || len(response.Items) != 0 {
+		t.Errorf("not recursive: got status %v and %d devices, want none", rr.Code, len(response.Items))
+	}
+
+	if rr := doRequest(router, "GET", "/inventory/v1/locations/rack/devices?recursive=maybe", "", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("bad recursive: got status %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if rr := doRequest(router, "GET", "/inventory/v1/locations/missing/devices", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("missing location: got status %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
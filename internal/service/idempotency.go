@@ -0,0 +1,141 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+)
+
+// DefaultIdempotencyTTL is how long the response to a request with an
+// Idempotency-Key is kept when the Server does not say.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// DefaultIdempotencyLease is how long a request with an Idempotency-Key
+// holds the key while it is being handled when the Server does not say. A
+// retry after that takes the key over, so that a request cut short by a
+// crash does not block its key until the key expires.
+const DefaultIdempotencyLease = time.Minute
+
+// maxIdempotencyKeyLength caps the length of an Idempotency-Key.
+const maxIdempotencyKeyLength = 255
+
+// idempotent lets clients retry requests to handler safely. The response to
+// a request with an Idempotency-Key header is stored with the key, and a
+// repeat of the request with the same key gets it back instead of being
+// handled again. Reusing a key for a different request is a 422, and
+// repeating one that is still being handled a 409 until its lease runs out.
+// Server errors are not stored, so the request can be retried.
+func (s *Server) idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeBadRequest(w, r, errors.New("Idempotency-Key is too long"))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBadRequest(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		fingerprint := r.Method + " " + r.URL.Path + " " + hex.EncodeToString(sum[:])
+
+		lease := s.IdempotencyLease
+		if lease <= 0 {
+			lease = DefaultIdempotencyLease
+		}
+		record := datastore.IdempotencyRecord{Key: key, Fingerprint: fingerprint, ExpiresAt: time.Now().Add(lease)}
+		existing, err := s.DB.ReserveIdempotencyKey(record)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		switch {
+		case existing == nil:
+		case existing.Fingerprint != fingerprint:
+			writeProblem(w, newProblem(r, http.StatusUnprocessableEntity, "idempotency_key_reused",
+				"Idempotency-Key was already used for a different request"))
+			return
+		case existing.Status == 0:
+			writeProblem(w, newProblem(r, http.StatusConflict, "idempotency_key_in_use",
+				"a request with this Idempotency-Key is still being handled"))
+			return
+		default:
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeResponse(w, existing.Status, existing.Header, existing.Body)
+			return
+		}
+
+		recorder := &responseRecorder{header: http.Header{}}
+		defer func() {
+			if p := recover(); p != nil {
+				// A panic is a server error too; free the key so that the
+				// request can be retried before the key expires.
+				if err := s.DB.ReleaseIdempotencyKey(key); err != nil {
+					log.Printf("releasing Idempotency-Key %q: %v", key, err)
+				}
+				panic(p)
+			}
+		}()
+		handler(recorder, r)
+		if recorder.status >= http.StatusInternalServerError {
+			err = s.DB.ReleaseIdempotencyKey(key)
+		} else {
+			ttl := s.IdempotencyTTL
+			if ttl <= 0 {
+				ttl = DefaultIdempotencyTTL
+			}
+			record.Status, record.Header, record.Body = recorder.status, recorder.header, recorder.body.Bytes()
+			record.ExpiresAt = time.Now().Add(ttl)
+			err = s.DB.CompleteIdempotencyKey(record)
+		}
+		if err != nil {
+			// The request itself succeeded; only a retry of it will not be
+			// recognised.
+			log.Printf("storing the response for Idempotency-Key %q: %v", key, err)
+		}
+		writeResponse(w, recorder.status, recorder.header, recorder.body.Bytes())
+	}
+}
+
+// responseRecorder buffers a response, so that it can be stored before it
+// is sent.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header { return r.header }
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(data)
+}
+
+// writeResponse sends a buffered response.
+func writeResponse(w http.ResponseWriter, status int, header map[string][]string, body []byte) {
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
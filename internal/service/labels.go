@@ -0,0 +1,76 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+)
+
+// setRequirementPattern matches the set-based requirements of a label
+// selector: "key in (a,b)" and "key notin (a,b)".
+var setRequirementPattern = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\(([^()]*)\)$`)
+
+// parseLabelSelector parses a Kubernetes label selector: comma-separated
+// requirements of the forms
+//
+//	key=value  key==value  key!=value
+//	key in (a,b)  key notin (a,b)
+//	key  !key
+//
+// The datastore checks the syntax of the keys and values.
+func parseLabelSelector(input string) (datastore.LabelSelector, error) {
+	var selector datastore.LabelSelector
+	for _, part := range splitRequirements(input) {
+		part = strings.TrimSpace(part)
+		var r datastore.LabelRequirement
+		if m := setRequirementPattern.FindStringSubmatch(part); m != nil {
+			r = datastore.LabelRequirement{Key: m[1], Op: datastore.LabelIn}
+			if m[2] == "notin" {
+				r.Op = datastore.LabelNotIn
+			}
+			for _, value := range strings.Split(m[3], ",") {
+				r.Values = append(r.Values, strings.TrimSpace(value))
+			}
+		} else if key, value, ok := strings.Cut(part, "!="); ok {
+			r = datastore.LabelRequirement{Key: strings.TrimSpace(key), Op: datastore.LabelNotIn, Values: []string{strings.TrimSpace(value)}}
+		} else if key, value, ok := strings.Cut(part, "="); ok {
+			value = strings.TrimPrefix(value, "=")
+			r = datastore.LabelRequirement{Key: strings.TrimSpace(key), Op: datastore.LabelIn, Values: []string{strings.TrimSpace(value)}}
+		} else if key, ok := strings.CutPrefix(part, "!"); ok {
+			r = datastore.LabelRequirement{Key: strings.TrimSpace(key), Op: datastore.LabelDoesNotExist}
+		} else {
+			r = datastore.LabelRequirement{Key: part, Op: datastore.LabelExists}
+		}
+		if r.Key == "" || strings.ContainsAny(r.Key, " ()") {
+			return nil, fmt.Errorf("labelSelector: malformed requirement %q", part)
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// splitRequirements splits a label selector at the commas that are not
+// inside a set of values.
+func splitRequirements(input string) []string {
+	if strings.TrimSpace(input) == "" {
+		return nil
+	}
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range input {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, input[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, input[start:])
+}
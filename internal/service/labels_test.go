@@ -0,0 +1,65 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	req := func(key string, op datastore.LabelOp, values ...string) datastore.LabelRequirement {
+		return datastore.LabelRequirement{Key: key, Op: op, Values: values}
+	}
+	tests := []struct {
+		input string
+		want  datastore.LabelSelector
+	}{
+		{"", nil},
+		{"partition=compute", datastore.LabelSelector{req("partition", datastore.LabelIn, "compute")}},
+		{"partition==compute", datastore.LabelSelector{req("partition", datastore.LabelIn, "compute")}},
+		{"env!=test", datastore.LabelSelector{req("env", datastore.LabelNotIn, "test")}},
+		{"gpu", datastore.LabelSelector{req("gpu", datastore.LabelExists)}},
+		{"!gpu", datastore.LabelSelector{req("gpu", datastore.LabelDoesNotExist)}},
+		{"example.com/batch=", datastore.LabelSelector{req("example.com/batch", datastore.LabelIn, "")}},
+		{
+			"partition=compute, env!=test,gpu",
+			datastore.LabelSelector{
+				req("partition", datastore.LabelIn, "compute"),
+				req("env", datastore.LabelNotIn, "test"),
+				req("gpu", datastore.LabelExists),
+			},
+		},
+		{
+			"env in (prod, staging),tier notin (a),!spare",
+			datastore.LabelSelector{
+				req("env", datastore.LabelIn, "prod", "staging"),
+				req("tier", datastore.LabelNotIn, "a"),
+				req("spare", datastore.LabelDoesNotExist),
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseLabelSelector(tt.input)
+		if err != nil {
+			t.Errorf("parseLabelSelector(%q): %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLabelSelector(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+
+	for _, input := range []string{
+		"a,,b",
+		"=value",
+		"!",
+		"env in prod",
+		"env in (prod",
+		"a b",
+	} {
+		if _, err := parseLabelSelector(input); err == nil {
+			t.Errorf("parseLabelSelector(%q) succeeded, want an error", input)
+		}
+	}
+}
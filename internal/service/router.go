@@ -40,27 +40,45 @@ func generateRoutes(s *Server) Routes {
 	return Routes{
 		// --- Device Routes ---
 		{"ListDevices", "GET", "/inventory/v1/devices", s.listDevicesHandler},
-		{"CreateDevice", "POST", "/inventory/v1/devices", s.createDeviceHandler},
+		{"CreateDevice", "POST", "/inventory/v1/devices", s.idempotent(s.createDeviceHandler)},
+		{"RelabelDevices", "POST", "/inventory/v1/devices:relabel", s.relabelDevicesHandler},
+		{"BatchDevices", "POST", "/inventory/v1/devices:batch", s.batchDevicesHandler},
 		{"GetDeviceByID", "GET", "/inventory/v1/devices/{id}", s.getDeviceByIDHandler},
 		{"GetDeviceByName", "GET", "/inventory/v1/devices/by-name/{name}", s.getDeviceByNameHandler},
 		{"UpdateDevice", "PUT", "/inventory/v1/devices/{id}", s.updateDeviceHandler},
+		{"PatchDevice", "PATCH", "/inventory/v1/devices/{id}", s.patchDeviceHandler},
 		{"DeleteDevice", "DELETE", "/inventory/v1/devices/{id}", s.deleteDeviceHandler},
+		{"RestoreDevice", "POST", "/inventory/v1/devices/{id}/restore", s.restoreDeviceHandler},
 		{"GetDeviceHistory", "GET", "/inventory/v1/devices/{id}/history", s.getDeviceHistoryHandler},
 
 		// --- Location Routes ---
 		{"ListLocations", "GET", "/inventory/v1/locations", s.listLocationsHandler},
-		{"CreateLocation", "POST", "/inventory/v1/locations", s.createLocationHandler},
+		{"CreateLocation", "POST", "/inventory/v1/locations", s.idempotent(s.createLocationHandler)},
+		{"RelabelLocations", "POST", "/inventory/v1/locations:relabel", s.relabelLocationsHandler},
+		{"BatchLocations", "POST", "/inventory/v1/locations:batch", s.batchLocationsHandler},
 		{"GetLocationByID", "GET", "/inventory/v1/locations/{id}", s.getLocationByIDHandler},
 		{"GetLocationByName", "GET", "/inventory/v1/locations/by-name/{name}", s.getLocationByNameHandler},
+		{"GetLocationByPath", "GET", "/inventory/v1/locations/by-path/*", s.getLocationByPathHandler},
 		{"UpdateLocation", "PUT", "/inventory/v1/locations/{id}", s.updateLocationHandler},
+		{"PatchLocation", "PATCH", "/inventory/v1/locations/{id}", s.patchLocationHandler},
 		{"DeleteLocation", "DELETE", "/inventory/v1/locations/{id}", s.deleteLocationHandler},
+		{"RestoreLocation", "POST", "/inventory/v1/locations/{id}/restore", s.restoreLocationHandler},
+		{"GetLocationTree", "GET", "/inventory/v1/locations/{id}/tree", s.getLocationTreeHandler},
+		{"GetLocationAncestors", "GET", "/inventory/v1/locations/{id}/ancestors", s.getLocationAncestorsHandler},
 		{"GetLocationHistory", "GET", "/inventory/v1/locations/{id}/history", s.getLocationHistoryHandler},
 		{"GetDeviceAtLocation", "GET", "/inventory/v1/locations/{id}/device", s.getDeviceAtLocationHandler},
-		{"InstallDevice", "PUT", "/inventory/v1/locations/{id}/device", s.installDeviceHandler},
-		{"RemoveDevice", "DELETE", "/inventory/v1/locations/{id}/device", s.removeDeviceHandler},
+		{"ListLocationDevices", "GET", "/inventory/v1/locations/{id}/devices", s.listLocationDevicesHandler},
+		{"InstallDevice", "PUT", "/inventory/v1/locations/{id}/device", s.idempotent(s.installDeviceHandler)},
+		{"RemoveDevice", "DELETE", "/inventory/v1/locations/{id}/device", s.idempotent(s.removeDeviceHandler)},
 
 		// --- Event Routes ---
 		{"ListEvents", "GET", "/inventory/v1/events", s.listEventsHandler},
 		{"GetEventByID", "GET", "/inventory/v1/events/{id}", s.getEventByIDHandler},
+
+		// --- Transaction Routes ---
+		{"ApplyTransaction", "POST", "/inventory/v1/transactions", s.applyTransactionHandler},
+
+		// --- Admin Routes ---
+		{"PurgeDeleted", "POST", "/inventory/v1/admin/purge", s.purgeDeletedHandler},
 	}
 }
@@ -1,10 +1,20 @@
 package service
 
-import "github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+import (
+	"time"
+
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+)
 
 // Server is the main application struct that holds dependencies.
 type Server struct {
 	DB datastore.Datastore
+	// IdempotencyTTL is how long responses to requests with an
+	// Idempotency-Key are kept; zero means DefaultIdempotencyTTL.
+	IdempotencyTTL time.Duration
+	// IdempotencyLease is how long a request with an Idempotency-Key holds
+	// the key while it is handled; zero means DefaultIdempotencyLease.
+	IdempotencyLease time.Duration
 }
 
 // NewServer creates a new server with its dependencies.
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/bmcdonald3/openchami-inventory-service/internal/datastore"
+	"github.com/bmcdonald3/openchami-inventory-service/pkg/models"
+)
+
+// txOperation is one operation in the body of a transaction request.
+type txOperation struct {
+	Op datastore.TxOp `json:"op"`
+	// Ref names the record a create makes; later operations refer to it as
+	// "$" followed by the name.
+	Ref        string `json:"ref"`
+	ID         string `json:"id"`
+	DeviceID   string `json:"deviceId"`
+	LocationID string `json:"locationId"`
+	// Patch is a JSON Merge Patch object or a JSON Patch array.
+	Patch           json.RawMessage  `json:"patch"`
+	ResourceVersion int64            `json:"resourceVersion"`
+	Cascade         string           `json:"cascade"`
+	Device          *models.Device   `json:"device"`
+	Location        *models.Location `json:"location"`
+}
+
+// txResult reports what one operation of a transaction left.
+type txResult struct {
+	Index    int              `json:"index"`
+	Device   *models.Device   `json:"device,omitempty"`
+	Location *models.Location `json:"location,omitempty"`
+	Event    *models.Event    `json:"event,omitempty"`
+}
+
+// transactionRequest reads the operations of a transaction request.
+func transactionRequest(r *http.Request) ([]datastore.TxOperation, error) {
+	var body struct {
+		Operations []txOperation `json:"operations"`
+	}
+	if err := decodeJSON(r, &body); err != nil {
+		return nil, err
+	}
+	if len(body.Operations) == 0 || len(body.Operations) > maxBatchOperations {
+		return nil, fmt.Errorf("operations must hold between 1 and %d operations", maxBatchOperations)
+	}
+	ops := make([]datastore.TxOperation, len(body.Operations))
+	for i, op := range body.Operations {
+		cascade, err := parseCascade(op.Cascade)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+		patch := datastore.Patch{Type: datastore.MergePatch, Document: op.Patch}
+		if bytes.HasPrefix(bytes.TrimSpace(op.Patch), []byte("[")) {
+			patch.Type = datastore.JSONPatch
+		}
+		ops[i] = datastore.TxOperation{
+			Op:              op.Op,
+			Ref:             op.Ref,
+			ID:              op.ID,
+			DeviceID:        op.DeviceID,
+			LocationID:      op.LocationID,
+			Device:          op.Device,
+			Location:        op.Location,
+			Patch:           patch,
+			ResourceVersion: op.ResourceVersion,
+			Cascade:         cascade,
+		}
+	}
+	return ops, nil
+}
+
+func (s *Server) applyTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	ops, err := transactionRequest(r)
+	if err != nil {
+		writeBadRequest(w, r, err)
+		return
+	}
+	results, err := s.DB.ApplyTransaction(ops, defaultActor)
+	if err == nil {
+		var locations []*models.Location
+		for _, result := range results {
+			if result.Location != nil {
+				locations = append(locations, result.Location)
+			}
+		}
+		err = s.setPaths(locations...)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	response := struct {
+		Results []txResult `json:"results"`
+	}{Results: make([]txResult, len(results))}
+	for i, result := range results {
+		response.Results[i] = txResult{Index: i, Device: result.Device, Location: result.Location, Event: result.Event}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
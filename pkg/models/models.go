@@ -5,6 +5,8 @@ import "time"
 // --- Core Models ---
 
 // Device represents a physical piece of hardware in the inventory.
+// Labels group devices by purpose and follow the Kubernetes label syntax.
+// ResourceVersion is incremented on every change and is served as the ETag.
 type Device struct {
 	ID                string                 `json:"id"`
 	Name              string                 `json:"name"`
@@ -16,29 +18,54 @@ type Device struct {
 	CurrentLocationID *string                `json:"currentLocationId,omitempty"`
 	Status            string                 `json:"status"`
 	Properties        map[string]interface{} `json:"properties,omitempty"`
+	Labels            map[string]string      `json:"labels,omitempty"`
 	ParentDeviceID    *string                `json:"parentDeviceId,omitempty"`
 	ChildrenDeviceIDs []string               `json:"childrenDeviceIds,omitempty"`
+	ResourceVersion   int64                  `json:"resourceVersion"`
 	CreatedAt         time.Time              `json:"createdAt"`
 	UpdatedAt         *time.Time             `json:"updatedAt,omitempty"`
 	DeletedAt         *time.Time             `json:"deletedAt,omitempty"`
 }
 
 // Location represents a physical slot or bay where hardware can be installed.
+// Labels are as for Device.
+// ResourceVersion is incremented on every change and is served as the ETag.
+// Path is the names of the location's ancestors and its own, from the root
+// down, joined by "/". It is computed for responses and ignored on writes.
 type Location struct {
 	ID                  string                 `json:"id"`
 	Name                string                 `json:"name"`
 	LocationType        string                 `json:"locationType"`
 	ParentLocationID    *string                `json:"parentLocationId,omitempty"`
 	ChildrenLocationIDs []string               `json:"childrenLocationIds,omitempty"`
+	Path                string                 `json:"path,omitempty"`
 	CurrentDeviceID     *string                `json:"currentDeviceId,omitempty"`
 	Status              string                 `json:"status"`
 	Properties          map[string]interface{} `json:"properties,omitempty"`
+	Labels              map[string]string      `json:"labels,omitempty"`
+	ResourceVersion     int64                  `json:"resourceVersion"`
 	CreatedAt           time.Time              `json:"createdAt"`
 	UpdatedAt           *time.Time             `json:"updatedAt,omitempty"`
 	DeletedAt           *time.Time             `json:"deletedAt,omitempty"`
 }
 
+// LocationTree is a location with the device installed in it and the
+// locations below it, nested by their parent pointers.
+type LocationTree struct {
+	Location
+	Device   *DeviceTree    `json:"device,omitempty"`
+	Children []LocationTree `json:"children,omitempty"`
+}
+
+// DeviceTree is a device with, when asked for, its child devices.
+type DeviceTree struct {
+	Device
+	Children []DeviceTree `json:"children,omitempty"`
+}
+
 // Event represents a historical record, conforming to the CloudEvents v1.0 spec.
+// Sequence increases with every event the datastore records and orders
+// events with the same Time.
 type Event struct {
 	ID              string    `json:"id"`
 	Source          string    `json:"source"`
@@ -47,6 +74,7 @@ type Event struct {
 	DataContentType *string   `json:"datacontenttype,omitempty"`
 	Subject         *string   `json:"subject,omitempty"`
 	Time            time.Time `json:"time"`
+	Sequence        int64     `json:"sequence"`
 	Data            EventData `json:"data"`
 }
 
@@ -68,10 +96,40 @@ type PaginationInfo struct {
 	Count  int `json:"count"`
 	Total  int `json:"total"`
 	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	// Next links to the following page; it is empty on the last page.
+	Next string `json:"next,omitempty"`
 }
 
-// ErrorResponse is a standard format for API error responses.
+// ErrorResponse is the body of every error response: an RFC 7807 problem
+// details object, sent as application/problem+json.
 type ErrorResponse struct {
-	Code    string `json:"code"`
+	// Type is a URI identifying the kind of problem.
+	Type string `json:"type"`
+	// Title summarises the kind of problem.
+	Title string `json:"title"`
+	// Status is the HTTP status code of the response.
+	Status int `json:"status"`
+	// Detail explains this occurrence of the problem.
+	Detail string `json:"detail"`
+	// Message repeats Detail for clients written before problem details.
 	Message string `json:"message"`
+	// Instance is the ID of the request that failed.
+	Instance string `json:"instance,omitempty"`
+	// Code names the kind of problem in a form that is stable for clients
+	// to match on.
+	Code string `json:"code"`
+	// Errors lists the fields of the request that failed validation.
+	Errors []FieldError `json:"errors,omitempty"`
+	// ConflictingID identifies the existing record a rejected write would
+	// have duplicated.
+	ConflictingID string `json:"conflictingId,omitempty"`
+}
+
+// FieldError is the failure of one field of a request.
+type FieldError struct {
+	// Field is the JSON name of the field, with map keys and nested fields
+	// following after dots.
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
 }